@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/crypto"
+	"github.com/restic/restic/lib/debug"
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+)
+
+// agentSocketEnv names the environment variable which holds the path of the
+// socket of the agent, if it isn't at the default location.
+const agentSocketEnv = "GIT_REMOTE_RESTIC_AUTH_SOCK"
+
+// defaultAgentTimeout is how long the agent keeps a master key, unless
+// restic.agentTimeout or --timeout is set.
+const defaultAgentTimeout = 15 * time.Minute
+
+// agentIOTimeout limits how long the agent and the helpers wait for each other,
+// so that neither hangs on a stuck peer.
+const agentIOTimeout = 5 * time.Second
+
+// agentCacheable is set when the password was found by git credential, which
+// may have asked the user, so that the master key is given to the agent once
+// the repository has been opened. Passwords in the environment and from
+// password commands are already available to every helper.
+var agentCacheable = false
+
+// agentProvided is set when the master key was provided by the agent.
+var agentProvided = false
+
+// agentRequest is sent by a helper to the agent, which answers with an
+// agentResponse. Each connection carries a single request.
+type agentRequest struct {
+	// Op is "get", "add", or "forget".
+	Op        string      `json:"op"`
+	Location  string      `json:"location"`
+	MasterKey *crypto.Key `json:"masterKey,omitempty"`
+	KeyID     string      `json:"keyID,omitempty"`
+}
+
+type agentResponse struct {
+	Found     bool        `json:"found,omitempty"`
+	MasterKey *crypto.Key `json:"masterKey,omitempty"`
+	KeyID     string      `json:"keyID,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// agentEntry is a master key held by the agent, along with the ID of the key
+// file which it was unlocked from.
+type agentEntry struct {
+	master  *crypto.Key
+	keyID   string
+	expires time.Time
+}
+
+// errNoAgentSocket indicates that there is no known location for the socket
+// of the agent.
+var errNoAgentSocket = errors.New(agentSocketEnv + " and XDG_RUNTIME_DIR are not set")
+
+// agentSocketPath returns the path of the socket of the agent. Unless
+// GIT_REMOTE_RESTIC_AUTH_SOCK is set, it is in a directory of the user in
+// XDG_RUNTIME_DIR, so that helpers find the agent without any configuration.
+// Otherwise there is no default, since a predictable path in the shared
+// temporary directory could be claimed by another user.
+func agentSocketPath() (string, bool) {
+	if path := os.Getenv(agentSocketEnv); path != "" {
+		return path, true
+	}
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return "", false
+	}
+	return filepath.Join(dir, fmt.Sprintf("git-remote-restic-%d", os.Getuid()), "agent.sock"), true
+}
+
+// checkAgentDir makes sure that the directory of the socket at path is owned
+// by the user and only accessible to them, like ssh-agent does, so that no
+// other user can replace the socket.
+func checkAgentDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || int(stat.Uid) != os.Getuid() || info.Mode().Perm() != 0700 {
+		return errors.Errorf("%s must be a directory owned by the user with mode 0700", dir)
+	}
+	return nil
+}
+
+// checkAgentPeer makes sure that the process at the other end of conn runs as
+// the user.
+func checkAgentPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return errors.New("the agent socket is not a unix socket")
+	}
+	uid, err := peerUID(unixConn)
+	if err != nil {
+		return errors.Wrap(err, "unable to identify the peer of the agent socket")
+	} else if uid != os.Getuid() {
+		return errors.Errorf("the peer of the agent socket runs as user %d", uid)
+	}
+	return nil
+}
+
+// cmdAgent holds the decrypted master keys of restic repositories in memory,
+// similar to ssh-agent, so that the user enters the password of a repository
+// once rather than for every push and fetch. The helpers give the agent the
+// master key of each repository they open after asking the user for the
+// password, and ask the agent for it before asking the user again. Keys are
+// forgotten after restic.agentTimeout, and are never written to disk. The
+// password itself is never given to the agent.
+func cmdAgent(args []string) error {
+	timeout := defaultAgentTimeout
+	if value, _, err := readGitConfig("--get", "restic.agentTimeout"); err != nil {
+		return err
+	} else if value != "" {
+		if timeout, err = time.ParseDuration(value); err != nil || timeout <= 0 {
+			return errors.Errorf("restic.agentTimeout: invalid duration %q", value)
+		}
+	}
+	if len(args) == 2 && args[0] == "--timeout" {
+		var err error
+		if timeout, err = time.ParseDuration(args[1]); err != nil || timeout <= 0 {
+			return errors.Errorf("--timeout: invalid duration %q", args[1])
+		}
+	} else if len(args) != 0 {
+		return errors.Errorf("Usage: %s --agent [--timeout duration]", os.Args[0])
+	}
+
+	path, known := agentSocketPath()
+	if !known {
+		path = filepath.Join(os.TempDir(), fmt.Sprintf("git-remote-restic-%d", os.Getuid()), "agent.sock")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// The directory may have been created by someone else.
+	if err := checkAgentDir(path); err != nil {
+		return err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return errors.Errorf("an agent is already listening on %s", path)
+	}
+	// The socket of an agent which was killed remains.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	go func() {
+		<-globalCtx.Done()
+		listener.Close()
+	}()
+	Warnf("agent listening on %s, keys are kept for %v\n", path, timeout)
+	if !known {
+		Warnf("set %s=%s for the helpers to find the agent\n", agentSocketEnv, path)
+	}
+
+	agent := &keyAgent{timeout: timeout, entries: map[string]agentEntry{}}
+	go agent.expire()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if globalCtx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go agent.serve(conn)
+	}
+}
+
+// keyAgent is the state of cmdAgent.
+type keyAgent struct {
+	timeout time.Duration
+	mu      sync.Mutex
+	entries map[string]agentEntry
+}
+
+// expire removes the expired keys from memory every minute.
+func (a *keyAgent) expire() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		a.mu.Lock()
+		for location, entry := range a.entries {
+			if now.After(entry.expires) {
+				delete(a.entries, location)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+func (a *keyAgent) serve(conn net.Conn) {
+	defer conn.Close()
+	if err := checkAgentPeer(conn); err != nil {
+		debug.Log("refusing agent connection: %v", err)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(agentIOTimeout))
+	var req agentRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		debug.Log("invalid agent request: %v", err)
+		return
+	}
+	var res agentResponse
+	a.mu.Lock()
+	switch req.Op {
+	case "get":
+		entry, ok := a.entries[req.Location]
+		if ok && time.Now().Before(entry.expires) {
+			res = agentResponse{Found: true, MasterKey: entry.master, KeyID: entry.keyID}
+		}
+	case "add":
+		a.entries[req.Location] = agentEntry{req.MasterKey, req.KeyID, time.Now().Add(a.timeout)}
+	case "forget":
+		delete(a.entries, req.Location)
+	default:
+		res.Error = fmt.Sprintf("unknown operation %q", req.Op)
+	}
+	a.mu.Unlock()
+	if err := json.NewEncoder(conn).Encode(res); err != nil {
+		debug.Log("unable to answer agent request: %v", err)
+	}
+}
+
+// callAgent sends req to the agent. It returns an error if no agent is
+// listening.
+func callAgent(req agentRequest) (agentResponse, error) {
+	var res agentResponse
+	path, ok := agentSocketPath()
+	if !ok {
+		return res, errNoAgentSocket
+	}
+	if err := checkAgentDir(path); err != nil {
+		return res, err
+	}
+	conn, err := net.DialTimeout("unix", path, agentIOTimeout)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close()
+	if err := checkAgentPeer(conn); err != nil {
+		return res, err
+	}
+	conn.SetDeadline(time.Now().Add(agentIOTimeout))
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return res, err
+	}
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return res, err
+	}
+	if res.Error != "" {
+		return res, errors.New(res.Error)
+	}
+	return res, nil
+}
+
+// agentMasterKey asks the agent for the master key of the repository at
+// location.
+func agentMasterKey(location string) (*cachedKey, bool) {
+	res, err := callAgent(agentRequest{Op: "get", Location: location})
+	if err != nil {
+		debug.Log("no agent: %v", err)
+		return nil, false
+	} else if !res.Found {
+		return nil, false
+	}
+	keyID, err := restic.ParseID(res.KeyID)
+	if err != nil || res.MasterKey == nil || !res.MasterKey.Valid() {
+		debug.Log("invalid key from the agent: %v", err)
+		return nil, false
+	}
+	key, err := newCachedKey(res.MasterKey, keyID)
+	if err != nil {
+		debug.Log("unable to use the key from the agent: %v", err)
+		return nil, false
+	}
+	agentProvided = true
+	return key, true
+}
+
+// rememberMasterKey gives the master key of repo, which was opened at
+// location, to the agent, if the password was found by git credential and an
+// agent is listening.
+func rememberMasterKey(location string, repo *repository.Repository) {
+	if !agentCacheable {
+		return
+	}
+	req := agentRequest{Op: "add", Location: location, MasterKey: repo.Key(), KeyID: repo.KeyID().String()}
+	if _, err := callAgent(req); err != nil {
+		debug.Log("unable to give the master key to the agent: %v", err)
+	}
+}
+
+// forgetMasterKey removes the master key of the repository at location from
+// the agent, after it failed to open the repository.
+func forgetMasterKey(location string) {
+	if _, err := callAgent(agentRequest{Op: "forget", Location: location}); err != nil {
+		debug.Log("unable to remove the master key from the agent: %v", err)
+		return
+	}
+	Warnf("the key from the agent doesn't open the repository and has been removed from it\n")
+}
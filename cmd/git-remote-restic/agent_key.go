@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/restic/restic/lib/crypto"
+	"github.com/restic/restic/lib/debug"
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+)
+
+// agentKey is the master key which was provided by the agent, if any.
+var agentKey *cachedKey
+
+// agentKeySaltLength is the length of the salt of a key file, which restic
+// requires.
+const agentKeySaltLength = 64
+
+// agentKeyParams are the key derivation parameters of the key file which is
+// made for a master key from the agent. They are cheap, since the file and
+// its password only exist in memory.
+var agentKeyParams = crypto.Params{N: 1024, R: 8, P: 1}
+
+// cachedKey opens a repository with a master key from the agent. Restic only
+// opens a repository with a password and a key file, so the master key is
+// sealed in a key file with a random password, which is served in place of
+// the stored key files while the repository is opened.
+type cachedKey struct {
+	// keyID is the stored key file which the master key was unlocked from.
+	keyID    restic.ID
+	fileID   restic.ID
+	file     []byte
+	password string
+	// serving is set while the repository is opened.
+	serving bool
+}
+
+func newCachedKey(master *crypto.Key, keyID restic.ID) (*cachedKey, error) {
+	password := restic.NewRandomID().String()
+	salt := make([]byte, agentKeySaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	user, err := crypto.KDF(agentKeyParams, salt, password)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := crypto.NewRandomNonce()
+	data := user.Seal(append([]byte{}, nonce...), nonce, buf, nil)
+	file, err := json.Marshal(repository.Key{
+		Created: time.Now(),
+		KDF:     "scrypt",
+		N:       agentKeyParams.N,
+		R:       agentKeyParams.R,
+		P:       agentKeyParams.P,
+		Salt:    salt,
+		Data:    data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &cachedKey{
+		keyID:    keyID,
+		fileID:   restic.Hash(file),
+		file:     file,
+		password: password,
+	}, nil
+}
+
+// wrap makes be serve the key file of the master key while it is used to open
+// the repository.
+func (k *cachedKey) wrap(be restic.Backend) restic.Backend {
+	return &cachedKeyBackend{Backend: be, key: k}
+}
+
+// open unlocks repo, whose backend was wrapped by wrap, with the master key.
+// It returns repository.ErrNoKeyFound if the master key doesn't open the
+// repository.
+func (k *cachedKey) open(ctx context.Context, repo *repository.Repository) error {
+	k.serving = true
+	defer func() {
+		k.serving = false
+	}()
+	if err := repo.SearchKey(ctx, k.password, 1, k.fileID.String()); err != nil {
+		debug.Log("unable to open the repository with the key from the agent: %v", err)
+		return repository.ErrNoKeyFound
+	}
+	return nil
+}
+
+// currentKeyID returns the ID of the stored key file which opened repo. A
+// repository which was opened with a master key from the agent reports the
+// key file which the agent got it from.
+func currentKeyID(repo *repository.Repository) restic.ID {
+	if agentKey != nil {
+		return agentKey.keyID
+	}
+	return repo.KeyID()
+}
+
+// cachedKeyBackend adds the key file of a cachedKey to the backend.
+type cachedKeyBackend struct {
+	restic.Backend
+	key *cachedKey
+}
+
+func (be *cachedKeyBackend) Unwrap() restic.Backend {
+	return be.Backend
+}
+
+func (be *cachedKeyBackend) isKeyFile(h restic.Handle) bool {
+	return be.key.serving && h.Type == restic.KeyFile && h.Name == be.key.fileID.String()
+}
+
+func (be *cachedKeyBackend) Load(ctx context.Context, h restic.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	if !be.isKeyFile(h) {
+		return be.Backend.Load(ctx, h, length, offset, fn)
+	}
+	data := be.key.file
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length > 0 && length < len(data) {
+		data = data[:length]
+	}
+	return fn(bytes.NewReader(data))
+}
+
+func (be *cachedKeyBackend) Stat(ctx context.Context, h restic.Handle) (restic.FileInfo, error) {
+	if !be.isKeyFile(h) {
+		return be.Backend.Stat(ctx, h)
+	}
+	return restic.FileInfo{Name: h.Name, Size: int64(len(be.key.file))}, nil
+}
+
+func (be *cachedKeyBackend) List(ctx context.Context, t restic.FileType, fn func(restic.FileInfo) error) error {
+	if err := be.Backend.List(ctx, t, fn); err != nil {
+		return err
+	}
+	if t == restic.KeyFile && be.key.serving {
+		return fn(restic.FileInfo{Name: be.key.fileID.String(), Size: int64(len(be.key.file))})
+	}
+	return nil
+}
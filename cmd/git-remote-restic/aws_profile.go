@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+)
+
+// awsProcessCredentials is the output of a credential_process, and of aws
+// configure export-credentials --format process.
+type awsProcessCredentials struct {
+	Version         int
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      string
+}
+
+// applyAWSProfile provides the credentials of an AWS profile which restic
+// can't read itself to the s3 backend. Restic reads static access keys from
+// ~/.aws/credentials, but not the credentials of profiles which use AWS SSO
+// (IAM Identity Center) or a credential_process. For those, the credentials
+// are obtained from the AWS CLI or the process respectively, and given to
+// restic as AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN.
+//
+// The profile is read from restic.<remote>.awsProfile or restic.awsProfile,
+// or otherwise from AWS_PROFILE. Access keys in the environment take
+// precedence, like in the AWS CLI.
+func applyAWSProfile() error {
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		return nil
+	}
+	profile, ok, err := getRemoteConfig("awsProfile")
+	if err != nil {
+		return err
+	} else if ok {
+		overrideEnv("AWS_PROFILE", profile)
+	} else if profile = os.Getenv("AWS_PROFILE"); profile == "" {
+		profile = "default"
+	}
+	settings, err := readAWSProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	var cmd *exec.Cmd
+	if process := settings["credential_process"]; process != "" {
+		cmd = exec.Command("sh", "-c", process)
+	} else if settings["sso_session"] != "" || settings["sso_start_url"] != "" {
+		cmd = exec.Command("aws", "configure", "export-credentials", "--profile", profile, "--format", "process")
+	} else {
+		return nil
+	}
+	debug.Log("getting the credentials of AWS profile %v", profile)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.Errorf("unable to get the credentials of AWS profile %q: %v", profile, err)
+	}
+	var creds awsProcessCredentials
+	if err := json.Unmarshal(out, &creds); err != nil || creds.AccessKeyID == "" {
+		return errors.Errorf("unable to get the credentials of AWS profile %q: invalid output", profile)
+	}
+	overrideEnv("AWS_ACCESS_KEY_ID", creds.AccessKeyID)
+	overrideEnv("AWS_SECRET_ACCESS_KEY", creds.SecretAccessKey)
+	overrideEnv("AWS_SESSION_TOKEN", creds.SessionToken)
+	return nil
+}
+
+// readAWSProfile returns the settings of the named profile in the AWS config
+// file, which is ~/.aws/config unless AWS_CONFIG_FILE is set. A profile which
+// isn't there has no settings.
+func readAWSProfile(profile string) (map[string]string, error) {
+	path := os.Getenv("AWS_CONFIG_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "config")
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	section := "profile " + profile
+	if profile == "default" {
+		section = "default"
+	}
+	settings := map[string]string{}
+	inProfile := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			inProfile = strings.Join(strings.Fields(name), " ") == section
+			continue
+		}
+		if !inProfile {
+			continue
+		}
+		if parts := strings.SplitN(line, "=", 2); len(parts) == 2 {
+			settings[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	return settings, scanner.Err()
+}
+
+// applyAWSSessionToken sets AWS_SESSION_TOKEN from
+// restic.<remote>.awsSessionToken or restic.awsSessionToken, if either is
+// set. Temporary credentials, such as those of an assumed role in a CI
+// runner, consist of an access key and a session token, which restic reads
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN. The
+// configured token only applies to the s3 remotes it's set for, unlike the
+// variable.
+func applyAWSSessionToken() error {
+	token, ok, err := getRemoteConfig("awsSessionToken")
+	if err != nil {
+		return err
+	} else if ok {
+		overrideEnv("AWS_SESSION_TOKEN", token)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/restic/restic/lib/debug"
+)
+
+// azureSettings map git configuration variables to the environment variables
+// which the azure backend reads. None of them are secrets, so they can be
+// kept in the git configuration of each remote.
+var azureSettings = []struct{ name, variable string }{
+	{"azureAccountName", "AZURE_ACCOUNT_NAME"},
+	{"azureEndpointSuffix", "AZURE_ENDPOINT_SUFFIX"},
+	// The client ID selects a user-assigned managed identity.
+	{"azureClientId", "AZURE_CLIENT_ID"},
+}
+
+// applyAzureCredentials prepares the environment of the azure backend, which
+// authenticates with the account key in AZURE_ACCOUNT_KEY, or otherwise with
+// the shared access signature in AZURE_ACCOUNT_SAS, or otherwise with the
+// default Azure credential: a service principal from AZURE_CLIENT_ID and
+// related variables, workload identity, the managed identity of an Azure VM,
+// or the Azure CLI. Managed identities let the helper run on Azure VMs without
+// distributing secrets.
+//
+// The account name, endpoint suffix, and client ID can also be set with
+// restic.<remote>.azureAccountName, restic.<remote>.azureEndpointSuffix, and
+// restic.<remote>.azureClientId, or the same variables without the remote.
+// A SAS copied from the Azure portal starts with "?", which is removed.
+func applyAzureCredentials() error {
+	for _, setting := range azureSettings {
+		value, ok, err := getRemoteConfig(setting.name)
+		if err != nil {
+			return err
+		} else if ok {
+			overrideEnv(setting.variable, value)
+		}
+	}
+	if sas := os.Getenv("AZURE_ACCOUNT_SAS"); strings.HasPrefix(sas, "?") {
+		overrideEnv("AZURE_ACCOUNT_SAS", strings.TrimPrefix(sas, "?"))
+	}
+	debug.Log("authenticating to azure with %v", azureAuthMethod())
+	return nil
+}
+
+// azureAuthMethod describes the credential which the azure backend uses with
+// the current environment, in the order of precedence of the backend.
+func azureAuthMethod() string {
+	switch {
+	case os.Getenv("AZURE_ACCOUNT_KEY") != "":
+		return "the account key"
+	case os.Getenv("AZURE_ACCOUNT_SAS") != "":
+		return "a shared access signature"
+	case os.Getenv("AZURE_CLIENT_ID") != "":
+		return "the default credential for client " + os.Getenv("AZURE_CLIENT_ID")
+	default:
+		return "the default credential"
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// setAzureTestEnv clears the variables read by the azure backend, sets the
+// given ones, and passes the given git configuration to git config.
+func setAzureTestEnv(t *testing.T, env map[string]string, gitConfig ...string) {
+	for _, name := range []string{"AZURE_ACCOUNT_NAME", "AZURE_ACCOUNT_KEY", "AZURE_ACCOUNT_SAS", "AZURE_ENDPOINT_SUFFIX", "AZURE_CLIENT_ID"} {
+		t.Setenv(name, env[name])
+	}
+	setTestGitConfig(t, gitConfig...)
+}
+
+func TestAzureAccountKeyPrecedence(t *testing.T) {
+	setAzureTestEnv(t, map[string]string{
+		"AZURE_ACCOUNT_KEY": "key",
+		"AZURE_ACCOUNT_SAS": "sv=2022-11-02&sig=abc",
+	})
+	require.NoError(t, applyAzureCredentials())
+	require.Equal(t, "the account key", azureAuthMethod())
+}
+
+func TestAzureSharedAccessSignature(t *testing.T) {
+	setAzureTestEnv(t, map[string]string{
+		"AZURE_ACCOUNT_SAS": "?sv=2022-11-02&sig=abc",
+	}, "restic.origin.azureAccountName", "account")
+	require.NoError(t, applyAzureCredentials())
+	require.Equal(t, "a shared access signature", azureAuthMethod())
+	require.Equal(t, "sv=2022-11-02&sig=abc", os.Getenv("AZURE_ACCOUNT_SAS"))
+	require.Equal(t, "account", os.Getenv("AZURE_ACCOUNT_NAME"))
+}
+
+func TestAzureManagedIdentity(t *testing.T) {
+	setAzureTestEnv(t, nil)
+	require.NoError(t, applyAzureCredentials())
+	require.Equal(t, "the default credential", azureAuthMethod())
+
+	setAzureTestEnv(t, nil,
+		"restic.azureClientId", "shared-identity",
+		"restic.origin.azureClientId", "origin-identity")
+	require.NoError(t, applyAzureCredentials())
+	require.Equal(t, "the default credential for client origin-identity", azureAuthMethod())
+}
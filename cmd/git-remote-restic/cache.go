@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/cache"
+	"github.com/restic/restic/lib/debug"
+	"github.com/restic/restic/lib/repository"
+)
+
+// packIndexCacheDir is the directory in the user's cache directory which holds
+// the pack index files of stored repositories.
+const packIndexCacheDir = "git-remote-restic/pack-idx"
+
+// openPackIndexCache returns the directory used to cache pack index files, or
+// nil if caching is disabled with restic.packIndexCache or no cache directory
+// is available.
+func openPackIndexCache() (billy.Filesystem, error) {
+	enabled, err := getConfigBool("packIndexCache", true)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		debug.Log("pack index cache disabled: %v", err)
+		return nil, nil
+	}
+	dir := filepath.Join(base, filepath.FromSlash(packIndexCacheDir))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		debug.Log("pack index cache disabled: %v", err)
+		return nil, nil
+	}
+	return osfs.New(dir), nil
+}
+
+// resticCacheDir is the directory in the user's cache directory which holds
+// restic's local cache of the repositories, unless RESTIC_CACHE_DIR or
+// restic.cacheDir is set, or the cache of the restic command line is shared.
+const resticCacheDir = "git-remote-restic/restic"
+
+// readCacheOptions reads where restic's local cache of the index, snapshots,
+// and tree packs of the repository is kept, like restic's --cache-dir and
+// --no-cache. Without the cache every git command downloads the index again,
+// which is most of the time spent opening a remote on a cloud backend. The
+// directory is read from RESTIC_CACHE_DIR, or restic.<remote>.cacheDir or
+// restic.cacheDir. The cache is disabled by the no-cache option in the remote
+// URL or restic.option, or by restic.<remote>.noCache or restic.noCache.
+// restic.shareResticCache controls whether an existing cache of the restic
+// command line is used.
+func readCacheOptions() error {
+	value, ok := extendedOptions["no-cache"]
+	source := "no-cache"
+	if !ok {
+		var err error
+		if value, ok, err = getRemoteConfig("noCache"); err != nil {
+			return err
+		}
+		source = "restic.noCache"
+	}
+	globalOptions.NoCache = false
+	if ok {
+		switch strings.ToLower(value) {
+		case "", "true", "yes", "on", "1":
+			globalOptions.NoCache = true
+		case "false", "no", "off", "0":
+		default:
+			return errors.Errorf("%s: invalid value %q, expected true or false", source, value)
+		}
+	}
+
+	var err error
+	if shareResticCache, err = getConfigBool("shareResticCache", true); err != nil {
+		return err
+	}
+	globalOptions.CacheDir = os.Getenv("RESTIC_CACHE_DIR")
+	if globalOptions.CacheDir == "" {
+		dir, _, err := getRemoteConfig("cacheDir")
+		if err != nil {
+			return err
+		}
+		globalOptions.CacheDir = dir
+	}
+	return nil
+}
+
+// useResticCache makes repo keep the index, snapshots, and tree packs in the
+// cache directory read by readCacheOptions. Repositories which are opened
+// without a cache, because it is disabled or can't be created, work as before,
+// only slower.
+func useResticCache(repo *repository.Repository) {
+	if globalOptions.NoCache {
+		return
+	}
+	id := repo.Config().ID
+	dir := globalOptions.CacheDir
+	if dir == "" && shareResticCache {
+		if shared := sharedResticCacheDir(id); shared != "" {
+			c, err := cache.New(id, shared)
+			if err == nil {
+				repo.UseCache(c)
+				return
+			}
+			debug.Log("unable to use the cache of restic in %v: %v", shared, err)
+		}
+	}
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			debug.Log("restic cache disabled: %v", err)
+			return
+		}
+		dir = filepath.Join(base, filepath.FromSlash(resticCacheDir))
+	}
+	c, err := cache.New(id, dir)
+	if err != nil {
+		Warnf("unable to open cache: %v\n", err)
+		return
+	}
+	repo.UseCache(c)
+}
+
+// shareResticCache is set by restic.shareResticCache, and is true by default.
+// When it is set, the cache which restic keeps for the repository is used if
+// there is one, see sharedResticCacheDir.
+var shareResticCache = true
+
+// sharedResticCacheDir returns the cache directory of the restic command line
+// if it already holds a writable cache of the repository with the ID id, for
+// example because the repository is also used for regular backups, or an
+// empty string otherwise. Using it avoids downloading the index again. Restic
+// doesn't lock its cache: files are written to a temporary name and renamed,
+// and files which are missing or damaged are downloaded again, so restic and
+// the remote helper can use the same cache at the same time.
+func sharedResticCacheDir(id string) string {
+	base, err := cache.DefaultDir()
+	if err != nil {
+		return ""
+	}
+	info, err := os.Stat(filepath.Join(base, id))
+	if err != nil || !info.IsDir() {
+		return ""
+	}
+	// A cache which can't be written, for example one shared by a backup
+	// job running as another user, isn't worth using, since every file
+	// which restic doesn't have yet would be downloaded each time.
+	probe, err := ioutil.TempFile(filepath.Join(base, id), "git-remote-restic-")
+	if err != nil {
+		debug.Log("restic cache in %v is not writable: %v", base, err)
+		return ""
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return base
+}
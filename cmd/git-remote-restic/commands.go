@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+const urlPrefix = "restic::"
+
+// command is an operation which is run directly by the user, rather than by
+// git. Commands are invoked as "git-remote-restic --<command> <remote> ...",
+// where remote is the name of a configured git remote or a restic URL.
+type command struct {
+	args string
+	help string
+	run  func(args []string) error
+	// noRemote is set for commands which don't operate on a single remote.
+	noRemote bool
+}
+
+var commands = map[string]command{
+	"--undo":                {"", "restore the remote to its state before the most recent push", cmdUndo, false},
+	"--fetch-all":           {"", "fetch all restic remotes of the current repository", cmdFetchAll, true},
+	"--restore-local-state": {"[--force] [snapshot]", "restore the stash, notes, and reflogs stored by restic.backupLocalState", cmdRestoreLocalState, false},
+	"--push-recursive":      {"[refspec...]", "push all branches and tags of the repository and its submodules", cmdPushRecursive, false},
+	"--manifest":            {"[snapshot]", "print the refs, object counts, and packs stored in the latest or the given snapshot", cmdManifest, false},
+	"--show":                {"[snapshot] rev:path", "print a file from the stored repository without cloning it", cmdShow, false},
+	"--ref-history":         {"[--utc] ref", "print the snapshots in which the ref was created, changed, or deleted", cmdRefHistory, false},
+	"--import":              {"remote url", "copy the branches and tags of another git remote in resumable batches", cmdImport, true},
+	"--gc":                  {"", "remove the packs uploaded by pushes from this repository which were interrupted", cmdGC, false},
+	"--locks":               {"remote", "list the locks in the repository, with their holders and ages", cmdLocks, true},
+	"--key":                 {keyArgs, "list, add, or remove the keys which can open the repository", cmdKey, true},
+	"--agent":               {"[--timeout duration]", "keep the passwords of repositories in memory so that they are entered once", cmdAgent, true},
+	"--version":             {"[remote]", "print the version, and the ID and chunker polynomial of the repository of the remote", cmdVersion, true},
+	"--ping":                {"remote", "check that the remote is reachable and measure its latency and throughput", cmdPing, true},
+}
+
+// runCommand opens the remote given as the first argument and runs the named
+// command with the remaining arguments.
+func runCommand(name string, args []string) error {
+	cmd := commands[name]
+	if cmd.noRemote {
+		return cmd.run(args)
+	}
+	if len(args) < 1 {
+		return fmt.Errorf("Usage: %s %s remote %s", os.Args[0], name, cmd.args)
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	if err := openSharedRepo(url, false); err != nil {
+		return err
+	}
+	if err := sharedRepo.LoadIndex(globalCtx); err != nil {
+		return err
+	}
+	return cmd.run(args[1:])
+}
+
+// resolveRemote finds the restic URL for a git remote. The argument can be the
+// name of a configured remote, a URL of the form restic::<location>, or a
+// restic location.
+func resolveRemote(arg string) (name string, url string, err error) {
+	if strings.HasPrefix(arg, urlPrefix) {
+		return arg, strings.TrimPrefix(arg, urlPrefix), nil
+	}
+	value, ok, err := readGitConfig("--get", "remote."+arg+".url")
+	if err != nil {
+		return "", "", err
+	} else if !ok {
+		return arg, arg, nil
+	} else if !strings.HasPrefix(value, urlPrefix) {
+		return "", "", errors.Errorf("remote %s is not a restic remote: %s", arg, value)
+	}
+	return arg, strings.TrimPrefix(value, urlPrefix), nil
+}
+
+// commandUsage describes all of the available commands.
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	for _, name := range names {
+		cmd := commands[name]
+		remote := "remote "
+		if cmd.noRemote {
+			remote = ""
+		}
+		fmt.Fprintf(&sb, "       %s %s %s%s\n\t\t%s\n", os.Args[0], name, remote, cmd.args, cmd.help)
+	}
+	return sb.String()
+}
+
+// resticRemotes returns the names and restic locations of every git remote
+// which uses git-remote-restic, in the order they are configured.
+func resticRemotes() (names []string, urls []string, err error) {
+	lines, err := readGitConfigAll("--get-regexp", `^remote\..*\.url$`)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], urlPrefix) {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(parts[0], "remote."), ".url")
+		names = append(names, name)
+		urls = append(urls, strings.TrimPrefix(parts[1], urlPrefix))
+	}
+	return names, urls, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// getConfig returns the value of the git configuration variable
+// "restic.<name>", and whether or not it was set.
+func getConfig(name string) (string, bool, error) {
+	return readGitConfig("--get", "restic."+name)
+}
+
+// getRemoteConfig returns the value of the git configuration variable
+// "restic.<remote>.<name>" for the current remote, or of "restic.<name>" if
+// that is not set, and whether either was set. Options such as --path are
+// passed to git config.
+func getRemoteConfig(name string, options ...string) (string, bool, error) {
+	if remoteName != "" {
+		value, ok, err := readGitConfig(append(options, "--get", "restic."+remoteName.String()+"."+name)...)
+		if err != nil || ok {
+			return value, ok, err
+		}
+	}
+	return readGitConfig(append(options, "--get", "restic."+name)...)
+}
+
+// getConfigBool returns the value of the boolean git configuration variable
+// "restic.<name>", or def if it is not set.
+func getConfigBool(name string, def bool) (bool, error) {
+	value, ok, err := readGitConfig("--bool", "--get", "restic."+name)
+	if err != nil || !ok {
+		return def, err
+	}
+	return value == "true", nil
+}
+
+// getConfigInt returns the value of the integer git configuration variable
+// "restic.<name>", or def if it is not set.
+func getConfigInt(name string, def int) (int, error) {
+	value, ok, err := readGitConfig("--int", "--get", "restic."+name)
+	if err != nil || !ok {
+		return def, err
+	}
+	return strconv.Atoi(value)
+}
+
+func readGitConfig(args ...string) (string, bool, error) {
+	cmd := exec.Command(gitBin(), append([]string{"config"}, args...)...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// The variable is not set.
+		return "", false, nil
+	} else if err != nil {
+		return "", false, errors.Wrapf(err, "unable to read git config %s", args[len(args)-1])
+	}
+	return strings.TrimSuffix(out.String(), "\n"), true, nil
+}
+
+// readGitConfigAll returns every line of output from git config, for options
+// such as --get-all which produce multiple values.
+func readGitConfigAll(args ...string) ([]string, error) {
+	value, ok, err := readGitConfig(args...)
+	if err != nil || !ok || value == "" {
+		return nil, err
+	}
+	return strings.Split(value, "\n"), nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// setTestGitConfig makes git config ignore the system and global
+// configuration and read the given pairs of names and values instead, and
+// makes the remote being used "origin".
+func setTestGitConfig(t *testing.T, gitConfig ...string) {
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_COUNT", "0")
+	for i := 0; i+1 < len(gitConfig); i += 2 {
+		n := strconv.Itoa(i / 2)
+		t.Setenv("GIT_CONFIG_KEY_"+n, gitConfig[i])
+		t.Setenv("GIT_CONFIG_VALUE_"+n, gitConfig[i+1])
+		t.Setenv("GIT_CONFIG_COUNT", strconv.Itoa(i/2+1))
+	}
+	remoteName = plumbing.ReferenceName("origin")
+	t.Cleanup(func() {
+		remoteName = ""
+		overriddenEnv = map[string]*string{}
+	})
+}
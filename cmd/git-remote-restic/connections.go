@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/options"
+)
+
+// backendConnections is the number of concurrent connections to the backend,
+// which applies to every backend that doesn't set its own, like
+// "sftp.connections", or "" to use the default of each backend.
+var backendConnections = ""
+
+// helperJobs bounds the number of operations which the helper performs in
+// parallel, or is 0 to use the defaults.
+var helperJobs = 0
+
+// readConnections sets backendConnections from the connections option in the
+// remote URL or restic.option, or otherwise from restic.<remote>.connections
+// or restic.connections. Slow servers, especially sftp ones, cope better with
+// fewer connections than the defaults.
+//
+// It also sets helperJobs from restic.<remote>.jobs or restic.jobs, which is
+// used as the number of connections when none is configured, and limits the
+// number of files chunked in parallel, so that a single setting balances the
+// speed of the helper against the rate limits of the backend.
+func readConnections() error {
+	jobs, _, err := getRemoteConfig("jobs", "--int")
+	if err != nil {
+		return err
+	}
+	helperJobs = 0
+	if jobs != "" {
+		if helperJobs, err = strconv.Atoi(jobs); err != nil || helperJobs < 1 {
+			return errors.Errorf("restic.jobs: invalid number of jobs %q", jobs)
+		}
+	}
+
+	value, source := extendedOptions["connections"], "connections"
+	if value == "" {
+		if value, _, err = getRemoteConfig("connections", "--int"); err != nil {
+			return err
+		}
+		source = "restic.connections"
+	}
+	if value == "" && helperJobs > 0 {
+		value = jobs
+	}
+	if value != "" {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 {
+			return errors.Errorf("%s: invalid number of connections %q", source, value)
+		}
+	}
+	backendConnections = value
+	return nil
+}
+
+// applyConnections adds backendConnections to the options of a backend, which
+// have already been extracted for its scheme, unless they set it themselves.
+func applyConnections(opts options.Options) options.Options {
+	if backendConnections == "" {
+		return opts
+	}
+	if _, ok := opts["connections"]; ok {
+		return opts
+	}
+	if opts == nil {
+		opts = options.Options{}
+	}
+	opts["connections"] = backendConnections
+	return opts
+}
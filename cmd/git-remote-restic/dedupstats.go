@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/restic/restic/lib/ui"
+)
+
+// Categories of stored files in dedup statistics.
+const (
+	categoryPackfiles = "packfiles"
+	categoryRefs      = "refs"
+	categoryMetadata  = "metadata"
+)
+
+var statCategories = []string{categoryPackfiles, categoryRefs, categoryMetadata}
+
+// classifyStoredFile returns the category of a file in the stored repository
+// for dedup statistics. Git objects are packfiles, refs and their logs are
+// refs, and everything else, including the directories themselves, is
+// metadata.
+func classifyStoredFile(name string) string {
+	rel := storedRepoPath(filepath.ToSlash(name))
+	parts := strings.Split(rel, "/")
+	switch {
+	case parts[0] == "objects" && len(parts) > 2, parts[0] == resticgit.ArchivedPacksPath && len(parts) > 2:
+		return categoryPackfiles
+	case parts[0] == "refs", parts[0] == "logs", rel == "packed-refs", rel == "HEAD":
+		return categoryRefs
+	case rel == refLogPath, strings.HasPrefix(rel, localStateLogPath+"/"):
+		return categoryRefs
+	default:
+		return categoryMetadata
+	}
+}
+
+// printDedupStats prints how much of the data written by the last commit of
+// fs was deduplicated, broken down by category.
+func printDedupStats(w io.Writer, fs *resticfs.Filesystem) {
+	stats := fs.Stats()
+	byCategory := map[string]*resticfs.BlobStats{}
+	for _, category := range statCategories {
+		byCategory[category] = &resticfs.BlobStats{}
+	}
+	for name, fileStats := range stats.Files {
+		byCategory[classifyStoredFile(name)].Add(fileStats)
+	}
+	byCategory[categoryMetadata].Add(stats.Trees)
+
+	fmt.Fprintf(w, "dedup statistics:\n")
+	for _, category := range statCategories {
+		s := byCategory[category]
+		if s.Blobs == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "  %-10s %d of %d chunks new, %s of %s added (%s stored), %s deduplicated\n",
+			category, s.NewBlobs, s.Blobs,
+			ui.FormatBytes(s.NewBytes), ui.FormatBytes(s.Bytes),
+			ui.FormatBytes(s.StoredBytes),
+			ui.FormatPercent(s.Bytes-s.NewBytes, s.Bytes))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/restic/restic/lib/ui"
+)
+
+// dryRun is set by the dry-run option, which git push --dry-run sends to ask
+// which refs would be updated without updating them.
+var dryRun = false
+
+// planPush reports the result of pushing refspecs like PushBatch, without
+// modifying the remote, and prints what the push would do.
+func planPush(refspecs []config.RefSpec) (map[string]error, error) {
+	var stored *git.Repository
+	if sharedRepo.Exists() {
+		lock, err := sharedRepo.Lock(false)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			sharedRepo.Unlock(lock)
+		}()
+		stored, err = sharedRepo.Git(false)
+		if err != nil && err != git.ErrRepositoryNotExists {
+			return nil, err
+		}
+	}
+	if stored == nil {
+		// The first push would start from an empty repository.
+		var err error
+		if stored, err = resticgit.Open(memfs.New(), true); err != nil {
+			return nil, err
+		}
+	}
+	refspecs, refused, err := checkProtectedRefs(stored, localGitPath, refspecs)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := resticgit.PlanPush(stored, localGitPath, refspecs)
+	if err != nil {
+		return nil, err
+	}
+	printPlan(os.Stderr, plan)
+	results := make(map[string]error, len(refspecs))
+	for _, refspec := range refspecs {
+		results[refspec.Dst("").String()] = nil
+	}
+	for dst, err := range refused {
+		results[dst] = err
+	}
+	return results, nil
+}
+
+// printPlan describes the changes which a transfer would make.
+func printPlan(w io.Writer, plan *resticgit.Plan) {
+	for _, change := range plan.Refs {
+		switch {
+		case change.New.IsZero():
+			fmt.Fprintf(w, "  delete %s (was %s)\n", change.Name, change.Old.String()[:7])
+		case change.Old.IsZero():
+			fmt.Fprintf(w, "  create %s at %s\n", change.Name, change.New.String()[:7])
+		case change.Forced:
+			fmt.Fprintf(w, "  update %s %s...%s (forced)\n", change.Name, change.Old.String()[:7], change.New.String()[:7])
+		default:
+			fmt.Fprintf(w, "  update %s %s..%s\n", change.Name, change.Old.String()[:7], change.New.String()[:7])
+		}
+	}
+	fmt.Fprintf(w, "%d refs changed, %d objects to copy, %s before compression\n",
+		len(plan.Refs), plan.Objects, ui.FormatBytes(uint64(plan.Size)))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/options"
+)
+
+// extendedOptions are the restic extended options, which restic accepts as
+// "-o key=value", for the opened repository. They are read from
+// restic.option and restic.<remote>.option, and from the query string of the
+// remote URL, in increasing order of precedence.
+var extendedOptions = options.Options{}
+
+// globalOptionNames are the options which may appear in the query string of
+// a remote URL, like "local:/srv/repo?limit-upload=500", or in restic.option
+// besides the extended options of the backends. They apply to every backend.
+var globalOptionNames = map[string]bool{
+	"limit-upload":    true,
+	"limit-download":  true,
+	"connections":     true,
+	"retry-lock":      true,
+	"no-lock":         true,
+	"compression":     true,
+	"pack-size":       true,
+	"no-extra-verify": true,
+	"no-cache":        true,
+}
+
+// configuredOptions maps extended options to the git configuration variables
+// which set them, as restic.<remote>.<name> or restic.<name>, when neither the
+// remote URL nor restic.option do. Commands are easier to write there than
+// percent-encoded in a URL, and the S3 options can be set once for every
+// remote.
+var configuredOptions = map[string]string{
+	"rclone.program": "rcloneProgram",
+	"rclone.args":    "rcloneArgs",
+	"sftp.command":   "sftpCommand",
+	"sftp.args":      "sftpArgs",
+
+	"s3.storage-class": "s3StorageClass",
+	"s3.region":        "s3Region",
+	"s3.bucket-lookup": "s3BucketLookup",
+}
+
+// splitLocationOptions removes the extended options from the end of a remote
+// URL such as "rclone:remote:path?rclone.program=ssh%20host", and returns
+// the location and the options. Like in a URL, the options are separated by
+// "&", and may be percent-encoded. The query string is only treated as
+// options when every key names a backend option, like "rclone.program", or
+// is one of globalOptionNames, so that locations such as REST server URLs can
+// still contain a query string.
+func splitLocationOptions(location string) (string, options.Options, error) {
+	i := strings.LastIndexByte(location, '?')
+	if i < 0 {
+		return location, nil, nil
+	}
+	query, err := url.ParseQuery(location[i+1:])
+	if err != nil || len(query) == 0 {
+		return location, nil, nil
+	}
+	var opts []string
+	for key, values := range query {
+		if !strings.Contains(key, ".") && !globalOptionNames[key] {
+			return location, nil, nil
+		}
+		for _, value := range values {
+			opts = append(opts, key+"="+value)
+		}
+	}
+	parsed, err := options.Parse(opts)
+	if err != nil {
+		return "", nil, errors.WithMessage(err, "invalid option in remote URL")
+	}
+	return location[:i], parsed, nil
+}
+
+// readExtendedOptions sets extendedOptions from the git configuration and
+// the options which were part of the remote URL, and the options in
+// configuredOptions from their variables.
+func readExtendedOptions(fromURL options.Options) error {
+	keys := []string{"restic.option"}
+	if remoteName != "" {
+		keys = append(keys, "restic."+remoteName.String()+".option")
+	}
+	opts := options.Options{}
+	for _, key := range keys {
+		values, err := readGitConfigAll("--get-all", key)
+		if err != nil {
+			return err
+		}
+		configured, err := options.Parse(values)
+		if err != nil {
+			return errors.WithMessagef(err, "invalid %s", key)
+		}
+		for key, value := range configured {
+			opts[key] = value
+		}
+	}
+	for key, value := range fromURL {
+		opts[key] = value
+	}
+	for option, name := range configuredOptions {
+		if _, ok := opts[option]; ok {
+			continue
+		}
+		value, ok, err := getRemoteConfig(name)
+		if err != nil {
+			return err
+		} else if ok {
+			opts[option] = value
+		}
+	}
+	extendedOptions = opts
+	return nil
+}
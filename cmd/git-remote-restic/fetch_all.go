@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+)
+
+// cmdFetchAll fetches every restic remote of the local repository using a
+// single process. Unlike "git fetch --all", which starts a new remote helper
+// for every remote, the password of a restic repository is only requested
+// once even when several remotes share it, however their URLs name it.
+//
+// The remote-tracking refs are updated directly rather than through git
+// fetch, so FETCH_HEAD isn't written, refs which were deleted from a remote
+// aren't pruned even with fetch.prune, and the reference-transaction hook
+// doesn't run.
+func cmdFetchAll(args []string) error {
+	if len(args) != 0 {
+		return errors.New("--fetch-all does not accept any arguments")
+	}
+	names, urls, err := resticRemotes()
+	if err != nil {
+		return err
+	}
+	opened := make(map[string]*Repository)
+	failed := 0
+	for i, name := range names {
+		fmt.Printf("Fetching %s\n", name)
+		remoteName = plumbing.ReferenceName(name)
+		location := remoteLocation(urls[i])
+		if repo, ok := opened[location]; ok && location != "" {
+			if err := readSnapshotSelection(); err != nil {
+				Warnf("error: could not fetch %s: %v\n", name, err)
+				failed++
+				continue
+			}
+			// The remote may select a different snapshot.
+			repo.fs = nil
+			repo.snapshot = nil
+			sharedRepo = repo
+		} else {
+			if err := openSharedRepo(urls[i], false); err != nil {
+				Warnf("error: could not fetch %s: %v\n", name, err)
+				failed++
+				continue
+			}
+			opened[location] = sharedRepo
+		}
+		if err := fetchRemote(name); err != nil {
+			Warnf("error: could not fetch %s: %v\n", name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("could not fetch %d of %d remotes", failed, len(names))
+	}
+	return nil
+}
+
+// remoteLocation returns the location of the restic repository which
+// openSharedRepo opens for the url of the current remote, without opening it,
+// or "" if it can't be determined. Different urls, such as a relative and an
+// absolute path, or the environment, may name the same location.
+func remoteLocation(url string) string {
+	applyRemoteEnvironment(remoteName.String())
+	if url == "" || url == envLocation {
+		var err error
+		if url, err = readEnvLocation(); err != nil {
+			return ""
+		}
+	}
+	url, _, err := splitLocationOptions(url)
+	if err != nil {
+		return ""
+	}
+	location, err := resolveLocation(remoteName.String(), url)
+	if err != nil {
+		return ""
+	}
+	return location
+}
+
+// fetchRemote updates the remote-tracking refs of the named remote from
+// sharedRepo, using the remote's configured fetch refspecs.
+func fetchRemote(name string) error {
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	state, err := readFetchState(name)
+	if err != nil {
+		debug.Log("unable to read fetch state: %v", err)
+	}
+	if err := sharedRepo.UseIntactSnapshot(globalCtx, state.checkedSnapshot(sharedRepo.location)); err != nil {
+		return err
+	}
+	repo, err := sharedRepo.Git(false)
+	if err == git.ErrRepositoryNotExists {
+		// Nothing has been pushed to the remote yet.
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	specs, err := readGitConfigAll("--get-all", "remote."+name+".fetch")
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		specs = []string{fmt.Sprintf("+refs/heads/*:refs/remotes/%s/*", name)}
+	}
+	refSpecs := make([]config.RefSpec, len(specs))
+	for i, spec := range specs {
+		refSpecs[i] = config.RefSpec(spec)
+		if err := refSpecs[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := resticgit.Fetch(globalCtx, repo, localGitPath, refSpecs, progressFunc()); err != nil {
+		return err
+	}
+	if syncNotes {
+		return fetchNotes(repo, localGitPath)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// fetchState records which snapshot the refs of a remote were last listed
+// from. When no snapshot has been added or removed since, and the snapshot is
+// selected the same way, the refs can be listed without loading the index or
+// any snapshots, which makes polling with "git fetch" inexpensive.
+type fetchState struct {
+	// Location is the restic repository location of the remote.
+	Location string
+	// SnapshotTag and IntactSnapshot are the values of restic.snapshotTag and
+	// restic.intactSnapshot which selected the snapshot.
+	SnapshotTag    string
+	IntactSnapshot bool
+	// Snapshots is the result of Repository.SnapshotsDigest at the time of
+	// listing.
+	Snapshots restic.ID
+	// Snapshot is the snapshot which the refs were read from. This is the
+	// latest snapshot, unless it is damaged.
+	Snapshot restic.ID
+	// Refs are the lines which were printed in response to "list".
+	Refs []string
+}
+
+// newFetchState returns the fetch state of refs read from the snapshot of the
+// repository at location, given the digest of its snapshots, which was
+// selected with the current configuration.
+func newFetchState(location string, digest, snapshot restic.ID, refs []string) *fetchState {
+	return &fetchState{
+		Location:       location,
+		SnapshotTag:    snapshotTag,
+		IntactSnapshot: useIntactSnapshot,
+		Snapshots:      digest,
+		Snapshot:       snapshot,
+		Refs:           refs,
+	}
+}
+
+// matches reports whether the state is for the repository at location, and
+// its snapshot was selected the way the current configuration selects it.
+// A nil state matches nothing.
+func (s *fetchState) matches(location string) bool {
+	return s != nil && s.Location == location && s.SnapshotTag == snapshotTag && s.IntactSnapshot == useIntactSnapshot
+}
+
+// checkedSnapshot returns the snapshot which the refs were read from, which
+// was found intact, if the state matches the repository at location. It
+// returns nil if there is no such snapshot, including for a nil state.
+func (s *fetchState) checkedSnapshot(location string) *restic.ID {
+	if !s.matches(location) || !s.IntactSnapshot {
+		return nil
+	}
+	return &s.Snapshot
+}
+
+// fetchStatePath returns the location of the fetch state of the named remote,
+// which is stored in the local repository.
+func fetchStatePath(remote string) string {
+	return filepath.Join(localGitPath, "restic", "fetched", url.PathEscape(remote))
+}
+
+// readFetchState returns the recorded fetch state of the named remote, or nil
+// if there is none.
+func readFetchState(remote string) (*fetchState, error) {
+	file, err := os.Open(fetchStatePath(remote))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	state := &fetchState{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid fetch state %#v", line)
+		}
+		switch parts[0] {
+		case "location":
+			state.Location = parts[1]
+		case "tag":
+			state.SnapshotTag = parts[1]
+		case "intact":
+			state.IntactSnapshot, err = strconv.ParseBool(parts[1])
+		case "snapshots":
+			state.Snapshots, err = restic.ParseID(parts[1])
+		case "snapshot":
+			state.Snapshot, err = restic.ParseID(parts[1])
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid fetch state %#v", line)
+		}
+	}
+	for scanner.Scan() {
+		state.Refs = append(state.Refs, scanner.Text())
+	}
+	return state, scanner.Err()
+}
+
+// writeFetchState records the fetch state of the named remote. Nothing is
+// recorded outside of a git repository, such as when running git ls-remote.
+func writeFetchState(remote string, state *fetchState) error {
+	if _, err := os.Stat(localGitPath); os.IsNotExist(err) {
+		return nil
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "location %s\n", state.Location)
+	fmt.Fprintf(&sb, "tag %s\n", state.SnapshotTag)
+	fmt.Fprintf(&sb, "intact %t\n", state.IntactSnapshot)
+	fmt.Fprintf(&sb, "snapshots %s\n", state.Snapshots)
+	fmt.Fprintf(&sb, "snapshot %s\n", state.Snapshot)
+	fmt.Fprintf(&sb, "\n")
+	for _, ref := range state.Refs {
+		fmt.Fprintf(&sb, "%s\n", ref)
+	}
+	path := fetchStatePath(remote)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that concurrent fetches never
+	// read a partial state.
+	temp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	if err := ioutil.WriteFile(temp, []byte(sb.String()), 0666); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/restic/restic/lib/restic"
+	"github.com/stretchr/testify/require"
+)
+
+// useTempGitDir points localGitPath at a new directory for the test.
+func useTempGitDir(t *testing.T) {
+	saved := localGitPath
+	localGitPath = t.TempDir()
+	t.Cleanup(func() {
+		localGitPath = saved
+	})
+}
+
+// setSnapshotSelection sets restic.snapshotTag and restic.intactSnapshot for
+// the test.
+func setSnapshotSelection(t *testing.T, tag string, intact bool) {
+	savedTag, savedIntact := snapshotTag, useIntactSnapshot
+	snapshotTag, useIntactSnapshot = tag, intact
+	t.Cleanup(func() {
+		snapshotTag, useIntactSnapshot = savedTag, savedIntact
+	})
+}
+
+func TestFetchStateRoundTrip(t *testing.T) {
+	useTempGitDir(t)
+	setSnapshotSelection(t, "backup", true)
+
+	state, err := readFetchState("origin")
+	require.NoError(t, err)
+	require.Nil(t, state)
+
+	refs := []string{
+		"0123456789012345678901234567890123456789 refs/heads/master",
+		"@refs/heads/master HEAD",
+	}
+	written := newFetchState("local:/repo", restic.NewRandomID(), restic.NewRandomID(), refs)
+	require.NoError(t, writeFetchState("origin", written))
+	state, err = readFetchState("origin")
+	require.NoError(t, err)
+	require.Equal(t, written, state)
+
+	// Remotes which are URLs are stored separately.
+	state, err = readFetchState("local:/repo")
+	require.NoError(t, err)
+	require.Nil(t, state)
+}
+
+func TestFetchStateSelection(t *testing.T) {
+	useTempGitDir(t)
+	setSnapshotSelection(t, "", true)
+	snapshot := restic.NewRandomID()
+	state := newFetchState("local:/repo", restic.NewRandomID(), snapshot, nil)
+
+	require.True(t, state.matches("local:/repo"))
+	require.Equal(t, &snapshot, state.checkedSnapshot("local:/repo"))
+	require.False(t, state.matches("local:/other"))
+	require.Nil(t, state.checkedSnapshot("local:/other"))
+
+	// A listing for another tag doesn't describe the selected snapshot.
+	snapshotTag = "backup"
+	require.False(t, state.matches("local:/repo"))
+	require.Nil(t, state.checkedSnapshot("local:/repo"))
+	snapshotTag = ""
+
+	// A snapshot selected without checking it isn't known to be intact.
+	useIntactSnapshot = false
+	require.False(t, state.matches("local:/repo"))
+	unchecked := newFetchState("local:/repo", restic.NewRandomID(), snapshot, nil)
+	require.True(t, unchecked.matches("local:/repo"))
+	require.Nil(t, unchecked.checkedSnapshot("local:/repo"))
+
+	var missing *fetchState
+	require.False(t, missing.matches("local:/repo"))
+	require.Nil(t, missing.checkedSnapshot("local:/repo"))
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	urlparser "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 
 	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
@@ -18,9 +16,6 @@ import (
 )
 
 var localGitPath string
-var returnedCredentials string
-
-const anonymous = "anonymous"
 
 func init() {
 	localGitPath = os.Getenv("GIT_DIR")
@@ -29,10 +24,28 @@ func init() {
 	}
 }
 
+// resolveLocalGitPath sets localGitPath to the absolute path of the common
+// directory of the local repository. In a linked worktree, GIT_DIR is a
+// directory which only holds the state of that worktree, and .git is a file
+// which points to it, while the objects and refs are in the common directory
+// of the main worktree. Outside of a repository, localGitPath is unchanged.
+func resolveLocalGitPath() {
+	out, err := exec.Command(gitBin(), "rev-parse", "--git-common-dir").Output()
+	if err != nil {
+		return
+	}
+	if path, err := filepath.Abs(strings.TrimSpace(string(out))); err == nil {
+		localGitPath = path
+	}
+}
+
 // FetchBatch is reponsible for fetching a batch of remote refs and storing
 // them locally; implemented by "pushing" the refs from the restic repo into
 // the local repo.
 func FetchBatch(fetchSpecs [][]string) error {
+	if err := checkFetchCaseCollisions(fetchSpecs); err != nil {
+		return err
+	}
 	lock, err := sharedRepo.Lock(false)
 	if err != nil {
 		return err
@@ -44,13 +57,6 @@ func FetchBatch(fetchSpecs [][]string) error {
 	if err != nil {
 		return err
 	}
-	remote, err := repo.CreateRemoteAnonymous(&config.RemoteConfig{
-		Name: anonymous,
-		URLs: []string{localGitPath},
-	})
-	if err != nil {
-		return err
-	}
 
 	var refSpecs []config.RefSpec
 	var deleteRefSpecs []config.RefSpec
@@ -63,39 +69,90 @@ func FetchBatch(fetchSpecs [][]string) error {
 		// Push into a local ref with a temporary name, because the
 		// git process that invoked us will get confused if we make a
 		// ref with the same name.  Later, delete this temporary ref.
-		localTempRef := fmt.Sprintf("%s-%d-%d",
-			plumbing.ReferenceName(refInBareRepo).Short(), os.Getpid(), i)
-		refSpec := fmt.Sprintf(
-			"%s:refs/remotes/%s/%s", refInBareRepo, remoteName, localTempRef)
+		// The ref isn't named after the remote, since the name of an
+		// anonymous remote is its URL, which isn't valid in a ref.
+		localTempRef := fmt.Sprintf("refs/restic-fetch-%d/%s-%d",
+			os.Getpid(), plumbing.ReferenceName(refInBareRepo).Short(), i)
+		refSpec := fmt.Sprintf("%s:%s", refInBareRepo, localTempRef)
 
 		refSpecs = append(refSpecs, config.RefSpec(refSpec))
-		deleteRefSpecs = append(deleteRefSpecs, config.RefSpec(
-			fmt.Sprintf(":refs/remotes/%s/%s", remoteName, localTempRef)))
+		deleteRefSpecs = append(deleteRefSpecs, config.RefSpec(":"+localTempRef))
 	}
 
-	err = remote.PushContext(globalCtx, &git.PushOptions{
-		RemoteName: anonymous,
-		RefSpecs:   refSpecs,
-	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
+	interval, err := getConfigInt("fetchCheckpointInterval", 0)
+	if err != nil {
 		return err
 	}
+	if interval > 0 {
+		if err := fetchStaged(repo, fetchSpecs, refSpecs, deleteRefSpecs, interval); err != nil {
+			return err
+		}
+	} else {
+		if err := resticgit.Fetch(globalCtx, repo, localGitPath, refSpecs, progressFunc()); err != nil {
+			return err
+		}
+		if err := resticgit.Fetch(globalCtx, repo, localGitPath, deleteRefSpecs, nil); err != nil {
+			return err
+		}
+	}
+	if syncNotes {
+		return fetchNotes(repo, localGitPath)
+	}
+	return nil
+}
 
-	err = remote.PushContext(globalCtx, &git.PushOptions{
-		RemoteName: anonymous,
-		RefSpecs:   deleteRefSpecs,
+// fetchStaged fetches the refs like FetchBatch, but copies the objects into
+// the staging repository first, committing them every interval commits. If
+// the fetch is interrupted, the next one resumes from the last commit which
+// was staged. The staging repository is removed once the fetch succeeds.
+func fetchStaged(repo *git.Repository, fetchSpecs [][]string, refSpecs, deleteRefSpecs []config.RefSpec, interval int) error {
+	staging, stagingDir, err := openStagingRepo(sharedRepo.location)
+	if err != nil {
+		return err
+	}
+	wants := make([]plumbing.Hash, len(fetchSpecs))
+	for i, fetch := range fetchSpecs {
+		wants[i] = plumbing.NewHash(fetch[0])
+	}
+	err = resticgit.Stage(globalCtx, repo, staging, wants, resticgit.StageOptions{
+		Interval: interval,
+		Progress: progressFunc(),
 	})
-	if err != nil && err != git.NoErrAlreadyUpToDate {
+	if err != nil {
+		Warnf("objects fetched so far are kept in %s, fetch again to resume\n", stagingDir)
 		return err
 	}
-
-	return nil
+	// The refs are fetched by name, so create them in the staging
+	// repository. Objects which were requested by hash are fetched by
+	// hash from it as well.
+	for i, fetch := range fetchSpecs {
+		if resticgit.IsObjectName(fetch[1]) {
+			continue
+		}
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(fetch[1]), wants[i])
+		if err := staging.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	if err := resticgit.Fetch(globalCtx, staging, localGitPath, refSpecs, progressFunc()); err != nil {
+		return err
+	}
+	if err := resticgit.Fetch(globalCtx, staging, localGitPath, deleteRefSpecs, nil); err != nil {
+		return err
+	}
+	return os.RemoveAll(stagingDir)
 }
 
 // PushBatch is responsible for pushing a set of refs to the restic remote;
 // implemented by "pulling" the refs from the local repository into the restic
 // repo.
 func PushBatch(refspecs []config.RefSpec) (map[string]error, error) {
+	if !sharedRepo.Exists() {
+		if err := sharedRepo.Init(globalCtx); err != nil {
+			return nil, err
+		}
+		confirmGitCredential(sharedRepo.location, true)
+	}
 	lock, err := sharedRepo.Lock(true)
 	if err != nil {
 		return nil, err
@@ -104,112 +161,143 @@ func PushBatch(refspecs []config.RefSpec) (map[string]error, error) {
 		sharedRepo.Unlock(lock)
 	}()
 	sharedRepo.fs.StartNewSnapshot()
+	if err := resticgit.ArchivePacks(sharedRepo.fs, incrementalLayout); err != nil {
+		return nil, errors.WithMessage(err, "unable to archive packs")
+	}
 
 	repo, err := sharedRepo.Git(true)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to open git remote")
 	}
-	remote, err := repo.CreateRemoteAnonymous(&config.RemoteConfig{
-		Name: anonymous,
-		URLs: []string{localGitPath},
-	})
+	refspecs, refused, err := checkProtectedRefs(repo, localGitPath, refspecs)
 	if err != nil {
 		return nil, err
+	} else if len(refspecs) == 0 {
+		return refused, nil
 	}
 
-	results := make(map[string]error, len(refspecs))
-	// Since we operate in reverse, we need to flip the refspecs around when we
-	// fetch them from the local repository. This stores a list of the refs, in
-	// reverse, which actually need to be fetched.
-	fetchRefspecs := make([]config.RefSpec, 0, len(refspecs))
-	for _, refspec := range refspecs {
-		dst := refspec.Dst("")
-		if refspec.IsDelete() {
-			if refspec.IsWildcard() {
-				results[dst.String()] = fmt.Errorf("wildcards (%#v) not supported for deletes", refspec)
-				continue
-			}
-			err := repo.Storer.RemoveReference(dst)
-			if err == git.NoErrAlreadyUpToDate {
-				err = nil
-			}
-			results[dst.String()] = err
-		} else {
-			fetchRefspecs = append(fetchRefspecs, refspec.Reverse())
-		}
-	}
-
-	err = remote.FetchContext(globalCtx, &git.FetchOptions{
-		RemoteName: anonymous,
-		RefSpecs:   refspecs,
-	})
-	if err == git.NoErrAlreadyUpToDate {
-		err = nil
+	// Record the refs which will be updated, including the targets of
+	// symbolic refs, so that the changes can be added to the ref log.
+	resolved, err := resticgit.ResolveSymbolicRefSpecs(repo, refspecs)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, refspec := range refspecs {
-		if !refspec.IsDelete() {
-			results[refspec.Dst("").String()] = err
+	var refNames []plumbing.ReferenceName
+	for _, refspec := range resolved {
+		if !refspec.IsWildcard() {
+			refNames = append(refNames, refspec.Dst(""))
 		}
 	}
-
-	_, err = sharedRepo.fs.CommitSnapshot(localGitPath, []string{})
-	if err != nil && err != resticfs.ErrNoChanges {
+	refsBefore, err := snapshotRefs(repo, refNames)
+	if err != nil {
 		return nil, err
 	}
+	if preCommitHook != "" {
+		planned, err := plannedUpdates(resolved, refsBefore)
+		if err != nil {
+			return nil, err
+		}
+		sharedRepo.fs.PreCommit = preCommitFunc(planned)
+		defer func() {
+			sharedRepo.fs.PreCommit = nil
+		}()
+	}
 
-	return results, nil
-}
+	if verbosity > 1 {
+		plan, err := resticgit.PlanPush(repo, localGitPath, refspecs)
+		if err != nil {
+			return nil, err
+		}
+		printPlan(os.Stderr, plan)
+	}
 
-func gitBin() string {
-	gitExec := os.Getenv("GIT_EXEC_PATH")
-	return filepath.Join(gitExec, "git")
-}
+	snapshotSize, err := getConfigInt("pushSnapshotSize", 0)
+	if err != nil {
+		return nil, err
+	}
+	if snapshotSize > 0 {
+		if err := pushIntermediateSnapshots(repo, resolved, int64(snapshotSize)); err != nil {
+			return nil, err
+		}
+	}
 
-func getGitCredential(urlStr string) (string, error) {
-	url, err := urlparser.Parse(urlStr)
+	results, err := resticgit.Push(globalCtx, repo, localGitPath, refspecs, progressFunc())
 	if err != nil {
-		Warnf("%s\n", urlStr)
-		return "", err
-	}
-	input := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\nusername=%s\n\n", "restic", "none", url.Opaque, url.User.Username())
-	cmd := exec.Command(gitBin(), "credential", "fill")
-	cmd.Stdin = strings.NewReader(input)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err = cmd.Run()
+		return nil, err
+	}
+	if syncNotes {
+		if err := pushNotes(repo, localGitPath); err != nil {
+			return nil, errors.WithMessage(err, "unable to push notes")
+		}
+	}
+	if err := removeCheckpointRefs(repo, sharedRepo.fs); err != nil {
+		return nil, err
+	}
+
+	refsAfter, err := snapshotRefs(repo, refNames)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	returnedCredentials = string(out.Bytes())
-	reader := bufio.NewReader(&out)
-	for {
-		prefix, err := reader.ReadString('=')
-		if err != nil {
-			return "", err
+	updates := diffRefs(refsBefore, refsAfter)
+	if err := appendRefLog(sharedRepo.fs, updates); err != nil {
+		return nil, errors.Wrap(err, "unable to update ref log")
+	}
+	if signPushes {
+		if err := writePushCert(sharedRepo.fs, sharedRepo.location, updates); err != nil {
+			return nil, err
 		}
-		argument, err := reader.ReadString('\n')
-		if err != nil {
-			return "", err
+	}
+
+	if backupLocalState {
+		if err := pushLocalState(repo, sharedRepo.fs, localGitPath); err != nil {
+			return nil, errors.WithMessage(err, "unable to back up local state")
+		}
+	}
+
+	if shouldPackRefs(sharedRepo.fs) {
+		if err := packStoredRefs(repo, sharedRepo.fs); err != nil {
+			return nil, errors.WithMessage(err, "unable to pack refs")
 		}
-		if prefix == "password=" {
-			return argument[:len(argument)-1], nil
+	}
+	if err := writeManifest(repo, sharedRepo.fs); err != nil {
+		return nil, errors.WithMessage(err, "unable to write manifest")
+	}
+	if normalizeRepo {
+		if err := normalizeRepository(sharedRepo.fs); err != nil {
+			return nil, err
 		}
 	}
+	if err := validateRepositoryLayout(sharedRepo.fs); err != nil {
+		return nil, err
+	}
+
+	stopKeepalive := startKeepalive("Committing snapshot")
+	_, err = sharedRepo.fs.CommitSnapshot(localGitPath, pushSnapshotTags())
+	stopKeepalive()
+	if err == nil && verbosity > 1 {
+		printDedupStats(os.Stderr, sharedRepo.fs)
+	} else if err != nil && err != resticfs.ErrNoChanges {
+		return nil, err
+	}
+
+	for dst, err := range refused {
+		results[dst] = err
+	}
+	return results, nil
 }
 
-func confirmGitCredential(url string, success bool) error {
-	if returnedCredentials == "" {
-		// Password didn't come from git credential
+// progressFunc returns the Progress which reports transfer progress to the
+// user, or nil if git did not request progress.
+func progressFunc() *resticgit.Progress {
+	if !printProgress {
 		return nil
 	}
-	var action = "reject"
-	if success {
-		action = "approve"
-	}
-	cmd := exec.Command(gitBin(), "credential", action)
-	cmd.Stdin = strings.NewReader(returnedCredentials)
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	return cmd.Run()
+	return resticgit.ProgressFunc(func(message string) {
+		fmt.Fprintf(os.Stderr, "%s\r", message)
+	}).Progress()
+}
+
+func gitBin() string {
+	gitExec := os.Getenv("GIT_EXEC_PATH")
+	return filepath.Join(gitExec, "git")
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/pkg/errors"
+)
+
+// preCommitHook is set by restic.preCommitHook, and is a shell command which
+// can reject a push before any of it is saved, for example to scan the pushed
+// commits for secrets.
+var preCommitHook = ""
+
+// plannedUpdates returns the updates which pushing refSpecs will make to the
+// refs of the stored repository, whose current values are in before. The new
+// value of each ref is read from the local repository.
+func plannedUpdates(refSpecs []config.RefSpec, before map[plumbing.ReferenceName]plumbing.Hash) ([]RefUpdate, error) {
+	local, err := git.PlainOpen(localGitPath)
+	if err != nil {
+		return nil, err
+	}
+	var updates []RefUpdate
+	for _, refSpec := range refSpecs {
+		if refSpec.IsWildcard() {
+			continue
+		}
+		name := refSpec.Dst("")
+		update := RefUpdate{Old: before[name], New: plumbing.ZeroHash, Name: name}
+		if !refSpec.IsDelete() {
+			ref, err := storer.ResolveReference(local.Storer, plumbing.ReferenceName(refSpec.Src()))
+			if err != nil {
+				return nil, errors.WithMessagef(err, "unable to resolve %s", refSpec.Src())
+			}
+			update.New = ref.Hash()
+		}
+		if update.Old != update.New {
+			updates = append(updates, update)
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Name < updates[j].Name
+	})
+	return updates, nil
+}
+
+// preCommitFunc returns the resticfs.Filesystem PreCommit callback which runs
+// preCommitHook once per push, before the first snapshot of the push is
+// saved, or nil if no hook is configured. Like git's pre-receive hook, the
+// hook receives a line "<old> <new> <ref>" on stdin for each ref which is
+// updated, and runs in the local repository, so it can inspect the pushed
+// commits with git. The files of the stored repository which the push
+// creates or modifies are listed in GIT_REMOTE_RESTIC_CHANGED_FILES, one per
+// line. If it exits with a non-zero status, no snapshot is created and the
+// push fails. It also runs before the snapshots of --push-recursive and
+// --undo.
+func preCommitFunc(updates []RefUpdate) func(changed []string) error {
+	if preCommitHook == "" {
+		return nil
+	}
+	done := false
+	return func(changed []string) error {
+		if done {
+			return nil
+		}
+		var stdin bytes.Buffer
+		for _, update := range updates {
+			fmt.Fprintf(&stdin, "%s %s %s\n", update.Old, update.New, update.Name)
+		}
+		cmd := exec.Command("sh", "-c", preCommitHook)
+		cmd.Stdin = &stdin
+		// The output of the hook is shown to the user; stdout belongs to
+		// git.
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "GIT_DIR="+localGitPath, "GIT_REMOTE_RESTIC_CHANGED_FILES="+strings.Join(changed, "\n"))
+		if err := cmd.Run(); err != nil {
+			return errors.Errorf("push rejected by restic.preCommitHook: %v", err)
+		}
+		done = true
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// printRepositoryIdentity writes the ID and the chunker polynomial of the
+// restic repository of sharedRepo to w. Two remotes with the same ID use the
+// same repository, and only repositories with the same chunker polynomial
+// share data when it is copied between them with restic copy.
+func printRepositoryIdentity(w io.Writer) {
+	cfg := sharedRepo.restic.Config()
+	fmt.Fprintf(w, "restic repository %s, chunker polynomial %s\n", cfg.ID, cfg.ChunkerPolynomial)
+}
+
+// cmdVersion prints the version of the program and, if a remote is given, the
+// identity of its restic repository.
+func cmdVersion(args []string) error {
+	PrintVersion()
+	if len(args) == 0 {
+		return nil
+	} else if len(args) != 1 {
+		return errors.Errorf("Usage: %s --version [remote]", os.Args[0])
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	if err := openSharedRepo(url, false); err != nil {
+		return err
+	}
+	if !sharedRepo.Exists() {
+		return ErrNoRepository
+	}
+	printRepositoryIdentity(os.Stdout)
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// importRefPrefix names the local refs which hold the refs fetched by --import
+// until they have been pushed to the restic remote.
+const importRefPrefix = "refs/restic-import/"
+
+// defaultImportBatch is the number of refs which --import fetches and pushes
+// at a time, unless restic.importBatch is set.
+const defaultImportBatch = 50
+
+// defaultImportSnapshotSize is used as restic.pushSnapshotSize by the pushes
+// of --import, unless it is set, so that large batches are saved in parts.
+const defaultImportSnapshotSize = "256m"
+
+// importAttempts is the number of times each fetch and push of --import is
+// tried before giving up.
+const importAttempts = 3
+
+// cmdImport copies the branches and tags of another git remote, such as a
+// hosted repository, to a restic remote through the local repository. The refs
+// are fetched and pushed in batches of restic.importBatch, and every push
+// creates intermediate snapshots, so that the progress made over an
+// unreliable link is kept. Failed transfers are retried, and running the
+// command again skips the refs which the restic remote already has.
+func cmdImport(args []string) error {
+	if len(args) != 2 {
+		return errors.Errorf("Usage: %s --import remote url", os.Args[0])
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	target := name
+	if name == url {
+		target = urlPrefix + url
+	}
+	source := args[1]
+
+	batchSize := defaultImportBatch
+	if value, ok, err := getRemoteConfig("importBatch", "--int"); err != nil {
+		return err
+	} else if ok {
+		if batchSize, err = strconv.Atoi(value); err != nil || batchSize < 1 {
+			return errors.Errorf("restic.importBatch: invalid number of refs %q", value)
+		}
+	}
+	var pushArgs []string
+	if _, ok, err := readGitConfig("--get", "restic.pushSnapshotSize"); err != nil {
+		return err
+	} else if !ok {
+		pushArgs = append(pushArgs, "-c", "restic.pushSnapshotSize="+defaultImportSnapshotSize)
+	}
+
+	wanted, err := listImportRefs(source, "--heads", "--tags")
+	if err != nil {
+		return errors.WithMessagef(err, "unable to list the refs of %s", source)
+	}
+	stored, err := listImportRefs(target)
+	if err != nil {
+		return errors.WithMessagef(err, "unable to list the refs of %s", args[0])
+	}
+	var pending []string
+	for ref, hash := range wanted {
+		if stored[ref] != hash {
+			pending = append(pending, ref)
+		}
+	}
+	sort.Strings(pending)
+	fmt.Printf("%d of %d refs already imported\n", len(wanted)-len(pending), len(wanted))
+
+	for start := 0; start < len(pending); start += batchSize {
+		batch := pending[start:]
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		fetch := []string{"fetch", "--no-tags", source}
+		push := append(append([]string{}, pushArgs...), "push", "--force", target)
+		for _, ref := range batch {
+			fetch = append(fetch, "+"+ref+":"+importRefPrefix+ref)
+			push = append(push, importRefPrefix+ref+":"+ref)
+		}
+		if err := runImportStep("fetch", fetch); err != nil {
+			return err
+		}
+		if err := runImportStep("push", push); err != nil {
+			return err
+		}
+		for _, ref := range batch {
+			deleteTempRef(localGitPath, importRefPrefix+ref)
+		}
+		fmt.Printf("imported %d of %d refs\n", start+len(batch), len(pending))
+	}
+	return nil
+}
+
+// listImportRefs returns the refs of a git remote and their hashes, as listed
+// by git ls-remote with the given options. Peeled tags are left out.
+func listImportRefs(remote string, options ...string) (map[string]string, error) {
+	args := append(append([]string{"ls-remote", "--refs"}, options...), remote)
+	cmd := exec.Command(gitBin(), args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// runImportStep runs git with args, which perform the named step, trying again
+// after a pause if it fails.
+func runImportStep(step string, args []string) error {
+	var err error
+	for attempt := 1; attempt <= importAttempts; attempt++ {
+		if attempt > 1 {
+			delay := time.Duration(attempt-1) * 10 * time.Second
+			Warnf("retrying in %v (attempt %d of %d)\n", delay, attempt, importAttempts)
+			time.Sleep(delay)
+		}
+		cmd := exec.Command(gitBin(), args...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err == nil {
+			return nil
+		}
+		Warnf("error: git %s failed: %v\n", step, err)
+	}
+	return errors.Errorf("giving up after %d attempts; run the command again to resume", importAttempts)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/restic/restic/lib/restic"
+)
+
+// checkpointRefPrefix names the refs in the stored repository which keep the
+// commits of intermediate snapshots reachable, so that an interrupted push
+// can build on them. They are not listed to git, and are removed once a push
+// completes.
+const checkpointRefPrefix = "refs/restic-checkpoints/"
+
+// pushStepCommits is the number of commits copied between checks of the size
+// of the data written since the last intermediate snapshot.
+const pushStepCommits = 100
+
+// pushTagPrefix starts the tag given to every snapshot of a push which is
+// split into intermediate snapshots, so that --undo can revert all of them.
+const pushTagPrefix = "push:"
+
+// pushTag is the tag of the snapshots of the current push, which is chosen
+// when its first intermediate snapshot is committed.
+var pushTag = ""
+
+// pushSnapshotTags returns the tags of the snapshots created by the current
+// push: snapshotTags, and pushTag if the push was split.
+func pushSnapshotTags() []string {
+	tags := snapshotTags()
+	if pushTag != "" {
+		tags = append(tags, pushTag)
+	}
+	return tags
+}
+
+// pushIntermediateSnapshots copies the objects of the local refs named by the
+// sources of refSpecs into the stored repository, oldest first, and commits an
+// intermediate snapshot whenever more than snapshotSize bytes have been
+// written since the previous one. If the push is interrupted, the completed
+// snapshots are kept, and the next push only copies the remaining objects.
+func pushIntermediateSnapshots(stored *git.Repository, refSpecs []config.RefSpec, snapshotSize int64) error {
+	local, err := git.PlainOpen(localGitPath)
+	if err != nil {
+		return err
+	}
+	wants, err := refSpecSources(local, refSpecs)
+	if err != nil {
+		return err
+	}
+	var pending int64
+	return resticgit.Stage(globalCtx, local, stored, wants, resticgit.StageOptions{
+		Interval: pushStepCommits,
+		Progress: progressFunc(),
+		Checkpoint: func(hash plumbing.Hash, packSize int64) error {
+			name := plumbing.ReferenceName(checkpointRefPrefix + hash.String())
+			if err := stored.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+				return err
+			}
+			pending += packSize
+			if pending < snapshotSize {
+				return nil
+			}
+			if pushTag == "" {
+				tag := restic.NewRandomID()
+				pushTag = pushTagPrefix + tag.Str()
+			}
+			stopKeepalive := startKeepalive("Committing intermediate snapshot")
+			id, err := sharedRepo.fs.CommitSnapshot(localGitPath, pushSnapshotTags())
+			stopKeepalive()
+			if err != nil {
+				return err
+			}
+			Warnf("created intermediate snapshot %v\n", id.Str())
+			pending = 0
+			return resticgit.ArchivePacks(sharedRepo.fs, incrementalLayout)
+		},
+	})
+}
+
+// refSpecSources returns the hashes of the local refs which match the sources
+// of refSpecs.
+func refSpecSources(local *git.Repository, refSpecs []config.RefSpec) ([]plumbing.Hash, error) {
+	refs, err := local.References()
+	if err != nil {
+		return nil, err
+	}
+	var hashes []plumbing.Hash
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		for _, refSpec := range refSpecs {
+			if refSpec.IsDelete() || !refSpec.Match(ref.Name()) {
+				continue
+			}
+			resolved, err := storer.ResolveReference(local.Storer, ref.Name())
+			if err != nil {
+				return err
+			}
+			hashes = append(hashes, resolved.Hash())
+			break
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+// removeCheckpointRefs removes the refs created by pushIntermediateSnapshots
+// from the stored repository in fs, along with their directory.
+func removeCheckpointRefs(stored *git.Repository, fs billy.Basic) error {
+	refs, err := stored.References()
+	if err != nil {
+		return err
+	}
+	var names []plumbing.ReferenceName
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if strings.HasPrefix(ref.Name().String(), checkpointRefPrefix) {
+			names = append(names, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	if err := resticgit.RemoveReferences(stored, names); err != nil {
+		return err
+	}
+	err = fs.Remove(strings.TrimSuffix(checkpointRefPrefix, "/"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
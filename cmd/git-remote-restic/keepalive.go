@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// keepaliveInterval is how often a progress message is printed during a phase
+// which otherwise produces no output.
+const keepaliveInterval = 10 * time.Second
+
+// startKeepalive prints a progress message naming phase every
+// keepaliveInterval until the returned function is called, so that CI systems
+// which stop silent jobs don't kill a push or fetch while the index is loaded
+// or a snapshot is committed. Nothing is printed when progress is disabled,
+// or when the phase finishes within the first interval.
+func startKeepalive(phase string) (stop func()) {
+	if !printProgress {
+		return func() {}
+	}
+	start := time.Now()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(keepaliveInterval)
+		defer ticker.Stop()
+		printed := false
+		for {
+			select {
+			case <-done:
+				if printed {
+					fmt.Fprintf(os.Stderr, "%s: %v, done.\n", phase, time.Since(start).Round(time.Second))
+				}
+				return
+			case now := <-ticker.C:
+				fmt.Fprintf(os.Stderr, "%s: %v\r", phase, now.Sub(start).Round(time.Second))
+				printed = true
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
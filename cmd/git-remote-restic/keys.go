@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+)
+
+// keyArgs describes the arguments of --key.
+const keyArgs = "remote list | add [--new-password-file file] | remove id"
+
+// cmdKey lists, adds, and removes the keys of the restic repository of a
+// remote, so that collaborators can be given their own password without
+// installing restic. The repository is opened with the same password as the
+// remote helper uses.
+func cmdKey(args []string) error {
+	if len(args) < 2 {
+		return errors.Errorf("Usage: %s --key %s", os.Args[0], keyArgs)
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	if err := openSharedRepo(url, false); err != nil {
+		return err
+	}
+	if !sharedRepo.Exists() {
+		return ErrNoRepository
+	}
+	repo, ok := sharedRepo.restic.(*repository.Repository)
+	if !ok {
+		return errors.New("keys of this repository can't be managed")
+	}
+
+	switch {
+	case args[1] == "list" && len(args) == 2:
+		return listKeys(repo)
+	case args[1] == "add" && len(args) == 2:
+		return addKey(repo, "")
+	case args[1] == "add" && len(args) == 4 && args[2] == "--new-password-file":
+		return addKey(repo, args[3])
+	case args[1] == "remove" && len(args) == 3:
+		return removeKey(repo, args[2])
+	}
+	return errors.Errorf("Usage: %s --key %s", os.Args[0], keyArgs)
+}
+
+// listKeys prints the keys of repo, oldest first, and marks the key which
+// was used to open it.
+func listKeys(repo *repository.Repository) error {
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer sharedRepo.Unlock(lock)
+
+	// LoadKey doesn't record the ID of the key, so it is kept alongside.
+	type storedKey struct {
+		id  restic.ID
+		key *repository.Key
+	}
+	var keys []storedKey
+	err = repo.Backend().List(globalCtx, restic.KeyFile, func(fi restic.FileInfo) error {
+		id, err := restic.ParseID(fi.Name)
+		if err != nil {
+			Warnf("skipping key %v: %v\n", fi.Name, err)
+			return nil
+		}
+		key, err := repository.LoadKey(globalCtx, repo, id)
+		if err != nil {
+			Warnf("skipping key %v: %v\n", id.Str(), err)
+			return nil
+		}
+		keys = append(keys, storedKey{id: id, key: key})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].key.Created.Before(keys[j].key.Created)
+	})
+	for _, k := range keys {
+		note := ""
+		if k.id == currentKeyID(repo) {
+			note = " (current)"
+		}
+		fmt.Printf("%s %s@%s created %s%s\n", k.id.Str(), k.key.Username, k.key.Hostname, formatTime(k.key.Created), note)
+	}
+	return nil
+}
+
+// addKey adds a key for a new password, which is read from passwordFile like
+// RESTIC_PASSWORD_FILE, or otherwise prompted for twice.
+func addKey(repo *repository.Repository, passwordFile string) error {
+	var password string
+	var err error
+	if passwordFile != "" {
+		password, err = readPasswordFile(passwordFile)
+	} else {
+		password, err = askNewPassword()
+	}
+	if err != nil {
+		return err
+	} else if password == "" {
+		return errors.New("an empty password is not allowed")
+	}
+
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer sharedRepo.Unlock(lock)
+
+	key, err := repository.AddKey(globalCtx, repo, password, "", "", repo.Key())
+	if err != nil {
+		return errors.WithMessage(err, "unable to add key")
+	}
+	id := key.ID()
+	fmt.Printf("added key %s\n", id.Str())
+	return nil
+}
+
+// askNewPassword prompts for a new password twice, and fails if the answers
+// differ.
+func askNewPassword() (string, error) {
+	password, err := askPassword("New password: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := askPassword("Retype new password: ")
+	if err != nil {
+		return "", err
+	} else if password != again {
+		return "", errors.New("passwords do not match")
+	}
+	return password, nil
+}
+
+// removeKey removes the key whose ID starts with prefix. The key which was
+// used to open the repository can't be removed, so that at least one key
+// remains which the user knows the password of.
+func removeKey(repo *repository.Repository, prefix string) error {
+	lock, err := sharedRepo.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer sharedRepo.Unlock(lock)
+
+	id, err := restic.Find(globalCtx, repo.Backend(), restic.KeyFile, prefix)
+	if err != nil {
+		return err
+	}
+	if id == currentKeyID(repo) {
+		return errors.New("refusing to remove the key which is used to open the repository")
+	}
+	h := restic.Handle{Type: restic.KeyFile, Name: id.String()}
+	if err := repo.Backend().Remove(globalCtx, h); err != nil {
+		return err
+	}
+	fmt.Printf("removed key %s\n", id.Str())
+	return nil
+}
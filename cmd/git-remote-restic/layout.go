@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+)
+
+// bareRepositoryEntries are the names which may appear at the top of a bare
+// git repository. Files written by git-remote-restic itself start with
+// "restic-".
+var bareRepositoryEntries = map[string]bool{
+	"HEAD":        true,
+	"config":      true,
+	"description": true,
+	"hooks":       true,
+	"info":        true,
+	"objects":     true,
+	"refs":        true,
+	"packed-refs": true,
+	"logs":        true,
+	"branches":    true,
+	"remotes":     true,
+	"modules":     true,
+	"worktrees":   true,
+	"shallow":     true,
+	"FETCH_HEAD":  true,
+	"ORIG_HEAD":   true,
+	"gc.log":      true,
+	"gc.pid":      true,
+}
+
+// incrementalLayout is set by restic.incrementalLayout. When it is set, each
+// snapshot only stores the packs written by its push in objects/pack, and
+// refers to the packs of earlier snapshots, see resticgit.ArchivePacks.
+var incrementalLayout = false
+
+// maxReportedEntries limits how many unexpected files are named in the error
+// returned by validateRepositoryLayout.
+const maxReportedEntries = 5
+
+// validateRepositoryLayout checks that the stored repository in fs looks like
+// a bare git repository before a snapshot is committed. Missing directories and
+// a missing config file are recreated. Files which don't belong in a bare
+// repository, such as the files of a working tree, indicate that something
+// other than a git directory was pushed, and cause an error so that they are
+// never committed.
+func validateRepositoryLayout(fs storedFilesystem) error {
+	entries, err := fs.ReadDir("")
+	if err != nil {
+		return err
+	}
+	present := map[string]os.FileInfo{}
+	var unexpected []string
+	for _, entry := range entries {
+		name := entry.Name()
+		present[name] = entry
+		if !bareRepositoryEntries[name] && !strings.HasPrefix(name, "restic-") && !isExcludedFile(name) {
+			unexpected = append(unexpected, name)
+		}
+	}
+	if len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		if len(unexpected) > maxReportedEntries {
+			unexpected = append(unexpected[:maxReportedEntries], "...")
+		}
+		return errors.Errorf("refusing to store a repository containing unexpected files (%s); check that GIT_DIR points to a git directory", strings.Join(unexpected, ", "))
+	}
+
+	if head, ok := present["HEAD"]; !ok || head.IsDir() {
+		return errors.New("refusing to store a repository without a HEAD file")
+	}
+	for _, dir := range []string{"objects", "refs"} {
+		if entry, ok := present[dir]; ok && !entry.IsDir() {
+			return errors.Errorf("refusing to store a repository where %s is not a directory", dir)
+		} else if !ok {
+			Warnf("warning: recreating missing %s directory in the stored repository\n", dir)
+			if err := fs.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+	}
+	if entry, ok := present["config"]; ok && entry.IsDir() {
+		return errors.New("refusing to store a repository where config is not a file")
+	} else if !ok {
+		Warnf("warning: recreating missing config file in the stored repository\n")
+		return billyutil.WriteFile(fs, "config", []byte(normalizedConfig), 0666)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// readLimits sets the upload and download limits of the backends, in KiB/s,
+// like restic's --limit-upload and --limit-download. Each is read from the
+// option of the same name in the remote URL or restic.option, or otherwise
+// from RESTIC_LIMIT_UPLOAD or RESTIC_LIMIT_DOWNLOAD, or from
+// restic.<remote>.limitUpload or restic.limitUpload and the download
+// equivalents.
+func readLimits() error {
+	var err error
+	if globalOptions.Limits.UploadKb, err = readLimit("limit-upload", "RESTIC_LIMIT_UPLOAD", "limitUpload"); err != nil {
+		return err
+	}
+	globalOptions.Limits.DownloadKb, err = readLimit("limit-download", "RESTIC_LIMIT_DOWNLOAD", "limitDownload")
+	return err
+}
+
+func readLimit(option, env, config string) (int, error) {
+	value, source := extendedOptions[option], option
+	if value == "" {
+		value, source = os.Getenv(env), env
+	}
+	if value == "" {
+		var err error
+		if value, _, err = getRemoteConfig(config); err != nil {
+			return 0, err
+		}
+		source = "restic." + config
+	}
+	if value == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, errors.Errorf("%s: invalid limit %q, expected KiB/s", source, value)
+	}
+	return limit, nil
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// localStateRefPrefix is the namespace of refs which store the local-only
+// state of the pushing repository. These refs are not listed to git, so they
+// are never fetched unless requested explicitly.
+const localStateRefPrefix = "refs/restic-local/"
+
+// localStateLogPath is the directory of the snapshot which holds a copy of the
+// reflogs of the pushing repository.
+const localStateLogPath = "restic-local/logs"
+
+// pushLocalState copies the state of the local repository at gitDir which is
+// not normally pushed into the stored repository: the stash, notes, and the
+// reflogs along with every commit which they mention. Stored state which no
+// longer exists locally is removed.
+func pushLocalState(stored *git.Repository, fs storedFilesystem, gitDir string) error {
+	logs, err := readLocalReflogs(gitDir)
+	if err != nil {
+		return err
+	}
+	commits, err := existingCommits(gitDir, reflogCommits(logs))
+	if err != nil {
+		return err
+	}
+
+	tempPrefix := fmt.Sprintf("refs/restic-local-%d/", os.Getpid())
+	var create, remove strings.Builder
+	for _, commit := range commits {
+		fmt.Fprintf(&create, "create %s%s %s\n", tempPrefix, commit, commit)
+		fmt.Fprintf(&remove, "delete %s%s\n", tempPrefix, commit)
+	}
+	if err := updateLocalRefs(gitDir, create.String()); err != nil {
+		return err
+	}
+	defer func() {
+		if err := updateLocalRefs(gitDir, remove.String()); err != nil {
+			Warnf("warning: %v\n", err)
+		}
+	}()
+
+	localRefs, err := readGitRefNames(gitDir, "refs/notes/", "refs/stash")
+	if err != nil {
+		return err
+	}
+	keep := map[plumbing.ReferenceName]bool{}
+	var refSpecs []config.RefSpec
+	if len(commits) > 0 {
+		refSpecs = append(refSpecs, config.RefSpec("+"+tempPrefix+"*:"+localStateRefPrefix+"reflog/*"))
+		for _, commit := range commits {
+			keep[plumbing.ReferenceName(localStateRefPrefix+"reflog/"+commit)] = true
+		}
+	}
+	for _, name := range localRefs {
+		dst := localStateRefPrefix + strings.TrimPrefix(name, "refs/")
+		refSpecs = append(refSpecs, config.RefSpec("+"+name+":"+dst))
+		keep[plumbing.ReferenceName(dst)] = true
+	}
+	if len(refSpecs) > 0 {
+		results, err := resticgit.Push(globalCtx, stored, gitDir, refSpecs, nil)
+		if err != nil {
+			return err
+		}
+		for dst, err := range results {
+			if err != nil {
+				return errors.WithMessage(err, dst)
+			}
+		}
+	}
+
+	// Remove stored refs for state which was deleted locally.
+	storedRefs, err := allRefs(stored)
+	if err != nil {
+		return err
+	}
+	var removed []plumbing.ReferenceName
+	for name := range storedRefs {
+		if strings.HasPrefix(name.String(), localStateRefPrefix) && !keep[name] {
+			removed = append(removed, name)
+		}
+	}
+	if err := resticgit.RemoveReferences(stored, removed); err != nil {
+		return err
+	}
+
+	return storeReflogs(fs, logs)
+}
+
+// readLocalReflogs returns the content of every reflog of the local
+// repository, keyed by the name of the ref.
+func readLocalReflogs(gitDir string) (map[string][]byte, error) {
+	logs := map[string][]byte{}
+	root := filepath.Join(gitDir, "logs")
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		logs[filepath.ToSlash(rel)] = content
+		return nil
+	})
+	return logs, err
+}
+
+// reflogCommits returns every commit mentioned in the reflogs.
+func reflogCommits(logs map[string][]byte) []string {
+	seen := map[string]bool{}
+	for _, content := range logs {
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), " ", 3)
+			if len(fields) < 3 {
+				continue
+			}
+			for _, hash := range fields[:2] {
+				if !plumbing.NewHash(hash).IsZero() {
+					seen[hash] = true
+				}
+			}
+		}
+	}
+	commits := make([]string, 0, len(seen))
+	for hash := range seen {
+		commits = append(commits, hash)
+	}
+	sort.Strings(commits)
+	return commits
+}
+
+// existingCommits filters out the objects which no longer exist in the local
+// repository, for example because they were pruned.
+func existingCommits(gitDir string, hashes []string) ([]string, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	cmd := exec.Command(gitBin(), "--git-dir", gitDir, "cat-file", "--batch-check=%(objectname) %(objecttype)")
+	cmd.Stdin = strings.NewReader(strings.Join(hashes, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to check reflog commits")
+	}
+	var existing []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == "commit" {
+			existing = append(existing, fields[0])
+		}
+	}
+	return existing, scanner.Err()
+}
+
+// updateLocalRefs runs the update-ref commands in a single transaction.
+func updateLocalRefs(gitDir, commands string) error {
+	if commands == "" {
+		return nil
+	}
+	cmd := exec.Command(gitBin(), "--git-dir", gitDir, "update-ref", "--stdin")
+	cmd.Stdin = strings.NewReader(commands)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("unable to update local refs: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// readGitRefNames returns the names of the local refs which match the
+// patterns, as understood by git for-each-ref.
+func readGitRefNames(gitDir string, patterns ...string) ([]string, error) {
+	args := append([]string{"--git-dir", gitDir, "for-each-ref", "--format=%(refname)"}, patterns...)
+	out, err := exec.Command(gitBin(), args...).Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list local refs")
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// localRefValue returns the object which the named local ref points to, or an
+// empty string if it doesn't exist.
+func localRefValue(gitDir, name string) (string, error) {
+	out, err := exec.Command(gitBin(), "--git-dir", gitDir, "rev-parse", "--verify", "--quiet", name).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrapf(err, "unable to read %s", name)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// storeReflogs replaces the stored copy of the reflogs with logs. Files are
+// only written when their content changed, to avoid creating redundant
+// snapshots.
+func storeReflogs(fs storedFilesystem, logs map[string][]byte) error {
+	stored, err := listStoredFiles(fs, localStateLogPath)
+	if err != nil {
+		return err
+	}
+	for _, p := range stored {
+		name := strings.TrimPrefix(p, localStateLogPath+"/")
+		if _, ok := logs[name]; !ok {
+			if err := fs.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+	for name, content := range logs {
+		p := path.Join(localStateLogPath, name)
+		if current, err := readStoredFile(fs, p); err == nil && bytes.Equal(current, content) {
+			continue
+		}
+		if err := billyutil.WriteFile(fs, p, content, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedFilesystem is the subset of billy.Filesystem implemented by
+// resticfs.Filesystem.
+type storedFilesystem interface {
+	billy.Basic
+	billy.Dir
+}
+
+// listStoredFiles returns the paths of all of the files below dir.
+func listStoredFiles(fs storedFilesystem, dir string) ([]string, error) {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		p := path.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		children, err := listStoredFiles(fs, p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	return files, nil
+}
+
+func readStoredFile(fs billy.Basic, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+// cmdRestoreLocalState restores the state stored by restic.backupLocalState
+// into the local repository. Before replacing a local ref or reflog which
+// differs from the stored one, the user is asked to confirm, unless --force is
+// given.
+func cmdRestoreLocalState(args []string) error {
+	force := false
+	snapshotID := "latest"
+	for _, arg := range args {
+		switch {
+		case arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			return errors.Errorf("unknown option %s", arg)
+		default:
+			snapshotID = arg
+		}
+	}
+
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	sn, err := findSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	fs, err := resticfs.New(globalCtx, sharedRepo.restic, sn.ID())
+	if err != nil {
+		return err
+	}
+	stored, err := resticgit.Open(fs, false)
+	if err != nil {
+		return err
+	}
+	storedRefs, err := allRefs(stored)
+	if err != nil {
+		return err
+	}
+	logs := map[string][]byte{}
+	files, err := listStoredFiles(fs, localStateLogPath)
+	if err != nil {
+		return err
+	}
+	for _, p := range files {
+		content, err := readStoredFile(fs, p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, localStateLogPath+"/")
+		if !isCleanRelativePath(name) {
+			return errors.Errorf("snapshot %v contains a reflog with the invalid path %q", sn.ID().Str(), name)
+		}
+		logs[name] = content
+	}
+
+	// The refs which are restored, excluding the reflog commits, which are
+	// only needed for their objects.
+	restored := map[string]plumbing.Hash{}
+	for name, hash := range storedRefs {
+		if !strings.HasPrefix(name.String(), localStateRefPrefix) ||
+			strings.HasPrefix(name.String(), localStateRefPrefix+"reflog/") {
+			continue
+		}
+		restored["refs/"+strings.TrimPrefix(name.String(), localStateRefPrefix)] = hash
+	}
+	if len(restored) == 0 && len(logs) == 0 {
+		return errors.Errorf("snapshot %v does not contain any local state", sn.ID().Str())
+	}
+
+	var conflicts []string
+	var update strings.Builder
+	for name, hash := range restored {
+		current, err := localRefValue(localGitPath, name)
+		if err != nil {
+			return err
+		}
+		if current != "" && current != hash.String() {
+			conflicts = append(conflicts, name)
+		}
+		fmt.Fprintf(&update, "update %s %s\n", name, hash)
+	}
+	for name, content := range logs {
+		current, err := ioutil.ReadFile(filepath.Join(localGitPath, "logs", filepath.FromSlash(name)))
+		if err == nil && !bytes.Equal(current, content) {
+			conflicts = append(conflicts, "reflog of "+name)
+		} else if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(conflicts) > 0 && !force {
+		sort.Strings(conflicts)
+		fmt.Printf("The following local state differs from snapshot %v and will be replaced:\n", sn.ID().Str())
+		for _, conflict := range conflicts {
+			fmt.Printf("    %s\n", conflict)
+		}
+		ok, err := askConfirmation("Replace the local state? [y/N] ")
+		if err != nil {
+			return err
+		} else if !ok {
+			return errors.New("restore cancelled")
+		}
+	}
+
+	// Copy all of the objects, including those which are only referenced by
+	// the reflogs, using temporary refs.
+	tempPrefix := fmt.Sprintf("refs/restic-restore-%d/", os.Getpid())
+	err = resticgit.Fetch(globalCtx, stored, localGitPath, []config.RefSpec{
+		config.RefSpec("+" + localStateRefPrefix + "*:" + tempPrefix + "*"),
+	}, progressFunc())
+	if err != nil {
+		return err
+	}
+	temps, err := readGitRefNames(localGitPath, tempPrefix)
+	if err != nil {
+		return err
+	}
+	var remove strings.Builder
+	for _, name := range temps {
+		fmt.Fprintf(&remove, "delete %s\n", name)
+	}
+	if err := updateLocalRefs(localGitPath, remove.String()); err != nil {
+		return err
+	}
+
+	if err := updateLocalRefs(localGitPath, update.String()); err != nil {
+		return err
+	}
+	// The reflogs are written last, since updating the refs appends to them.
+	for name, content := range logs {
+		p := filepath.Join(localGitPath, "logs", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, content, 0666); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("restored %d refs and %d reflogs from snapshot %v\n", len(restored), len(logs), sn.ID().Str())
+	return nil
+}
+
+// isCleanRelativePath reports whether name is a relative, slash-separated
+// path which stays below the directory it's joined to, so that a stored reflog
+// can't be written outside of the logs directory.
+func isCleanRelativePath(name string) bool {
+	return name != "." && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.ContainsAny(name, "\\:")
+}
+
+// askConfirmation asks the user a yes or no question on the terminal, since
+// stdin and stdout may be used by git.
+func askConfirmation(prompt string) (bool, error) {
+	if nonInteractive {
+		return false, errors.WithMessage(ErrInteractionRequired, "confirmation required, use --force to proceed")
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false, errors.Wrap(err, "unable to open terminal, use --force to proceed without confirmation")
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, prompt)
+	answer, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return false, errors.Wrap(err, "unable to read answer")
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes", nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/textfile"
+)
+
+const localPrefix = "local:"
+
+// envLocation is the location which reads the repository from the
+// environment. An empty location does the same.
+const envLocation = "env:"
+
+// readEnvLocation returns the location named by RESTIC_REPOSITORY, or stored
+// in the file named by RESTIC_REPOSITORY_FILE, like restic does when neither
+// -r nor --repository-file is given.
+func readEnvLocation() (string, error) {
+	if globalOptions.Repo != "" && globalOptions.RepositoryFile != "" {
+		return "", errors.New("RESTIC_REPOSITORY and RESTIC_REPOSITORY_FILE are mutually exclusive")
+	} else if globalOptions.Repo != "" {
+		return globalOptions.Repo, nil
+	} else if globalOptions.RepositoryFile == "" {
+		return "", errors.New("no restic repository given: set RESTIC_REPOSITORY or RESTIC_REPOSITORY_FILE, or add the location to the URL")
+	}
+	data, err := textfile.Read(globalOptions.RepositoryFile)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read RESTIC_REPOSITORY_FILE")
+	}
+	location := strings.TrimSpace(string(data))
+	if location == "" {
+		return "", errors.Errorf("%s is empty", globalOptions.RepositoryFile)
+	}
+	return location, nil
+}
+
+// resolveLocation makes a relative local repository location absolute.
+//
+// Git runs the remote helper from different directories depending on the
+// operation: the top level of the working tree for most commands, the
+// submodule for submodule commands, and the directory the user was in for
+// clones. Relative locations are therefore resolved against a stable base
+// directory, which is the working tree of the superproject, or the main working
+// tree of the repository. When the location only names a restic repository
+// relative to the current directory, as happens when cloning, that repository
+// is used instead, and the configured remote is updated to use the absolute
+// location so that later operations find it as well. A warning is printed when
+// the location names different restic repositories relative to each
+// directory.
+func resolveLocation(remote, location string) (string, error) {
+	prefix := ""
+	path := location
+	if strings.HasPrefix(location, localPrefix) {
+		prefix = localPrefix
+		path = strings.TrimPrefix(location, localPrefix)
+	} else if strings.ContainsRune(location, ':') {
+		// Another backend, or an absolute path with a drive letter.
+		return location, nil
+	}
+	if path == "" || filepath.IsAbs(path) {
+		return location, nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	base, err := locationBase()
+	if err != nil {
+		// Not running inside of a git repository.
+		base = cwd
+	}
+	fromBase := filepath.Join(base, path)
+	fromCwd := filepath.Join(cwd, path)
+	if fromBase == fromCwd {
+		return prefix + fromBase, nil
+	}
+
+	switch {
+	case isResticRepository(fromBase) && isResticRepository(fromCwd):
+		Warnf("warning: %s could refer to %s or %s, using %s\n", location, fromBase, fromCwd, fromBase)
+	case isResticRepository(fromCwd):
+		resolved := prefix + fromCwd
+		if err := makeRemoteAbsolute(remote, location, resolved); err != nil {
+			return "", err
+		}
+		return resolved, nil
+	}
+	return prefix + fromBase, nil
+}
+
+// locationBase returns the directory which relative locations are resolved
+// against.
+func locationBase() (string, error) {
+	superproject, err := gitRevParse("--show-superproject-working-tree")
+	if err != nil {
+		return "", err
+	} else if superproject != "" {
+		return superproject, nil
+	}
+	// The common directory is shared by all worktrees of the repository.
+	commonDir, err := gitRevParse("--git-common-dir")
+	if err != nil {
+		return "", err
+	}
+	commonDir, err = filepath.Abs(commonDir)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(commonDir) == git.GitDirName {
+		return filepath.Dir(commonDir), nil
+	}
+	// A bare repository.
+	return commonDir, nil
+}
+
+// makeRemoteAbsolute replaces the URL of the named remote with the resolved
+// location, if it is currently configured with the relative location.
+func makeRemoteAbsolute(remote, location, resolved string) error {
+	key := "remote." + remote + ".url"
+	value, ok, err := readGitConfig("--get", key)
+	if err != nil || !ok || value != urlPrefix+location {
+		return err
+	}
+	cmd := exec.Command(gitBin(), "config", key, urlPrefix+resolved)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "unable to update %s: %s", key, strings.TrimSpace(string(out)))
+	}
+	Warnf("note: updated remote %s to use absolute location %s\n", remote, resolved)
+	return nil
+}
+
+func isResticRepository(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "config"))
+	return err == nil
+}
+
+func gitRevParse(arg string) (string, error) {
+	out, err := exec.Command(gitBin(), "rev-parse", arg).Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git rev-parse %s", arg)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// lockEntry is a lock listed by cmdLocks.
+type lockEntry struct {
+	id   restic.ID
+	lock *restic.Lock
+}
+
+// cmdLocks lists the locks in the restic repository of a remote, so that
+// users can see who holds the lock which a push is waiting for. Locks which
+// restic considers stale, because they are old or their process is gone, are
+// marked, since they can be removed with restic unlock.
+func cmdLocks(args []string) error {
+	if len(args) != 1 {
+		return errors.New("--locks requires exactly one remote")
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	if err := openSharedRepo(url, false); err != nil {
+		return err
+	}
+	if !sharedRepo.Exists() {
+		return ErrNoRepository
+	}
+
+	var mu sync.Mutex
+	var locks []lockEntry
+	err = restic.ForAllLocks(globalCtx, sharedRepo.restic, nil, func(id restic.ID, lock *restic.Lock, err error) error {
+		if err != nil {
+			Warnf("skipping lock %v: %v\n", id.Str(), err)
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		locks = append(locks, lockEntry{id, lock})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(locks) == 0 {
+		fmt.Printf("no locks\n")
+		return nil
+	}
+	sort.Slice(locks, func(i, j int) bool {
+		return locks[i].lock.Time.Before(locks[j].lock.Time)
+	})
+	stale := 0
+	for _, entry := range locks {
+		kind := "shared"
+		if entry.lock.Exclusive {
+			kind = "exclusive"
+		}
+		age := time.Since(entry.lock.Time).Round(time.Second)
+		note := ""
+		if entry.lock.Stale() {
+			note = " (stale)"
+			stale++
+		}
+		fmt.Printf("%s %-9s %s@%s pid %d since %s, %v ago%s\n", entry.id.Str(), kind,
+			entry.lock.Username, entry.lock.Hostname, entry.lock.PID, formatTime(entry.lock.Time), age, note)
+	}
+	if stale > 0 {
+		fmt.Printf("stale locks can be removed with: restic -r %s unlock\n", sharedRepo.location)
+	}
+	return nil
+}
+
+// readRetryLock sets how long to wait for a repository which is locked by
+// another process, like restic's --retry-lock. It is read from the retry-lock
+// option in the remote URL or restic.option, or otherwise from
+// RESTIC_RETRY_LOCK, or from restic.<remote>.retryLock or restic.retryLock,
+// as a duration such as "5m".
+func readRetryLock() error {
+	value, source := extendedOptions["retry-lock"], "retry-lock"
+	if value == "" {
+		value, source = os.Getenv("RESTIC_RETRY_LOCK"), "RESTIC_RETRY_LOCK"
+	}
+	if value == "" {
+		var err error
+		if value, _, err = getRemoteConfig("retryLock"); err != nil {
+			return err
+		}
+		source = "restic.retryLock"
+	}
+	globalOptions.RetryLock = 0
+	if value == "" {
+		return nil
+	}
+	retry, err := time.ParseDuration(value)
+	if err != nil || retry < 0 {
+		return errors.Errorf("%s: invalid duration %q, such as 5m", source, value)
+	}
+	globalOptions.RetryLock = retry
+	return nil
+}
+
+// noLockWrites is set when no lock is created even for operations which
+// change the repository, see readNoLock.
+var noLockWrites = false
+
+// readNoLock reads whether locks are created in the repository, like restic's
+// --no-lock, for backends such as an append-only REST server where lock files
+// can't be removed. It is read from the no-lock option in the remote URL or
+// restic.option, or otherwise from restic.<remote>.noLock or restic.noLock.
+// "true" or "fetch" skip the locks of operations which only read the
+// repository, such as fetches, and "all" also skips the exclusive locks of
+// pushes, which is only safe while nothing else writes to the repository.
+func readNoLock() error {
+	value, ok := extendedOptions["no-lock"]
+	source := "no-lock"
+	if !ok {
+		var err error
+		if value, ok, err = getRemoteConfig("noLock"); err != nil {
+			return err
+		}
+		source = "restic.noLock"
+	}
+	globalOptions.NoLock, noLockWrites = false, false
+	if !ok {
+		return nil
+	}
+	switch strings.ToLower(value) {
+	case "", "true", "yes", "on", "1", "fetch":
+		globalOptions.NoLock = true
+	case "all":
+		globalOptions.NoLock, noLockWrites = true, true
+	case "false", "no", "off", "0":
+	default:
+		return errors.Errorf("%s: invalid value %q, expected true, fetch, all, or false", source, value)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/restic/restic/lib/debug"
+)
+
+// resticfsLogger routes the log messages of resticfs into the debug log,
+// which is enabled by DEBUG_LOG. Warnings are also printed, and so are the
+// snapshots which are saved when the verbosity is above 1.
+type resticfsLogger struct{}
+
+func (resticfsLogger) Debugf(format string, args ...interface{}) {
+	debug.Log("resticfs: "+format, args...)
+}
+
+func (resticfsLogger) Infof(format string, args ...interface{}) {
+	if verbosity > 1 {
+		Warnf("resticfs: "+format+"\n", args...)
+	} else {
+		debug.Log("resticfs: "+format, args...)
+	}
+}
+
+func (resticfsLogger) Warnf(format string, args ...interface{}) {
+	Warnf("resticfs: "+format+"\n", args...)
+}
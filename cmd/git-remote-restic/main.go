@@ -5,16 +5,19 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 
+	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
 	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
 )
 
 var sharedRepo *Repository
@@ -22,8 +25,24 @@ var remoteName plumbing.ReferenceName
 var reader *bufio.Reader
 var printProgress = false
 var verbosity = 1
+var normalizeRepo = false
+var backupLocalState = false
+var packIndexCache billy.Filesystem
+var excludePatterns = defaultExcludes
+var chunkerWorkers = 1
+var maxStagedSize = 0
 var globalCtx = context.Background()
 
+// defaultChunkerWorkers leaves one CPU free for the uploads to the backend,
+// which keeps the connections busy on machines where chunking and encryption
+// would otherwise use all of the CPU time.
+func defaultChunkerWorkers() int {
+	if n := runtime.NumCPU() - 1; n > 1 {
+		return n
+	}
+	return 1
+}
+
 func cmdCapabilities() error {
 	fmt.Printf("fetch\n")
 	fmt.Printf("push\n")
@@ -33,6 +52,31 @@ func cmdCapabilities() error {
 }
 
 func cmdList(forPush bool) error {
+	if verbosity > 1 && sharedRepo.Exists() {
+		printRepositoryIdentity(os.Stderr)
+	}
+	var digest *restic.ID
+	if !forPush && sharedRepo.Exists() {
+		id, err := sharedRepo.SnapshotsDigest(globalCtx)
+		if err != nil {
+			return err
+		}
+		digest = &id
+		state, err := readFetchState(remoteName.String())
+		if err != nil {
+			debug.Log("unable to read fetch state: %v", err)
+		} else if state.matches(sharedRepo.location) && state.Snapshots.Equal(id) {
+			// Nothing has been pushed since the last listing, so
+			// neither the index nor the snapshot need to be loaded.
+			sharedRepo.SelectSnapshot(state.Snapshot)
+			warnRefCaseCollisions(state.Refs)
+			printRefList(state.Refs)
+			return nil
+		}
+		if err := sharedRepo.UseIntactSnapshot(globalCtx, state.checkedSnapshot(sharedRepo.location)); err != nil {
+			return err
+		}
+	}
 	repo, err := sharedRepo.Git(false)
 	if err == git.ErrRepositoryNotExists {
 		fmt.Print("\n")
@@ -41,13 +85,19 @@ func cmdList(forPush bool) error {
 	if err != nil {
 		return err
 	}
+	// Loading the refs one at a time would need a request to the backend
+	// for each loose ref, which takes minutes for repositories with many
+	// refs.
+	if err := sharedRepo.fs.Prefetch(globalCtx, storedRefPaths...); err != nil {
+		return err
+	}
 	refs, err := repo.References()
 	if err != nil {
 		return err
 	}
 
+	var lines []string
 	var symRefs []string
-	hashesSeen := false
 	for {
 		ref, err := refs.Next()
 		if errors.Cause(err) == io.EOF {
@@ -57,42 +107,64 @@ func cmdList(forPush bool) error {
 			return err
 		}
 
+		if strings.HasPrefix(ref.Name().String(), localStateRefPrefix) ||
+			strings.HasPrefix(ref.Name().String(), checkpointRefPrefix) {
+			continue
+		}
+
 		value := ""
 		switch ref.Type() {
 		case plumbing.HashReference:
 			value = ref.Hash().String()
-			hashesSeen = true
 		case plumbing.SymbolicReference:
 			value = "@" + ref.Target().String()
 		default:
 			value = "?"
 		}
-		refStr := value + " " + ref.Name().String() + "\n"
+		refStr := value + " " + ref.Name().String()
 		if ref.Type() == plumbing.SymbolicReference {
-			// Don't list any symbolic references until we're sure
-			// there's at least one object available.  Otherwise
-			// cloning an empty repo will result in an error because
-			// the HEAD symbolic ref points to a ref that doesn't
-			// exist.
+			// Don't list any symbolic references which point to a ref that
+			// doesn't exist. Otherwise cloning an empty repo will result
+			// in an error because the HEAD symbolic ref points to a ref
+			// that doesn't exist.
+			if _, err := repo.Reference(ref.Name(), true); err != nil {
+				continue
+			}
 			symRefs = append(symRefs, refStr)
 			continue
 		}
-		fmt.Print(refStr)
+		lines = append(lines, refStr)
 	}
 
-	if hashesSeen && !forPush {
-		for _, refStr := range symRefs {
-			fmt.Print(refStr)
+	if !forPush {
+		lines = append(lines, symRefs...)
+		warnRefCaseCollisions(lines)
+	}
+	printRefList(lines)
+	if digest != nil && sharedRepo.snapshot != nil {
+		err := writeFetchState(remoteName.String(), newFetchState(sharedRepo.location, *digest, *sharedRepo.snapshot, lines))
+		if err != nil {
+			debug.Log("unable to write fetch state: %v", err)
 		}
 	}
-	fmt.Print("\n")
 	return nil
 }
 
+// printRefList prints the response to the list command.
+func printRefList(lines []string) {
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	fmt.Print("\n")
+}
+
 func cmdOption(command string) error {
 	switch {
-	case command == "progress true":
-		printProgress = true
+	case command == "progress true", command == "progress false":
+		printProgress = command == "progress true"
+		goto ok
+	case command == "dry-run true", command == "dry-run false":
+		dryRun = command == "dry-run true"
 		goto ok
 	case command == "cloning true":
 		// Nothing different here
@@ -100,6 +172,11 @@ func cmdOption(command string) error {
 	case command == "followtags true":
 		// Nothing different here
 		goto ok
+	case strings.HasPrefix(command, "pushcert "):
+		if !setPushCert(command[9:]) {
+			goto unsupported
+		}
+		goto ok
 	case strings.HasPrefix(command, "verbosity "):
 		newV, err := strconv.Atoi(command[10:len(command)])
 		if err != nil {
@@ -186,7 +263,13 @@ loop:
 		}
 	}
 
-	results, err := PushBatch(refspecs)
+	var results map[string]error
+	var err error
+	if dryRun {
+		results, err = planPush(refspecs)
+	} else {
+		results, err = PushBatch(refspecs)
+	}
 	if err != nil {
 		return err
 	}
@@ -194,7 +277,7 @@ loop:
 		if err == nil {
 			fmt.Printf("ok %s\n", dst)
 		} else {
-			fmt.Printf("error %s %#v\n", dst, err.Error())
+			fmt.Printf("error %s %#v\n", dst, explainTempError(err).Error())
 		}
 	}
 	fmt.Printf("\n")
@@ -202,54 +285,254 @@ loop:
 }
 
 func findPassword(url string) (string, error) {
+	agentKey = nil
+	if fdPassword != nil {
+		return *fdPassword, nil
+	}
 	password := os.Getenv("RESTIC_PASSWORD")
 	if password != "" {
 		return password, nil
 	}
 
 	pwFile := os.Getenv("RESTIC_PASSWORD_FILE")
+	pwCommand := os.Getenv("RESTIC_PASSWORD_COMMAND")
+	if pwFile != "" && pwCommand != "" {
+		return "", errors.New("RESTIC_PASSWORD_FILE and RESTIC_PASSWORD_COMMAND are mutually exclusive")
+	}
 	if pwFile != "" {
-		data, err := ioutil.ReadFile(pwFile)
-		password = strings.TrimSpace(string(data))
+		return readPasswordFile(pwFile)
+	}
+
+	if pwCommand == "" {
+		var err error
+		pwCommand, _, err = getRemoteConfig("passwordCommand")
 		if err != nil {
 			return "", err
 		}
-		return password, nil
+	}
+	if pwCommand != "" {
+		return runPasswordCommand(pwCommand)
 	}
 
+	// Credential helpers and askpass programs may hang or open a window,
+	// which some environments need to avoid entirely.
+	useGitCredential, err := getConfigBool("gitCredential", true)
+	if err != nil {
+		return "", err
+	} else if !useGitCredential {
+		return "", errors.WithMessage(ErrNoPassword, "repository password required")
+	}
+	// The master key from the agent opens the repository without a
+	// password.
+	if key, ok := agentMasterKey(url); ok {
+		agentKey = key
+		return "", nil
+	}
+	agentCacheable = true
 	return getGitCredential(url)
 }
 
-// Main entry point.
-func Main() (err error) {
-	reader = bufio.NewReader(os.Stdin)
-
-	if len(os.Args) > 1 && os.Args[1] == "--version" {
-		PrintVersion()
+// readKeyHint sets the ID of the key which is tried first when opening the
+// repository from restic.<remote>.keyHint or restic.keyHint, unless
+// RESTIC_KEY_HINT is set. Otherwise every key is tried, which is slow for
+// repositories with many keys.
+func readKeyHint() error {
+	if globalOptions.KeyHint != "" {
 		return nil
-	} else if len(os.Args) < 3 {
-		return fmt.Errorf("Usage: %s remote-name url", os.Args[0])
 	}
+	hint, _, err := getRemoteConfig("keyHint")
+	globalOptions.KeyHint = hint
+	return err
+}
 
-	remoteName = plumbing.ReferenceName(os.Args[1])
-	url := os.Args[2]
-
+// openSharedRepo opens the restic repository at url as sharedRepo. If
+// allowInit is true, restic.autoInit is respected.
+func openSharedRepo(url string, allowInit bool) error {
+	applyRemoteEnvironment(remoteName.String())
+	if url == "" || url == envLocation {
+		var err error
+		if url, err = readEnvLocation(); err != nil {
+			return err
+		}
+	}
+	url, urlOptions, err := splitLocationOptions(url)
+	if err != nil {
+		return err
+	}
+	if err := readExtendedOptions(urlOptions); err != nil {
+		return err
+	}
+	if err := readTLSConfig(); err != nil {
+		return err
+	}
+	if err := readProxyConfig(); err != nil {
+		return err
+	}
+	if err := readLimits(); err != nil {
+		return err
+	}
+	if err := readConnections(); err != nil {
+		return err
+	}
+	if err := readRetryLock(); err != nil {
+		return err
+	}
+	if err := readNoLock(); err != nil {
+		return err
+	}
+	if err := readCompression(); err != nil {
+		return err
+	}
+	if err := readPackSize(); err != nil {
+		return err
+	}
+	if err := readNoExtraVerify(); err != nil {
+		return err
+	}
+	if err := readS3Options(); err != nil {
+		return err
+	}
+	if err := readCacheOptions(); err != nil {
+		return err
+	}
+	url, err = resolveLocation(remoteName.String(), url)
+	if err != nil {
+		return err
+	}
 	password, err := findPassword(url)
 	if err != nil {
 		return err
 	}
+	if err := readKeyHint(); err != nil {
+		return err
+	}
+
+	autoInit, err := getConfigBool("autoInit", false)
+	if err != nil {
+		return err
+	}
+	normalizeRepo, err = getConfigBool("normalize", false)
+	if err != nil {
+		return err
+	}
+	backupLocalState, err = getConfigBool("backupLocalState", false)
+	if err != nil {
+		return err
+	}
+	hideRefNames, err = getConfigBool("hideRefNames", false)
+	if err != nil {
+		return err
+	}
+	refsDatabase, err = getConfigBool("refsDatabase", false)
+	if err != nil {
+		return err
+	}
+	incrementalLayout, err = getConfigBool("incrementalLayout", false)
+	if err != nil {
+		return err
+	}
+	packIndexCache, err = openPackIndexCache()
+	if err != nil {
+		return err
+	}
+	if err := readLowSpeedConfig(); err != nil {
+		return err
+	}
+	configExcludes, err := readGitConfigAll("--get-all", "restic.exclude")
+	if err != nil {
+		return err
+	}
+	excludePatterns = append(append([]string{}, defaultExcludes...), configExcludes...)
+	if chunkerWorkers, err = getConfigInt("chunkers", defaultChunkerWorkers()); err != nil {
+		return err
+	}
+	if helperJobs > 0 && chunkerWorkers > helperJobs {
+		chunkerWorkers = helperJobs
+	}
+	if maxStagedSize, err = getConfigInt("maxStagedSize", 0); err != nil {
+		return err
+	}
+	if err := readTempDir(); err != nil {
+		return err
+	}
+	if compressTempFiles, err = getConfigBool("compressTempFiles", false); err != nil {
+		return err
+	}
+	if err := readSnapshotSelection(); err != nil {
+		return err
+	}
+	if preCommitHook, _, err = getRemoteConfig("preCommitHook"); err != nil {
+		return err
+	}
+	if syncNotes, err = getConfigBool("syncNotes", false); err != nil {
+		return err
+	}
+	if logRequests, err = getConfigBool("logRequests", false); err != nil {
+		return err
+	}
 
-	sharedRepo, err = NewRepository(context.Background(), url, password, repository.Options{
-		Compression: repository.CompressionOff,
-		PackSize:    0,
-	})
+	sharedRepo, err = NewRepository(globalCtx, url, password, repository.Options{
+		Compression:   globalOptions.Compression,
+		PackSize:      globalOptions.PackSize * 1024 * 1024,
+		NoExtraVerify: globalOptions.NoExtraVerify,
+	}, allowInit && autoInit)
+	if isUnauthorized(err) {
+		confirmRESTCredentials(false)
+	} else if err == nil {
+		confirmRESTCredentials(true)
+	}
 	if err != nil {
 		if err == repository.ErrNoKeyFound {
 			confirmGitCredential(url, false)
+			if agentProvided {
+				forgetMasterKey(url)
+			}
 		}
 		return err
 	}
-	confirmGitCredential(url, true)
+	if sharedRepo.Exists() {
+		confirmGitCredential(url, true)
+	}
+	return nil
+}
+
+// Main entry point.
+func Main() (err error) {
+	reader = bufio.NewReader(os.Stdin)
+	cancelOnSignal()
+
+	args, err := parsePasswordFD(os.Args[1:])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 && args[0] == "--version" {
+		PrintVersion()
+		return nil
+	}
+	// The password is read before anything else, in particular before the
+	// commands from git, which arrive on stdin.
+	isCommand := len(args) > 0 && commands[args[0]].run != nil
+	if err := readPasswordFD(!isCommand); err != nil {
+		return err
+	}
+	// Unlike git, the user may run commands from a subdirectory of the
+	// working tree, or from a linked worktree.
+	resolveLocalGitPath()
+	if isCommand {
+		return runCommand(args[0], args[1:])
+	} else if len(args) < 2 {
+		return fmt.Errorf("Usage: %s [--password-from-fd n] remote-name url\n%s", os.Args[0], commandUsage())
+	}
+
+	remoteName = plumbing.ReferenceName(args[0])
+	url := args[1]
+	if err := readGitProtocol(); err != nil {
+		return err
+	}
+
+	if err = openSharedRepo(url, true); err != nil {
+		return err
+	}
 
 	for {
 		// Note that command will include the trailing newline.
@@ -281,15 +564,28 @@ func Main() (err error) {
 			}
 		case command == "\n":
 			return nil
+		case strings.HasPrefix(command, "connect "), strings.HasPrefix(command, "stateless-connect "):
+			// git only sends these to helpers which offer them, so
+			// they mean that git and the helper disagree.
+			return fmt.Errorf("git-remote-restic doesn't support the %s command, only fetch and push", strings.Fields(command)[0])
 		default:
 			return fmt.Errorf("Received unknown command %q", command)
 		}
 	}
 }
 
+// exitInteractionRequired is the exit code used when the program would need
+// to prompt the user, but is running in non-interactive mode.
+const exitInteractionRequired = 3
+
 func main() {
-	if err := Main(); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
+	err := Main()
+	closeBackends()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", explainTempError(err))
+		if errors.Is(err, ErrInteractionRequired) {
+			os.Exit(exitInteractionRequired)
+		}
 		os.Exit(1)
 	}
 }
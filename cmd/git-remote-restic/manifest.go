@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/pkg/errors"
+)
+
+// manifestPath is the location of the manifest in the stored repository. It
+// describes the repository in the same snapshot, see resticgit.Manifest.
+const manifestPath = "restic-manifest.json"
+
+// writeManifest stores the manifest of the stored repository. It is left
+// unchanged if the repository didn't change.
+func writeManifest(stored *git.Repository, fs billy.Basic) error {
+	content, err := encodeManifest(stored)
+	if err != nil {
+		return err
+	}
+	if current, err := readStoredFile(fs, manifestPath); err == nil && bytes.Equal(current, content) {
+		return nil
+	}
+	return billyutil.WriteFile(fs, manifestPath, content, 0666)
+}
+
+// encodeManifest returns the manifest of the stored repository as indented
+// JSON.
+func encodeManifest(stored *git.Repository) ([]byte, error) {
+	manifest, err := resticgit.BuildManifest(stored)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(content, '\n'), nil
+}
+
+// cmdManifest prints the manifest of the latest or the given snapshot. The
+// manifest of snapshots which were created before manifests were stored is
+// built from the stored repository instead.
+func cmdManifest(args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("Usage: %s --manifest remote [snapshot]", os.Args[0])
+	}
+	snapshotID := "latest"
+	if len(args) == 1 {
+		snapshotID = args[0]
+	}
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	sn, err := findSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	fs, err := resticfs.New(globalCtx, sharedRepo.restic, sn.ID())
+	if err != nil {
+		return err
+	}
+	content, err := readStoredFile(fs, manifestPath)
+	if os.IsNotExist(err) {
+		stored, err := resticgit.Open(fs, false)
+		if err != nil {
+			return err
+		}
+		if content, err = encodeManifest(stored); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+)
+
+// housekeepingFiles are created by git while maintaining a repository. They
+// only describe the client that wrote them, so they are never stored.
+var housekeepingFiles = []string{
+	"gc.log",
+	"gc.pid",
+	"FETCH_HEAD",
+	"ORIG_HEAD",
+}
+
+// defaultExcludes are patterns of files which are never stored in snapshots,
+// in addition to those configured with restic.exclude. They match temporary
+// files which git and go-git create while writing to a repository, and files
+// which only describe the last local operation. See isExcludedFile for the
+// syntax.
+var defaultExcludes = []string{
+	"*.lock",
+	"._packed-refs*",
+	"objects/pack/tmp_*",
+	"objects/*/tmp_obj_*",
+	"objects/incoming-*",
+	"/shallow",
+	"/FETCH_HEAD",
+	"/ORIG_HEAD",
+	"/gc.pid",
+}
+
+// isExcludedFile reports whether a file in the stored repository matches one
+// of excludePatterns. Patterns use the syntax of path.Match. Like in
+// gitignore files, a pattern without a slash matches the base name of a file
+// at any depth, and other patterns match the path from the top of the
+// repository, ignoring a leading slash. Submodules, which are stored in the
+// modules directory of their superproject, are matched like the
+// superproject.
+func isExcludedFile(name string) bool {
+	rel := storedRepoPath(name)
+	for _, pattern := range excludePatterns {
+		target := path.Base(rel)
+		if strings.ContainsRune(pattern, '/') {
+			pattern = strings.TrimPrefix(pattern, "/")
+			target = rel
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// storedRepoPath returns the path of a file of the stored repository relative
+// to the repository containing it, which is a submodule when the path is in
+// the modules directory.
+func storedRepoPath(name string) string {
+	parts := strings.Split(name, "/")
+	for len(parts) > 2 && parts[0] == "modules" {
+		parts = parts[2:]
+	}
+	return strings.Join(parts, "/")
+}
+
+// normalizedConfig is the content of the config file of a normalized
+// repository. It contains only the settings which are necessary to open the
+// repository.
+const normalizedConfig = "[core]\n\trepositoryformatversion = 0\n\tbare = true\n"
+
+// normalizeRepository removes client-specific files from the stored bare
+// repository, so that two clients pushing the same refs produce identical
+// snapshots. Files are only modified when their content differs from the
+// normalized content, to avoid creating redundant snapshots.
+func normalizeRepository(fs billy.Basic) error {
+	for _, name := range housekeepingFiles {
+		if err := fs.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	file, err := fs.Open("config")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		current, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(current, []byte(normalizedConfig)) {
+			return nil
+		}
+	}
+	return billyutil.WriteFile(fs, "config", []byte(normalizedConfig), 0666)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// syncNotes is set by restic.syncNotes. When it is set, every push mirrors the
+// notes of the local repository into the stored repository, and every fetch
+// updates the local notes from it, so that notes don't need to be named
+// explicitly in refspecs.
+var syncNotes = false
+
+// notesRefPrefix is the namespace of the refs which hold git notes.
+const notesRefPrefix = "refs/notes/"
+
+// notesRefSpec copies every notes ref, replacing the existing value.
+const notesRefSpec = config.RefSpec("+" + notesRefPrefix + "*:" + notesRefPrefix + "*")
+
+// pushNotes copies every notes ref of the local repository at gitDir into the
+// stored repository, and removes the stored notes refs which no longer exist
+// locally.
+func pushNotes(stored *git.Repository, gitDir string) error {
+	local, err := readGitRefNames(gitDir, notesRefPrefix)
+	if err != nil {
+		return err
+	}
+	keep := map[plumbing.ReferenceName]bool{}
+	for _, name := range local {
+		keep[plumbing.ReferenceName(name)] = true
+	}
+	if len(local) > 0 {
+		results, err := resticgit.Push(globalCtx, stored, gitDir, []config.RefSpec{notesRefSpec}, nil)
+		if err != nil {
+			return err
+		}
+		for dst, err := range results {
+			if err != nil {
+				return errors.WithMessage(err, dst)
+			}
+		}
+	}
+
+	storedRefs, err := allRefs(stored)
+	if err != nil {
+		return err
+	}
+	var removed []plumbing.ReferenceName
+	for name := range storedRefs {
+		if strings.HasPrefix(name.String(), notesRefPrefix) && !keep[name] {
+			removed = append(removed, name)
+		}
+	}
+	return resticgit.RemoveReferences(stored, removed)
+}
+
+// fetchNotes updates the notes refs of the local repository at gitDir from the
+// stored repository. Notes which only exist locally are kept, and a local
+// notes ref which has commits that the stored one doesn't is left alone with a
+// warning, since replacing it would lose them.
+func fetchNotes(stored *git.Repository, gitDir string) error {
+	storedRefs, err := allRefs(stored)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range storedRefs {
+		if strings.HasPrefix(name.String(), notesRefPrefix) {
+			names = append(names, name.String())
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	tempPrefix := fmt.Sprintf("refs/restic-notes-%d/", os.Getpid())
+	refSpec := config.RefSpec("+" + notesRefPrefix + "*:" + tempPrefix + "*")
+	if err := resticgit.Fetch(globalCtx, stored, gitDir, []config.RefSpec{refSpec}, nil); err != nil {
+		return err
+	}
+	var update, remove strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&remove, "delete %s%s\n", tempPrefix, strings.TrimPrefix(name, notesRefPrefix))
+		value := storedRefs[plumbing.ReferenceName(name)].String()
+		old, err := localRefValue(gitDir, name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case old == value:
+		case old == "":
+			fmt.Fprintf(&update, "create %s %s\n", name, value)
+		case isAncestor(gitDir, old, value):
+			fmt.Fprintf(&update, "update %s %s %s\n", name, value, old)
+		default:
+			Warnf("warning: not updating %s, which has notes that the remote doesn't; push them or merge with git notes merge\n", name)
+		}
+	}
+	defer func() {
+		if err := updateLocalRefs(gitDir, remove.String()); err != nil {
+			Warnf("warning: %v\n", err)
+		}
+	}()
+	return updateLocalRefs(gitDir, update.String())
+}
+
+// isAncestor reports whether the commit ancestor is an ancestor of commit in
+// the local repository at gitDir.
+func isAncestor(gitDir, ancestor, commit string) bool {
+	return exec.Command(gitBin(), "--git-dir", gitDir, "merge-base", "--is-ancestor", ancestor, commit).Run() == nil
+}
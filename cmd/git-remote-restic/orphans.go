@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+	"github.com/restic/restic/lib/restic"
+)
+
+// packJournalPath returns the location of the journal of the packs which were
+// uploaded to the restic repository at location since the last snapshot was
+// saved. It is stored in the local repository.
+func packJournalPath(location string) string {
+	return filepath.Join(localGitPath, "restic", "pending-packs", url.PathEscape(location))
+}
+
+// journalBackend records the name of every pack saved to the backend in the
+// pack journal before it is uploaded, and removes them from the journal once
+// a snapshot has been saved. The packs which remain in the journal were
+// uploaded by a push which was interrupted before it created a snapshot.
+type journalBackend struct {
+	restic.Backend
+	path string
+	mu   sync.Mutex
+	// recorded holds the packs recorded by this process.
+	recorded restic.IDSet
+}
+
+// wrapPackJournal adds the pack journal of the repository at location to be.
+func wrapPackJournal(be restic.Backend, location string) restic.Backend {
+	return &journalBackend{Backend: be, path: packJournalPath(location), recorded: restic.NewIDSet()}
+}
+
+func (be *journalBackend) Unwrap() restic.Backend {
+	return be.Backend
+}
+
+func (be *journalBackend) Save(ctx context.Context, h restic.Handle, rd restic.RewindReader) error {
+	if h.Type == restic.PackFile {
+		be.record(h.Name)
+	}
+	err := be.Backend.Save(ctx, h, rd)
+	if err == nil && h.Type == restic.SnapshotFile {
+		be.clear()
+	}
+	return err
+}
+
+// Remove removes the packs recorded by this process from the journal once they
+// are removed from the backend, such as the test object of --ping.
+func (be *journalBackend) Remove(ctx context.Context, h restic.Handle) error {
+	err := be.Backend.Remove(ctx, h)
+	if err == nil && h.Type == restic.PackFile {
+		be.forget(h.Name)
+	}
+	return err
+}
+
+// record appends name to the journal. The journal is only kept in a local
+// repository, so nothing is recorded when running git ls-remote.
+func (be *journalBackend) record(name string) {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(be.path), 0777); err != nil {
+		debug.Log("unable to record pack %v: %v", name, err)
+		return
+	}
+	file, err := os.OpenFile(be.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		debug.Log("unable to record pack %v: %v", name, err)
+		return
+	}
+	defer file.Close()
+	if _, err := fmt.Fprintln(file, name); err != nil {
+		debug.Log("unable to record pack %v: %v", name, err)
+	} else if id, err := restic.ParseID(name); err == nil {
+		be.recorded.Insert(id)
+	}
+}
+
+// forget removes name from the journal, if it was recorded by this process.
+func (be *journalBackend) forget(name string) {
+	id, err := restic.ParseID(name)
+	if err != nil {
+		return
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if !be.recorded.Has(id) {
+		return
+	}
+	packs, err := readPackJournalFile(be.path)
+	if err == nil {
+		packs.Delete(id)
+		err = writePackJournalFile(be.path, packs)
+	}
+	if err != nil {
+		debug.Log("unable to remove pack %v from the journal: %v", name, err)
+		return
+	}
+	be.recorded.Delete(id)
+}
+
+// clear removes the packs recorded by this process from the journal. The
+// packs of earlier pushes which were interrupted remain.
+func (be *journalBackend) clear() {
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if len(be.recorded) == 0 {
+		return
+	}
+	packs, err := readPackJournalFile(be.path)
+	if err == nil {
+		err = writePackJournalFile(be.path, packs.Sub(be.recorded))
+	}
+	if err != nil {
+		debug.Log("unable to clear pack journal: %v", err)
+		return
+	}
+	be.recorded = restic.NewIDSet()
+}
+
+// readPackJournalFile returns the packs in the journal at path.
+func readPackJournalFile(path string) (restic.IDSet, error) {
+	packs := restic.NewIDSet()
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return packs, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		id, err := restic.ParseID(scanner.Text())
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pack journal entry %#v", scanner.Text())
+		}
+		packs.Insert(id)
+	}
+	return packs, scanner.Err()
+}
+
+// writePackJournalFile replaces the journal at path with packs, or removes it
+// if there are none.
+func writePackJournalFile(path string, packs restic.IDSet) error {
+	if len(packs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	var content []byte
+	for id := range packs {
+		content = append(content, id.String()+"\n"...)
+	}
+	return ioutil.WriteFile(path, content, 0666)
+}
+
+// cmdGC removes the packs which were uploaded by pushes from the local
+// repository that were interrupted before they saved a snapshot. Such packs
+// are not in the index unless the push saved part of it, so no snapshot can
+// use their data, and they are removed. Packs which are in the index are left
+// for restic prune, which checks whether any snapshot uses them. The
+// repository is locked exclusively, so that no push is in progress.
+func cmdGC(args []string) error {
+	if len(args) != 0 {
+		return errors.New("--gc does not accept any arguments")
+	}
+	lock, err := sharedRepo.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	// The journal is read once no push can be in progress, since a push
+	// which completes removes its packs from the journal.
+	journalPath := packJournalPath(sharedRepo.location)
+	journaled, err := readPackJournalFile(journalPath)
+	if err != nil {
+		return err
+	}
+	if len(journaled) == 0 {
+		fmt.Printf("no packs left by interrupted pushes\n")
+		return nil
+	}
+
+	// A push which was interrupted after the index was loaded may have
+	// saved part of it.
+	if err := sharedRepo.restic.LoadIndex(globalCtx, nil); err != nil {
+		return err
+	}
+	indexed := restic.NewIDSet()
+	for pack := range sharedRepo.restic.Index().ListPacks(globalCtx, journaled) {
+		// ListPacks also returns the packs which have no blobs in the
+		// index.
+		if len(pack.Blobs) > 0 {
+			indexed.Insert(pack.PackID)
+		}
+	}
+	be := sharedRepo.restic.Backend()
+	removed := 0
+	for id := range journaled {
+		if indexed.Has(id) {
+			continue
+		}
+		h := restic.Handle{Type: restic.PackFile, Name: id.String()}
+		if _, err := be.Stat(globalCtx, h); be.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := be.Remove(globalCtx, h); err != nil {
+			return errors.WithMessagef(err, "unable to remove pack %v", id.Str())
+		}
+		removed++
+	}
+	fmt.Printf("removed %d packs left by interrupted pushes\n", removed)
+	if len(indexed) > 0 {
+		fmt.Printf("%d packs are in the index; run restic prune to remove them if no snapshot uses them\n", len(indexed))
+	}
+	return writePackJournalFile(journalPath, nil)
+}
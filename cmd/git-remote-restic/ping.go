@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+	"github.com/restic/restic/lib/ui"
+)
+
+// pingRequests is the number of requests used to measure latency.
+const pingRequests = 5
+
+// pingObjectSize is the size of the test object used to measure throughput.
+const pingObjectSize = 1 << 20
+
+// cmdPing checks that a remote is usable: the backend is reachable, the
+// password is valid, and a lock can be created and removed. It then measures
+// the latency of the backend, and its throughput by uploading, downloading,
+// and removing a test object.
+func cmdPing(args []string) error {
+	if len(args) != 1 {
+		return errors.New("--ping requires exactly one remote")
+	}
+	name, url, err := resolveRemote(args[0])
+	if err != nil {
+		return err
+	}
+	remoteName = plumbing.ReferenceName(name)
+	start := time.Now()
+	if err := openSharedRepo(url, false); err != nil {
+		return err
+	}
+	if !sharedRepo.Exists() {
+		return ErrNoRepository
+	}
+	fmt.Printf("%-9s %s opened in %v\n", "backend", sharedRepo.location, roundDuration(time.Since(start)))
+	fmt.Printf("%-9s valid for repository %s\n", "password", sharedRepo.restic.Config().ID[:10])
+
+	start = time.Now()
+	lock, err := restic.NewLock(globalCtx, sharedRepo.restic)
+	if err != nil {
+		return errors.WithMessage(err, "unable to create lock")
+	}
+	if err := lock.Unlock(); err != nil {
+		return errors.WithMessage(err, "unable to remove lock")
+	}
+	fmt.Printf("%-9s created and removed in %v\n", "lock", roundDuration(time.Since(start)))
+
+	be := sharedRepo.restic.Backend()
+	var total, fastest time.Duration
+	for i := 0; i < pingRequests; i++ {
+		start = time.Now()
+		if _, err := be.Stat(globalCtx, restic.Handle{Type: restic.ConfigFile}); err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		total += elapsed
+		if i == 0 || elapsed < fastest {
+			fastest = elapsed
+		}
+	}
+	fmt.Printf("%-9s %d requests, min %v, avg %v\n", "latency", pingRequests, roundDuration(fastest), roundDuration(total/pingRequests))
+
+	return measureThroughput(be)
+}
+
+// measureThroughput uploads a test object with random content, downloads it
+// again, and removes it. The object is stored as a pack file with a random
+// name, which is not referenced by any index, so that restic ignores it if
+// it cannot be removed.
+func measureThroughput(be restic.Backend) error {
+	data := make([]byte, pingObjectSize)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	h := restic.Handle{Type: restic.PackFile, Name: restic.NewRandomID().String()}
+
+	start := time.Now()
+	if err := be.Save(globalCtx, h, restic.NewByteReader(data, be.Hasher())); err != nil {
+		return errors.WithMessage(err, "unable to upload test object")
+	}
+	fmt.Printf("%-9s %s\n", "upload", formatThroughput(len(data), time.Since(start)))
+	defer func() {
+		if err := be.Remove(globalCtx, h); err != nil {
+			Warnf("warning: unable to remove test object %v: %v\n", h, err)
+		}
+	}()
+
+	start = time.Now()
+	var loaded []byte
+	err := be.Load(globalCtx, h, 0, 0, func(rd io.Reader) (err error) {
+		loaded, err = ioutil.ReadAll(rd)
+		return err
+	})
+	if err != nil {
+		return errors.WithMessage(err, "unable to download test object")
+	}
+	elapsed := time.Since(start)
+	if !bytes.Equal(loaded, data) {
+		return errors.New("downloaded test object differs from the uploaded one")
+	}
+	fmt.Printf("%-9s %s\n", "download", formatThroughput(len(loaded), elapsed))
+	return nil
+}
+
+func formatThroughput(size int, elapsed time.Duration) string {
+	rate := float64(size) / elapsed.Seconds()
+	return fmt.Sprintf("%s in %v (%s/s)", ui.FormatBytes(uint64(size)), roundDuration(elapsed), ui.FormatBytes(uint64(rate)))
+}
+
+// roundDuration rounds a measured duration for display.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// presetPrefix starts the locations which name one of rclonePresets, like
+// "preset:gdrive:backups/project".
+const presetPrefix = "preset:"
+
+// rclonePreset is a storage provider which is reached through an rclone
+// backend, so that it can be used without configuring an rclone remote.
+type rclonePreset struct {
+	// backend is the name of the rclone backend.
+	backend string
+	// params are the default parameters of the backend, as "name=value".
+	params []string
+}
+
+// rclonePresets are the providers which a location can name with
+// presetPrefix. Their defaults suit restic repositories: files deleted by
+// restic prune aren't kept in the trash, and Google Drive is only given access
+// to the files it creates.
+var rclonePresets = map[string]rclonePreset{
+	"webdav":    {"webdav", []string{"vendor=other"}},
+	"nextcloud": {"webdav", []string{"vendor=nextcloud"}},
+	"owncloud":  {"webdav", []string{"vendor=owncloud"}},
+	"gdrive":    {"drive", []string{"scope=drive.file", "use_trash=false"}},
+	"onedrive":  {"onedrive", []string{"hard_delete=true"}},
+	"opendrive": {"opendrive", nil},
+}
+
+// expandPreset replaces a location such as "preset:gdrive:backups/project"
+// by the equivalent rclone location, which uses an rclone connection string
+// to configure the backend of the preset. The parameters of the backend, such
+// as the URL of a WebDAV server, are read from restic.preset.<name>.<param>
+// and override the defaults of the preset. Other locations are returned
+// unchanged.
+func expandPreset(location string) (string, error) {
+	if !strings.HasPrefix(location, presetPrefix) {
+		return location, nil
+	}
+	name, path := strings.TrimPrefix(location, presetPrefix), ""
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name, path = name[:i], name[i+1:]
+	}
+	preset, ok := rclonePresets[name]
+	if !ok {
+		var names []string
+		for name := range rclonePresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", errors.Errorf("unknown preset %q, the presets are %s", name, strings.Join(names, ", "))
+	}
+
+	params := map[string]string{}
+	var order []string
+	setParam := func(key, value string) {
+		if _, ok := params[key]; !ok {
+			order = append(order, key)
+		}
+		params[key] = value
+	}
+	for _, param := range preset.params {
+		parts := strings.SplitN(param, "=", 2)
+		setParam(parts[0], parts[1])
+	}
+	prefix := "restic.preset." + name + "."
+	lines, err := readGitConfigAll("--get-regexp", "^"+regexp.QuoteMeta(prefix))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) < 2 {
+			// A variable which is set without a value.
+			parts = append(parts, "true")
+		}
+		setParam(strings.TrimPrefix(parts[0], prefix), parts[1])
+	}
+
+	remote := ":" + preset.backend
+	for _, key := range order {
+		// Values are quoted since they may contain ':' or ','.
+		remote += fmt.Sprintf(",%s='%s'", key, strings.ReplaceAll(params[key], "'", "''"))
+	}
+	return "rclone:" + remote + ":" + path, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os/exec"
+	"path"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// readProtectedRefs returns the patterns of the protected refs, from the
+// multi-valued restic.<remote>.protect and restic.protect. Both apply, so a
+// remote can't lift the protection configured for every remote.
+func readProtectedRefs() ([]string, error) {
+	keys := []string{"restic.protect"}
+	if remoteName != "" {
+		keys = append(keys, "restic."+remoteName.String()+".protect")
+	}
+	var patterns []string
+	for _, key := range keys {
+		values, err := readGitConfigAll("--get-all", key)
+		if err != nil {
+			return nil, err
+		}
+		for _, value := range values {
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, errors.Errorf("%s: invalid pattern %q", key, value)
+			}
+			patterns = append(patterns, value)
+		}
+	}
+	return patterns, nil
+}
+
+// isProtected reports whether the ref name matches one of patterns. The
+// patterns are matched like shell globs, where "*" doesn't match "/".
+func isProtected(patterns []string, name plumbing.ReferenceName) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name.String()); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkProtectedRefs refuses the refspecs which would delete a protected ref
+// or update it to a commit which doesn't descend from its current value in
+// the stored repository, even when the push is forced. This gives a shared
+// remote some of the protection of a branch protection rule on a server. The
+// refspecs are pushed from the local repository at gitDir. It returns the
+// refspecs which may be pushed, and the results of the refused ones, by
+// destination.
+func checkProtectedRefs(stored *git.Repository, gitDir string, refspecs []config.RefSpec) ([]config.RefSpec, map[string]error, error) {
+	patterns, err := readProtectedRefs()
+	if err != nil || len(patterns) == 0 {
+		return refspecs, nil, err
+	}
+	refspecs, err = expandForcedWildcards(gitDir, refspecs)
+	if err != nil {
+		return nil, nil, err
+	}
+	resolved, err := resticgit.ResolveSymbolicRefSpecs(stored, refspecs)
+	if err != nil {
+		return nil, nil, err
+	}
+	var allowed []config.RefSpec
+	refused := map[string]error{}
+	for i, refspec := range resolved {
+		if refspec.IsWildcard() {
+			allowed = append(allowed, refspecs[i])
+			continue
+		}
+		dst := refspec.Dst("")
+		if !isProtected(patterns, dst) {
+			allowed = append(allowed, refspecs[i])
+			continue
+		}
+		if refspec.IsDelete() {
+			refused[refspecs[i].Dst("").String()] = errors.New("refusing to delete protected ref")
+			continue
+		}
+		current, err := stored.Storer.Reference(dst)
+		if err == plumbing.ErrReferenceNotFound {
+			allowed = append(allowed, refspecs[i])
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		fastForward, err := isLocalAncestor(gitDir, current.Hash(), refspec.Src())
+		if err != nil {
+			return nil, nil, err
+		}
+		if !fastForward {
+			refused[refspecs[i].Dst("").String()] = errors.New("refusing non-fast-forward update of protected ref")
+			continue
+		}
+		allowed = append(allowed, refspecs[i])
+	}
+	return allowed, refused, nil
+}
+
+// expandForcedWildcards replaces each forced wildcard refspec with a refspec
+// for every matching ref of the local repository at gitDir, so that the
+// protected refs among their destinations can be checked. Wildcard refspecs
+// never delete refs, so the expanded refspecs update the same refs.
+func expandForcedWildcards(gitDir string, refspecs []config.RefSpec) ([]config.RefSpec, error) {
+	var names []string
+	expanded := make([]config.RefSpec, 0, len(refspecs))
+	for _, refspec := range refspecs {
+		if !refspec.IsWildcard() || !refspec.IsForceUpdate() {
+			expanded = append(expanded, refspec)
+			continue
+		}
+		if names == nil {
+			var err error
+			if names, err = readGitRefNames(gitDir); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range names {
+			ref := plumbing.ReferenceName(name)
+			if refspec.Match(ref) {
+				expanded = append(expanded, config.RefSpec("+"+name+":"+refspec.Dst(ref).String()))
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// isLocalAncestor reports whether the commit old is an ancestor of the
+// revision rev of the local repository at gitDir. A commit which isn't in the
+// local repository isn't an ancestor.
+func isLocalAncestor(gitDir string, old plumbing.Hash, rev string) (bool, error) {
+	err := exec.Command(gitBin(), "--git-dir", gitDir, "merge-base", "--is-ancestor", old.String(), rev).Run()
+	if _, ok := err.(*exec.ExitError); ok {
+		// 1 if old isn't an ancestor, 128 if it's missing.
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "git merge-base")
+	}
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+)
+
+// maxProtocolVersion is the highest version of the git wire protocol which
+// may be requested in GIT_PROTOCOL. The helper transfers objects itself, using
+// the fetch and push capabilities, so the wire protocol doesn't apply to it,
+// and the versions up to 2 are all accepted. Features of version 2 would
+// require the stateless-connect capability, which isn't offered.
+const maxProtocolVersion = 2
+
+// gitProtocol holds the parameters which git passed in GIT_PROTOCOL, such as
+// the requested protocol version.
+var gitProtocol = map[string]string{}
+
+// readGitProtocol parses GIT_PROTOCOL, which is a colon-separated list of
+// keys, which may have a value after "=". Like git, unknown keys are ignored,
+// but a protocol version which the helper doesn't know is an error, rather
+// than being silently treated as an older one.
+func readGitProtocol() error {
+	value := os.Getenv("GIT_PROTOCOL")
+	if value == "" {
+		return nil
+	}
+	debug.Log("GIT_PROTOCOL=%s", value)
+	params := map[string]string{}
+	for _, param := range strings.Split(value, ":") {
+		parts := strings.SplitN(param, "=", 2)
+		if len(parts) == 2 {
+			params[parts[0]] = parts[1]
+		} else {
+			params[parts[0]] = ""
+		}
+	}
+	if version, ok := params["version"]; ok {
+		n, err := strconv.Atoi(version)
+		if err != nil || n < 0 {
+			return errors.Errorf("invalid protocol version %#v in GIT_PROTOCOL", version)
+		} else if n > maxProtocolVersion {
+			return errors.Errorf("protocol version %d requested in GIT_PROTOCOL is not supported, git-remote-restic supports versions up to %d", n, maxProtocolVersion)
+		}
+	}
+	gitProtocol = params
+	return nil
+}
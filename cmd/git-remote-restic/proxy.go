@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// proxyURL is the proxy which HTTP backends connect through, or nil to use
+// HTTPS_PROXY and HTTP_PROXY.
+var proxyURL *url.URL
+
+// readProxyConfig sets proxyURL from restic.<remote>.proxy or restic.proxy,
+// or otherwise from git's http.proxy. ALL_PROXY is used when none of these
+// are set and neither are HTTPS_PROXY or HTTP_PROXY, which Go already
+// honors. Like git, a proxy without a scheme is an HTTP proxy. SOCKS5
+// proxies are given as socks5://host:port, and host names are always
+// resolved by the proxy, so socks5h:// is accepted as well.
+func readProxyConfig() error {
+	proxyURL = nil
+	value, ok, err := getRemoteConfig("proxy")
+	if err != nil {
+		return err
+	} else if !ok {
+		if value, ok, err = readGitConfig("--get", "http.proxy"); err != nil {
+			return err
+		}
+	}
+	if !ok && firstEnv("HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy") == "" {
+		value = firstEnv("ALL_PROXY", "all_proxy")
+	}
+	if value == "" {
+		return nil
+	}
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return errors.Wrap(err, "invalid proxy")
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		parsed.Scheme = "socks5"
+	default:
+		return errors.Errorf("unsupported proxy scheme %s in %s", parsed.Scheme, value)
+	}
+	proxyURL = parsed
+	return nil
+}
+
+// applyProxy makes the transport of an HTTP backend use proxyURL, if set.
+func applyProxy(rt http.RoundTripper) {
+	if proxyURL == nil {
+		return
+	}
+	tr, ok := rt.(*http.Transport)
+	if !ok {
+		// restic wraps the transport when debug logging is enabled.
+		Warnf("warning: the proxy %s can't be used while debug logging is enabled\n", proxyURL.Redacted())
+		return
+	}
+	tr.Proxy = http.ProxyURL(proxyURL)
+}
+
+// firstEnv returns the value of the first of the named environment variables
+// which is set to a non-empty value.
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
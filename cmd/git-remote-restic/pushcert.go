@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+)
+
+// pushCertPath is the location of the certificate of the most recent signed
+// push in the snapshot. Earlier certificates remain in earlier snapshots.
+const pushCertPath = "restic-pushcert"
+
+// signPushes is set when the push should be signed with the user's signing
+// key, as requested by "git push --signed".
+var signPushes = false
+
+// setPushCert handles the pushcert option, which git sends for "git push
+// --signed". The result reports whether the option is supported. Signed pushes
+// are only supported when user.signingKey is configured. With
+// --signed=if-asked, the push is signed when a signing key is configured, and
+// is silently left unsigned otherwise, including when the key can't be read.
+func setPushCert(value string) bool {
+	switch value {
+	case "false":
+		signPushes = false
+		return true
+	case "if-asked":
+		key, err := signingKey()
+		if err != nil {
+			debug.Log("unable to read the signing key: %v", err)
+		}
+		signPushes = err == nil && key != ""
+		return true
+	case "true":
+		key, err := signingKey()
+		if err != nil {
+			Warnf("%v\n", err)
+			return false
+		}
+		signPushes = key != ""
+		return signPushes
+	}
+	return false
+}
+
+// readPushGPGSign sets signPushes from push.gpgSign, for pushes which aren't
+// started by git push, which would send the pushcert option instead.
+func readPushGPGSign() error {
+	value, ok, err := readGitConfig("--get", "push.gpgSign")
+	if err != nil || !ok {
+		return err
+	}
+	switch strings.ToLower(value) {
+	case "if-asked":
+		value = "if-asked"
+	case "true", "yes", "on", "1":
+		value = "true"
+	default:
+		value = "false"
+	}
+	if !setPushCert(value) {
+		return errors.New("push.gpgSign is set, but user.signingKey is not configured")
+	}
+	return nil
+}
+
+func signingKey() (string, error) {
+	key, _, err := readGitConfig("--get", "user.signingKey")
+	return key, err
+}
+
+// writePushCert stores a certificate describing the updates, signed with the
+// user's signing key. The format is the same as the certificates created by
+// git push --signed.
+func writePushCert(fs billy.Basic, url string, updates []RefUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	ident, err := exec.Command(gitBin(), "var", "GIT_COMMITTER_IDENT").Output()
+	if err != nil {
+		return errors.Wrap(err, "unable to determine pusher identity")
+	}
+	var cert strings.Builder
+	fmt.Fprintf(&cert, "certificate version 0.1\n")
+	fmt.Fprintf(&cert, "pusher %s\n", strings.TrimSpace(string(ident)))
+	fmt.Fprintf(&cert, "pushee %s%s\n", urlPrefix, url)
+	fmt.Fprintf(&cert, "\n")
+	for _, update := range updates {
+		fmt.Fprintf(&cert, "%s %s %s\n", update.Old, update.New, update.Name)
+	}
+	signature, err := signBuffer(cert.String())
+	if err != nil {
+		return err
+	}
+	return billyutil.WriteFile(fs, pushCertPath, []byte(cert.String()+signature), 0666)
+}
+
+// gpgProgram returns the configured gpg.program, like git.
+func gpgProgram() (string, error) {
+	program, ok, err := readGitConfig("--get", "gpg.program")
+	if err != nil {
+		return "", err
+	} else if !ok {
+		program = "gpg"
+	}
+	return program, nil
+}
+
+// signBuffer creates a detached, armored signature of payload using the
+// configured gpg.program and user.signingKey, in the same way as git.
+func signBuffer(payload string) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	program, err := gpgProgram()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(program, "--status-fd=2", "-bsau", key)
+	cmd.Stdin = strings.NewReader(payload)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil || !strings.Contains(stderr.String(), "[GNUPG:] SIG_CREATED ") {
+		return "", errors.Errorf("gpg failed to sign the push certificate: %s", strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/backend"
+	"github.com/restic/restic/lib/backend/limiter"
+	"github.com/restic/restic/lib/backend/location"
+	"github.com/restic/restic/lib/backend/rclone"
+	"github.com/restic/restic/lib/backend/rest"
+	"github.com/restic/restic/lib/debug"
+	"golang.org/x/net/http2"
+)
+
+// rcloneWaitForExit is how long rclone is given to exit once its connection
+// is closed, before its process group is killed.
+const rcloneWaitForExit = 5 * time.Second
+
+// newRcloneFactory returns the factory of the rclone backend. It replaces the
+// one of restic, which leaves rclone in the process group of the remote helper
+// when there is no terminal and prints its messages directly to stderr.
+// Instead, rclone is started in its own process group, which is killed with
+// every process rclone started if it doesn't exit when the backend is closed,
+// and its messages are also written to the debug log.
+func newRcloneFactory() location.Factory {
+	return location.NewLimitedBackendFactory("rclone", rclone.ParseConfig, location.NoPassword, createRclone, openRclone)
+}
+
+// rcloneBackend is a REST backend served by an rclone process over its stdin
+// and stdout.
+type rcloneBackend struct {
+	*rest.Backend
+	tr   *http2.Transport
+	cmd  *exec.Cmd
+	conn *rcloneConn
+	// exited is closed once rclone has exited, after which waitErr holds
+	// its exit status.
+	exited  chan struct{}
+	waitErr error
+}
+
+func openRclone(ctx context.Context, cfg rclone.Config, lim limiter.Limiter) (*rcloneBackend, error) {
+	be, err := startRclone(ctx, cfg, lim)
+	if err != nil {
+		return nil, err
+	}
+	be.Backend, err = rest.Open(ctx, rcloneRestConfig(cfg), debug.RoundTripper(be.tr))
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+	return be, nil
+}
+
+func createRclone(ctx context.Context, cfg rclone.Config, lim limiter.Limiter) (*rcloneBackend, error) {
+	be, err := startRclone(ctx, cfg, lim)
+	if err != nil {
+		return nil, err
+	}
+	be.Backend, err = rest.Create(ctx, rcloneRestConfig(cfg), debug.RoundTripper(be.tr))
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
+	return be, nil
+}
+
+func rcloneRestConfig(cfg rclone.Config) rest.Config {
+	return rest.Config{
+		Connections: cfg.Connections,
+		URL:         &url.URL{Scheme: "http", Host: "localhost", Path: "/"},
+	}
+}
+
+// startRclone runs rclone as configured by cfg and waits until it answers
+// requests.
+func startRclone(ctx context.Context, cfg rclone.Config, lim limiter.Limiter) (*rcloneBackend, error) {
+	var args []string
+	for _, s := range []string{cfg.Program, cfg.Args} {
+		if s == "" {
+			continue
+		}
+		a, err := backend.SplitShellStrings(s)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a...)
+	}
+	args = append(args, cfg.Remote)
+
+	debug.Log("running command: %v", args)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// The pipes are made here rather than by cmd, since Wait would close
+	// them while they may still be in use, and would wait for every process
+	// which inherited stderr to exit.
+	var pipes [3][2]*os.File
+	var err error
+	for i := range pipes {
+		pipes[i][0], pipes[i][1], err = os.Pipe()
+		if err != nil {
+			for _, p := range pipes[:i] {
+				_ = p[0].Close()
+				_ = p[1].Close()
+			}
+			return nil, err
+		}
+	}
+	childStdin, stdin := pipes[0][0], pipes[0][1]
+	stdout, childStdout := pipes[1][0], pipes[1][1]
+	stderr, childStderr := pipes[2][0], pipes[2][1]
+	cmd.Stdin = childStdin
+	cmd.Stdout = childStdout
+	cmd.Stderr = childStderr
+	err = cmd.Start()
+	_ = childStdin.Close()
+	_ = childStdout.Close()
+	_ = childStderr.Close()
+	if err != nil {
+		_ = stdin.Close()
+		_ = stdout.Close()
+		_ = stderr.Close()
+		if backend.IsErrDot(err) {
+			return nil, errors.Errorf("cannot implicitly run relative executable %v found in current directory, use -o rclone.program=./<program> to override", cmd.Path)
+		}
+		return nil, err
+	}
+
+	conn := &rcloneConn{Reader: stdout, Writer: stdin, stdin: stdin, stdout: stdout}
+	if lim != nil {
+		conn.Reader = lim.Downstream(stdout)
+		conn.Writer = lim.UpstreamWriter(stdin)
+	}
+	be := &rcloneBackend{
+		cmd:    cmd,
+		conn:   conn,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		// The messages end once every process which inherited stderr
+		// has exited, which may be after rclone itself.
+		defer stderr.Close()
+		sc := bufio.NewScanner(stderr)
+		for sc.Scan() {
+			Warnf("rclone: %s\n", sc.Text())
+		}
+	}()
+	go func() {
+		be.waitErr = cmd.Wait()
+		debug.Log("rclone exited: %v", be.waitErr)
+		close(be.exited)
+	}()
+
+	dialed := false
+	be.tr = &http2.Transport{
+		// This is not really HTTP, just stdin and stdout.
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if dialed {
+				return nil, backoff.Permanent(errors.New("rclone stdio connection already closed"))
+			}
+			dialed = true
+			return conn, nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-be.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Request a file which doesn't exist, just to see when rclone is able to
+	// answer requests.
+	client := http.Client{Transport: debug.RoundTripper(be.tr), Timeout: cfg.Timeout}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost/file-%d", rand.Uint64()), nil)
+	if err != nil {
+		be.kill()
+		return nil, err
+	}
+	req.Header.Set("Accept", rest.ContentTypeV2)
+	res, err := client.Do(req)
+	if err != nil {
+		select {
+		case <-be.exited:
+			// The exit status of rclone explains why it didn't
+			// answer better than the failure to talk to it.
+			if be.waitErr != nil {
+				err = be.waitErr
+			}
+		default:
+			be.kill()
+		}
+		_ = stdout.Close()
+		return nil, errors.Wrap(err, "error talking HTTP to rclone")
+	}
+	_ = res.Body.Close()
+	return be, nil
+}
+
+// kill kills the process group of rclone and waits for it to exit.
+func (be *rcloneBackend) kill() {
+	select {
+	case <-be.exited:
+		return
+	default:
+	}
+	debug.Log("killing the process group of rclone")
+	if err := syscall.Kill(-be.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		debug.Log("unable to kill rclone: %v", err)
+	}
+	<-be.exited
+}
+
+// Close closes the connection to rclone, which makes it exit, and kills its
+// process group if it doesn't exit promptly.
+func (be *rcloneBackend) Close() error {
+	debug.Log("exiting rclone")
+	be.tr.CloseIdleConnections()
+	_ = be.conn.Close()
+	select {
+	case <-be.exited:
+	case <-time.After(rcloneWaitForExit):
+		be.kill()
+	}
+	_ = be.conn.stdout.Close()
+	return be.waitErr
+}
+
+// rcloneConn is the connection to rclone over its stdin and stdout.
+type rcloneConn struct {
+	io.Reader
+	io.Writer
+	stdin  *os.File
+	stdout *os.File
+}
+
+// Close closes stdin, which rclone treats as the end of the connection.
+func (c *rcloneConn) Close() error {
+	return c.stdin.Close()
+}
+
+func (c *rcloneConn) LocalAddr() net.Addr {
+	return rcloneAddr{}
+}
+
+func (c *rcloneConn) RemoteAddr() net.Addr {
+	return rcloneAddr{}
+}
+
+func (c *rcloneConn) SetDeadline(t time.Time) error {
+	if err := c.stdout.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.stdin.SetWriteDeadline(t)
+}
+
+func (c *rcloneConn) SetReadDeadline(t time.Time) error {
+	return c.stdout.SetReadDeadline(t)
+}
+
+func (c *rcloneConn) SetWriteDeadline(t time.Time) error {
+	return c.stdin.SetWriteDeadline(t)
+}
+
+type rcloneAddr struct{}
+
+func (rcloneAddr) Network() string {
+	return "stdio"
+}
+
+func (rcloneAddr) String() string {
+	return "rclone"
+}
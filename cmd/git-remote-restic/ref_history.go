@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// refHistoryBatch is the number of snapshots which cmdRefHistory opens at
+// once.
+const refHistoryBatch = 32
+
+// cmdRefHistory prints each snapshot in which the given ref was created,
+// changed, or deleted, from oldest to newest. This finds the push which
+// removed a ref from the remote without restoring every snapshot.
+func cmdRefHistory(args []string) error {
+	var refs []string
+	for _, arg := range args {
+		switch {
+		case arg == "--utc":
+			utcTimes = true
+		case strings.HasPrefix(arg, "-"):
+			return errors.Errorf("unknown option %s", arg)
+		default:
+			refs = append(refs, arg)
+		}
+	}
+	if len(refs) != 1 {
+		return errors.Errorf("Usage: %s --ref-history remote [--utc] ref", os.Args[0])
+	}
+	refName := plumbing.ReferenceName(refs[0])
+	if refName != plumbing.HEAD && !refName.IsBranch() && !refName.IsTag() && !refName.IsNote() && !refName.IsRemote() {
+		return errors.Errorf("%s is not a full ref name, such as refs/heads/main", refName)
+	}
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+
+	snapshots, err := sharedRepo.Snapshots(globalCtx)
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.Reverse(snapshots))
+
+	cache := resticfs.NewCache()
+	previous := ""
+	for start := 0; start < len(snapshots); start += refHistoryBatch {
+		batch := snapshots[start:]
+		if len(batch) > refHistoryBatch {
+			batch = batch[:refHistoryBatch]
+		}
+		ids := make([]restic.ID, len(batch))
+		for i, sn := range batch {
+			ids[i] = *sn.ID()
+		}
+		filesystems, err := resticfs.OpenSnapshots(globalCtx, sharedRepo.restic, ids, cache)
+		if err != nil {
+			return err
+		}
+		for i, fs := range filesystems {
+			value, err := readRefAt(fs, refName)
+			if err != nil {
+				return errors.WithMessagef(err, "snapshot %v", batch[i].ID().Str())
+			}
+			if value == previous {
+				continue
+			}
+			previous = value
+			if value == "" {
+				value = "(deleted)"
+			}
+			fmt.Printf("%s %s %s\n", batch[i].ID().Str(), formatTime(batch[i].Time), value)
+		}
+	}
+	return nil
+}
+
+// readRefAt returns the value of the named ref in the repository stored in
+// fs, or "" if the ref doesn't exist.
+func readRefAt(fs *resticfs.Filesystem, name plumbing.ReferenceName) (string, error) {
+	stored, err := resticgit.Open(fs, false)
+	if err != nil {
+		return "", err
+	}
+	ref, err := stored.Storer.Reference(name)
+	if err == plumbing.ErrReferenceNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if ref.Type() == plumbing.SymbolicReference {
+		return ref.Target().String(), nil
+	}
+	return ref.Hash().String(), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
+)
+
+// localIgnoresCase reports whether the local repository is on a
+// case-insensitive filesystem, such as the default ones of macOS and Windows.
+// Git detects this when the repository is created and sets core.ignoreCase.
+func localIgnoresCase() bool {
+	value, _, err := readGitConfig("--bool", "--get", "core.ignoreCase")
+	if err != nil {
+		debug.Log("unable to read core.ignoreCase: %v", err)
+		return false
+	}
+	return value == "true"
+}
+
+// refCaseCollisions returns the groups of names which differ only in case,
+// sorted. Git stores loose refs as files, so on a case-insensitive filesystem
+// the refs of each group would overwrite each other.
+func refCaseCollisions(names []string) [][]string {
+	groups := map[string][]string{}
+	for _, name := range names {
+		key := strings.ToLower(name)
+		group := groups[key]
+		duplicate := false
+		for _, other := range group {
+			duplicate = duplicate || other == name
+		}
+		if !duplicate {
+			groups[key] = append(group, name)
+		}
+	}
+	var collisions [][]string
+	for _, group := range groups {
+		if len(group) > 1 {
+			sort.Strings(group)
+			collisions = append(collisions, group)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i][0] < collisions[j][0]
+	})
+	return collisions
+}
+
+// describeCollisions formats collisions with one group per line.
+func describeCollisions(collisions [][]string) string {
+	var lines []string
+	for _, group := range collisions {
+		lines = append(lines, "  "+strings.Join(group, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// warnRefCaseCollisions warns about the refs in the response to the list
+// command, "<value> <name>", whose names differ only in case, if the local
+// repository is on a case-insensitive filesystem. Git only asks for the refs
+// whose objects it doesn't have yet, so checkFetchCaseCollisions doesn't see
+// every collision.
+func warnRefCaseCollisions(lines []string) {
+	names := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			names = append(names, line[i+1:])
+		}
+	}
+	collisions := refCaseCollisions(names)
+	if len(collisions) == 0 || !localIgnoresCase() {
+		return
+	}
+	Warnf("warning: the remote has refs whose names differ only in case, which the case-insensitive filesystem of the local repository can't keep apart:\n%s\nfetch them separately with refspecs which give them different local names\n", describeCollisions(collisions))
+}
+
+// checkFetchCaseCollisions fails a fetch of refs whose names differ only in
+// case if the local repository is on a case-insensitive filesystem, since git
+// would store them in the same file and lose one of them.
+func checkFetchCaseCollisions(fetchSpecs [][]string) error {
+	names := make([]string, 0, len(fetchSpecs))
+	for _, fetch := range fetchSpecs {
+		if len(fetch) == 2 {
+			names = append(names, fetch[1])
+		}
+	}
+	collisions := refCaseCollisions(names)
+	if len(collisions) == 0 || !localIgnoresCase() {
+		return nil
+	}
+	return errors.Errorf("refusing to fetch refs whose names differ only in case into a repository on a case-insensitive filesystem:\n%s\nfetch them separately with refspecs which give them different local names", describeCollisions(collisions))
+}
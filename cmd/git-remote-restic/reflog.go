@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/pkg/errors"
+)
+
+// refLogPath is the location of the ref transaction log in the stored
+// repository. Since every snapshot contains the complete log, it survives the
+// removal of intermediate snapshots by restic forget.
+const refLogPath = "restic-reflog"
+
+// RefUpdate is a single entry in the ref transaction log.
+type RefUpdate struct {
+	Old  plumbing.Hash
+	New  plumbing.Hash
+	Name plumbing.ReferenceName
+	Time time.Time
+	// Who identifies the user and host which pushed the update.
+	Who string
+}
+
+// String formats the RefUpdate as a line in the log, without the trailing
+// newline.
+func (u RefUpdate) String() string {
+	return fmt.Sprintf("%s %s %s %d %s", u.Old, u.New, u.Name, u.Time.Unix(), u.Who)
+}
+
+func parseRefUpdate(line string) (RefUpdate, error) {
+	fields := strings.SplitN(line, " ", 5)
+	if len(fields) != 5 {
+		return RefUpdate{}, errors.Errorf("invalid ref log entry %#v", line)
+	}
+	timestamp, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return RefUpdate{}, errors.Wrapf(err, "invalid ref log entry %#v", line)
+	}
+	return RefUpdate{
+		Old:  plumbing.NewHash(fields[0]),
+		New:  plumbing.NewHash(fields[1]),
+		Name: plumbing.ReferenceName(fields[2]),
+		Time: time.Unix(timestamp, 0),
+		Who:  fields[4],
+	}, nil
+}
+
+// readRefLog returns all of the entries in the ref transaction log, oldest
+// first.
+func readRefLog(fs billy.Basic) ([]RefUpdate, error) {
+	file, err := fs.Open(refLogPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var updates []RefUpdate
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		update, err := parseRefUpdate(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		updates = append(updates, update)
+	}
+	return updates, scanner.Err()
+}
+
+// appendRefLog adds the updates to the end of the ref transaction log.
+func appendRefLog(fs billy.Basic, updates []RefUpdate) error {
+	if len(updates) == 0 {
+		return nil
+	}
+	existing, err := readRefLog(fs)
+	if err != nil {
+		return err
+	}
+	return writeRefLog(fs, append(existing, updates...))
+}
+
+// writeRefLog replaces the ref transaction log with the provided entries.
+func writeRefLog(fs billy.Basic, updates []RefUpdate) error {
+	var sb strings.Builder
+	for _, update := range updates {
+		sb.WriteString(update.String())
+		sb.WriteString("\n")
+	}
+	return billyutil.WriteFile(fs, refLogPath, []byte(sb.String()), 0666)
+}
+
+// snapshotRefs returns the current value of each of the named refs, using
+// plumbing.ZeroHash for refs which don't exist.
+func snapshotRefs(repo *git.Repository, names []plumbing.ReferenceName) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	values := make(map[plumbing.ReferenceName]plumbing.Hash, len(names))
+	for _, name := range names {
+		ref, err := repo.Reference(name, true)
+		if err == plumbing.ErrReferenceNotFound {
+			values[name] = plumbing.ZeroHash
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		values[name] = ref.Hash()
+	}
+	return values, nil
+}
+
+// allRefs returns the value of every ref in the repository which points
+// directly to an object.
+func allRefs(repo *git.Repository) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[plumbing.ReferenceName]plumbing.Hash)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			values[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return values, err
+}
+
+// diffRefs returns a RefUpdate for each ref which changed between before and
+// after.
+func diffRefs(before, after map[plumbing.ReferenceName]plumbing.Hash) []RefUpdate {
+	now := time.Now()
+	who := pusherName()
+	var updates []RefUpdate
+	for name, old := range before {
+		if after[name] == old {
+			continue
+		}
+		updates = append(updates, RefUpdate{
+			Old:  old,
+			New:  after[name],
+			Name: name,
+			Time: now,
+			Who:  who,
+		})
+	}
+	for name, new := range after {
+		if _, ok := before[name]; ok || new.IsZero() {
+			continue
+		}
+		updates = append(updates, RefUpdate{
+			Old:  plumbing.ZeroHash,
+			New:  new,
+			Name: name,
+			Time: now,
+			Who:  who,
+		})
+	}
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Name < updates[j].Name
+	})
+	return updates
+}
+
+// printRefUpdates describes each of the updates on stdout, in a format
+// similar to git push.
+func printRefUpdates(updates []RefUpdate) {
+	for _, update := range updates {
+		switch {
+		case update.Old.IsZero():
+			fmt.Printf(" * [new]       %s -> %s\n", update.New.String()[:7], update.Name.Short())
+		case update.New.IsZero():
+			fmt.Printf(" - [deleted]   %s\n", update.Name.Short())
+		default:
+			fmt.Printf("   %s..%s  %s\n", update.Old.String()[:7], update.New.String()[:7], update.Name.Short())
+		}
+	}
+}
+
+func pusherName() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, _ := os.Hostname()
+	return name + "@" + host
+}
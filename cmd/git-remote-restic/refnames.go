@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// hideRefNames is set by restic.hideRefNames. When it is set, the refs of the
+// stored repository are kept in packed-refs instead of one file per ref, so
+// that branch and tag names don't appear as file names in the snapshot, for
+// example in the output of restic ls.
+var hideRefNames = false
+
+// refsDatabase is set by restic.refsDatabase. When it is set, the refs of the
+// stored repository are kept in a single file maintained by git-remote-restic,
+// see resticgit.Options.
+var refsDatabase = false
+
+// storedRefPaths are the locations of the refs in the stored repository.
+var storedRefPaths = []string{"HEAD", "packed-refs", resticgit.RefsDatabasePath, "refs"}
+
+// keptRefDirs are the directories which a bare repository always contains,
+// and which are not removed when they are empty.
+var keptRefDirs = map[string]bool{
+	"refs":       true,
+	"refs/heads": true,
+	"refs/tags":  true,
+}
+
+// shouldPackRefs reports whether packStoredRefs needs to run after a push to
+// the stored repository in fs. A refs database which is no longer enabled is
+// emptied by packStoredRefs, so that git can read the refs again.
+func shouldPackRefs(fs storedFilesystem) bool {
+	if hideRefNames || refsDatabase {
+		return true
+	}
+	_, err := fs.Stat(resticgit.RefsDatabasePath)
+	return err == nil
+}
+
+// packStoredRefs moves every loose ref of the stored repository in fs into
+// packed-refs, or into the refs database if it is enabled, and removes the
+// directories which held them. Symbolic refs other than HEAD can't be stored
+// in packed-refs, so without the refs database they remain loose.
+func packStoredRefs(stored *git.Repository, fs storedFilesystem) error {
+	var symbolic []*plumbing.Reference
+	if !refsDatabase {
+		refs, err := stored.Storer.IterReferences()
+		if err != nil {
+			return err
+		}
+		err = refs.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() == plumbing.SymbolicReference && ref.Name() != plumbing.HEAD {
+				symbolic = append(symbolic, ref)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// go-git would write symbolic refs into packed-refs in a form which
+	// git can't read, so they are set aside while the refs are packed.
+	for _, ref := range symbolic {
+		if err := stored.Storer.RemoveReference(ref.Name()); err != nil {
+			return err
+		}
+	}
+	if err := stored.Storer.PackRefs(); err != nil {
+		return err
+	}
+	for _, ref := range symbolic {
+		if hideRefNames {
+			Warnf("warning: symbolic ref %s can't be packed, its name remains visible\n", ref.Name())
+		}
+		if err := stored.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	_, err := removeEmptyDirs(fs, "refs")
+	return err
+}
+
+// removeEmptyDirs removes the directories below dir which contain no files,
+// except for those in keptRefDirs, and reports whether dir itself is empty.
+func removeEmptyDirs(fs storedFilesystem, dir string) (bool, error) {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	empty := true
+	for _, entry := range entries {
+		name := path.Join(dir, entry.Name())
+		if !entry.IsDir() {
+			empty = false
+			continue
+		}
+		childEmpty, err := removeEmptyDirs(fs, name)
+		if err != nil {
+			return false, err
+		}
+		if !childEmpty || keptRefDirs[name] {
+			empty = false
+			continue
+		}
+		if err := fs.Remove(name); err != nil {
+			return false, err
+		}
+	}
+	return empty && !strings.Contains(dir, "/") && !keptRefDirs[dir], nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// remoteEnvPrefix returns the prefix of the environment variables which only
+// apply to the named remote, such as RESTIC_ORIGIN_ for origin. Letters are
+// upper-cased, and every other character which can't appear in the name of a
+// variable becomes an underscore. It returns "" for remotes which are URLs,
+// since git names a remote after its URL when it isn't configured.
+func remoteEnvPrefix(remote string) string {
+	if remote == "" || strings.ContainsRune(remote, ':') {
+		return ""
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, remote)
+	return "RESTIC_" + name + "_"
+}
+
+// overriddenEnv holds the original values of the variables which were
+// replaced by applyRemoteEnvironment, or nil for variables which weren't set.
+var overriddenEnv = map[string]*string{}
+
+// applyRemoteEnvironment makes each variable named RESTIC_<REMOTE>_<NAME>
+// take the place of RESTIC_<NAME> while the named remote is used, for
+// example RESTIC_ORIGIN_PASSWORD for RESTIC_PASSWORD. The variables replaced
+// for a previous remote are restored first, since some commands use several
+// remotes.
+func applyRemoteEnvironment(remote string) {
+	for name, value := range overriddenEnv {
+		if value == nil {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, *value)
+		}
+	}
+	overriddenEnv = map[string]*string{}
+
+	if prefix := remoteEnvPrefix(remote); prefix != "" {
+		for _, entry := range os.Environ() {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) || parts[0] == prefix {
+				continue
+			}
+			overrideEnv("RESTIC_"+strings.TrimPrefix(parts[0], prefix), parts[1])
+		}
+	}
+
+	// Refresh the options which restic read from the environment at
+	// startup.
+	globalOptions.Repo = os.Getenv("RESTIC_REPOSITORY")
+	globalOptions.RepositoryFile = os.Getenv("RESTIC_REPOSITORY_FILE")
+	globalOptions.KeyHint = os.Getenv("RESTIC_KEY_HINT")
+	globalOptions.RootCertFilenames = nil
+	if os.Getenv("RESTIC_CACERT") != "" {
+		globalOptions.RootCertFilenames = strings.Split(os.Getenv("RESTIC_CACERT"), ",")
+	}
+	globalOptions.TLSClientCertKeyFilename = os.Getenv("RESTIC_TLS_CLIENT_CERT")
+}
+
+// overrideEnv sets the variable name to value until applyRemoteEnvironment is
+// called for the next remote, which restores its original value.
+func overrideEnv(name, value string) {
+	if _, ok := overriddenEnv[name]; !ok {
+		if original, ok := os.LookupEnv(name); ok {
+			overriddenEnv[name] = &original
+		} else {
+			overriddenEnv[name] = nil
+		}
+	}
+	os.Setenv(name, value)
+}
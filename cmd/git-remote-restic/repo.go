@@ -2,21 +2,29 @@ package main
 
 import (
 	"context"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
-	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/cache"
-	gitfs "github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/debug"
 	"github.com/restic/restic/lib/repository"
 	"github.com/restic/restic/lib/restic"
 )
 
 const lockRefreshInterval = 5 * time.Minute
 
+// lockRetryDelay and maxLockRetryDelay bound the time between attempts to
+// lock a repository which is already locked.
+const (
+	lockRetryDelay    = time.Second
+	maxLockRetryDelay = time.Minute
+)
+
 var globalLocks struct {
 	locks         []*restic.Lock
 	cancelRefresh chan struct{}
@@ -24,80 +32,340 @@ var globalLocks struct {
 	sync.Mutex
 }
 
+// ErrNoRepository indicates that the backend location exists, but does not
+// contain a restic repository.
+var ErrNoRepository = errors.New("no restic repository found")
+
 // Repository is a wrapper around a restic-backed git repository.
 type Repository struct {
-	restic restic.Repository
-	git    *git.Repository
-	fs     *resticfs.Filesystem
+	// location is the restic repository location which was opened.
+	location string
+	restic   restic.Repository
+	git      *git.Repository
+	fs       *resticfs.Filesystem
+	// snapshot is the snapshot which fs was opened from, or which will be
+	// opened by Filesystem, or nil for an empty filesystem.
+	snapshot *restic.ID
+	// indexLoaded is set once the index of the restic repository has been
+	// loaded. Loading the index is deferred until data needs to be read,
+	// since it is expensive for large repositories.
+	indexLoaded bool
+	// pending holds the information required to create the restic
+	// repository, if it doesn't exist yet.
+	pending *pendingRepository
 }
 
-// NewRepository creates a new Repository.
-func NewRepository(ctx context.Context, path string, password string, opts repository.Options) (*Repository, error) {
-	be, err := open(ctx, path, nil)
-	if err != nil {
+type pendingRepository struct {
+	path     string
+	password string
+	opts     repository.Options
+}
+
+// NewRepository creates a new Repository. If there is no restic repository at
+// the location and allowInit is true, the returned Repository will be empty
+// and the restic repository will be created by the Init method.
+func NewRepository(ctx context.Context, path string, password string, opts repository.Options, allowInit bool) (*Repository, error) {
+	be, err := open(ctx, path, extendedOptions)
+	if errors.Is(err, ErrNoRepository) && allowInit && agentKey == nil {
+		return &Repository{
+			location: path,
+			pending:  &pendingRepository{path, password, opts},
+		}, nil
+	} else if err != nil {
 		return nil, err
 	}
+	be = wrapPackJournal(wrapStallDetection(be), path)
+	if agentKey != nil {
+		be = agentKey.wrap(be)
+	}
 	resticRepo, err := repository.New(be, opts)
 	if err != nil {
 		return nil, err
 	}
-	if err = resticRepo.SearchKey(ctx, password, 0, ""); err != nil {
-		return nil, err
+	if agentKey != nil {
+		err = agentKey.open(ctx, resticRepo)
+	} else {
+		err = resticRepo.SearchKey(ctx, password, 0, globalOptions.KeyHint)
+		for attempt := 1; errors.Is(err, repository.ErrNoKeyFound); attempt++ {
+			var retry bool
+			password, retry, err = retryPassword(path, attempt)
+			if err != nil {
+				return nil, err
+			} else if !retry {
+				return nil, repository.ErrNoKeyFound
+			}
+			err = resticRepo.SearchKey(ctx, password, 0, globalOptions.KeyHint)
+		}
 	}
-
-	if err = resticRepo.LoadIndex(ctx, nil); err != nil {
+	if err != nil {
 		return nil, err
 	}
+	rememberMasterKey(path, resticRepo)
+	useResticCache(resticRepo)
+	if opts.Compression != repository.CompressionOff && resticRepo.Config().Version < 2 {
+		Warnf("warning: the repository uses format version %d, which doesn't support compression; run restic migrate upgrade_repo_v2 to enable it\n", resticRepo.Config().Version)
+	}
 
 	repo := &Repository{
-		restic: resticRepo,
+		location: path,
+		restic:   resticRepo,
 	}
 
 	return repo, err
 }
 
+// Exists returns false if the restic repository has not yet been created.
+func (r *Repository) Exists() bool {
+	return r.restic != nil
+}
+
+// Init creates the restic repository using the location and password that
+// were provided to NewRepository. It does nothing if the repository already
+// exists.
+func (r *Repository) Init(ctx context.Context) error {
+	if r.Exists() {
+		return nil
+	}
+	be, err := create(ctx, r.pending.path, extendedOptions)
+	if err != nil {
+		return errors.WithMessage(err, "unable to create repository")
+	}
+	be = wrapPackJournal(wrapStallDetection(be), r.pending.path)
+	resticRepo, err := repository.New(be, r.pending.opts)
+	if err != nil {
+		return err
+	}
+	err = resticRepo.Init(ctx, restic.StableRepoVersion, r.pending.password, nil)
+	if err != nil {
+		return errors.WithMessage(err, "unable to create repository")
+	}
+	Warnf("created restic repository %v at %s\n", resticRepo.Config().ID[:10], r.pending.path)
+	useResticCache(resticRepo)
+	r.restic = resticRepo
+	r.indexLoaded = true
+	r.pending = nil
+	// A new repository has no snapshots, so start with an empty filesystem.
+	return r.openFilesystem(ctx, nil)
+}
+
 // Git returns the *git.Repository stored in the restic.Repository. If no such
 // repository exists, one will be created if allowInit is true.
 func (r *Repository) Git(allowInit bool) (*git.Repository, error) {
 	if r.git != nil {
 		return r.git, nil
 	}
-	var err error
-	if r.fs == nil {
-		var parentSnapshot *restic.ID
-		f := restic.SnapshotFilter{}
-		sn, _, err := f.FindLatest(context.Background(), r.restic.Backend(), r.restic, "latest")
-		if err != nil && !errors.Is(err, restic.ErrNoSnapshotFound) {
+	fs, err := r.Filesystem()
+	if err != nil {
+		return nil, err
+	}
+	r.git, err = resticgit.OpenWithOptions(fs, resticgit.Options{
+		AllowInit:      allowInit,
+		PackIndexCache: packIndexCache,
+		RefsDatabase:   refsDatabase,
+	})
+	return r.git, err
+}
+
+// Filesystem returns the filesystem of the snapshot in use, opening the latest
+// snapshot if none has been selected.
+func (r *Repository) Filesystem() (*resticfs.Filesystem, error) {
+	if r.fs != nil {
+		return r.fs, nil
+	}
+	if !r.Exists() {
+		return nil, git.ErrRepositoryNotExists
+	}
+	parentSnapshot := r.snapshot
+	if parentSnapshot == nil {
+		var err error
+		parentSnapshot, err = r.LatestSnapshot(globalCtx)
+		if err != nil {
 			return nil, err
 		}
-		if err == nil {
-			parentSnapshot = sn.ID()
-		}
-		r.fs, err = resticfs.New(context.Background(), r.restic, parentSnapshot)
+	}
+	if err := r.openFilesystem(globalCtx, parentSnapshot); err != nil {
+		return nil, err
+	}
+	return r.fs, nil
+}
+
+// LoadIndex loads the index of the restic repository, which is required before
+// reading any data. It does nothing if the index has already been loaded.
+func (r *Repository) LoadIndex(ctx context.Context) error {
+	if r.indexLoaded || !r.Exists() {
+		return nil
+	}
+	defer startKeepalive("Loading index")()
+	if err := r.restic.LoadIndex(ctx, nil); err != nil {
+		return err
+	}
+	r.indexLoaded = true
+	return nil
+}
+
+// SnapshotsDigest returns a digest of the IDs of all snapshots in the
+// repository, which changes whenever a snapshot is added or removed. Unlike
+// LatestSnapshot, it only needs to list the snapshots, not load them.
+func (r *Repository) SnapshotsDigest(ctx context.Context) (restic.ID, error) {
+	var ids restic.IDs
+	err := r.restic.List(ctx, restic.SnapshotFile, func(id restic.ID, size int64) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return restic.ID{}, err
+	}
+	sort.Sort(ids)
+	buf := make([]byte, 0, len(ids)*len(restic.ID{}))
+	for _, id := range ids {
+		buf = append(buf, id[:]...)
+	}
+	return restic.Hash(buf), nil
+}
+
+// LatestSnapshot returns the ID of the most recent snapshot, or nil if the
+// repository has no snapshots. If restic.snapshotTag is set, only snapshots
+// with the tag are considered.
+func (r *Repository) LatestSnapshot(ctx context.Context) (*restic.ID, error) {
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sn, err := r.latestSnapshot(ctx, snapshots)
+	if err != nil || sn == nil {
+		return nil, err
+	}
+	return sn.ID(), nil
+}
+
+// Snapshots returns all of the snapshots in the repository, from newest to
+// oldest. Snapshots which can't be loaded are skipped with a warning.
+func (r *Repository) Snapshots(ctx context.Context) (restic.Snapshots, error) {
+	var snapshots restic.Snapshots
+	err := restic.ForAllSnapshots(ctx, r.restic.Backend(), r.restic, nil, func(id restic.ID, sn *restic.Snapshot, err error) error {
 		if err != nil {
-			return nil, err
+			Warnf("skipping snapshot %v: %v\n", id.Str(), err)
+			return nil
 		}
-		//r.fs.Logger = log.New(os.Stderr, "resticfs: ", 0)
+		snapshots = append(snapshots, sn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	pf := polyfill.New(r.fs)
-	s := gitfs.NewStorageWithOptions(pf, cache.NewObjectLRUDefault(), gitfs.Options{KeepDescriptors: true})
-	r.git, err = git.Open(s, nil)
-	if err == git.ErrRepositoryNotExists && allowInit {
-		r.git, err = git.Init(s, nil)
+	sortSnapshots(snapshots)
+	return snapshots, nil
+}
+
+// SelectSnapshot arranges for Filesystem to open the given snapshot instead of
+// the latest one. The snapshot is not loaded until it is needed.
+func (r *Repository) SelectSnapshot(id restic.ID) {
+	r.snapshot = &id
+}
+
+// UseIntactSnapshot selects the most recent snapshot whose data is fully
+// present in the repository for reading. If the latest snapshot is damaged,
+// for example because blobs were pruned or a push was interrupted, a warning is
+// printed and older snapshots are tried instead. Checking a snapshot loads
+// all of its trees, so the snapshot checked, which an earlier fetch found
+// intact, isn't checked again, and nothing is checked unless
+// restic.intactSnapshot is set.
+func (r *Repository) UseIntactSnapshot(ctx context.Context, checked *restic.ID) error {
+	if r.fs != nil || !r.Exists() {
+		return nil
 	}
-	return r.git, err
+	snapshots, err := r.Snapshots(ctx)
+	if err != nil {
+		return err
+	}
+	snapshots, err = r.candidateSnapshots(ctx, snapshots)
+	if err != nil {
+		return err
+	} else if len(snapshots) == 0 {
+		return r.openFilesystem(ctx, nil)
+	} else if !useIntactSnapshot {
+		return r.openFilesystem(ctx, snapshots[0].ID())
+	}
+	for i, sn := range snapshots {
+		err = r.openFilesystem(ctx, sn.ID())
+		if err == nil && (checked == nil || !sn.ID().Equal(*checked)) {
+			err = r.fs.Check()
+		}
+		if err == nil {
+			if i > 0 {
+				Warnf("using snapshot %v from %v instead\n", sn.ID().Str(), sn.Time.Format(TimeFormat))
+			}
+			return nil
+		}
+		Warnf("snapshot %v is damaged: %v\n", sn.ID().Str(), err)
+		r.fs = nil
+	}
+	return errors.New("no intact snapshot found in the repository")
+}
+
+func (r *Repository) openFilesystem(ctx context.Context, parentSnapshot *restic.ID) error {
+	if err := r.LoadIndex(ctx); err != nil {
+		return err
+	}
+	fs, err := resticfs.New(ctx, r.restic, parentSnapshot)
+	if err != nil {
+		return err
+	}
+	fs.Deterministic = normalizeRepo
+	fs.Exclude = isExcludedFile
+	fs.ChunkerWorkers = chunkerWorkers
+	fs.MaxStagedBytes = int64(maxStagedSize)
+	if tempDir != "" {
+		fs.Temporary = osfs.New(tempDir)
+	}
+	if compressTempFiles {
+		fs.TempCompressor = resticfs.ZstdCompressor{}
+	}
+	fs.Logger = resticfsLogger{}
+	r.fs = fs
+	r.snapshot = parentSnapshot
+	return nil
 }
 
 // Lock creates the listed type of lock on the repository, and uses a goroutine
-// to ensure that the lock doesn't expire.
+// to ensure that the lock doesn't expire. No lock is created, and the result
+// is nil, when the lock is skipped because of restic.noLock.
 func (r *Repository) Lock(exclusive bool) (*restic.Lock, error) {
-	ctx := context.Background()
+	if !r.Exists() {
+		return nil, ErrNoRepository
+	}
+	if globalOptions.NoLock && (!exclusive || noLockWrites) {
+		debug.Log("not locking the repository because of no-lock")
+		return nil, nil
+	}
+	ctx := globalCtx
 	lockFn := restic.NewLock
 	if exclusive {
 		lockFn = restic.NewExclusiveLock
 	}
 
 	lock, err := lockFn(ctx, r.restic)
+	// Like restic's --retry-lock, wait for other processes, such as a
+	// running backup, to release their locks.
+	deadline := time.Now().Add(globalOptions.RetryLock)
+	for attempt := 0; err != nil && restic.IsAlreadyLocked(err) && time.Now().Before(deadline); attempt++ {
+		if attempt == 0 {
+			Warnf("%v, waiting up to %v\n", err, globalOptions.RetryLock)
+		}
+		delay := lockRetryDelay << uint(attempt)
+		if delay > maxLockRetryDelay || delay <= 0 {
+			delay = maxLockRetryDelay
+		}
+		if remaining := time.Until(deadline); delay > remaining {
+			delay = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		lock, err = lockFn(ctx, r.restic)
+	}
 	if err != nil {
 		return nil, errors.WithMessage(err, "unable to create lock in backend")
 	}
@@ -140,6 +408,19 @@ func (r *Repository) Unlock(lock *restic.Lock) {
 	}
 }
 
+// releaseLocks removes every lock which is still held, for when the program
+// is interrupted before the locks are unlocked normally.
+func releaseLocks() {
+	globalLocks.Lock()
+	defer globalLocks.Unlock()
+	for _, lock := range globalLocks.locks {
+		if err := lock.Unlock(); err != nil {
+			Warnf("error while unlocking: %v\n", err)
+		}
+	}
+	globalLocks.locks = nil
+}
+
 func refreshLocks(wg *sync.WaitGroup, done <-chan struct{}) {
 	defer func() {
 		wg.Done()
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultCompression is the compression mode of the data written by the
+// remote helper unless another one is configured. Git already compresses
+// objects and packs, so compressing them again mostly costs CPU time.
+const defaultCompression = "off"
+
+// readCompression sets the compression mode of the data written to the
+// repository, like restic's --compression, to auto, off, or max. It is read
+// from the compression option in the remote URL or restic.option, or
+// otherwise from RESTIC_COMPRESSION, or from restic.<remote>.compression or
+// restic.compression. Compression requires a repository in format version 2,
+// which is what the remote helper creates.
+func readCompression() error {
+	value, source := extendedOptions["compression"], "compression"
+	if value == "" {
+		value, source = os.Getenv("RESTIC_COMPRESSION"), "RESTIC_COMPRESSION"
+	}
+	if value == "" {
+		var err error
+		if value, _, err = getRemoteConfig("compression"); err != nil {
+			return err
+		}
+		source = "restic.compression"
+	}
+	if value == "" {
+		value = defaultCompression
+	}
+	if err := globalOptions.Compression.Set(value); err != nil {
+		return errors.Errorf("%s: invalid compression mode %q, expected auto, off, or max", source, value)
+	}
+	return nil
+}
+
+// readPackSize sets the target size of the pack files written to the
+// repository, in MiB, like restic's --pack-size. Larger packs reduce the
+// number of files on backends which charge per object, such as cold storage.
+// It is read from the pack-size option in the remote URL or restic.option, or
+// otherwise from RESTIC_PACK_SIZE, or from restic.<remote>.packSize or
+// restic.packSize. Restic's default is used if none is set.
+func readPackSize() error {
+	value, source := extendedOptions["pack-size"], "pack-size"
+	if value == "" {
+		value, source = os.Getenv("RESTIC_PACK_SIZE"), "RESTIC_PACK_SIZE"
+	}
+	if value == "" {
+		var err error
+		if value, _, err = getRemoteConfig("packSize"); err != nil {
+			return err
+		}
+		source = "restic.packSize"
+	}
+	if value == "" {
+		globalOptions.PackSize = 0
+		return nil
+	}
+	size, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || size == 0 {
+		return errors.Errorf("%s: invalid pack size %q, expected MiB", source, value)
+	}
+	globalOptions.PackSize = uint(size)
+	return nil
+}
+
+// readNoExtraVerify reads whether the blobs written by pushes are decrypted
+// and checked again before they are uploaded, like restic's
+// --no-extra-verify. The check guards against corruption caused by faulty
+// hardware, but is costly on slow machines such as a NAS or a Raspberry Pi,
+// so it can be skipped by setting the no-extra-verify option in the remote
+// URL or restic.option, or restic.<remote>.noExtraVerify or
+// restic.noExtraVerify, to true.
+func readNoExtraVerify() error {
+	value, ok := extendedOptions["no-extra-verify"]
+	source := "no-extra-verify"
+	if !ok {
+		var err error
+		if value, ok, err = getRemoteConfig("noExtraVerify"); err != nil {
+			return err
+		}
+		source = "restic.noExtraVerify"
+	}
+	globalOptions.NoExtraVerify = false
+	if !ok {
+		return nil
+	}
+	switch strings.ToLower(value) {
+	case "", "true", "yes", "on", "1":
+		globalOptions.NoExtraVerify = true
+	case "false", "no", "off", "0":
+	default:
+		return errors.Errorf("%s: invalid value %q, expected true or false", source, value)
+	}
+	return nil
+}
+
+// archiveStorageClasses are the S3 storage classes whose objects can't be read
+// without restoring them first, which restic needs to do for the index and
+// snapshots of every push and fetch.
+var archiveStorageClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// readS3Options checks the options of the s3 backend, s3.storage-class,
+// s3.region, and s3.bucket-lookup, which are read from the remote URL or
+// restic.option like the other extended options, or otherwise from
+// restic.<remote>.s3StorageClass, restic.<remote>.s3Region, and
+// restic.<remote>.s3BucketLookup, or the same variables without the remote.
+// The storage class lets pushes write directly to a cheaper tier such as
+// STANDARD_IA or GLACIER_IR, and the region and bucket lookup are needed for
+// buckets which are pinned to a region or don't support virtual-hosted
+// addressing.
+func readS3Options() error {
+	if class := extendedOptions["s3.storage-class"]; archiveStorageClasses[strings.ToUpper(class)] {
+		return errors.Errorf("s3.storage-class: objects in the %s storage class must be restored before they can be read, use GLACIER_IR instead", class)
+	}
+	switch lookup := extendedOptions["s3.bucket-lookup"]; lookup {
+	case "", "auto", "dns", "path":
+	default:
+		return errors.Errorf("s3.bucket-lookup: invalid value %q, expected auto, dns, or path", lookup)
+	}
+	return nil
+}
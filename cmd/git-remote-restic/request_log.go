@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// logRequests is set by restic.logRequests to print every HTTP request which
+// the backend makes, which helps to diagnose throttling by S3-compatible
+// providers and other slow or failing servers.
+var logRequests = false
+
+// requestLogger is an http.RoundTripper which prints the method, the host and
+// path, the status, and the latency of every request to stderr. The query
+// string and credentials of the URL are left out, since they can contain
+// signatures and tokens, such as an Azure shared access signature.
+type requestLogger struct {
+	rt http.RoundTripper
+}
+
+// unloggedBackends are the backends of the schemes which don't use the HTTP
+// transport, so their requests can't be printed.
+var unloggedBackends = map[string]bool{
+	"local":  true,
+	"sftp":   true,
+	"rclone": true,
+}
+
+// logRequestsTransport wraps the transport of an HTTP backend in a
+// requestLogger, if restic.logRequests is set. The latency is measured until
+// the headers of the response are received, and doesn't include the time
+// spent waiting for the bandwidth limits. A warning is printed for the
+// backends which don't make HTTP requests.
+func logRequestsTransport(rt http.RoundTripper, scheme string) http.RoundTripper {
+	if !logRequests {
+		return rt
+	}
+	if unloggedBackends[scheme] {
+		Warnf("warning: restic.logRequests has no effect for the %s backend\n", scheme)
+		return rt
+	}
+	return requestLogger{rt}
+}
+
+func (l requestLogger) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := l.rt.RoundTrip(req)
+	latency := time.Since(start).Round(time.Millisecond)
+	target := req.URL.Host + req.URL.EscapedPath()
+	if err != nil {
+		Warnf("request: %s %s failed after %v: %v\n", req.Method, target, latency, err)
+		return res, err
+	}
+	Warnf("request: %s %s %d %v\n", req.Method, target, res.StatusCode, latency)
+	return res, err
+}
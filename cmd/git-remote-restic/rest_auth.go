@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/backend/rest"
+	"github.com/restic/restic/lib/debug"
+)
+
+// restCredentials holds the output of git credential fill for the REST server,
+// which is given to git credential approve or reject once it is known whether
+// the server accepted it, or is empty if the credentials didn't come from git.
+var restCredentials string
+
+// fillRESTCredentials asks git for the HTTP password of the REST server of cfg
+// when its URL names a user without a password, as in
+// rest:https://user@host/repo. Like for an HTTPS git remote, the credential
+// helpers are consulted first, then the user is prompted. The credentials use
+// the protocol and host of the server, so they are separate from the
+// repository password, and may be shared with git remotes on the same host.
+// Nothing is asked when restic.gitCredential is false.
+func fillRESTCredentials(cfg *rest.Config) error {
+	u := cfg.URL
+	if u == nil || u.User == nil {
+		return nil
+	} else if _, ok := u.User.Password(); ok {
+		return nil
+	}
+	if useGitCredential, err := getConfigBool("gitCredential", true); err != nil {
+		return err
+	} else if !useGitCredential {
+		return nil
+	}
+	input := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\nusername=%s\n",
+		u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"), u.User.Username())
+	cmd := exec.Command(gitBin(), "credential", "fill")
+	if nonInteractive {
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	}
+	cmd.Stdin = strings.NewReader(input + "\n")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return errors.Errorf("unable to get the password of %s@%s: %v", u.User.Username(), u.Host, err)
+	}
+	fields := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if parts := strings.SplitN(scanner.Text(), "=", 2); len(parts) == 2 {
+			fields[parts[0]] = parts[1]
+		}
+	}
+	if fields["password"] == "" {
+		return nil
+	}
+	username := fields["username"]
+	if username == "" {
+		username = u.User.Username()
+	}
+	withPassword := *u
+	withPassword.User = url.UserPassword(username, fields["password"])
+	cfg.URL = &withPassword
+	restCredentials = string(out)
+	return nil
+}
+
+// confirmRESTCredentials tells the credential helpers whether the REST server
+// accepted the credentials found by fillRESTCredentials, so that they store
+// them, or forget them if they were rejected.
+func confirmRESTCredentials(accepted bool) {
+	if restCredentials == "" {
+		return
+	}
+	action := "reject"
+	if accepted {
+		action = "approve"
+	}
+	cmd := exec.Command(gitBin(), "credential", action)
+	cmd.Stdin = strings.NewReader(restCredentials)
+	if err := cmd.Run(); err != nil {
+		debug.Log("git credential %s: %v", action, err)
+	}
+	restCredentials = ""
+}
+
+// isUnauthorized reports whether err is the response of a REST server which
+// rejected the credentials.
+func isUnauthorized(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "401 Unauthorized")
+}
@@ -17,7 +17,6 @@ import (
 	"github.com/restic/restic/lib/backend/local"
 	"github.com/restic/restic/lib/backend/location"
 	"github.com/restic/restic/lib/backend/logger"
-	"github.com/restic/restic/lib/backend/rclone"
 	"github.com/restic/restic/lib/backend/rest"
 	"github.com/restic/restic/lib/backend/s3"
 	"github.com/restic/restic/lib/backend/sema"
@@ -88,7 +87,7 @@ func init() {
 	backends.Register(b2.NewFactory())
 	backends.Register(gs.NewFactory())
 	backends.Register(local.NewFactory())
-	backends.Register(rclone.NewFactory())
+	backends.Register(newRcloneFactory())
 	backends.Register(rest.NewFactory())
 	backends.Register(s3.NewFactory())
 	backends.Register(sftp.NewFactory())
@@ -163,17 +162,36 @@ func Warnf(format string, args ...interface{}) {
 
 func parseConfig(loc location.Location, opts options.Options) (interface{}, error) {
 	cfg := loc.Config
+	if loc.Scheme == "s3" {
+		if err := applyAWSSessionToken(); err != nil {
+			return nil, err
+		}
+		if err := applyAWSProfile(); err != nil {
+			return nil, err
+		}
+	}
+	if loc.Scheme == "azure" {
+		if err := applyAzureCredentials(); err != nil {
+			return nil, err
+		}
+	}
 	if cfg, ok := cfg.(restic.ApplyEnvironmenter); ok {
 		cfg.ApplyEnvironment("")
 	}
 
 	// only apply options for a particular backend here
-	opts = opts.Extract(loc.Scheme)
+	opts = applyConnections(opts.Extract(loc.Scheme))
 	if err := opts.Apply(loc.Scheme, cfg); err != nil {
 		return nil, err
 	}
 
 	debug.Log("opening %v repository at %#v", loc.Scheme, cfg)
+	// The password is filled in after logging the configuration.
+	if cfg, ok := cfg.(*rest.Config); ok {
+		if err := fillRESTCredentials(cfg); err != nil {
+			return nil, err
+		}
+	}
 	return cfg, nil
 }
 
@@ -181,7 +199,11 @@ func parseConfig(loc location.Location, opts options.Options) (interface{}, erro
 func open(ctx context.Context, s string, opts options.Options) (restic.Backend, error) {
 	gopts := globalOptions
 	debug.Log("parsing location %v", location.StripPassword(gopts.backends, s))
-	loc, err := location.Parse(gopts.backends, s)
+	expanded, err := expandPreset(s)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := location.Parse(gopts.backends, expanded)
 	if err != nil {
 		return nil, errors.Fatalf("parsing repository location failed: %v", err)
 	}
@@ -197,6 +219,8 @@ func open(ctx context.Context, s string, opts options.Options) (restic.Backend,
 	if err != nil {
 		return nil, errors.Fatal(err.Error())
 	}
+	applyProxy(rt)
+	rt = logRequestsTransport(rt, loc.Scheme)
 
 	// wrap the transport so that the throughput via HTTP is limited
 	lim := limiter.NewStaticLimiter(gopts.Limits)
@@ -213,7 +237,7 @@ func open(ctx context.Context, s string, opts options.Options) (restic.Backend,
 	}
 
 	// wrap with debug logging and connection limiting
-	be = logger.New(sema.NewBackend(be))
+	be = logger.New(sema.NewBackend(trackBackend(be)))
 
 	// wrap backend if a test specified an inner hook
 	if gopts.backendInnerTestHook != nil {
@@ -225,7 +249,9 @@ func open(ctx context.Context, s string, opts options.Options) (restic.Backend,
 
 	// check if config is there
 	fi, err := be.Stat(ctx, restic.Handle{Type: restic.ConfigFile})
-	if err != nil {
+	if err != nil && be.IsNotExist(err) {
+		return nil, errors.Wrap(ErrNoRepository, location.StripPassword(gopts.backends, s))
+	} else if err != nil {
 		return nil, errors.Fatalf("unable to open config file: %v\nIs there a repository at the following location?\n%v", err, location.StripPassword(gopts.backends, s))
 	}
 
@@ -235,3 +261,45 @@ func open(ctx context.Context, s string, opts options.Options) (restic.Backend,
 
 	return be, nil
 }
+
+// Create the backend specified by URI.
+func create(ctx context.Context, s string, opts options.Options) (restic.Backend, error) {
+	gopts := globalOptions
+	debug.Log("parsing location %v", location.StripPassword(gopts.backends, s))
+	expanded, err := expandPreset(s)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := location.Parse(gopts.backends, expanded)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := parseConfig(loc, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rt, err := backend.Transport(gopts.TransportOptions)
+	if err != nil {
+		return nil, errors.Fatal(err.Error())
+	}
+	applyProxy(rt)
+	rt = logRequestsTransport(rt, loc.Scheme)
+
+	// wrap the transport so that the throughput via HTTP is limited
+	lim := limiter.NewStaticLimiter(gopts.Limits)
+	rt = lim.Transport(rt)
+
+	factory := gopts.backends.Lookup(loc.Scheme)
+	if factory == nil {
+		return nil, errors.Fatalf("invalid backend: %q", loc.Scheme)
+	}
+
+	be, err := factory.Create(ctx, cfg, rt, lim)
+	if err != nil {
+		return nil, err
+	}
+
+	return logger.New(sema.NewBackend(trackBackend(be))), nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// cmdShow prints a single file of the stored repository, given like git show
+// as <rev>:<path>, from the latest or the given snapshot. Only the objects
+// needed to find the file are read from restic, so a remote can be inspected
+// without cloning it.
+func cmdShow(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.Errorf("Usage: %s --show remote [snapshot] rev:path", os.Args[0])
+	}
+	snapshotID := "latest"
+	if len(args) == 2 {
+		snapshotID = args[0]
+	}
+	parts := strings.SplitN(args[len(args)-1], ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return errors.Errorf("%s is not of the form rev:path", args[len(args)-1])
+	}
+	rev, path := parts[0], strings.TrimPrefix(parts[1], "/")
+	if rev == "" {
+		rev = "HEAD"
+	}
+
+	lock, err := sharedRepo.Lock(false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	sn, err := findSnapshot(snapshotID)
+	if err != nil {
+		return err
+	}
+	fs, err := resticfs.New(globalCtx, sharedRepo.restic, sn.ID())
+	if err != nil {
+		return err
+	}
+	stored, err := resticgit.Open(fs, false)
+	if err != nil {
+		return err
+	}
+	hash, err := stored.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return errors.WithMessagef(err, "unable to resolve %s", rev)
+	}
+	commit, err := stored.CommitObject(*hash)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	file, err := tree.File(path)
+	if err == object.ErrFileNotFound {
+		return errors.Errorf("path %s does not exist in %s", path, rev)
+	} else if err != nil {
+		return err
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(os.Stdout, reader)
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/restic/restic/lib/debug"
+	"github.com/restic/restic/lib/restic"
+)
+
+// openBackends holds every backend opened by open or create, so that they can
+// be closed when the program exits.
+var openBackends struct {
+	list []restic.Backend
+	sync.Mutex
+}
+
+// trackBackend records be so that closeBackends closes it.
+func trackBackend(be restic.Backend) restic.Backend {
+	openBackends.Lock()
+	openBackends.list = append(openBackends.list, be)
+	openBackends.Unlock()
+	return be
+}
+
+// closeBackends closes every open backend. Closing the rclone backend closes
+// the connection to the rclone child process and kills its process group if
+// it doesn't exit promptly, so that it doesn't continue uploading after a push
+// is aborted.
+func closeBackends() {
+	openBackends.Lock()
+	defer openBackends.Unlock()
+	for _, be := range openBackends.list {
+		if err := be.Close(); err != nil {
+			debug.Log("unable to close backend: %v", err)
+		}
+	}
+	openBackends.list = nil
+}
+
+// cancelOnSignal cancels globalCtx when the program is interrupted or
+// terminated, for example when git is killed or the user presses Ctrl-C
+// during a push. The transfers in progress are aborted, the locks are
+// removed, and the backends are closed before exiting.
+func cancelOnSignal() {
+	ctx, cancel := context.WithCancel(context.Background())
+	globalCtx = ctx
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-signals
+		debug.Log("received %v, cancelling", sig)
+		cancel()
+		releaseLocks()
+		closeBackends()
+		code := 1
+		if sig, ok := sig.(syscall.Signal); ok {
+			code = 128 + int(sig)
+		}
+		os.Exit(code)
+	}()
+}
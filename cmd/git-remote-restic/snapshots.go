@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/restic/restic/lib/restic"
+)
+
+// snapshotTag is set by restic.snapshotTag. When it is set, only snapshots
+// with the tag are considered as the state of the remote, and the snapshots
+// created by pushes are given the tag.
+var snapshotTag = ""
+
+// useIntactSnapshot is set by restic.intactSnapshot, which is true unless it
+// is configured. When it is set, the latest snapshot is checked before refs
+// are fetched from it, and an older one is used if it is damaged.
+var useIntactSnapshot = true
+
+// readSnapshotSelection reads restic.snapshotTag and restic.intactSnapshot,
+// which select the snapshot which the refs of the remote are read from.
+func readSnapshotSelection() error {
+	var err error
+	if snapshotTag, _, err = getRemoteConfig("snapshotTag"); err != nil {
+		return err
+	}
+	intactSnapshot, ok, err := getRemoteConfig("intactSnapshot", "--bool")
+	if err != nil {
+		return err
+	}
+	useIntactSnapshot = !ok || intactSnapshot == "true"
+	return nil
+}
+
+// snapshotTags returns the tags of the snapshots created by pushes.
+func snapshotTags() []string {
+	if snapshotTag == "" {
+		return []string{}
+	}
+	return []string{snapshotTag}
+}
+
+// sortSnapshots sorts snapshots from newest to oldest. Snapshots created at
+// the same time are ordered by ID, so that the same snapshot is always chosen
+// as the latest one.
+func sortSnapshots(snapshots restic.Snapshots) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.After(b.Time)
+		}
+		return a.ID().String() > b.ID().String()
+	})
+}
+
+// filterSnapshotTag returns the snapshots with the tag snapshotTag, or all of
+// them if it isn't set.
+func filterSnapshotTag(snapshots restic.Snapshots) restic.Snapshots {
+	if snapshotTag == "" {
+		return snapshots
+	}
+	var tagged restic.Snapshots
+	for _, sn := range snapshots {
+		if sn.HasTags([]string{snapshotTag}) {
+			tagged = append(tagged, sn)
+		}
+	}
+	return tagged
+}
+
+// latestSnapshot returns the most recent of snapshots, which are sorted by
+// sortSnapshots, with the tag snapshotTag if it is set, or nil if there is
+// none.
+func (r *Repository) latestSnapshot(ctx context.Context, snapshots restic.Snapshots) (*restic.Snapshot, error) {
+	candidates, err := r.candidateSnapshots(ctx, snapshots)
+	if err != nil || len(candidates) == 0 {
+		return nil, err
+	}
+	return candidates[0], nil
+}
+
+// candidateSnapshots returns the snapshots which may hold the state of the
+// remote, newest first, which are the ones with the tag snapshotTag if it is
+// set.
+//
+// Snapshots made by restic backup of a copy of the repository, for example of
+// the bare repository on a server, are candidates just like the ones made by
+// the remote helper, and whichever is newer silently becomes the state of the
+// remote. A warning names the latest candidate when both kinds are present.
+func (r *Repository) candidateSnapshots(ctx context.Context, snapshots restic.Snapshots) (restic.Snapshots, error) {
+	candidates := filterSnapshotTag(snapshots)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	latest := candidates[0]
+
+	// Only the newest snapshot of each host and path is inspected, since
+	// loading the tree of every snapshot would be slow.
+	seen := map[string]bool{}
+	var helper, other *restic.Snapshot
+	for _, sn := range candidates {
+		source := sn.Hostname + "\x00" + strings.Join(sn.Paths, "\x00")
+		if seen[source] {
+			continue
+		}
+		seen[source] = true
+		if len(seen) == 1 {
+			continue
+		}
+		if len(seen) == 2 {
+			// There is more than one source, so the latest snapshot
+			// needs to be inspected too.
+			if err := r.classifySnapshot(ctx, latest, &helper, &other); err != nil {
+				return nil, err
+			}
+		}
+		if err := r.classifySnapshot(ctx, sn, &helper, &other); err != nil {
+			return nil, err
+		}
+		if helper != nil && other != nil {
+			break
+		}
+	}
+	if helper != nil && other != nil {
+		kind := "restic backup"
+		if latest == helper {
+			kind = "git-remote-restic"
+		}
+		Warnf("warning: the repository contains snapshots made by both git-remote-restic and restic backup; using %s snapshot %v of %s from %v, set restic.snapshotTag to choose\n",
+			kind, latest.ID().Str(), strings.Join(latest.Paths, ", "), latest.Time.Format(TimeFormat))
+	}
+	return candidates, nil
+}
+
+// classifySnapshot stores sn in helper if it was made by the remote helper, or
+// in other otherwise, unless they are already set. The snapshots made by the
+// remote helper hold the git directory at their root, where restic backup
+// stores the full path of the directory which was backed up.
+func (r *Repository) classifySnapshot(ctx context.Context, sn *restic.Snapshot, helper, other **restic.Snapshot) error {
+	if sn.Tree == nil {
+		return nil
+	}
+	if err := r.LoadIndex(ctx); err != nil {
+		return err
+	}
+	tree, err := restic.LoadTree(ctx, r.restic, *sn.Tree)
+	if err != nil {
+		Warnf("skipping snapshot %v: %v\n", sn.ID().Str(), err)
+		return nil
+	}
+	// The nodes of the trees written by resticfs aren't sorted, so
+	// tree.Find, which does a binary search, can't be used.
+	hasHead := false
+	for _, node := range tree.Nodes {
+		if node.Name == "HEAD" {
+			hasHead = true
+			break
+		}
+	}
+	if hasHead {
+		if *helper == nil {
+			*helper = sn
+		}
+	} else if *other == nil {
+		*other = sn
+	}
+	return nil
+}
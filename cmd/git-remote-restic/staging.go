@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// stagingCacheDir is the directory in the user's cache directory which holds
+// the objects of fetches which have not completed yet.
+const stagingCacheDir = "git-remote-restic/staging"
+
+// openStagingRepo opens the staging repository for the restic repository at
+// location, creating it if needed, and returns it with its path. Fetched
+// objects are copied into the staging repository first, where they survive an
+// interrupted fetch, or a clone whose directory git removed. The staging
+// repository borrows the objects of the local repository through its
+// alternates, so that objects which are already present are not copied.
+func openStagingRepo(location string) (*git.Repository, string, error) {
+	out, err := exec.Command(gitBin(), "rev-parse", "--git-path", "objects").Output()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "unable to locate local objects")
+	}
+	objects, err := filepath.Abs(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, "", err
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return nil, "", err
+	}
+	// The staged objects build on the objects of the local repository, so
+	// each local repository uses its own staging repository.
+	key := restic.Hash([]byte(location + "\n" + objects)).String()
+	dir := filepath.Join(base, filepath.FromSlash(stagingCacheDir), key)
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, true)
+	}
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "unable to open staging repository %s", dir)
+	}
+	// Remove packs which were being written when a previous fetch was
+	// interrupted.
+	partial, _ := filepath.Glob(filepath.Join(dir, "objects", "pack", "tmp_pack_*"))
+	for _, path := range partial {
+		os.Remove(path)
+	}
+
+	alternates := filepath.Join(dir, "objects", "info", "alternates")
+	if err := os.MkdirAll(filepath.Dir(alternates), 0755); err != nil {
+		return nil, "", err
+	}
+	if err := ioutil.WriteFile(alternates, []byte(objects+"\n"), 0644); err != nil {
+		return nil, "", err
+	}
+	return repo, dir, nil
+}
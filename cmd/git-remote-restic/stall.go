@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// stallCheckInterval is how often the throughput of a transfer is measured.
+const stallCheckInterval = time.Second
+
+// lowSpeedLimit and lowSpeedTime configure stall detection, like git's
+// http.lowSpeedLimit and http.lowSpeedTime: a transfer is aborted when it
+// moves fewer than lowSpeedLimit bytes per second for lowSpeedTime. Stall
+// detection is disabled unless both are set.
+var lowSpeedLimit = 0
+var lowSpeedTime = 0
+
+// ErrTransferStalled indicates that a backend transfer was aborted because it
+// was too slow.
+var ErrTransferStalled = errors.New("transfer stalled")
+
+// readLowSpeedConfig sets lowSpeedLimit and lowSpeedTime from
+// restic.lowSpeedLimit and restic.lowSpeedTime, falling back to git's
+// GIT_HTTP_LOW_SPEED_LIMIT and GIT_HTTP_LOW_SPEED_TIME, and then to
+// http.lowSpeedLimit and http.lowSpeedTime.
+func readLowSpeedConfig() error {
+	var err error
+	if lowSpeedLimit, err = readLowSpeedSetting("lowSpeedLimit", "GIT_HTTP_LOW_SPEED_LIMIT"); err != nil {
+		return err
+	}
+	lowSpeedTime, err = readLowSpeedSetting("lowSpeedTime", "GIT_HTTP_LOW_SPEED_TIME")
+	return err
+}
+
+func readLowSpeedSetting(name, env string) (int, error) {
+	value, ok, err := readGitConfig("--int", "--get", "restic."+name)
+	if err != nil {
+		return 0, err
+	} else if !ok {
+		value, ok = os.LookupEnv(env)
+	}
+	if !ok {
+		value, ok, err = readGitConfig("--int", "--get", "http."+name)
+		if err != nil || !ok {
+			return 0, err
+		}
+	}
+	return strconv.Atoi(value)
+}
+
+// stallBackend aborts transfers of file contents which are slower than
+// lowSpeedLimit for lowSpeedTime, so that a push or fetch over a failing
+// connection fails instead of appearing to hang.
+type stallBackend struct {
+	restic.Backend
+	limit    int64
+	period   time.Duration
+	interval time.Duration
+}
+
+// wrapStallDetection adds stall detection to be, if it is enabled.
+func wrapStallDetection(be restic.Backend) restic.Backend {
+	if lowSpeedLimit <= 0 || lowSpeedTime <= 0 {
+		return be
+	}
+	return &stallBackend{
+		Backend:  be,
+		limit:    int64(lowSpeedLimit),
+		period:   time.Duration(lowSpeedTime) * time.Second,
+		interval: stallCheckInterval,
+	}
+}
+
+func (be *stallBackend) Unwrap() restic.Backend {
+	return be.Backend
+}
+
+func (be *stallBackend) Save(ctx context.Context, h restic.Handle, rd restic.RewindReader) error {
+	ctx, mon := be.monitor(ctx)
+	defer mon.stop()
+	err := be.Backend.Save(ctx, h, &stallRewindReader{RewindReader: rd, mon: mon})
+	return mon.result(h, err)
+}
+
+func (be *stallBackend) Load(ctx context.Context, h restic.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	ctx, mon := be.monitor(ctx)
+	defer mon.stop()
+	err := be.Backend.Load(ctx, h, length, offset, func(rd io.Reader) error {
+		return fn(&stallReader{Reader: rd, mon: mon})
+	})
+	return mon.result(h, err)
+}
+
+// monitor starts measuring the throughput of a transfer, and returns a
+// context which is canceled when the transfer stalls.
+func (be *stallBackend) monitor(ctx context.Context) (context.Context, *transferMonitor) {
+	ctx, cancel := context.WithCancel(ctx)
+	mon := &transferMonitor{
+		limit:    be.limit,
+		period:   be.period,
+		interval: be.interval,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go mon.run()
+	return ctx, mon
+}
+
+type transferMonitor struct {
+	limit    int64
+	period   time.Duration
+	interval time.Duration
+	cancel   context.CancelFunc
+	done     chan struct{}
+	bytes    int64
+	stalled  int32
+}
+
+func (m *transferMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	var last int64
+	var slowSince time.Time
+	for {
+		select {
+		case <-m.done:
+			return
+		case now := <-ticker.C:
+			current := atomic.LoadInt64(&m.bytes)
+			speed := float64(current-last) / m.interval.Seconds()
+			last = current
+			if speed >= float64(m.limit) {
+				slowSince = time.Time{}
+				continue
+			}
+			if slowSince.IsZero() {
+				slowSince = now.Add(-m.interval)
+			}
+			if now.Sub(slowSince) >= m.period {
+				atomic.StoreInt32(&m.stalled, 1)
+				m.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (m *transferMonitor) add(n int) {
+	atomic.AddInt64(&m.bytes, int64(n))
+}
+
+func (m *transferMonitor) stop() {
+	close(m.done)
+	m.cancel()
+}
+
+// result replaces the error of a transfer which was aborted by the monitor.
+func (m *transferMonitor) result(h restic.Handle, err error) error {
+	if err != nil && atomic.LoadInt32(&m.stalled) != 0 {
+		return errors.Wrapf(ErrTransferStalled, "%v: less than %d bytes/s for %v", h, m.limit, m.period)
+	}
+	return err
+}
+
+type stallReader struct {
+	io.Reader
+	mon *transferMonitor
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.mon.add(n)
+	return n, err
+}
+
+type stallRewindReader struct {
+	restic.RewindReader
+	mon *transferMonitor
+}
+
+func (r *stallRewindReader) Read(p []byte) (int, error) {
+	n, err := r.RewindReader.Read(p)
+	r.mon.add(n)
+	return n, err
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+	"github.com/stretchr/testify/require"
+)
+
+// phasedReader produces no data for each slow phase and then data at well
+// above the limit for each fast phase, alternating between them, starting
+// with a slow phase. It fails with the error of ctx if it is canceled.
+type phasedReader struct {
+	ctx    context.Context
+	phases []time.Duration
+	start  time.Time
+}
+
+func (r *phasedReader) Read(p []byte) (int, error) {
+	if r.start.IsZero() {
+		r.start = time.Now()
+	}
+	elapsed := time.Since(r.start)
+	for i, phase := range r.phases {
+		if elapsed >= phase {
+			elapsed -= phase
+			continue
+		}
+		if i%2 == 0 {
+			select {
+			case <-r.ctx.Done():
+				return 0, r.ctx.Err()
+			case <-time.After(phase - elapsed):
+				return 0, nil
+			}
+		}
+		time.Sleep(time.Millisecond)
+		if len(p) > 100 {
+			p = p[:100]
+		}
+		return len(p), nil
+	}
+	return 0, io.EOF
+}
+
+// phasedBackend loads and saves files using a phasedReader.
+type phasedBackend struct {
+	restic.Backend
+	phases []time.Duration
+}
+
+func (be *phasedBackend) Load(ctx context.Context, h restic.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
+	return fn(&phasedReader{ctx: ctx, phases: be.phases})
+}
+
+func (be *phasedBackend) Save(ctx context.Context, h restic.Handle, rd restic.RewindReader) error {
+	_, err := io.Copy(ioutil.Discard, io.MultiReader(rd, &phasedReader{ctx: ctx, phases: be.phases}))
+	return err
+}
+
+func newTestStallBackend(phases ...time.Duration) *stallBackend {
+	return &stallBackend{
+		Backend:  &phasedBackend{phases: phases},
+		limit:    1000,
+		period:   100 * time.Millisecond,
+		interval: 10 * time.Millisecond,
+	}
+}
+
+func loadAll(be restic.Backend) error {
+	h := restic.Handle{Type: restic.PackFile, Name: "pack"}
+	return be.Load(context.Background(), h, 0, 0, func(rd io.Reader) error {
+		_, err := io.Copy(ioutil.Discard, rd)
+		return err
+	})
+}
+
+func TestStallDetectionAbortsStalledLoad(t *testing.T) {
+	be := newTestStallBackend(10*time.Millisecond, 20*time.Millisecond, time.Minute)
+	start := time.Now()
+	err := loadAll(be)
+	require.Equal(t, ErrTransferStalled, errors.Cause(err))
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestStallDetectionAbortsStalledSave(t *testing.T) {
+	be := newTestStallBackend(time.Minute)
+	h := restic.Handle{Type: restic.PackFile, Name: "pack"}
+	err := be.Save(context.Background(), h, restic.NewByteReader([]byte("data"), nil))
+	require.Equal(t, ErrTransferStalled, errors.Cause(err))
+}
+
+func TestStallDetectionAllowsRecovery(t *testing.T) {
+	// Each slow phase is shorter than the period, but together they are
+	// longer, so the transfer must only be aborted for a continuous stall.
+	be := newTestStallBackend(
+		60*time.Millisecond, 30*time.Millisecond,
+		60*time.Millisecond, 30*time.Millisecond,
+	)
+	require.NoError(t, loadAll(be))
+}
+
+func TestStallDetectionKeepsOtherErrors(t *testing.T) {
+	be := newTestStallBackend()
+	h := restic.Handle{Type: restic.PackFile, Name: "pack"}
+	failure := errors.New("failure")
+	err := be.Load(context.Background(), h, 0, 0, func(rd io.Reader) error {
+		return failure
+	})
+	require.Equal(t, failure, err)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/pkg/errors"
+)
+
+// recordedRef is the ref in a stored submodule repository which points to the
+// commit recorded for the submodule by the HEAD of its superproject. It keeps
+// the recorded commit reachable even when no branch of the submodule contains
+// it.
+const recordedRef = "refs/superproject/recorded"
+
+// backupRefSpecs are pushed when no refspecs are provided. Every branch and tag
+// is copied, replacing the stored value.
+var backupRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// submodule is an initialized submodule of the local repository.
+type submodule struct {
+	// displayPath is the path of the submodule relative to the current
+	// directory.
+	displayPath string
+	// gitDir is the absolute path of the local git directory.
+	gitDir string
+	// recorded is the commit recorded for the submodule by its superproject.
+	recorded string
+	// storedPath is the location of the stored repository in the snapshot.
+	// Like git, the repository of a submodule is stored in the "modules"
+	// directory of its superproject's repository.
+	storedPath string
+}
+
+// cmdPushRecursive pushes the local repository and all of its initialized
+// submodules, recursively, into a single new snapshot. The arguments are
+// refspecs for the superproject; submodules always use backupRefSpecs.
+func cmdPushRecursive(args []string) error {
+	refSpecs := backupRefSpecs
+	if len(args) > 0 {
+		refSpecs = make([]config.RefSpec, len(args))
+		for i, arg := range args {
+			refSpecs[i] = config.RefSpec(arg)
+			if err := refSpecs[i].Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := readPushGPGSign(); err != nil {
+		return err
+	}
+	submodules, err := listSubmodules()
+	if err != nil {
+		return err
+	}
+
+	lock, err := sharedRepo.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+	fs, err := sharedRepo.Filesystem()
+	if err != nil {
+		return err
+	}
+	fs.StartNewSnapshot()
+
+	if syncNotes {
+		refSpecs = append(append([]config.RefSpec{}, refSpecs...), notesRefSpec)
+	}
+	failed := 0
+	updates, ok := pushStoredRepository(fs, localGitPath, refSpecs)
+	if !ok {
+		failed++
+	}
+	stored := []storedFilesystem{fs}
+	for _, sm := range submodules {
+		fmt.Printf("Pushing submodule %s\n", sm.displayPath)
+		refSpecs := backupRefSpecs
+		if sm.recorded != "" {
+			tempRef, err := createTempRef(sm.gitDir, sm.recorded)
+			if err != nil {
+				Warnf("warning: unable to push commit %s recorded for %s: %v\n", sm.recorded, sm.displayPath, err)
+			} else {
+				defer deleteTempRef(sm.gitDir, tempRef)
+				refSpecs = append(refSpecs, config.RefSpec("+"+tempRef+":"+recordedRef))
+			}
+		}
+		smFS := chroot.New(polyfill.New(fs), sm.storedPath)
+		if _, ok := pushStoredRepository(smFS, sm.gitDir, refSpecs); !ok {
+			failed++
+		}
+		stored = append(stored, smFS)
+	}
+	for _, repoFS := range stored {
+		if _, err := repoFS.Stat(""); os.IsNotExist(err) {
+			// The push failed before the repository was created.
+			continue
+		}
+		if err := validateRepositoryLayout(repoFS); err != nil {
+			return err
+		}
+	}
+
+	if signPushes {
+		if err := writePushCert(fs, sharedRepo.location, updates); err != nil {
+			return err
+		}
+	}
+	// The hook runs in the superproject, so only its ref updates are given
+	// to it; the changed files of the submodules are listed as well.
+	fs.PreCommit = preCommitFunc(updates)
+	defer func() {
+		fs.PreCommit = nil
+	}()
+	id, err := fs.CommitSnapshot(localGitPath, snapshotTags())
+	if err == resticfs.ErrNoChanges {
+		Warnf("Everything up-to-date\n")
+	} else if err != nil {
+		return err
+	} else {
+		fmt.Printf("created snapshot %v\n", id.Str())
+		printDedupStats(os.Stdout, fs)
+	}
+	if failed > 0 {
+		return errors.Errorf("could not push %d of %d repositories", failed, len(submodules)+1)
+	}
+	return nil
+}
+
+// pushStoredRepository pushes the refs of the local repository at gitDir into
+// the repository stored in fs, printing the changes. Errors are printed. It
+// returns the updates which were made, and whether every ref was pushed.
+func pushStoredRepository(fs storedFilesystem, gitDir string, refSpecs []config.RefSpec) ([]RefUpdate, bool) {
+	var updates []RefUpdate
+	err := func() error {
+		repo, err := resticgit.OpenWithOptions(fs, resticgit.Options{
+			AllowInit:    true,
+			RefsDatabase: refsDatabase,
+		})
+		if err != nil {
+			return err
+		}
+		refSpecs, refused, err := checkProtectedRefs(repo, gitDir, refSpecs)
+		if err != nil {
+			return err
+		}
+		for dst, err := range refused {
+			Warnf("error: %s: %v\n", dst, err)
+		}
+		if len(refused) > 0 {
+			return errors.Errorf("refused to update %d protected refs", len(refused))
+		}
+		before, err := allRefs(repo)
+		if err != nil {
+			return err
+		}
+		results, err := resticgit.Push(globalCtx, repo, gitDir, refSpecs, progressFunc())
+		if err != nil {
+			return err
+		}
+		for dst, err := range results {
+			if err != nil {
+				return errors.WithMessage(err, dst)
+			}
+		}
+		after, err := allRefs(repo)
+		if err != nil {
+			return err
+		}
+		updates = diffRefs(before, after)
+		printRefUpdates(updates)
+		if err := appendRefLog(fs, updates); err != nil {
+			return errors.Wrap(err, "unable to update ref log")
+		}
+		if backupLocalState {
+			if err := pushLocalState(repo, fs, gitDir); err != nil {
+				return errors.WithMessage(err, "unable to back up local state")
+			}
+		}
+		if shouldPackRefs(fs) {
+			if err := packStoredRefs(repo, fs); err != nil {
+				return errors.WithMessage(err, "unable to pack refs")
+			}
+		}
+		if err := writeManifest(repo, fs); err != nil {
+			return errors.WithMessage(err, "unable to write manifest")
+		}
+		if normalizeRepo {
+			return normalizeRepository(fs)
+		}
+		return nil
+	}()
+	if err != nil {
+		Warnf("error: could not push %s: %v\n", gitDir, err)
+		return updates, false
+	}
+	return updates, true
+}
+
+// listSubmodules returns every initialized submodule of the local repository,
+// with each superproject before its own submodules.
+func listSubmodules() ([]submodule, error) {
+	top, err := gitRevParse("--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	script := `printf '%s\0' "$toplevel" "$sm_path" "$name" "$sha1" "$displaypath" "$(git rev-parse --absolute-git-dir)"`
+	cmd := exec.Command(gitBin(), "submodule", "--quiet", "foreach", "--recursive", script)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list submodules")
+	}
+	fields := strings.Split(string(out), "\x00")
+	storedPaths := map[string]string{filepath.Clean(top): ""}
+	var submodules []submodule
+	for i := 0; i+6 <= len(fields); i += 6 {
+		toplevel, smPath, name := filepath.Clean(fields[i]), fields[i+1], fields[i+2]
+		parent, ok := storedPaths[toplevel]
+		if !ok {
+			return nil, errors.Errorf("submodule %s listed before its superproject", fields[i+4])
+		}
+		sm := submodule{
+			displayPath: fields[i+4],
+			gitDir:      fields[i+5],
+			recorded:    fields[i+3],
+			storedPath:  path.Join(parent, "modules", name),
+		}
+		storedPaths[filepath.Join(toplevel, smPath)] = sm.storedPath
+		submodules = append(submodules, sm)
+	}
+	return submodules, nil
+}
+
+// createTempRef creates a ref with a unique name in the local repository at
+// gitDir, so that the commit can be pushed.
+func createTempRef(gitDir, commit string) (string, error) {
+	name := fmt.Sprintf("refs/restic/recorded-%d", os.Getpid())
+	cmd := exec.Command(gitBin(), "--git-dir", gitDir, "update-ref", name, commit)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", errors.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return name, nil
+}
+
+func deleteTempRef(gitDir, name string) {
+	cmd := exec.Command(gitBin(), "--git-dir", gitDir, "update-ref", "-d", name)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		Warnf("warning: unable to delete %s: %s\n", name, strings.TrimSpace(string(out)))
+	}
+}
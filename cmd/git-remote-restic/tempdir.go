@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// tempDir is set by restic.tempDir, and is the directory which holds the
+// files written to the stored repository until the snapshot is committed. If
+// it is empty, the system temporary directory is used.
+var tempDir = ""
+
+// compressTempFiles is set by restic.compressTempFiles, and compresses the
+// temporary files of complete files with zstd.
+var compressTempFiles = false
+
+// readTempDir reads restic.tempDir and checks that the directory exists.
+func readTempDir() error {
+	dir, ok, err := getRemoteConfig("tempDir", "--path")
+	if err != nil || !ok {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return errors.Wrap(err, "restic.tempDir")
+	} else if !info.IsDir() {
+		return errors.Errorf("restic.tempDir: %s is not a directory", dir)
+	}
+	tempDir = dir
+	return nil
+}
+
+// explainTempError adds advice to errors caused by a full temporary
+// directory. Pushing writes the pack file received from git, and every other
+// file which changes, to the temporary directory before they are saved to
+// restic, so it needs at least as much free space as the data being pushed.
+func explainTempError(err error) error {
+	if err == nil || !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	dir := tempDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return errors.WithMessagef(err, "the temporary directory %s is full; it needs as much free space as the data being pushed, set restic.tempDir to use a larger disk", dir)
+}
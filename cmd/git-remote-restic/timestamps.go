@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// utcTimes is set by --utc to print timestamps in UTC instead of the local
+// timezone.
+var utcTimes bool
+
+// formatTime formats a timestamp for output which may be read by scripts, so
+// it always includes the timezone.
+func formatTime(t time.Time) string {
+	if utcTimes {
+		t = t.UTC()
+	}
+	return t.Format(time.RFC3339)
+}
+
+// timeSelectorLayouts are the formats accepted by parseTimeSelector, other
+// than RFC 3339. They are interpreted in the local timezone.
+var timeSelectorLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// parseTimeSelector interprets a snapshot selector as a point in time. It
+// accepts RFC 3339 timestamps, dates and times without a timezone, which are
+// in the local timezone, and seconds since the epoch prefixed with @, like
+// git. It returns false if the selector isn't a time.
+func parseTimeSelector(selector string) (time.Time, bool) {
+	if strings.HasPrefix(selector, "@") {
+		seconds, err := strconv.ParseInt(selector[1:], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(seconds, 0), true
+	}
+	if t, err := time.Parse(time.RFC3339Nano, selector); err == nil {
+		return t, true
+	}
+	for _, layout := range timeSelectorLayouts {
+		if t, err := time.ParseInLocation(layout, selector, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// findSnapshot returns the snapshot described by selector, which is "latest",
+// a snapshot ID, or a time accepted by parseTimeSelector, which selects the
+// most recent snapshot created at or before that time.
+func findSnapshot(selector string) (*restic.Snapshot, error) {
+	at, ok := parseTimeSelector(selector)
+	if !ok && selector != "latest" {
+		f := restic.SnapshotFilter{}
+		sn, _, err := f.FindLatest(globalCtx, sharedRepo.restic.Backend(), sharedRepo.restic, selector)
+		return sn, err
+	}
+	snapshots, err := sharedRepo.Snapshots(globalCtx)
+	if err != nil {
+		return nil, err
+	}
+	snapshots = filterSnapshotTag(snapshots)
+	if !ok {
+		sn, err := sharedRepo.latestSnapshot(globalCtx, snapshots)
+		if err == nil && sn == nil {
+			err = restic.ErrNoSnapshotFound
+		}
+		return sn, err
+	}
+	for _, sn := range snapshots {
+		if !sn.Time.After(at) {
+			return sn, nil
+		}
+	}
+	return nil, errors.Errorf("no snapshot was created at or before %s", formatTime(at))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+)
+
+// readTLSConfig sets the CA certificates and client certificate which are
+// used to connect to HTTPS backends, such as rest, s3 and azure, from
+// restic.<remote>.caCert or restic.caCert and restic.<remote>.tlsClientCert
+// or restic.tlsClientCert, unless RESTIC_CACERT or RESTIC_TLS_CLIENT_CERT are
+// set. restic.insecureTLS disables verifying the certificate of the server,
+// like restic's --insecure-tls, which is a last resort behind proxies which
+// intercept TLS with a certificate that isn't available.
+func readTLSConfig() error {
+	if len(globalOptions.RootCertFilenames) == 0 {
+		value, ok, err := getRemoteConfig("caCert", "--path")
+		if err != nil {
+			return err
+		} else if ok && value != "" {
+			globalOptions.RootCertFilenames = strings.Split(value, ",")
+		}
+	}
+	if globalOptions.TLSClientCertKeyFilename == "" {
+		value, _, err := getRemoteConfig("tlsClientCert", "--path")
+		if err != nil {
+			return err
+		}
+		globalOptions.TLSClientCertKeyFilename = value
+	}
+	value, ok, err := getRemoteConfig("insecureTLS", "--bool")
+	if err != nil {
+		return err
+	}
+	globalOptions.InsecureTLS = ok && value == "true"
+	if globalOptions.InsecureTLS {
+		Warnf("warning: restic.insecureTLS is set, the certificate of the backend is not verified\n")
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticgit"
+	"github.com/pkg/errors"
+	"github.com/restic/restic/lib/restic"
+)
+
+// cmdUndo restores the remote to its state before the most recent push. The
+// previous state is found by following the parent of the latest snapshot, or
+// of the first snapshot of the push if it was split into intermediate
+// snapshots, and a new snapshot is created with the same content. The ref
+// transaction log is carried forward, so the undo can itself be undone.
+func cmdUndo(args []string) error {
+	if len(args) != 0 {
+		return errors.New("--undo does not accept any arguments")
+	}
+	lock, err := sharedRepo.Lock(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sharedRepo.Unlock(lock)
+	}()
+
+	snapshots, err := sharedRepo.Snapshots(globalCtx)
+	if err != nil {
+		return err
+	}
+	latest, err := sharedRepo.latestSnapshot(globalCtx, snapshots)
+	if err != nil {
+		return err
+	} else if latest == nil {
+		return restic.ErrNoSnapshotFound
+	}
+	first := firstSnapshotOfPush(snapshots, latest)
+	if first.Parent == nil {
+		return errors.Errorf("snapshot %v has no parent, there is no push to undo", first.ID().Str())
+	}
+	latestFS, err := resticfs.New(globalCtx, sharedRepo.restic, latest.ID())
+	if err != nil {
+		return err
+	}
+	parentFS, err := resticfs.New(globalCtx, sharedRepo.restic, first.Parent)
+	if err != nil {
+		return errors.WithMessagef(err, "unable to load parent snapshot %v", first.Parent.Str())
+	}
+	latestGit, err := resticgit.Open(latestFS, false)
+	if err != nil {
+		return err
+	}
+	parentGit, err := resticgit.Open(parentFS, false)
+	if err != nil {
+		return err
+	}
+	latestRefs, err := allRefs(latestGit)
+	if err != nil {
+		return err
+	}
+	parentRefs, err := allRefs(parentGit)
+	if err != nil {
+		return err
+	}
+
+	updates := diffRefs(latestRefs, parentRefs)
+	refLog, err := readRefLog(latestFS)
+	if err != nil {
+		return err
+	}
+	parentFS.Deterministic = normalizeRepo
+	parentFS.StartNewSnapshot()
+	if err := writeRefLog(parentFS, append(refLog, updates...)); err != nil {
+		return err
+	}
+	parentFS.SetParent(latest.ID())
+	parentFS.PreCommit = preCommitFunc(updates)
+	path := localGitPath
+	if len(latest.Paths) > 0 {
+		path = latest.Paths[0]
+	}
+	var tags []string
+	for _, tag := range latest.Tags {
+		if !strings.HasPrefix(tag, pushTagPrefix) {
+			tags = append(tags, tag)
+		}
+	}
+	id, err := parentFS.CommitSnapshot(path, tags)
+	if err == resticfs.ErrNoChanges {
+		return errors.Errorf("snapshot %v is identical to its parent, there is no push to undo", latest.ID().Str())
+	} else if err != nil {
+		return err
+	}
+
+	printRefUpdates(updates)
+	fmt.Printf("restored snapshot %v as snapshot %v\n", first.Parent.Str(), id.Str())
+	return nil
+}
+
+// firstSnapshotOfPush returns the first snapshot of the push which created
+// latest. The snapshots of a push which was split into intermediate snapshots
+// share a tag starting with pushTagPrefix, and each is the parent of the next.
+func firstSnapshotOfPush(snapshots restic.Snapshots, latest *restic.Snapshot) *restic.Snapshot {
+	var tag string
+	for _, t := range latest.Tags {
+		if strings.HasPrefix(t, pushTagPrefix) {
+			tag = t
+		}
+	}
+	if tag == "" {
+		return latest
+	}
+	byID := make(map[restic.ID]*restic.Snapshot, len(snapshots))
+	for _, sn := range snapshots {
+		byID[*sn.ID()] = sn
+	}
+	first := latest
+	for first.Parent != nil {
+		parent, ok := byID[*first.Parent]
+		if !ok || !parent.HasTags([]string{tag}) {
+			break
+		}
+		first = parent
+	}
+	return first
+}
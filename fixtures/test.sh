@@ -47,6 +47,685 @@ rm -rf ../restic
 restic init -r ../restic
 git push origin master
 
+banner "Test that HEAD follows the first branch pushed to a new repository"
+rm -rf ../restic
+restic init -r ../restic
+git push origin master:main
+[ "$(git ls-remote --symref origin HEAD | head -1)" == "$(printf 'ref: refs/heads/main\tHEAD')" ]
+
+banner "Test that a new restic repository can be created by pushing"
+rm -rf ../restic
+mkdir ../restic
+! git push origin master
+git -c restic.autoInit=true push origin master
+
+banner "Test that a repository cloned from a relative location can be fetched"
+cd ..
+git clone restic::local:restic clone
+[ "$(git -C clone config remote.origin.url)" == "restic::local:$PWD/restic" ]
+mkdir clone/subdir
+(cd clone/subdir && git fetch origin)
+rm -rf clone
+cd workdir
+
+banner "Test that the repository can be read from the environment"
+[ "$(RESTIC_REPOSITORY=local:../restic git ls-remote restic:: refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+echo local:../restic > ../repository-file
+[ "$(RESTIC_REPOSITORY_FILE=../repository-file git ls-remote restic::env: refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! git ls-remote restic::
+rm ../repository-file
+
+banner "Test that environment variables can be set for a single remote"
+git remote add envremote restic::
+[ "$(env -u RESTIC_PASSWORD RESTIC_ENVREMOTE_PASSWORD=password RESTIC_ENVREMOTE_REPOSITORY=local:../restic git -c restic.gitCredential=false ls-remote envremote refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! env -u RESTIC_PASSWORD RESTIC_ENVREMOTE_PASSWORD=password git -c restic.gitCredential=false ls-remote restic::local:../restic
+git remote remove envremote
+
+banner "Test that a key hint can be given"
+[ "$(git -c restic.keyHint="$(ls ../restic/keys | head -n1)" ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+[ "$(RESTIC_KEY_HINT=0000000000000000000000000000000000000000000000000000000000000000 git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+
+banner "Test that the password can be read from an encrypted file"
+printf '#!/bin/sh\n[ "$1 $2" = "--quiet --decrypt" ] && base64 -d "$3"\n' > ../fakegpg
+chmod +x ../fakegpg
+printf 'password\nurl: local:restic\n' | base64 > ../password.gpg
+[ "$(env -u RESTIC_PASSWORD RESTIC_PASSWORD_FILE=../password.gpg git -c gpg.program=../fakegpg -c restic.gitCredential=false ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+rm ../fakegpg ../password.gpg
+[ "$(env -u RESTIC_PASSWORD RESTIC_PASSWORD_FILE=age:../password.age RESTIC_AGE_IDENTITY=../age-identity.txt git -c restic.gitCredential=false ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! env -u RESTIC_PASSWORD RESTIC_PASSWORD_FILE=age:../password.age git -c restic.gitCredential=false ls-remote origin
+
+banner "Test that non-interactive mode never prompts for the password"
+cat > ../fakegpg <<EOF
+#!/bin/sh
+echo "\$@" > "$(cd .. && pwd)/fakegpg-args"
+[ "\$1" = --batch ] && exit 2
+base64 -d "\$3"
+EOF
+chmod +x ../fakegpg
+printf 'password\n' | base64 > ../password.gpg
+! env -u RESTIC_PASSWORD RESTIC_PASSWORD_FILE=../password.gpg GIT_REMOTE_RESTIC_NONINTERACTIVE=1 git -c gpg.program=../fakegpg -c restic.gitCredential=false ls-remote origin
+grep -q -- "--batch --pinentry-mode error --quiet --decrypt" ../fakegpg-args
+env -u RESTIC_PASSWORD RESTIC_PASSWORD_FILE=../password.gpg git -c gpg.program=../fakegpg -c restic.gitCredential=false ls-remote origin
+grep -q -- "^--quiet --decrypt" ../fakegpg-args
+rm ../fakegpg ../fakegpg-args ../password.gpg
+status=0
+env -u RESTIC_PASSWORD -u GIT_ASKPASS -u SSH_ASKPASS GIT_CONFIG_COUNT=1 GIT_CONFIG_KEY_0=credential.helper GIT_CONFIG_VALUE_0= GIT_REMOTE_RESTIC_NONINTERACTIVE=1 git-remote-restic --manifest origin < /dev/null 2> ../stderr || status=$?
+[ "$status" == 3 ]
+grep -q "GIT_REMOTE_RESTIC_NONINTERACTIVE" ../stderr
+rm ../stderr
+
+banner "Test that the password can be read from a file descriptor"
+[ "$(env -u RESTIC_PASSWORD GIT_REMOTE_RESTIC_PASSWORD_FD=3 git -c restic.gitCredential=false ls-remote origin refs/heads/master 3<<< password | cut -f1)" == "$(git rev-parse master)" ]
+echo password | env -u RESTIC_PASSWORD git-remote-restic --password-from-fd 0 --manifest origin | grep '"refs"'
+! env -u RESTIC_PASSWORD GIT_REMOTE_RESTIC_PASSWORD_FD=0 git -c restic.gitCredential=false ls-remote origin < /dev/null
+
+banner "Test that credential helpers are given the repository location"
+printf '#!/bin/sh\n[ "$1" = get ] && cat > "%s" && echo password=password\n' "$(cd .. && pwd)/credential-input" > ../credential-helper
+chmod +x ../credential-helper
+[ "$(env -u RESTIC_PASSWORD git -c credential.helper="$(cd .. && pwd)/credential-helper" ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+grep '^protocol=restic$' ../credential-input
+grep '^host=none$' ../credential-input
+grep "^path=$(cd ../restic && pwd)\$" ../credential-input
+rm ../credential-helper ../credential-input
+
+banner "Test that the password can be entered with an askpass program"
+printf '#!/bin/sh\nif [ -e ../askpass-asked ]; then echo password; else touch ../askpass-asked; echo wrong; fi\n' > ../askpass
+chmod +x ../askpass
+[ "$(env -u RESTIC_PASSWORD GIT_ASKPASS=../askpass git -c credential.helper= ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+rm ../askpass-asked
+! env -u RESTIC_PASSWORD GIT_ASKPASS=../askpass git -c credential.helper= -c restic.passwordAttempts=1 ls-remote origin
+rm ../askpass ../askpass-asked
+
+banner "Test that the agent keeps the master key of an entered password"
+mkdir -m 755 ../agent
+export GIT_REMOTE_RESTIC_AUTH_SOCK="$(cd .. && pwd)/agent/agent.sock"
+! git-remote-restic --agent --timeout 1m
+chmod 700 ../agent
+git-remote-restic --agent --timeout 1m &
+agent=$!
+while [ ! -S "$GIT_REMOTE_RESTIC_AUTH_SOCK" ]; do sleep 0.1; done
+printf '#!/bin/sh\necho password\n' > ../askpass
+chmod +x ../askpass
+env -u RESTIC_PASSWORD GIT_ASKPASS=../askpass git -c credential.helper= ls-remote origin
+[ "$(env -u RESTIC_PASSWORD GIT_ASKPASS=false git -c credential.helper= ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+[ "$(env -u RESTIC_PASSWORD GIT_ASKPASS=false git-remote-restic --key origin list | grep '(current)' | cut -d' ' -f1)" == "$(git-remote-restic --key origin list | grep '(current)' | cut -d' ' -f1)" ]
+kill $agent
+wait $agent || true
+unset GIT_REMOTE_RESTIC_AUTH_SOCK
+rm -rf ../askpass ../agent
+
+banner "Test that a missing password is reported without a terminal"
+! env -u RESTIC_PASSWORD -u SSH_ASKPASS GIT_ASKPASS= git -c credential.helper= ls-remote origin 2> ../stderr
+grep "no terminal to prompt" ../stderr
+rm ../stderr
+
+banner "Test that the password is asked for in the same order as git"
+cat > ../credential-helper <<EOF
+#!/bin/sh
+echo "helper \$1" >> "$(cd .. && pwd)/credential-order"
+cat > /dev/null
+[ "\$1" = get ] && [ -e "$(cd .. && pwd)/helper-knows" ] && echo password=password
+exit 0
+EOF
+cat > ../askpass <<EOF
+#!/bin/sh
+echo askpass >> "$(cd .. && pwd)/credential-order"
+[ -e "$(cd .. && pwd)/askpass-knows" ] && echo password
+EOF
+chmod +x ../credential-helper ../askpass
+helper="$(cd .. && pwd)/credential-helper"
+touch ../helper-knows ../askpass-knows
+env -u RESTIC_PASSWORD GIT_ASKPASS=../askpass git -c credential.helper="$helper" ls-remote origin
+[ "$(cat ../credential-order | tr '\n' ' ')" == "helper get helper store " ]
+rm ../helper-knows ../credential-order
+env -u RESTIC_PASSWORD GIT_ASKPASS=../askpass git -c credential.helper="$helper" ls-remote origin
+[ "$(cat ../credential-order | tr '\n' ' ')" == "helper get askpass helper store " ]
+rm ../askpass-knows ../credential-order
+! env -u RESTIC_PASSWORD -u SSH_ASKPASS GIT_ASKPASS=../askpass git -c credential.helper="$helper" ls-remote origin 2> ../stderr
+[ "$(cat ../credential-order | tr '\n' ' ')" == "helper get askpass " ]
+grep -q "unable to read askpass response" ../stderr
+grep -q "no terminal to prompt" ../stderr
+rm ../credential-helper ../askpass ../credential-order ../stderr
+
+banner "Test that a linked worktree can push and fetch"
+git worktree add -b worktree ../worktree master
+(cd ../worktree && git commit --allow-empty -m 'Worktree commit' && git push origin worktree)
+[ "$(git ls-remote origin refs/heads/worktree | cut -f1)" == "$(git rev-parse worktree)" ]
+(cd ../worktree && git push origin :worktree && git fetch --prune origin)
+! git rev-parse --verify -q refs/remotes/origin/worktree
+git worktree remove --force ../worktree
+git branch -D worktree
+
+banner "Test that a mirror clone round-trips through a new repository"
+git tag v1
+git branch feature
+git push origin feature v1
+cd ..
+git clone --mirror restic::local:restic mirror
+[ "$(git -C mirror symbolic-ref HEAD)" == "refs/heads/master" ]
+rm -rf restic-mirror
+restic init -r restic-mirror
+git -C mirror push --mirror restic::local:../restic-mirror
+git clone --bare restic::local:restic-mirror bare
+[ "$(git -C bare symbolic-ref HEAD)" == "refs/heads/master" ]
+[ "$(git -C mirror show-ref)" == "$(git -C bare show-ref)" ]
+rm -rf mirror bare restic-mirror
+cd workdir
+git push origin :feature :v1
+git tag -d v1
+git branch -D feature
+
+banner "Test that another remote can be imported in batches"
+git init ../import
+git -C ../import remote add origin restic::local:"$(cd .. && pwd)/imported"
+restic init -r ../imported
+git -C ../import config restic.importBatch 1
+source="$(pwd)"
+(cd ../import && git-remote-restic --import origin "$source")
+(cd ../import && git-remote-restic --import origin "$source") | grep "^\([0-9]*\) of \1 refs already imported$"
+[ "$(git -C ../import ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+[ -z "$(git -C ../import for-each-ref refs/restic-import)" ]
+rm -rf ../import ../imported
+
+banner "Test that a pre-commit hook can reject a push"
+git commit --allow-empty -m 'Hooked commit'
+! git -c restic.preCommitHook='grep -q refs/heads/master && exit 1' push origin master
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master~1)" ]
+git -c restic.preCommitHook='cat > ../hook-input; echo "$GIT_REMOTE_RESTIC_CHANGED_FILES" > ../hook-files' push origin master
+[ "$(cat ../hook-input)" == "$(git rev-parse master~1) $(git rev-parse master) refs/heads/master" ]
+grep '^restic-reflog$' ../hook-files
+git reset --hard HEAD^
+git push --force origin master
+rm ../hook-input ../hook-files
+
+banner "Test that the pre-commit hook runs for every kind of snapshot"
+git commit --allow-empty -m 'Hooked commit'
+snapshots="$(restic -r ../restic list snapshots | wc -l)"
+! git -c restic.pushSnapshotSize=1 -c restic.preCommitHook='exit 1' push origin master
+git config restic.preCommitHook 'exit 1'
+! git-remote-restic --push-recursive origin
+[ "$(restic -r ../restic list snapshots | wc -l)" == "$snapshots" ]
+git config --unset restic.preCommitHook
+git push origin master
+git config restic.preCommitHook 'exit 1'
+! git-remote-restic --undo origin
+git config --unset restic.preCommitHook
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that the repository ID of a remote is printed"
+repo_id="$(restic -r ../restic cat config | grep '"id"' | cut -d'"' -f4)"
+git-remote-restic --version origin | grep "^restic repository $repo_id, chunker polynomial "
+git fetch -v origin 2>&1 | grep "^restic repository $repo_id"
+
+banner "Test that refs differing only in case are refused on case-insensitive filesystems"
+git branch case-lower
+git commit --allow-empty -m 'Case commit'
+git push origin master:refs/heads/Case case-lower:refs/heads/case
+! git clone -c core.ignoreCase=true restic::local:../restic ../case 2> ../stderr
+grep "refs/heads/Case, refs/heads/case" ../stderr
+rm -rf ../case ../stderr
+git clone restic::local:../restic ../case
+rm -rf ../case
+git push origin :refs/heads/Case :refs/heads/case
+git reset --hard HEAD^
+git branch -D case-lower
+
+banner "Test that the restic cache is used"
+RESTIC_CACHE_DIR="$(cd .. && pwd)/cache" git ls-remote origin
+ls ../cache/*/index
+git -c restic.cacheDir="$(cd .. && pwd)/cache2" -c restic.noCache=true ls-remote origin
+[ ! -e ../cache2 ]
+rm -rf ../cache
+XDG_CACHE_HOME="$(cd .. && pwd)/xdg" restic -r ../restic snapshots
+XDG_CACHE_HOME="$(cd .. && pwd)/xdg" git ls-remote origin
+[ ! -e ../xdg/git-remote-restic/restic ]
+XDG_CACHE_HOME="$(cd .. && pwd)/xdg" git -c restic.shareResticCache=false ls-remote origin
+ls ../xdg/git-remote-restic/restic/*/index
+rm -rf ../xdg
+
+banner "Test that a dry-run push changes nothing"
+git commit --allow-empty -m 'Dry run commit'
+git push --dry-run origin HEAD:refs/heads/dry-run 2> ../stderr
+grep "create refs/heads/dry-run" ../stderr
+grep "1 refs changed, 1 objects to copy" ../stderr
+! git ls-remote --exit-code origin refs/heads/dry-run
+git reset --hard HEAD^
+rm ../stderr
+
+banner "Test that the rclone program and arguments can be configured"
+if command -v rclone > /dev/null; then
+    printf '#!/bin/sh\ntouch "%s"\nexec rclone "$@"\n' "$(cd .. && pwd)/rclone-ran" > ../rclone-program
+    chmod +x ../rclone-program
+    [ "$(git -c restic.rcloneProgram="$(cd .. && pwd)/rclone-program" -c restic.rcloneArgs='serve restic --stdio' ls-remote "restic::rclone:$(cd ../restic && pwd)" refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+    [ -e ../rclone-ran ]
+    rm ../rclone-program ../rclone-ran
+fi
+
+banner "Test that rclone is killed with the processes it started when it doesn't answer"
+printf '#!/bin/sh\necho starting >&2\nsleep 1000 &\necho $! > "%s"\nexec sleep 1000\n' "$(cd .. && pwd)/rclone-child" > ../rclone-program
+chmod +x ../rclone-program
+! DEBUG_LOG="$(cd .. && pwd)/rclone-log" git -c restic.rcloneProgram="$(cd .. && pwd)/rclone-program" ls-remote "restic::rclone:remote?rclone.timeout=2s" 2> ../stderr
+grep -q '^rclone: starting$' ../stderr
+grep -q 'rclone: starting' ../rclone-log
+! ps -o stat= -p "$(cat ../rclone-child)" | grep -qv Z
+rm ../rclone-program ../rclone-child ../rclone-log ../stderr
+
+banner "Test that notes are synchronized"
+git commit --allow-empty -m 'Noted commit'
+git notes add -m 'Reviewed' HEAD
+git -c restic.syncNotes=true push origin master
+git ls-remote --exit-code origin refs/notes/commits
+git -c restic.syncNotes=true clone restic::local:../restic ../notes
+[ "$(git -C ../notes notes show HEAD)" == "Reviewed" ]
+rm -rf ../notes
+git notes remove HEAD
+git push origin :refs/notes/commits
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that the sftp command can be configured"
+! git -c restic.sftpCommand="sh -c 'touch $(cd .. && pwd)/sftp-ran; exit 1'" ls-remote restic::sftp:backup-host:/srv/restic
+[ -e ../sftp-ran ]
+rm ../sftp-ran
+
+banner "Test that the password of a REST server is requested from git credential"
+printf '#!/bin/sh\n[ "$1" = get ] && cat > "%s"\n' "$(cd .. && pwd)/rest-credential-input" > ../rest-credential
+chmod +x ../rest-credential
+! GIT_TERMINAL_PROMPT=0 git -c credential.helper="$(cd .. && pwd)/rest-credential" ls-remote restic::rest:http://alice@127.0.0.1:1/project
+grep -q '^protocol=http$' ../rest-credential-input
+grep -q '^host=127.0.0.1:1$' ../rest-credential-input
+grep -q '^username=alice$' ../rest-credential-input
+rm ../rest-credential ../rest-credential-input
+
+banner "Test that presets are expanded to rclone backends"
+printf '#!/bin/sh\necho "$@" > "%s"\nexit 1\n' "$(cd .. && pwd)/preset-args" > ../rclone-program
+chmod +x ../rclone-program
+! git -c restic.rcloneProgram="$(cd .. && pwd)/rclone-program" -c restic.preset.webdav.url=https://dav.example.com/files ls-remote restic::preset:webdav:backups/project
+grep -q ":webdav,vendor='other',url='https://dav.example.com/files':backups/project" ../preset-args
+! git ls-remote restic::preset:unknown:backups/project 2> ../stderr
+grep -q 'unknown preset "unknown"' ../stderr
+rm ../rclone-program ../preset-args ../stderr
+
+banner "Test that the S3 options are checked"
+! git ls-remote 'restic::s3:s3.amazonaws.com/bucket/project?s3.bucket-lookup=virtual' 2> ../stderr
+grep -q 's3.bucket-lookup: invalid value "virtual"' ../stderr
+! git -c restic.s3StorageClass=DEEP_ARCHIVE ls-remote restic::s3:s3.amazonaws.com/bucket/project 2> ../stderr
+grep -q 'use GLACIER_IR instead' ../stderr
+rm ../stderr
+
+banner "Test that the credential_process of an AWS profile is used"
+cat > ../aws-process <<EOF
+#!/bin/sh
+touch "$(cd .. && pwd)/aws-process-ran"
+echo '{"Version": 1, "AccessKeyId": "AKIDEXAMPLE", "SecretAccessKey": "secret"}'
+EOF
+chmod +x ../aws-process
+printf '[profile backups]\ncredential_process = %s\n' "$(cd .. && pwd)/aws-process" > ../aws-config
+! env -u AWS_ACCESS_KEY_ID AWS_CONFIG_FILE="$(cd .. && pwd)/aws-config" git -c restic.awsProfile=backups ls-remote restic::s3:http://127.0.0.1:1/bucket/project
+[ -e ../aws-process-ran ]
+rm ../aws-process ../aws-config ../aws-process-ran
+
+banner "Test that the AWS session token is read from the remote's config"
+cat > ../aws-process <<EOF
+#!/bin/sh
+echo "\$AWS_SESSION_TOKEN" > "$(cd .. && pwd)/aws-session-token"
+echo '{"Version": 1, "AccessKeyId": "AKIDEXAMPLE", "SecretAccessKey": "secret"}'
+EOF
+chmod +x ../aws-process
+printf '[profile backups]\ncredential_process = %s\n' "$(cd .. && pwd)/aws-process" > ../aws-config
+git remote add s3-remote restic::s3:http://127.0.0.1:1/bucket/project
+! env -u AWS_ACCESS_KEY_ID AWS_CONFIG_FILE="$(cd .. && pwd)/aws-config" git -c restic.awsProfile=backups -c restic.awsSessionToken=shared -c restic.s3-remote.awsSessionToken=remote ls-remote s3-remote
+[ "$(cat ../aws-session-token)" == "remote" ]
+! env -u AWS_ACCESS_KEY_ID AWS_CONFIG_FILE="$(cd .. && pwd)/aws-config" git -c restic.awsProfile=backups -c restic.awsSessionToken=shared ls-remote s3-remote
+[ "$(cat ../aws-session-token)" == "shared" ]
+git remote remove s3-remote
+rm ../aws-process ../aws-config ../aws-session-token
+
+banner "Test that protected refs can't be force-pushed or deleted"
+git commit --allow-empty -m 'Protected commit'
+git push origin master
+git reset --hard HEAD^
+! git -c restic.protect=refs/heads/master push --force origin master
+! git -c restic.protect='refs/heads/*' push origin :master
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse HEAD@{1})" ]
+git config restic.protect refs/heads/master
+! git-remote-restic --push-recursive origin 2> ../push-recursive-errors
+grep -q "refs/heads/master: refusing non-fast-forward update of protected ref" ../push-recursive-errors
+git config --unset restic.protect
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse HEAD@{1})" ]
+rm ../push-recursive-errors
+git push --force origin master
+
+banner "Test that the number of jobs can be configured"
+[ "$(git -c restic.jobs=1 ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! git -c restic.jobs=0 ls-remote origin 2> ../stderr
+grep -q 'restic.jobs: invalid number of jobs "0"' ../stderr
+rm ../stderr
+
+banner "Test that the requests of HTTP backends can be logged"
+! git -c restic.logRequests=true ls-remote restic::rest:http://127.0.0.1:1/project 2> ../stderr
+grep -q '^request: [A-Z]* 127.0.0.1:1/project/.* failed after' ../stderr
+git -c restic.logRequests=true ls-remote origin 2> ../stderr
+grep -q 'restic.logRequests has no effect for the local backend' ../stderr
+rm ../stderr
+
+banner "Test that undo reverts every snapshot of a split push"
+before="$(git ls-remote origin refs/heads/master | cut -f1)"
+snapshots="$(restic -r ../restic list snapshots | wc -l)"
+git commit --allow-empty -m 'Split commit 1'
+git commit --allow-empty -m 'Split commit 2'
+git -c restic.pushSnapshotSize=1 push origin master 2> ../stderr
+grep -q "created intermediate snapshot" ../stderr
+[ "$(restic -r ../restic list snapshots | wc -l)" -gt "$((snapshots + 1))" ]
+git-remote-restic --undo origin
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$before" ]
+git reset --hard "$before"
+rm ../stderr
+
+banner "Test that fetching falls back to an intact snapshot"
+before="$(git rev-parse master)"
+restic -r ../restic list packs | sort > ../packs-before
+restic -r ../restic list snapshots | sort > ../snapshots-before
+git commit --allow-empty -m 'Damaged commit'
+git push origin master
+restic -r ../restic list packs | sort | comm -13 ../packs-before - | while read -r pack; do
+    rm "../restic/data/${pack:0:2}/$pack"
+done
+restic -r ../restic repair index
+git fetch origin 2> ../stderr
+grep -q "is damaged" ../stderr
+grep -q "using snapshot" ../stderr
+[ "$(git rev-parse origin/master)" == "$before" ]
+restic -r ../restic list snapshots | sort | comm -13 ../snapshots-before - | xargs restic -r ../restic forget
+git reset --hard "$before"
+rm ../packs-before ../snapshots-before ../stderr
+
+banner "Test that unchanged refs are listed from the fetch state"
+git ls-remote origin > /dev/null
+grep -q '^intact true$' .git/restic/fetched/origin
+sed 's#refs/heads/master$#refs/heads/from-state#' .git/restic/fetched/origin > ../state
+mv ../state .git/restic/fetched/origin
+git ls-remote origin | grep -q refs/heads/from-state
+! git -c restic.snapshotTag=other ls-remote origin | grep -q refs/heads/from-state
+! git -c restic.intactSnapshot=false ls-remote origin | grep -q refs/heads/from-state
+grep -q '^intact false$' .git/restic/fetched/origin
+git ls-remote origin | grep -q refs/heads/master
+
+banner "Test that a fetch skips unchanged snapshots and picks up new ones"
+git fetch origin
+# Without the index, no data can be read from the repository.
+mv ../restic/index ../index-saved
+mkdir ../restic/index
+git fetch origin
+rmdir ../restic/index
+mv ../index-saved ../restic/index
+git clone restic::local:"$(cd ../restic && pwd)" ../second
+git -C ../second commit --allow-empty -m 'Commit from another clone'
+git -C ../second push origin master
+git fetch origin
+[ "$(git rev-parse origin/master)" == "$(git -C ../second rev-parse master)" ]
+git reset --hard origin/master
+git reset --hard HEAD^
+git push --force origin master
+rm -rf ../second
+
+banner "Test that pushes are signed if asked when a signing key is configured"
+cat > ../fake-gpg <<'EOF'
+#!/bin/sh
+cat > /dev/null
+echo '[GNUPG:] SIG_CREATED D 1 8 00 0 0' >&2
+printf -- '-----BEGIN PGP SIGNATURE-----\nfake\n-----END PGP SIGNATURE-----\n'
+EOF
+chmod +x ../fake-gpg
+git commit --allow-empty -m 'Unsigned commit'
+git -c gpg.program="$(cd .. && pwd)/fake-gpg" push --signed=if-asked origin master
+! restic -r ../restic dump latest /restic-pushcert | grep "$(git rev-parse HEAD) refs/heads/master"
+git commit --allow-empty -m 'Signed commit'
+git -c user.signingKey=ABCDEF -c gpg.program="$(cd .. && pwd)/fake-gpg" push --signed=if-asked origin master
+restic -r ../restic dump latest /restic-pushcert | grep "$(git rev-parse HEAD) refs/heads/master"
+git config user.signingKey ABCDEF
+git config gpg.program "$(cd .. && pwd)/fake-gpg"
+git config push.gpgSign true
+git commit --allow-empty -m 'Recursively signed commit'
+git-remote-restic --push-recursive origin
+restic -r ../restic dump latest /restic-pushcert | grep "$(git rev-parse HEAD) refs/heads/master"
+git config --unset user.signingKey
+git config --unset gpg.program
+git config --unset push.gpgSign
+git reset --hard HEAD~3
+git push --force origin master
+rm ../fake-gpg
+
+banner "Test that --fetch-all opens a repository shared by several remotes once"
+cat > ../askpass <<EOF
+#!/bin/sh
+echo asked >> "$(cd .. && pwd)/askpass-asked"
+echo password
+EOF
+chmod +x ../askpass
+git remote add same-repo restic::local:"$(cd ../restic && pwd)"
+env -u RESTIC_PASSWORD GIT_ASKPASS="$(cd .. && pwd)/askpass" GIT_CONFIG_COUNT=1 GIT_CONFIG_KEY_0=credential.helper GIT_CONFIG_VALUE_0= git-remote-restic --fetch-all
+[ "$(wc -l < ../askpass-asked)" -eq 1 ]
+[ "$(git rev-parse same-repo/master)" == "$(git rev-parse origin/master)" ]
+git remote remove same-repo
+rm ../askpass ../askpass-asked
+
+banner "Test that the local state is backed up into the snapshot"
+echo 'Stashed content' > stashed.txt
+git add stashed.txt
+git stash
+git notes add -m 'A note' HEAD
+git commit --allow-empty -m 'Local state'
+git -c restic.backupLocalState=true push origin master
+stash="$(git rev-parse refs/stash)"
+notes="$(git rev-parse refs/notes/commits)"
+! git ls-remote origin | grep -q restic-local
+restic -r ../restic ls latest > ../listing
+grep -q '/restic-local/logs/refs/stash$' ../listing
+grep -q '/restic-local/logs/refs/notes/commits$' ../listing
+grep -q '/restic-local/logs/HEAD$' ../listing
+rm ../listing
+
+banner "Test that the local state can be restored"
+git update-ref -d refs/stash
+git update-ref refs/notes/commits HEAD
+! GIT_REMOTE_RESTIC_NONINTERACTIVE=1 git-remote-restic --restore-local-state origin > ../stdout 2> ../stderr
+grep -q "refs/notes/commits" ../stdout
+grep -q "use --force" ../stderr
+[ "$(git rev-parse refs/notes/commits)" == "$(git rev-parse HEAD)" ]
+! git rev-parse --verify --quiet refs/stash
+git-remote-restic --restore-local-state origin --force
+[ "$(git rev-parse refs/stash)" == "$stash" ]
+[ "$(git rev-parse refs/notes/commits)" == "$notes" ]
+git stash list | grep -q 'WIP on master'
+git stash drop
+git update-ref -d refs/notes/commits
+git reset --hard HEAD^
+git push --force origin master
+rm ../stdout ../stderr
+
+banner "Test that TLS certificates are loaded from git config"
+openssl req -x509 -newkey rsa:2048 -nodes -subj /CN=localhost -days 1 -keyout ../tls-key.pem -out ../tls-cert.pem 2> /dev/null
+cat ../tls-cert.pem ../tls-key.pem > ../tls-client.pem
+echo 'not a certificate' > ../tls-invalid.pem
+git -c restic.caCert="$(cd .. && pwd)/tls-cert.pem" ls-remote origin
+git -c restic.origin.caCert="$(cd .. && pwd)/tls-cert.pem,$(cd .. && pwd)/tls-cert.pem" ls-remote origin
+git -c restic.tlsClientCert="$(cd .. && pwd)/tls-client.pem" ls-remote origin
+! git -c restic.caCert="$(cd .. && pwd)/tls-missing.pem" ls-remote origin 2> ../stderr
+grep -q "tls-missing.pem" ../stderr
+! git -c restic.caCert="$(cd .. && pwd)/tls-cert.pem" -c restic.origin.caCert="$(cd .. && pwd)/tls-invalid.pem" ls-remote origin
+! git -c restic.tlsClientCert="$(cd .. && pwd)/tls-cert.pem" ls-remote origin
+RESTIC_CACERT="$(cd .. && pwd)/tls-cert.pem" git -c restic.caCert="$(cd .. && pwd)/tls-missing.pem" ls-remote origin
+git -c restic.insecureTLS=true ls-remote origin 2> ../stderr
+grep -q "restic.insecureTLS is set" ../stderr
+! git -c restic.insecureTLS=maybe ls-remote origin
+rm ../tls-key.pem ../tls-cert.pem ../tls-client.pem ../tls-invalid.pem ../stderr
+
+banner "Test that --push-recursive stores the manifest and reports on stderr"
+git commit --allow-empty -m 'Recursive manifest'
+git-remote-restic --push-recursive origin
+restic -r ../restic dump latest /restic-manifest.json | grep "\"hash\": \"$(git rev-parse master)\""
+git-remote-restic --push-recursive origin > ../stdout 2> ../stderr
+grep -q "Everything up-to-date" ../stderr
+! grep -q "Everything up-to-date" ../stdout
+git reset --hard HEAD^
+git push --force origin master
+rm ../stdout ../stderr
+
+banner "Test that --ping checks a remote"
+restic -r ../restic list packs | sort > ../packs-before
+git-remote-restic --ping origin > ../ping
+for step in backend password lock latency upload download; do
+    grep -q "^$step " ../ping
+done
+[ "$(restic -r ../restic list packs | sort)" == "$(cat ../packs-before)" ]
+[ "$(git-remote-restic --locks origin)" == "no locks" ]
+! git-remote-restic --ping restic::local:../missing > ../ping
+! grep -q "^password " ../ping
+! RESTIC_PASSWORD=wrong git-remote-restic --ping origin > ../ping
+! grep -q "^password " ../ping
+! git-remote-restic --ping
+rm ../ping ../packs-before
+
+banner "Test that the locks of a remote can be listed"
+[ "$(git-remote-restic --locks origin)" == "no locks" ]
+
+banner "Test that locking the repository can be configured"
+RESTIC_RETRY_LOCK=1s git ls-remote origin
+git -c restic.retryLock=1m ls-remote origin
+! git -c restic.retryLock=soon ls-remote origin
+git -c restic.noLock=fetch ls-remote origin
+git commit --allow-empty -m 'Unlocked commit'
+git -c restic.noLock=all push origin master
+[ -z "$(ls ../restic/locks)" ]
+! git -c restic.noLock=sometimes ls-remote origin
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that GIT_PROTOCOL is checked"
+[ "$(GIT_PROTOCOL=version=2 git -c protocol.version=2 ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! GIT_PROTOCOL=version=3 git-remote-restic origin local:../restic < /dev/null 2> ../stderr
+grep "not supported" ../stderr
+rm ../stderr
+
+banner "Test that a commit can be fetched by hash and from an anonymous remote"
+git init ../by-hash
+git -C ../by-hash fetch restic::local:"$(cd ../restic && pwd)" "$(git rev-parse master~1)"
+[ "$(git -C ../by-hash rev-parse FETCH_HEAD)" == "$(git rev-parse master~1)" ]
+git -C ../by-hash fetch restic::local:"$(cd ../restic && pwd)" master
+[ "$(git -C ../by-hash rev-parse FETCH_HEAD)" == "$(git rev-parse master)" ]
+! git -C ../by-hash for-each-ref | grep restic-fetch
+! git -C ../by-hash fetch restic::local:"$(cd ../restic && pwd)" 1111111111111111111111111111111111111111
+rm -rf ../by-hash
+
+banner "Test that keys can be added, listed, and removed"
+echo newpassword > ../new-password
+git-remote-restic --key origin add --new-password-file ../new-password | grep '^added key'
+new_key="$(git-remote-restic --key origin list | grep -v '(current)' | cut -d' ' -f1)"
+[ "$(RESTIC_PASSWORD=newpassword git-remote-restic --key origin list | grep '(current)' | cut -d' ' -f1)" == "$new_key" ]
+! RESTIC_PASSWORD=newpassword git-remote-restic --key origin remove "$new_key"
+git-remote-restic --key origin remove "$new_key"
+[ "$(git-remote-restic --key origin list | wc -l)" == "1" ]
+rm ../new-password
+
+banner "Test that packs left by an interrupted push are removed"
+[ "$(git-remote-restic --gc origin)" == "no packs left by interrupted pushes" ]
+pack="$(echo orphaned | sha256sum | cut -d' ' -f1)"
+mkdir -p "../restic/data/${pack:0:2}"
+echo orphaned > "../restic/data/${pack:0:2}/$pack"
+echo "$pack" > ".git/restic/pending-packs/local:$(cd ../restic && pwd | sed 's|/|%2F|g')"
+git-remote-restic --gc origin | grep "^removed 1 packs"
+[ ! -e "../restic/data/${pack:0:2}/$pack" ]
+git commit --allow-empty -m 'Journaled commit'
+git push origin master
+[ -z "$(ls .git/restic/pending-packs)" ]
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that each snapshot stores a manifest"
+git-remote-restic --manifest origin | grep "\"hash\": \"$(git rev-parse master)\""
+restic ls -r ../restic latest | grep '^/restic-manifest.json$'
+
+banner "Test that a file can be shown from the stored repository"
+[ "$(git-remote-restic --show origin master:README.md)" == "$(git show master:README.md)" ]
+[ "$(git-remote-restic --show origin latest master~1:README.md)" == "$(git show master~1:README.md)" ]
+! git-remote-restic --show origin master:missing-file
+
+banner "Test that the history of a ref lists its creation and deletion"
+git-remote-restic --ref-history origin refs/heads/feature > ../history
+cut -d' ' -f3 ../history | paste -sd' ' | grep "^$(git rev-parse master) (deleted)$"
+cut -d' ' -f2 ../history | grep -E '^[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:]{8}(Z|[+-][0-9:]{5})$'
+git-remote-restic --ref-history origin --utc refs/heads/feature | cut -d' ' -f2 | grep 'Z$'
+git-remote-restic --manifest origin "$(date -d '+1 hour' '+%Y-%m-%d %H:%M')" | grep '"refs"'
+! git-remote-restic --manifest origin 2000-01-01
+rm ../history
+
+banner "Test that the incremental layout only stores new packs in each snapshot"
+git commit --allow-empty -m 'Incremental commit'
+git -c restic.incrementalLayout=true push origin master
+restic ls -r ../restic latest | grep '^/restic-packs/000001/pack-'
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+git clone restic::local:../restic ../incremental
+[ "$(git -C ../incremental rev-parse origin/master)" == "$(git rev-parse master)" ]
+rm -rf ../incremental
+git reset --hard HEAD^
+git push --force origin master
+! restic ls -r ../restic latest | grep restic-packs
+
+banner "Test that a push with bandwidth, connection, compression, pack size, and verification options succeeds"
+git commit --allow-empty -m 'Limited commit'
+git -c restic.limitUpload=100000 push origin master
+[ "$(RESTIC_LIMIT_DOWNLOAD=100000 git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! git -c restic.limitUpload=fast ls-remote origin
+git -c restic.connections=1 push origin master
+git -c restic.option=connections=1 -c restic.option=local.connections=2 ls-remote origin
+! git -c restic.connections=0 ls-remote origin
+git commit --allow-empty -m 'Compressed by restic commit'
+git -c restic.compression=max push origin master
+[ "$(RESTIC_COMPRESSION=auto git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! git -c restic.compression=best ls-remote origin
+git commit --allow-empty -m 'Large pack commit'
+git -c restic.packSize=64 push origin master
+[ "$(RESTIC_PACK_SIZE=8 git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+! git -c restic.packSize=big ls-remote origin
+git commit --allow-empty -m 'Unverified commit'
+git -c restic.noExtraVerify=true push origin master
+! git -c restic.noExtraVerify=maybe ls-remote origin
+git reset --hard HEAD~4
+git push --force origin master
+
+banner "Test that a push with a limit on staged data succeeds"
+git commit --allow-empty -m 'Staged commit'
+git -c restic.maxStagedSize=1 push origin master
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that a push with compressed temporary files succeeds"
+git commit --allow-empty -m 'Compressed commit'
+git -c restic.compressTempFiles=true -c restic.maxStagedSize=1 push origin master
+[ "$(git ls-remote origin refs/heads/master | cut -f1)" == "$(git rev-parse master)" ]
+git reset --hard HEAD^
+git push --force origin master
+
+banner "Test that snapshots made by restic backup are reported and can be excluded by tag"
+mkdir ../other
+echo 'Other data' > ../other/file
+restic -r ../restic list snapshots | sort > ../snapshots-before
+restic backup -r ../restic "$(cd ../other && pwd)"
+git ls-remote origin 2> ../stderr || true
+grep "restic backup" ../stderr
+git config restic.snapshotTag git
+git push origin master
+[ "$(git ls-remote origin refs/heads/master 2> ../stderr | cut -f1)" == "$(git rev-parse master)" ]
+! grep "restic backup" ../stderr
+restic snapshots -r ../restic --tag git latest
+git config --unset restic.snapshotTag
+restic -r ../restic list snapshots | sort | comm -13 ../snapshots-before - | xargs restic -r ../restic forget
+rm -rf ../other ../stderr ../snapshots-before
+
 banner "Test that the restic repository works as a bare git repository"
 cd ..
 rm -rf workdir
@@ -0,0 +1,225 @@
+package resticfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/restic/restic/lib/restic"
+	"golang.org/x/sync/errgroup"
+)
+
+// archivePrefetch is the number of blobs of a file which are loaded ahead of
+// the one being written to an archive.
+const archivePrefetch = 8
+
+// archiveEpoch is used for entries without a modification time, such as
+// those in deterministic snapshots, since the zero time can't be represented
+// in archives.
+var archiveEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ErrUncommittedChanges indicates that an archive couldn't be created because
+// the directory has changes which are not part of a snapshot yet.
+var ErrUncommittedChanges = errors.New("directory has uncommitted changes")
+
+// archiveWriter adds the entries of a snapshot to an archive.
+type archiveWriter interface {
+	// WriteEntry adds an entry to the archive. For files, the content is
+	// written to the returned io.Writer, which is nil for other entries.
+	WriteEntry(name string, node *restic.Node) (io.Writer, error)
+	Close() error
+}
+
+// WriteTar writes the directory at dir and everything in it to w as a tar
+// archive. Names in the archive are relative to dir. The directory must not
+// have uncommitted changes. Files are read directly from the repository
+// rather than through the Filesystem, so this doesn't affect the blob cache,
+// and only holds the lock of the Filesystem while looking up dir.
+func (fs *Filesystem) WriteTar(ctx context.Context, w io.Writer, dir string) error {
+	return fs.writeArchive(ctx, &tarArchive{tar.NewWriter(w)}, dir)
+}
+
+// WriteZip is like WriteTar, but writes a zip archive. File contents are
+// compressed using deflate.
+func (fs *Filesystem) WriteZip(ctx context.Context, w io.Writer, dir string) error {
+	return fs.writeArchive(ctx, &zipArchive{zip.NewWriter(w)}, dir)
+}
+
+func (fs *Filesystem) writeArchive(ctx context.Context, aw archiveWriter, dir string) error {
+	id, err := fs.committedTree(dir)
+	if err != nil {
+		return err
+	}
+	if err := fs.archiveTree(ctx, aw, "", id); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// committedTree returns the ID of the tree stored for the directory at dir.
+func (fs *Filesystem) committedTree(dir string) (restic.ID, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	components, err := cleanPath(dir)
+	if err != nil {
+		return restic.ID{}, err
+	}
+	tree, err := fs.getTree(components, false)
+	if err != nil {
+		return restic.ID{}, err
+	} else if tree.ID == nil {
+		return restic.ID{}, ErrUncommittedChanges
+	}
+	return *tree.ID, nil
+}
+
+func (fs *Filesystem) archiveTree(ctx context.Context, aw archiveWriter, dir string, id restic.ID) error {
+	tree, err := fs.loadTree(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, node := range tree.Nodes {
+		name := path.Join(dir, node.Name)
+		switch node.Type {
+		case "dir", "file", "symlink":
+		default:
+			// Other node types can't be represented in every archive
+			// format, and never appear in git repositories.
+			continue
+		}
+		w, err := aw.WriteEntry(name, node)
+		if err != nil {
+			return err
+		}
+		switch node.Type {
+		case "dir":
+			if node.Subtree == nil {
+				return fmt.Errorf("%v: directory has no subtree", name)
+			}
+			err = fs.archiveTree(ctx, aw, name, *node.Subtree)
+		case "file":
+			err = fs.copyBlobs(ctx, w, node.Content)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyBlobs writes the contents of the data blobs to w in order, loading up
+// to archivePrefetch blobs ahead.
+func (fs *Filesystem) copyBlobs(ctx context.Context, w io.Writer, blobs restic.IDs) error {
+	if len(blobs) == 0 {
+		return nil
+	}
+	wg, ctx := errgroup.WithContext(ctx)
+	pending := make(chan chan []byte, archivePrefetch)
+	wg.Go(func() error {
+		defer close(pending)
+		for _, id := range blobs {
+			id := id
+			result := make(chan []byte, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wg.Go(func() error {
+				blob, err := fs.loadBlob(ctx, restic.DataBlob, id)
+				if err != nil {
+					return err
+				}
+				result <- blob
+				return nil
+			})
+		}
+		return nil
+	})
+	wg.Go(func() error {
+		for result := range pending {
+			select {
+			case blob := <-result:
+				if _, err := w.Write(blob); err != nil {
+					return err
+				}
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	return wg.Wait()
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a *tarArchive) WriteEntry(name string, node *restic.Node) (io.Writer, error) {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(node.Mode.Perm()),
+		Uid:     int(node.UID),
+		Gid:     int(node.GID),
+		Uname:   node.User,
+		Gname:   node.Group,
+		ModTime: node.ModTime,
+	}
+	switch node.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case "file":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(node.Size)
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = node.LinkTarget
+	}
+	if hdr.ModTime.IsZero() {
+		hdr.ModTime = archiveEpoch
+	}
+	if err := a.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	return a.Writer, nil
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) WriteEntry(name string, node *restic.Node) (io.Writer, error) {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Modified: node.ModTime,
+	}
+	if hdr.Modified.IsZero() {
+		hdr.Modified = archiveEpoch
+	}
+	switch node.Type {
+	case "dir":
+		hdr.Name += "/"
+		hdr.SetMode(os.ModeDir | node.Mode.Perm())
+	case "file":
+		hdr.Method = zip.Deflate
+		hdr.SetMode(node.Mode.Perm())
+	case "symlink":
+		hdr.SetMode(os.ModeSymlink | node.Mode.Perm())
+	}
+	w, err := a.CreateHeader(hdr)
+	if err != nil {
+		return nil, err
+	}
+	if node.Type == "symlink" {
+		_, err = io.WriteString(w, node.LinkTarget)
+	}
+	return w, err
+}
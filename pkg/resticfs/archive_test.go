@@ -0,0 +1,92 @@
+package resticfs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeArchiveFixture commits a snapshot containing a small file and a file
+// large enough to be split into several blobs, and returns their contents.
+func writeArchiveFixture(t *testing.T, fs *Filesystem) map[string][]byte {
+	large := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(large)
+	files := map[string][]byte{
+		"dir/file-1":       []byte("content of file-1\n"),
+		"dir/sub/large":    large,
+		"outside/of/dir-1": []byte("not archived\n"),
+	}
+	fs.StartNewSnapshot()
+	for name, content := range files {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	err := fs.WriteTar(testCtx, ioutil.Discard, "dir")
+	require.Equal(t, ErrUncommittedChanges, err)
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	require.Greater(t, len(fs.root.Find("dir").subtree.Find("sub").subtree.Find("large").Content), 1)
+	return map[string][]byte{
+		"file-1":    files["dir/file-1"],
+		"sub/large": large,
+	}
+}
+
+func TestWriteTar(t *testing.T) {
+	fs := openTestRepo(t)
+	expected := writeArchiveFixture(t, fs)
+
+	var buf bytes.Buffer
+	require.NoError(t, fs.WriteTar(testCtx, &buf, "dir"))
+	rd := tar.NewReader(&buf)
+	var dirs []string
+	actual := map[string][]byte{}
+	for {
+		hdr, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr.Name)
+			continue
+		}
+		actual[hdr.Name], err = ioutil.ReadAll(rd)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"sub/"}, dirs)
+	require.Equal(t, expected, actual)
+}
+
+func TestWriteZip(t *testing.T) {
+	fs := openTestRepo(t)
+	expected := writeArchiveFixture(t, fs)
+
+	var buf bytes.Buffer
+	require.NoError(t, fs.WriteZip(testCtx, &buf, "/dir/"))
+	rd, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	actual := map[string][]byte{}
+	for _, file := range rd.File {
+		if file.FileInfo().IsDir() {
+			require.Equal(t, "sub/", file.Name)
+			continue
+		}
+		f, err := file.Open()
+		require.NoError(t, err)
+		actual[file.Name], err = ioutil.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	require.Equal(t, expected, actual)
+}
@@ -0,0 +1,190 @@
+package resticfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressor compresses the temporary files of modified files once they are
+// closed, which reduces the scratch space needed for large snapshots at the
+// cost of CPU time. The files are decompressed as they are read, including
+// when they are chunked as the snapshot is committed, and are decompressed
+// into a new temporary file when they are opened for writing again.
+type Compressor interface {
+	// NewWriter returns a writer which compresses the data written to it
+	// into w. The compressed data is complete once the writer is closed.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a reader of the data compressed in r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// ZstdCompressor is a Compressor which uses zstd at its fastest level, so that
+// compression keeps up with a fast disk.
+type ZstdCompressor struct{}
+
+func (ZstdCompressor) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+}
+
+func (ZstdCompressor) NewReader(r io.Reader) (io.ReadCloser, error) {
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// compressedFile is the read-only backing of a closed file whose temporary
+// file is compressed. Reads are served by a decompressor, which is restarted
+// from the beginning when a read precedes its position, so sequential reads
+// are fast and random reads are slow.
+type compressedFile struct {
+	file       billy.File
+	compressor Compressor
+	size       int64
+	isClosed   bool
+	position   int64
+
+	mu sync.Mutex
+	// rd decompresses the file, and has returned the data before offset.
+	rd     io.ReadCloser
+	offset int64
+}
+
+var _ billy.File = (*compressedFile)(nil)
+
+// compress writes the contents of the temporary file src, which holds size
+// bytes, compressed to a new temporary file, and returns the backing which
+// reads it. src is left alone.
+func (fs *Filesystem) compress(src billy.File, size int64, name string) (*compressedFile, error) {
+	dst, err := fs.tempFile(name)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		w, err := fs.TempCompressor.NewWriter(dst)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(src, 0, size)); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	}()
+	if err != nil {
+		dst.Close()
+		fs.removeTemp(dst.Name())
+		return nil, err
+	}
+	return &compressedFile{file: dst, compressor: fs.TempCompressor, size: size}, nil
+}
+
+func (f *compressedFile) Name() string {
+	return f.file.Name()
+}
+
+func (f *compressedFile) Lock() error {
+	return nil
+}
+
+func (f *compressedFile) Unlock() error {
+	return nil
+}
+
+func (f *compressedFile) Truncate(size int64) error {
+	return os.ErrPermission
+}
+
+func (f *compressedFile) Close() error {
+	if f.isClosed {
+		return os.ErrClosed
+	}
+	f.isClosed = true
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rd != nil {
+		f.rd.Close()
+		f.rd = nil
+	}
+	return f.file.Close()
+}
+
+func (f *compressedFile) Write(p []byte) (int, error) {
+	if f.isClosed {
+		return 0, os.ErrClosed
+	}
+	return 0, os.ErrPermission
+}
+
+func (f *compressedFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.position)
+	f.position += int64(n)
+	if err == io.EOF && n != 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *compressedFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.isClosed {
+		return 0, os.ErrClosed
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rd == nil || off < f.offset {
+		if f.rd != nil {
+			f.rd.Close()
+		}
+		rd, err := f.compressor.NewReader(io.NewSectionReader(f.file, 0, 1<<62))
+		if err != nil {
+			f.rd = nil
+			return 0, err
+		}
+		f.rd, f.offset = rd, 0
+	}
+	if off > f.offset {
+		skipped, err := io.CopyN(ioutil.Discard, f.rd, off-f.offset)
+		f.offset += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+	want := len(b)
+	if remaining := f.size - off; int64(want) > remaining {
+		want = int(remaining)
+	}
+	n, err := io.ReadFull(f.rd, b[:want])
+	f.offset += int64(n)
+	if err != nil {
+		return n, err
+	} else if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	if f.isClosed {
+		return 0, os.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		f.position += offset
+	case io.SeekStart:
+		f.position = offset
+	case io.SeekEnd:
+		f.position = f.size + offset
+	}
+
+	return f.position, nil
+}
@@ -0,0 +1,69 @@
+package resticfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/restic/restic/lib/repository"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTempCompressor(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.Temporary = memfs.New()
+	fs.TempCompressor = ZstdCompressor{}
+	fs.StartNewSnapshot()
+
+	content := bytes.Repeat([]byte("compressible content\n"), 10000)
+	file, err := fs.Create("file")
+	require.NoError(t, err)
+	_, err = file.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Less(t, fs.StagedBytes(), int64(len(content))/10)
+	fi, err := fs.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), fi.Size())
+
+	// Reads may go backwards.
+	file, err = fs.Open("file")
+	require.NoError(t, err)
+	buf := make([]byte, 21)
+	_, err = file.(io.ReaderAt).ReadAt(buf, 21*5000)
+	require.NoError(t, err)
+	require.Equal(t, "compressible content\n", string(buf))
+	data, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.Equal(t, content, data)
+	require.NoError(t, file.Close())
+
+	// Writing decompresses the file again.
+	file, err = fs.OpenFile("file", os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = file.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("more"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	content = append(content, "more"...)
+	entries, err := fs.Temporary.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	fs, err = New(testCtx, repo, &id)
+	require.NoError(t, err)
+	file, err = fs.Open("file")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, content, data)
+}
@@ -0,0 +1,13 @@
+// Package resticfs exposes restic snapshots as go-billy filesystems.
+//
+// A Filesystem opened with New is read-only, and can browse any snapshot,
+// including those created by restic itself. The snapshot contains the full
+// paths of the directories which were backed up, relative to the root of the
+// Filesystem. Symbolic links are followed by Stat, OpenFile and ReadDir, and
+// described by Lstat and Readlink. The contents of files are loaded from the
+// repository as they are read, and io.Copy streams them, loading the
+// following blobs ahead of time.
+//
+// After StartNewSnapshot, the Filesystem can be modified, and CommitSnapshot
+// saves the changes as a new snapshot.
+package resticfs
@@ -51,6 +51,9 @@ func (f *fileHandle) Unlock() error {
 func (f *fileHandle) Truncate(size int64) error {
 	backing := f.n.Backing()
 	err := backing.Truncate(size)
+	if err == nil {
+		f.n.touch()
+	}
 	return err
 }
 
@@ -66,6 +69,14 @@ func (f *fileHandle) Close() error {
 	f.isClosed = true
 	if f.flag&oWRITEABLE != 0 {
 		f.n.openWriters--
+		if f.n.openWriters == 0 && f.n.removed {
+			return f.n.releaseBacking()
+		} else if f.n.openWriters == 0 {
+			if err := f.n.compressBacking(); err != nil {
+				return err
+			}
+			f.n.stage()
+		}
 	}
 	return nil
 }
@@ -81,8 +92,17 @@ func (f *fileHandle) Write(p []byte) (int, error) {
 		// Need to atomically seek and write when this flag is specified.
 		panic("O_APPEND not supported")
 	}
+	// The backing is shared by all handles to the file, so its position
+	// can't be relied upon.
 	backing := f.n.Backing()
+	if _, err := backing.Seek(f.position, io.SeekStart); err != nil {
+		return 0, err
+	}
 	n, err := backing.Write(p)
+	f.position += int64(n)
+	if n > 0 {
+		f.n.touch()
+	}
 	return n, err
 }
 
@@ -104,6 +124,24 @@ func (f *fileHandle) ReadAt(b []byte, pos int64) (int, error) {
 	return n, err
 }
 
+// WriteTo writes the rest of the file to w, and is used by io.Copy. Files
+// which have not been modified are streamed from the repository, see
+// (*resticFile).writeAt.
+func (f *fileHandle) WriteTo(w io.Writer) (int64, error) {
+	if f.isClosed {
+		return 0, os.ErrClosed
+	}
+	backing, ok := f.n.Backing().(*resticFile)
+	if !ok {
+		// Hide WriteTo from io.Copy, which would otherwise call it again.
+		// Read advances the position.
+		return io.Copy(w, struct{ io.Reader }{f})
+	}
+	n, err := backing.writeAt(w, f.position)
+	f.position += n
+	return n, err
+}
+
 func (f *fileHandle) Seek(offset int64, whence int) (int64, error) {
 	if f.isClosed {
 		return 0, os.ErrClosed
@@ -115,7 +153,7 @@ func (f *fileHandle) Seek(offset int64, whence int) (int64, error) {
 	case io.SeekStart:
 		f.position = offset
 	case io.SeekEnd:
-		f.position = int64(f.n.Node.Size) + offset
+		f.position = f.n.size() + offset
 	}
 
 	return f.position, nil
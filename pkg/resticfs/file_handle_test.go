@@ -33,3 +33,26 @@ func TestCopyOnWrite(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("But with revised con"), b1)
 }
+
+func TestRewriteUncommitted(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	h1, err := fs.Create("HEAD")
+	require.NoError(t, err)
+	_, err = h1.Write([]byte("ref: refs/heads/master\n"))
+	require.NoError(t, err)
+	require.NoError(t, h1.Close())
+
+	h2, err := fs.Create("HEAD")
+	require.NoError(t, err)
+	_, err = h2.Write([]byte("ref: refs/heads/main\n"))
+	require.NoError(t, err)
+	require.NoError(t, h2.Close())
+
+	h3, err := fs.Open("HEAD")
+	require.NoError(t, err)
+	actual, err := io.ReadAll(h3)
+	require.NoError(t, err)
+	require.Equal(t, "ref: refs/heads/main\n", string(actual))
+}
@@ -3,13 +3,12 @@ package resticfs
 import (
 	"context"
 	"errors"
-	"log"
 	"os"
-	"os/user"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -24,28 +23,16 @@ import (
 // Currently hardcoded to 64 MiB.
 const blobCacheSize = 64 << 20
 
-var uid, gid uint32
-var userName, groupName, hostname string
-
 // ErrNoChanges indicates that a snapshot was not created because it would be
 // identical to the parent snapshot.
 var ErrNoChanges = errors.New("no changes to commit")
 
-func init() {
-	uid = uint32(os.Getuid())
-	u, err := user.Current()
-	if err == nil {
-		userName = u.Username
-	}
+// ErrInvalidPath indicates that a path refers to a location outside of the
+// root of the Filesystem, or to the root itself where a file is required.
+var ErrInvalidPath = errors.New("invalid path")
 
-	gid = uint32(os.Getgid())
-	g, err := user.LookupGroupId(strconv.Itoa(int(gid)))
-	if err == nil {
-		groupName = g.Name
-	}
-
-	hostname, _ = os.Hostname()
-}
+// defaultDirectoryMode is used for directories which are created implicitly.
+const defaultDirectoryMode = 0755
 
 // Filesystem satisfies billy.Filesystem and allows reading and writing restic
 // snapshots. By default, Filesystems are read-only, writing can be enabled
@@ -57,16 +44,99 @@ type Filesystem struct {
 	ctx       context.Context
 	repo      restic.Repository
 	writable  bool
+	parent    *restic.ID
 	root      *resticTree
 	blobCache *blobCache
+	// trees, if set, holds the trees loaded by this and other Filesystems.
+	trees *Cache
 	// Temporary is the backing store for temporary files created by the
-	// Filesystem. The default value for Temporary is an osfs.FileSystem, but a
-	// custom value can be provided here.
+	// Filesystem. The default value for Temporary is an osfs.FileSystem in
+	// the system temporary directory, but a custom value can be provided
+	// here. Temporary files are removed once they are committed or the file
+	// is removed. Temporary is only used by one goroutine at a time, so it
+	// doesn't have to be safe for concurrent use.
 	Temporary billy.Filesystem
-	// Logger can be provided to enable detailed logging of operations.
-	Logger  *log.Logger
+	// Logger can be provided to enable detailed logging of operations. Use
+	// StdLogger to log to a *log.Logger.
+	Logger Logger
+	// Deterministic causes new files and directories to be created with
+	// fixed timestamps and no ownership information, so that the same
+	// content produces the same tree regardless of who writes it.
+	Deterministic bool
+	// FreezeTimes keeps the timestamps of files and directories unchanged
+	// when they are modified or renamed, so they only reflect when they were
+	// created. It is implied by Deterministic.
+	FreezeTimes bool
+	// Exclude, if set, is called with the slash-separated path of every
+	// modified file and directory when a snapshot is committed. Those for
+	// which it returns true, such as temporary files, are left out of the
+	// snapshot, but remain in the Filesystem.
+	Exclude func(path string) bool
+	// ChunkerWorkers is the maximum number of modified files which are
+	// chunked and encrypted concurrently when a snapshot is committed. Values
+	// below 2 commit files one at a time. Uploads run in separate goroutines,
+	// so on a slow CPU, a low value leaves more time for keeping the
+	// connections to the backend busy.
+	ChunkerWorkers int
+	// MaxStagedBytes limits the size of the temporary files of closed,
+	// modified files. When they hold more, they are saved to the repository
+	// before the next file is opened for writing, and their temporary files
+	// are removed, without creating a snapshot. Zero disables the limit.
+	MaxStagedBytes int64
+	// TempCompressor, if set, compresses the temporary file of each
+	// modified file once it is closed, which reduces the space used in
+	// Temporary. MaxStagedBytes then applies to the compressed size.
+	TempCompressor Compressor
+	// PreCommit, if set, is called by CommitSnapshot with the result of
+	// ChangedFiles before anything is saved, and may read the files, for
+	// example to scan them for secrets. If it returns an error, no snapshot
+	// is created, CommitSnapshot returns the error, and the changes remain
+	// pending. It isn't called when no files were created or modified.
+	PreCommit func(changed []string) error
+
+	chunker *fileChunker
+	// tempMu serializes access to Temporary, see tempFile.
+	tempMu  sync.Mutex
+	statsMu sync.Mutex
+	stats   CommitStats
+	// staged is the size of the temporary files of closed, modified files.
+	// It is accessed atomically.
+	staged int64
+	// flushed is set when files were saved by flushStaged since the last
+	// snapshot, whose statistics are part of the next snapshot.
+	flushed bool
+	// flushedFiles are the paths of the files which were saved by
+	// flushStaged since the last snapshot.
+	flushedFiles []string
+	// skipped holds the paths of the nodes of unsupported types which have
+	// been reported to the Logger.
+	skipped map[string]bool
+}
+
+// saveBatchSize is the amount of chunked file data which is collected before
+// the chunks are saved to the repository.
+const saveBatchSize = 8 << 20
+
+// fileChunker holds the state needed to split a file into chunks, which is
+// reused between files.
+type fileChunker struct {
 	chunker *chunker.Chunker
-	buf     []byte
+	// batch holds the data of the chunks which have not been saved yet,
+	// and has room for saveBatchSize bytes plus one more chunk.
+	batch  []byte
+	chunks []batchChunk
+}
+
+// batchChunk locates a chunk in the batch of a fileChunker.
+type batchChunk struct {
+	id         restic.ID
+	start, end int
+}
+
+// pendingFile is a modified file which has not been saved to the repository.
+type pendingFile struct {
+	name string
+	node *resticNode
 }
 
 var _ billy.Basic = (*Filesystem)(nil)
@@ -78,25 +148,35 @@ var _ billy.TempFile = (*Filesystem)(nil)
 // will be initially empty. The caller is responsible for properly locking and
 // unlocking the restic repository.
 func New(ctx context.Context, repo restic.Repository, parentSnapshotID *restic.ID) (*Filesystem, error) {
-	fs := &Filesystem{
+	fs := newFilesystem(ctx, repo, parentSnapshotID)
+	if err := fs.openRoot(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func newFilesystem(ctx context.Context, repo restic.Repository, parentSnapshotID *restic.ID) *Filesystem {
+	return &Filesystem{
 		ctx:       ctx,
 		repo:      repo,
+		parent:    parentSnapshotID,
 		blobCache: newBlobCache(blobCacheSize),
-		Temporary: osfs.New(""),
+		Temporary: osfs.New(os.TempDir()),
 	}
-	if parentSnapshotID != nil {
-		snapshot, err := restic.LoadSnapshot(ctx, repo, *parentSnapshotID)
-		if err != nil {
-			return nil, err
-		}
-		fs.root, err = openTree(fs, nil, *snapshot.Tree)
-		if err != nil {
-			return nil, err
-		}
-	} else {
+}
+
+// openRoot loads the root tree of the parent snapshot.
+func (fs *Filesystem) openRoot() error {
+	if fs.parent == nil {
 		fs.root = newTree(fs, nil)
+		return nil
 	}
-	return fs, nil
+	snapshot, err := restic.LoadSnapshot(fs.ctx, fs.repo, *fs.parent)
+	if err != nil {
+		return err
+	}
+	fs.root, err = openTree(fs, nil, *snapshot.Tree)
+	return err
 }
 
 // StartNewSnapshot enables writing to this Filesystem.  Writing to files is
@@ -105,7 +185,7 @@ func New(ctx context.Context, repo restic.Repository, parentSnapshotID *restic.I
 // the data will be orphaned until the CommitSnapshot method is called.
 func (fs *Filesystem) StartNewSnapshot() {
 	if fs.Logger != nil {
-		fs.Logger.Printf("StartNewSnapshot()\n")
+		fs.Logger.Debugf("StartNewSnapshot()")
 	}
 	fs.writable = true
 }
@@ -114,6 +194,13 @@ func (fs *Filesystem) StartNewSnapshot() {
 // resulting as a tree as a new snapshot. May return ErrNoChanges if commiting
 // a snapshot would be redundant.
 func (fs *Filesystem) CommitSnapshot(path string, tags []string) (id restic.ID, err error) {
+	if fs.PreCommit != nil {
+		if changed := fs.ChangedFiles(); len(changed) > 0 {
+			if err := fs.PreCommit(changed); err != nil {
+				return restic.ID{}, err
+			}
+		}
+	}
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	if fs.Logger != nil {
@@ -124,17 +211,26 @@ func (fs *Filesystem) CommitSnapshot(path string, tags []string) (id restic.ID,
 			} else {
 				val = &id
 			}
-			fs.Logger.Printf("CommitSnapshot() => %v\n", val)
+			fs.Logger.Debugf("CommitSnapshot() => %v", val)
 		}()
 	}
+	if !fs.flushed {
+		fs.stats = CommitStats{Files: map[string]BlobStats{}}
+	}
 	if !fs.root.IsDirty() {
 		return restic.ID{}, ErrNoChanges
 	}
+	fs.flushed = false
 	wg, ctx := errgroup.WithContext(fs.ctx)
 	fs.repo.StartPackUploader(ctx, wg)
 	var tree restic.ID
 	var snapshot *restic.Snapshot
-	tree, err = fs.root.Commit()
+	if fs.ChunkerWorkers > 1 {
+		if err = fs.commitFiles(ctx, fs.root.pendingFiles("", nil)); err != nil {
+			return restic.ID{}, err
+		}
+	}
+	tree, err = fs.root.Commit("")
 	if err != nil {
 		return restic.ID{}, err
 	}
@@ -142,11 +238,17 @@ func (fs *Filesystem) CommitSnapshot(path string, tags []string) (id restic.ID,
 	if err != nil {
 		return restic.ID{}, err
 	}
-	snapshot, err = restic.NewSnapshot([]string{path}, tags, hostname, time.Now())
+	owner := getOwner()
+	snapshot, err = restic.NewSnapshot([]string{path}, tags, owner.hostname, time.Now())
 	if err != nil {
 		return restic.ID{}, err
 	}
+	// NewSnapshot looks up the current user itself, ignoring failures.
+	snapshot.Username = owner.user
+	snapshot.UID = owner.uid
+	snapshot.GID = owner.gid
 	snapshot.Tree = &tree
+	snapshot.Parent = fs.parent
 	id, err = restic.SaveSnapshot(fs.ctx, fs.repo, snapshot)
 	if err != nil {
 		return restic.ID{}, err
@@ -154,9 +256,145 @@ func (fs *Filesystem) CommitSnapshot(path string, tags []string) (id restic.ID,
 	if err := wg.Wait(); err != nil {
 		return restic.ID{}, err
 	}
+	fs.parent = &id
+	fs.flushedFiles = nil
+	if fs.Logger != nil {
+		fs.Logger.Infof("saved snapshot %v with tree %v", id.Str(), tree.Str())
+	}
 	return id, nil
 }
 
+// ChangedFiles returns the slash-separated paths of the files which were
+// created or modified since the last snapshot, in sorted order. Files which
+// were saved early because of MaxStagedBytes are included even if they were
+// removed afterwards.
+func (fs *Filesystem) ChangedFiles() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	changed := append([]string{}, fs.flushedFiles...)
+	for _, file := range fs.root.pendingFiles("", nil) {
+		changed = append(changed, filepath.ToSlash(file.name))
+	}
+	sort.Strings(changed)
+	unique := changed[:0]
+	for i, name := range changed {
+		if i == 0 || name != changed[i-1] {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// commitFiles saves the given modified files to the repository using up to
+// ChunkerWorkers goroutines, so that committing the trees afterwards only
+// needs to save the trees themselves.
+func (fs *Filesystem) commitFiles(ctx context.Context, files []pendingFile) error {
+	queue := make(chan pendingFile)
+	wg, ctx := errgroup.WithContext(ctx)
+	wg.Go(func() error {
+		defer close(queue)
+		for _, file := range files {
+			select {
+			case queue <- file:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	for i := 0; i < fs.ChunkerWorkers && i < len(files); i++ {
+		wg.Go(func() error {
+			fc := &fileChunker{}
+			for file := range queue {
+				if err := file.node.commitFile(file.name, fc); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return wg.Wait()
+}
+
+// saveBatch saves the chunks collected by fc to the repository and empties the
+// batch. The chunks are first checked against the index together, skipping
+// those which occur more than once, and the remaining ones are then saved one
+// after another, so that the new blobs of a file end up next to each other in
+// the packs.
+func (fs *Filesystem) saveBatch(fc *fileChunker, stats *BlobStats) error {
+	idx := fs.repo.Index()
+	seen := make(map[restic.ID]struct{}, len(fc.chunks))
+	var missing []batchChunk
+	for _, c := range fc.chunks {
+		_, dup := seen[c.id]
+		if dup || idx.Has(restic.BlobHandle{ID: c.id, Type: restic.DataBlob}) {
+			stats.addBlob(uint(c.end-c.start), false, 0)
+			continue
+		}
+		seen[c.id] = struct{}{}
+		missing = append(missing, c)
+	}
+	for _, c := range missing {
+		// Another file being committed concurrently may have saved the
+		// same blob since the index was checked, in which case restic
+		// reports it as known and doesn't store it again.
+		_, known, stored, err := fs.repo.SaveBlob(fs.ctx, restic.DataBlob, fc.batch[c.start:c.end], c.id, false)
+		if err != nil {
+			return err
+		}
+		stats.addBlob(uint(c.end-c.start), !known, stored)
+	}
+	fc.batch = fc.batch[:0]
+	fc.chunks = fc.chunks[:0]
+	return nil
+}
+
+// freezeTimes reports whether modifications leave timestamps unchanged.
+func (fs *Filesystem) freezeTimes() bool {
+	return fs.Deterministic || fs.FreezeTimes
+}
+
+// isExcluded reports whether the file at path is left out of snapshots.
+func (fs *Filesystem) isExcluded(path string) bool {
+	return fs.Exclude != nil && fs.Exclude(filepath.ToSlash(path))
+}
+
+// Stats returns statistics about the data written by the most recent call to
+// CommitSnapshot, including the files which were saved before it because of
+// MaxStagedBytes.
+func (fs *Filesystem) Stats() CommitStats {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.stats
+}
+
+// SetParent changes the snapshot which will be recorded as the parent of the
+// next snapshot created by CommitSnapshot. By default, this is the snapshot
+// the Filesystem was created from.
+func (fs *Filesystem) SetParent(id *restic.ID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.parent = id
+}
+
+// Check verifies that all of the trees and blobs referenced by the Filesystem
+// are present in the repository, without reading the contents of any files.
+func (fs *Filesystem) Check() (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("Check() => %v", err)
+		}()
+	}
+	// Loading the trees in batches is much faster than loading them one at
+	// a time as they are checked.
+	if err := fs.prefetch(fs.ctx, fs.root.Nodes, 0); err != nil {
+		return err
+	}
+	return fs.root.Check("")
+}
+
 // Create creates the named file with mode 0666 (before umask), truncating
 // it if it already exists. If successful, methods on the returned File can
 // be used for I/O; the associated file descriptor has mode O_RDWR.
@@ -180,20 +418,31 @@ func (fs *Filesystem) OpenFile(fullpath string, flag int, perm os.FileMode) (fil
 	defer fs.mu.Unlock()
 	if fs.Logger != nil {
 		defer func() {
-			fs.Logger.Printf("OpenFile(%#v, %x, 0%03o) => %v\n", fullpath, flag, perm, err)
+			fs.Logger.Debugf("OpenFile(%#v, %x, 0%03o) => %v", fullpath, flag, perm, err)
 		}()
 	}
-	dir, filename := filepath.Split(fullpath)
+	components, err := fs.resolve(fullpath, true)
+	if err != nil {
+		return nil, err
+	} else if len(components) == 0 {
+		return nil, ErrInvalidPath
+	}
+	if flag&oWRITEABLE != 0 && fs.MaxStagedBytes > 0 && atomic.LoadInt64(&fs.staged) > fs.MaxStagedBytes {
+		if err = fs.flushStaged(); err != nil {
+			return nil, err
+		}
+	}
 	var tree *resticTree
-	tree, err = fs.getTree(dir)
+	tree, err = fs.getTree(components[:len(components)-1], flag&os.O_CREATE != 0)
 	if err != nil {
 		return nil, err
 	}
-	file, err = tree.OpenFile(fullpath, filename, flag, perm)
+	file, err = tree.OpenFile(fullpath, components[len(components)-1], flag, perm)
 	return file, err
 }
 
-// Stat returns a FileInfo describing the named file.
+// Stat returns a FileInfo describing the named file. Symbolic links are
+// followed, see Lstat.
 func (fs *Filesystem) Stat(fullpath string) (fi os.FileInfo, err error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -205,17 +454,16 @@ func (fs *Filesystem) Stat(fullpath string) (fi os.FileInfo, err error) {
 			} else {
 				val = fi
 			}
-			fs.Logger.Printf("Stat(%#v) => %v\n", fullpath, val)
+			fs.Logger.Debugf("Stat(%#v) => %v", fullpath, val)
 		}()
 	}
-	dir, filename := filepath.Split(fullpath)
-	tree, err := fs.getTree(dir)
+	components, err := fs.resolve(fullpath, true)
 	if err != nil {
 		return nil, err
 	}
-	node := tree.Find(filename)
-	if node == nil {
-		return nil, os.ErrNotExist
+	node, err := fs.lookupSupported(fullpath, components)
+	if err != nil {
+		return nil, err
 	}
 	return NodeInfo{node}, nil
 }
@@ -228,12 +476,21 @@ func (fs *Filesystem) Rename(oldpath, newpath string) (err error) {
 	defer fs.mu.Unlock()
 	if fs.Logger != nil {
 		defer func() {
-			fs.Logger.Printf("Rename(%#v, %#v) => %v\n", oldpath, newpath, err)
+			fs.Logger.Debugf("Rename(%#v, %#v) => %v", oldpath, newpath, err)
 		}()
 	}
 	var oldtree, newtree *resticTree
-	olddir, oldname := filepath.Split(oldpath)
-	oldtree, err = fs.getTree(olddir)
+	olddir, oldname, err := splitPath(oldpath)
+	if err != nil {
+		return err
+	}
+	newdir, newname, err := splitPath(newpath)
+	if err != nil {
+		return err
+	} else if oldname == "" || newname == "" {
+		return ErrInvalidPath
+	}
+	oldtree, err = fs.getTree(olddir, false)
 	if err != nil {
 		return err
 	}
@@ -241,8 +498,11 @@ func (fs *Filesystem) Rename(oldpath, newpath string) (err error) {
 	if node == nil {
 		return os.ErrNotExist
 	}
-	newdir, newname := filepath.Split(newpath)
-	newtree, err = fs.getTree(newdir)
+	if node.Type == "dir" && isWithin(newdir, append(olddir, oldname)) {
+		// A directory can't be moved into itself.
+		return ErrInvalidPath
+	}
+	newtree, err = fs.getTree(newdir, true)
 	if err != nil {
 		return err
 	}
@@ -255,12 +515,17 @@ func (fs *Filesystem) Remove(fullpath string) (err error) {
 	defer fs.mu.Unlock()
 	if fs.Logger != nil {
 		defer func() {
-			fs.Logger.Printf("Remove(%#v) => %v\n", fullpath, err)
+			fs.Logger.Debugf("Remove(%#v) => %v", fullpath, err)
 		}()
 	}
-	dir, filename := filepath.Split(fullpath)
+	dir, filename, err := splitPath(fullpath)
+	if err != nil {
+		return err
+	} else if filename == "" {
+		return ErrInvalidPath
+	}
 	var tree *resticTree
-	tree, err = fs.getTree(dir)
+	tree, err = fs.getTree(dir, false)
 	if err != nil {
 		return err
 	}
@@ -269,7 +534,7 @@ func (fs *Filesystem) Remove(fullpath string) (err error) {
 		return os.ErrNotExist
 	}
 	tree.Remove(filename)
-	return nil
+	return node.release()
 }
 
 // Join joins any number of path elements into a single path, adding a
@@ -293,21 +558,47 @@ func (fs *Filesystem) ReadDir(path string) (result []os.FileInfo, err error) {
 			} else {
 				val = result
 			}
-			fs.Logger.Printf("ReadDir(%#v) => %v\n", path, val)
+			fs.Logger.Debugf("ReadDir(%#v) => %v", path, val)
 		}()
 	}
+	var components []string
+	components, err = fs.resolve(path, true)
+	if err != nil {
+		return nil, err
+	}
 	var tree *resticTree
-	tree, err = fs.getTree(path)
+	tree, err = fs.getTree(components, false)
 	if err != nil {
 		return nil, err
 	}
-	result = make([]os.FileInfo, len(tree.Nodes))
-	for i, node := range tree.Nodes {
-		result[i] = NodeInfo{node}
+	result = make([]os.FileInfo, 0, len(tree.Nodes))
+	for _, node := range tree.Nodes {
+		if !isSupportedType(node.Type) {
+			fs.skipUnsupported(filepath.Join(path, node.Name), node.Type)
+			continue
+		}
+		result = append(result, NodeInfo{node})
 	}
 	return result, nil
 }
 
+// skipUnsupported reports that the node at path is skipped by a read, since
+// its type isn't supported. Each node is only reported once, and reads of
+// such nodes behave as if they didn't exist, so that a snapshot made by
+// restic from a directory which contained a socket can still be fetched.
+func (fs *Filesystem) skipUnsupported(path, nodeType string) {
+	if fs.skipped[path] {
+		return
+	}
+	if fs.skipped == nil {
+		fs.skipped = map[string]bool{}
+	}
+	fs.skipped[path] = true
+	if fs.Logger != nil {
+		fs.Logger.Warnf("skipping %v, restic nodes with type %#v are not supported", path, nodeType)
+	}
+}
+
 // MkdirAll creates a directory named path, along with any necessary
 // parents, and returns nil, or else returns an error. The permission bits
 // perm are used for all directories that MkdirAll creates. If path is/
@@ -315,27 +606,23 @@ func (fs *Filesystem) ReadDir(path string) (result []os.FileInfo, err error) {
 func (fs *Filesystem) MkdirAll(path string, perm os.FileMode) (err error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-	components := strings.Split(filepath.Clean(path), string(os.PathSeparator))
+	var components []string
+	components, err = cleanPath(path)
 	tree := fs.root
-	for _, component := range components {
-		if component == "" || component == "." {
-			continue
-		}
-		tree, err = tree.OpenSubtree(component, os.O_CREATE, perm)
-		if err != nil {
-			break
-		}
+	for i := 0; err == nil && i < len(components); i++ {
+		tree, err = tree.OpenSubtree(components[i], os.O_CREATE, perm)
 	}
 	if fs.Logger != nil {
-		fs.Logger.Printf("MkdirAll(%#v, 0%03o) => %v\n", path, perm, err)
+		fs.Logger.Debugf("MkdirAll(%#v, 0%03o) => %v", path, perm, err)
 	}
 	return err
 }
 
 // TempFile creates a new temporary file in the directory dir with a name
 // beginning with prefix, opens the file for reading and writing, and
-// returns the resulting *os.File. If dir is the empty string, TempFile
-// uses the default directory for temporary files (see os.TempDir).
+// returns the resulting *os.File. If dir is the empty string, the file is
+// created in the root of the filesystem, which is where go-git expects the
+// temporary files used to rewrite packed-refs.
 // Multiple programs calling TempFile simultaneously will not choose the
 // same file. The caller can use f.Name() to find the pathname of the file.
 // It is the caller's responsibility to remove the file when no longer
@@ -344,18 +631,24 @@ func (fs *Filesystem) TempFile(dir, prefix string) (billy.File, error) {
 	if !fs.writable {
 		return nil, os.ErrPermission
 	}
+	if dir == "" {
+		dir = "."
+	}
 	return billyutil.TempFile(fs, dir, prefix)
 }
 
-func (fs *Filesystem) getTree(path string) (*resticTree, error) {
-	components := strings.Split(filepath.Clean(path), string(os.PathSeparator))
+// getTree returns the directory with the given path components. If create is
+// true, like the OS filesystem used by go-git, any missing directories are
+// created.
+func (fs *Filesystem) getTree(components []string, create bool) (*resticTree, error) {
 	tree := fs.root
+	flag := 0
+	if create {
+		flag = os.O_CREATE
+	}
 	for _, component := range components {
-		if component == "" || component == "." {
-			continue
-		}
 		var err error
-		tree, err = tree.OpenSubtree(component, 0, 0)
+		tree, err = tree.OpenSubtree(component, flag, defaultDirectoryMode)
 		if err != nil {
 			return nil, err
 		}
@@ -363,12 +656,89 @@ func (fs *Filesystem) getTree(path string) (*resticTree, error) {
 	return tree, nil
 }
 
+// rootNode returns a node describing the root directory, which has no
+// metadata of its own.
+func (fs *Filesystem) rootNode() *resticNode {
+	return &resticNode{
+		fs:      fs,
+		Node:    restic.Node{Type: "dir", Mode: os.ModeDir | defaultDirectoryMode},
+		subtree: fs.root,
+	}
+}
+
+// cleanPath returns the components of path, which is relative to the root of
+// the Filesystem. Paths which refer outside of the root, such as "../file",
+// are rejected instead of being resolved against the root, so that they
+// can't reach unexpected nodes. An absolute path is relative to the root.
+func cleanPath(path string) ([]string, error) {
+	clean := strings.TrimPrefix(filepath.Clean(path), string(os.PathSeparator))
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) {
+		return nil, ErrInvalidPath
+	}
+	var components []string
+	for _, component := range strings.Split(clean, string(os.PathSeparator)) {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+	return components, nil
+}
+
+// splitPath returns the components of the directory containing path, and the
+// name of the entry at path, which is empty for the root.
+func splitPath(path string) (dir []string, name string, err error) {
+	components, err := cleanPath(path)
+	if err != nil || len(components) == 0 {
+		return nil, "", err
+	}
+	return components[:len(components)-1], components[len(components)-1], nil
+}
+
+// isWithin reports whether the path with the given components is dir or one
+// of its descendants.
+func isWithin(path, dir []string) bool {
+	if len(path) < len(dir) {
+		return false
+	}
+	for i := range dir {
+		if path[i] != dir[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// newNode returns the metadata for a new file or directory.
+func (fs *Filesystem) newNode(name string, nodeType string, perm os.FileMode) restic.Node {
+	if fs.Deterministic {
+		return restic.Node{
+			Name: name,
+			Type: nodeType,
+			Mode: perm & ^uMask,
+		}
+	}
+	now := time.Now()
+	owner := getOwner()
+	return restic.Node{
+		Name:       name,
+		Type:       nodeType,
+		Mode:       perm & ^uMask,
+		ModTime:    now,
+		AccessTime: now,
+		ChangeTime: now,
+		UID:        owner.uid,
+		GID:        owner.gid,
+		User:       owner.user,
+		Group:      owner.group,
+	}
+}
+
 func (fs *Filesystem) getBlob(id restic.ID) ([]byte, error) {
 	blob, ok := fs.blobCache.get(id)
 	if ok {
 		return blob, nil
 	}
-	blob, err := fs.repo.LoadBlob(fs.ctx, restic.DataBlob, id, nil)
+	blob, err := fs.loadBlob(fs.ctx, restic.DataBlob, id)
 	if err != nil {
 		return nil, err
 	}
@@ -386,17 +756,25 @@ func (n NodeInfo) Name() string {
 
 // Size satisfies os.FileInfo
 func (n NodeInfo) Size() int64 {
-	return int64(n.resticNode.Size)
+	return n.resticNode.size()
 }
 
 // Mode satisfies os.FileInfo
 func (n NodeInfo) Mode() os.FileMode {
-	return n.resticNode.Mode
+	mode := n.resticNode.Mode
+	// Nodes created by the Filesystem only record their permissions.
+	switch n.resticNode.Type {
+	case "dir":
+		mode |= os.ModeDir
+	case "symlink":
+		mode |= os.ModeSymlink
+	}
+	return mode
 }
 
 // ModTime satisfies os.FileInfo
 func (n NodeInfo) ModTime() time.Time {
-	return n.resticNode.ModTime
+	return n.resticNode.modTime()
 }
 
 // IsDir satisfies os.FileInfo
@@ -404,7 +782,8 @@ func (n NodeInfo) IsDir() bool {
 	return n.resticNode.Type == "dir"
 }
 
-// Sys satisfies os.FileInfo
+// Sys satisfies os.FileInfo, and returns the *restic.Node, which holds
+// metadata such as the owner and extended attributes.
 func (n NodeInfo) Sys() interface{} {
-	return nil
+	return &n.resticNode.Node
 }
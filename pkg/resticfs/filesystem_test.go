@@ -3,11 +3,16 @@ package resticfs
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/restic/restic/lib/backend/local"
 	"github.com/restic/restic/lib/repository"
 	"github.com/restic/restic/lib/restic"
@@ -151,6 +156,105 @@ func TestWriteFile(t *testing.T) {
 	require.NotEmpty(t, id)
 }
 
+func TestSizeBeforeCommit(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+	file, err := fs.Create("file")
+	require.NoError(t, err)
+	_, err = file.Write([]byte("content"))
+	require.NoError(t, err)
+	fi, err := fs.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, int64(7), fi.Size())
+	end, err := file.Seek(0, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), end)
+	require.NoError(t, file.Close())
+	entries, err := fs.ReadDir("")
+	require.NoError(t, err)
+	require.Equal(t, int64(7), entries[0].Size())
+}
+
+func TestStats(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	content := []byte("content of file-1\n")
+	for _, name := range []string{"dir/file-1", "dir/file-2"} {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write(content)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	_, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	stats := fs.Stats()
+	require.Equal(t, 1, stats.Files["dir/file-1"].NewBlobs)
+	require.Equal(t, uint64(len(content)), stats.Files["dir/file-1"].NewBytes)
+	// The second file has the same content, so it was deduplicated.
+	require.Equal(t, BlobStats{Blobs: 1, Bytes: uint64(len(content))}, stats.Files["dir/file-2"])
+	require.Equal(t, 2, stats.Trees.Blobs)
+	require.Equal(t, 2, stats.Trees.NewBlobs)
+
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.Equal(t, ErrNoChanges, err)
+	require.Empty(t, fs.Stats().Files)
+}
+
+func TestDuplicateChunks(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	// A file which repeats the same data contains the same chunks several
+	// times, but each of them is only stored once.
+	block := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(block)
+	file, err := fs.Create("file-1")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = file.Write(block)
+		require.NoError(t, err)
+	}
+	require.NoError(t, file.Close())
+
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	stats := fs.Stats().Files["file-1"]
+	require.Equal(t, uint64(3*len(block)), stats.Bytes)
+	require.Less(t, stats.NewBytes, uint64(2*len(block)))
+	require.Less(t, stats.StoredBytes, uint64(2*len(block)))
+}
+
+func TestChunkerWorkers(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.ChunkerWorkers = 4
+	fs.StartNewSnapshot()
+
+	names := []string{"file-1", "dir/file-2", "dir/file-3", "dir/sub/file-4", "file-5"}
+	for _, name := range names {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("content of " + name + "\n"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	require.Len(t, fs.Stats().Files, len(names))
+	snapshot, err := New(testCtx, fs.repo, &id)
+	require.NoError(t, err)
+	for _, name := range names {
+		file, err := snapshot.Open(name)
+		require.NoError(t, err)
+		actual, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.Equal(t, "content of "+name+"\n", string(actual))
+	}
+}
+
 func TestMkdirAll(t *testing.T) {
 	fs := openTestRepo(t)
 	fs.StartNewSnapshot()
@@ -170,3 +274,435 @@ func TestMkdirAll(t *testing.T) {
 	require.NoError(t, err)
 	require.NotEmpty(t, id)
 }
+
+func TestPathTraversal(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	require.NoError(t, fs.MkdirAll("foo/bar", 0755))
+	for _, name := range []string{"../file-1", "foo/../../file-1", "foo/bar/../../../file-1", ".."} {
+		_, err := fs.Create(name)
+		require.Equal(t, ErrInvalidPath, err, name)
+		_, err = fs.Stat(name)
+		require.Equal(t, ErrInvalidPath, err, name)
+		require.Equal(t, ErrInvalidPath, fs.MkdirAll(name, 0755), name)
+		require.Equal(t, ErrInvalidPath, fs.Rename("foo", name), name)
+	}
+	_, err := fs.ReadDir("foo/../..")
+	require.Equal(t, ErrInvalidPath, err)
+
+	// Paths which stay inside the root are resolved normally.
+	file, err := fs.Create("foo/bar/../file-1")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	_, err = fs.Stat("/foo/./file-1")
+	require.NoError(t, err)
+	fi, err := fs.Stat("")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+	infos, err := fs.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+
+	_, err = fs.Create("foo/..")
+	require.Equal(t, ErrInvalidPath, err)
+	require.Equal(t, ErrInvalidPath, fs.Rename("foo", "foo/bar/baz"))
+	require.Equal(t, ErrInvalidPath, fs.Remove("/"))
+}
+
+func TestCreateParents(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	_, err := fs.Open("foo/bar/file-1")
+	require.True(t, os.IsNotExist(err))
+	file, err := fs.Create("foo/bar/file-1")
+	require.NoError(t, err)
+	err = file.Close()
+	require.NoError(t, err)
+	err = fs.Rename("foo/bar/file-1", "baz/file-2")
+	require.NoError(t, err)
+	fi, err := fs.Stat("baz")
+	require.NoError(t, err)
+	require.True(t, fi.IsDir())
+}
+
+func TestModTime(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	file, err := fs.Create("file-1")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	fi, err := fs.Stat("file-1")
+	require.NoError(t, err)
+	created := fi.ModTime()
+
+	time.Sleep(10 * time.Millisecond)
+	file, err = fs.OpenFile("file-1", os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("content of file-1\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	fi, err = fs.Stat("file-1")
+	require.NoError(t, err)
+	modified := fi.ModTime()
+	require.True(t, modified.After(created))
+
+	require.NoError(t, fs.Rename("file-1", "file-2"))
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	snapshot, err := New(testCtx, fs.repo, &id)
+	require.NoError(t, err)
+	fi, err = snapshot.Stat("file-2")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(modified))
+	node := fi.(NodeInfo).Node
+	require.True(t, node.ChangeTime.After(modified))
+}
+
+func TestFreezeTimes(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.FreezeTimes = true
+	fs.StartNewSnapshot()
+
+	file, err := fs.Create("file-1")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	fi, err := fs.Stat("file-1")
+	require.NoError(t, err)
+	created := fi.ModTime()
+
+	time.Sleep(10 * time.Millisecond)
+	file, err = fs.OpenFile("file-1", os.O_RDWR|os.O_TRUNC, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte("content of file-1\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.NoError(t, fs.Rename("file-1", "file-2"))
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	snapshot, err := New(testCtx, fs.repo, &id)
+	require.NoError(t, err)
+	fi, err = snapshot.Stat("file-2")
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(created))
+	require.True(t, fi.(NodeInfo).Node.ChangeTime.Equal(created))
+}
+
+func TestRenameReplace(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	for _, name := range []string{"file-1", "file-2"} {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte("content of " + name + "\n"))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	require.NoError(t, fs.MkdirAll("dir", 0755))
+
+	require.NoError(t, fs.Rename("file-2", "file-1"))
+	file, err := fs.Open("file-1")
+	require.NoError(t, err)
+	actual, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.Equal(t, "content of file-2\n", string(actual))
+	_, err = fs.Stat("file-2")
+	require.True(t, os.IsNotExist(err))
+	infos, err := fs.ReadDir("")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+
+	// Directories are never replaced.
+	require.Equal(t, os.ErrExist, fs.Rename("file-1", "dir"))
+}
+
+func TestDeterministic(t *testing.T) {
+	var trees []restic.ID
+	for i := 0; i < 2; i++ {
+		fs := openTestRepo(t)
+		fs.Deterministic = true
+		fs.StartNewSnapshot()
+
+		err := fs.MkdirAll("foo", 0777)
+		require.NoError(t, err)
+		file, err := fs.Create("foo/file-1")
+		require.NoError(t, err)
+		_, err = file.Write([]byte("content of file-1\n"))
+		require.NoError(t, err)
+		err = file.Close()
+		require.NoError(t, err)
+
+		_, err = fs.CommitSnapshot("/tmp", []string{})
+		require.NoError(t, err)
+		trees = append(trees, *fs.root.ID)
+	}
+	require.Equal(t, trees[0], trees[1])
+}
+
+func TestExclude(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+	fs.Exclude = func(path string) bool {
+		return strings.Contains(path, "/tmp_") || path == "objects/info"
+	}
+
+	names := []string{"objects/pack/tmp_pack_1", "objects/pack/pack-1", "objects/info/packs", "info/exclude"}
+	for _, name := range names {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	// Excluded files which are still open don't prevent a commit.
+	open, err := fs.Create("objects/tmp_obj_2")
+	require.NoError(t, err)
+	defer open.Close()
+
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	snapshot, err := New(testCtx, fs.repo, &id)
+	require.NoError(t, err)
+	for _, name := range names {
+		_, err := snapshot.Stat(name)
+		if strings.Contains(name, "tmp_") || strings.HasPrefix(name, "objects/info/") {
+			require.True(t, os.IsNotExist(err), name)
+		} else {
+			require.NoError(t, err, name)
+		}
+	}
+	// Excluded files are still present in the Filesystem itself.
+	_, err = fs.Stat("objects/pack/tmp_pack_1")
+	require.NoError(t, err)
+}
+
+func TestPreCommit(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.Temporary = memfs.New()
+	fs.StartNewSnapshot()
+	for _, name := range []string{"refs/heads/master", "objects/pack/pack-1"} {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(name))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	// A vetoed commit leaves the changes pending.
+	var seen []string
+	fs.PreCommit = func(changed []string) error {
+		seen = changed
+		file, err := fs.Open(changed[0])
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		return fmt.Errorf("rejected %s", data)
+	}
+	_, err := fs.CommitSnapshot("/tmp", []string{})
+	require.EqualError(t, err, "rejected objects/pack/pack-1")
+	require.Equal(t, []string{"objects/pack/pack-1", "refs/heads/master"}, seen)
+	require.True(t, fs.root.IsDirty())
+
+	fs.PreCommit = func(changed []string) error {
+		seen = changed
+		return nil
+	}
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	require.Empty(t, fs.ChangedFiles())
+}
+
+func TestCheck(t *testing.T) {
+	fs := openBasicRepo()
+	require.NoError(t, fs.Check())
+
+	fs.StartNewSnapshot()
+	n := newFile(fs, fs.root, "missing", 0644)
+	n.Node.Content = restic.IDs{restic.NewRandomID()}
+	require.Error(t, fs.Check())
+}
+
+func TestCommitSnapshotParent(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.StartNewSnapshot()
+
+	var ids []restic.ID
+	for i := 0; i < 2; i++ {
+		file, err := fs.Create(fmt.Sprintf("file-%d", i))
+		require.NoError(t, err)
+		err = file.Close()
+		require.NoError(t, err)
+		id, err := fs.CommitSnapshot("/tmp", []string{})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	sn, err := restic.LoadSnapshot(testCtx, fs.repo, ids[0])
+	require.NoError(t, err)
+	require.Nil(t, sn.Parent)
+	sn, err = restic.LoadSnapshot(testCtx, fs.repo, ids[1])
+	require.NoError(t, err)
+	require.Equal(t, &ids[0], sn.Parent)
+}
+
+// countingRepository counts the blobs which are loaded individually.
+type countingRepository struct {
+	restic.Repository
+	loads int32
+}
+
+func (r *countingRepository) LoadBlob(ctx context.Context, t restic.BlobType, id restic.ID, buf []byte) ([]byte, error) {
+	atomic.AddInt32(&r.loads, 1)
+	return r.Repository.LoadBlob(ctx, t, id, buf)
+}
+
+func TestPrefetch(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	files := map[string]string{}
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("refs/changes/%02d/%d/1", i%10, i)
+		files[name] = fmt.Sprintf("%040d\n", i)
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(files[name]))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	counting := &countingRepository{Repository: repo}
+	fs, err = New(testCtx, counting, &id)
+	require.NoError(t, err)
+	atomic.StoreInt32(&counting.loads, 0)
+	require.NoError(t, fs.Prefetch(testCtx, "refs", "missing"))
+	for name, content := range files {
+		file, err := fs.Open(name)
+		require.NoError(t, err)
+		actual, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.Equal(t, content, string(actual))
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&counting.loads))
+}
+
+// flakyRepository fails the first failures blob loads.
+type flakyRepository struct {
+	restic.Repository
+	failures int32
+}
+
+func (r *flakyRepository) LoadBlob(ctx context.Context, t restic.BlobType, id restic.ID, buf []byte) ([]byte, error) {
+	if atomic.AddInt32(&r.failures, -1) >= 0 {
+		return nil, fmt.Errorf("decrypting blob %v failed", id.Str())
+	}
+	return r.Repository.LoadBlob(ctx, t, id, buf)
+}
+
+func TestRetryBlobLoad(t *testing.T) {
+	defer func(delay time.Duration) { blobRetryDelay = delay }(blobRetryDelay)
+	blobRetryDelay = time.Millisecond
+
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	file, err := fs.Create("dir/file")
+	require.NoError(t, err)
+	_, err = file.Write([]byte("contents"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	flaky := &flakyRepository{Repository: repo, failures: blobLoadAttempts - 1}
+	fs, err = New(testCtx, flaky, &id)
+	require.NoError(t, err)
+	file, err = fs.Open("dir/file")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, "contents", string(data))
+
+	flaky = &flakyRepository{Repository: repo, failures: blobLoadAttempts}
+	_, err = New(testCtx, flaky, &id)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "decrypting blob")
+}
+
+func TestTemporaryFilesRemoved(t *testing.T) {
+	fs := openTestRepo(t)
+	fs.Temporary = memfs.New()
+	fs.StartNewSnapshot()
+	for _, name := range []string{"packed-refs", "removed"} {
+		file, err := fs.Create(name)
+		require.NoError(t, err)
+		_, err = file.Write([]byte(name))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+
+	// Like go-git, replace packed-refs while it is still open.
+	packed, err := fs.OpenFile("packed-refs", os.O_RDWR, 0)
+	require.NoError(t, err)
+	tmp, err := fs.TempFile("", "._packed-refs")
+	require.NoError(t, err)
+	_, err = tmp.Write([]byte("new"))
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	require.NoError(t, fs.Rename(tmp.Name(), "packed-refs"))
+	require.NoError(t, packed.Close())
+	require.NoError(t, fs.Remove("removed"))
+
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	entries, err := fs.Temporary.ReadDir("/")
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestUnsupportedNodeTypes(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	file, err := fs.Create("file")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	// Restic records sockets and devices, which git never creates.
+	socket := fs.newNode("socket", "socket", 0755)
+	fs.root.addNode(newFromNode(fs, fs.root, &socket))
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	fs, err = New(testCtx, repo, &id)
+	require.NoError(t, err)
+	logger := &recordingLogger{}
+	fs.Logger = logger
+	items, err := fs.ReadDir("")
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, "file", items[0].Name())
+	_, err = fs.Open("socket")
+	require.True(t, os.IsNotExist(err))
+	require.Equal(t, `warning: skipping socket, restic nodes with type "socket" are not supported`, logger.find("warning: "))
+	_, err = fs.Stat("socket")
+	require.True(t, os.IsNotExist(err))
+	_, err = fs.Lstat("socket")
+	require.True(t, os.IsNotExist(err))
+	fi, err := fs.Stat("file")
+	require.NoError(t, err)
+	require.Equal(t, "file", fi.Name())
+
+	fs.StartNewSnapshot()
+	_, err = fs.OpenFile("socket", os.O_RDWR, 0)
+	require.Error(t, err)
+	require.False(t, os.IsNotExist(err))
+}
@@ -0,0 +1,36 @@
+package resticfs
+
+import "log"
+
+// Logger receives the log messages of a Filesystem. Debugf describes every
+// operation and its result, Infof reports the snapshots which are created,
+// and Warnf reports problems which the Filesystem recovered from, such as a
+// blob which could only be loaded after retrying. Messages don't end with a
+// newline.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+}
+
+// StdLogger returns a Logger which writes every message to l, prefixed with
+// its level.
+func StdLogger(l *log.Logger) Logger {
+	return stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debugf(format string, args ...interface{}) {
+	s.l.Printf("debug: "+format, args...)
+}
+
+func (s stdLogger) Infof(format string, args ...interface{}) {
+	s.l.Printf("info: "+format, args...)
+}
+
+func (s stdLogger) Warnf(format string, args ...interface{}) {
+	s.l.Printf("warning: "+format, args...)
+}
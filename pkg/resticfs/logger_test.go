@@ -0,0 +1,85 @@
+package resticfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/lib/repository"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingLogger keeps every message, prefixed with its level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.record("debug", format, args...)
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record("info", format, args...)
+}
+
+func (l *recordingLogger) Warnf(format string, args ...interface{}) {
+	l.record("warning", format, args...)
+}
+
+// find returns the first message with the given prefix, or "".
+func (l *recordingLogger) find(prefix string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.HasPrefix(message, prefix) {
+			return message
+		}
+	}
+	return ""
+}
+
+func TestLogger(t *testing.T) {
+	defer func(delay time.Duration) { blobRetryDelay = delay }(blobRetryDelay)
+	blobRetryDelay = time.Millisecond
+
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	logger := &recordingLogger{}
+	fs.Logger = logger
+	fs.StartNewSnapshot()
+	file, err := fs.Create("dir/file")
+	require.NoError(t, err)
+	_, err = file.Write([]byte("contents"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	require.Equal(t, `debug: OpenFile("dir/file", 242, 0666) => <nil>`, logger.find("debug: OpenFile"))
+	require.Equal(t, "info: saved snapshot "+id.Str(), strings.Split(logger.find("info: "), " with ")[0])
+	require.Empty(t, logger.find("warning: "))
+
+	flaky := &flakyRepository{Repository: repo}
+	fs, err = New(testCtx, flaky, &id)
+	require.NoError(t, err)
+	logger = &recordingLogger{}
+	fs.Logger = logger
+	atomic.StoreInt32(&flaky.failures, 1)
+	file, err = fs.Open("dir/file")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Contains(t, logger.find("warning: "), "decrypting blob")
+}
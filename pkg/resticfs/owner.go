@@ -0,0 +1,92 @@
+package resticfs
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// The environment variables which override the names recorded as the owner of
+// the files and snapshots created by a Filesystem. RESTIC_HOST is also used
+// by restic backup.
+const (
+	HostEnv  = "RESTIC_HOST"
+	UserEnv  = "RESTIC_USER"
+	GroupEnv = "RESTIC_GROUP"
+)
+
+// owner describes the user who owns the files and snapshots created by a
+// Filesystem.
+type owner struct {
+	uid, gid              uint32
+	user, group, hostname string
+}
+
+var (
+	currentOwnerOnce sync.Once
+	currentOwner     owner
+)
+
+// getOwner returns the owner of new files and snapshots. It is looked up the
+// first time a Filesystem creates one, rather than when the package is
+// loaded, and cached. Static binaries built without cgo, and containers
+// without /etc/passwd or /etc/group, may be unable to look up the names;
+// they are then left empty, unless they are given by HostEnv, UserEnv, and
+// GroupEnv.
+func getOwner() owner {
+	currentOwnerOnce.Do(func() {
+		currentOwner = lookupOwner()
+	})
+	return currentOwner
+}
+
+func lookupOwner() owner {
+	o := owner{
+		uid:      uint32(os.Getuid()),
+		gid:      uint32(os.Getgid()),
+		user:     os.Getenv(UserEnv),
+		group:    os.Getenv(GroupEnv),
+		hostname: os.Getenv(HostEnv),
+	}
+	if o.user == "" {
+		o.user = lookupName(func() (string, error) {
+			u, err := user.Current()
+			if err != nil {
+				return "", err
+			}
+			return u.Username, nil
+		})
+	}
+	if o.user == "" {
+		o.user = os.Getenv("USER")
+	}
+	if o.group == "" {
+		o.group = lookupName(func() (string, error) {
+			g, err := user.LookupGroupId(strconv.Itoa(int(o.gid)))
+			if err != nil {
+				return "", err
+			}
+			return g.Name, nil
+		})
+	}
+	if o.hostname == "" {
+		o.hostname, _ = os.Hostname()
+	}
+	return o
+}
+
+// lookupName calls lookup, and returns an empty name if it fails or panics,
+// which the user database of some systems has been known to do.
+func lookupName(lookup func() (string, error)) (name string) {
+	defer func() {
+		if r := recover(); r != nil {
+			name = ""
+		}
+	}()
+	name, err := lookup()
+	if err != nil {
+		return ""
+	}
+	return name
+}
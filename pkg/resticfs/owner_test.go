@@ -0,0 +1,30 @@
+package resticfs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupOwnerOverrides(t *testing.T) {
+	t.Setenv(UserEnv, "builder")
+	t.Setenv(GroupEnv, "builders")
+	t.Setenv(HostEnv, "ci")
+	o := lookupOwner()
+	require.Equal(t, "builder", o.user)
+	require.Equal(t, "builders", o.group)
+	require.Equal(t, "ci", o.hostname)
+}
+
+func TestLookupNameFailure(t *testing.T) {
+	require.Equal(t, "", lookupName(func() (string, error) {
+		return "ignored", errors.New("no user database")
+	}))
+	require.Equal(t, "", lookupName(func() (string, error) {
+		panic("no user database")
+	}))
+	require.Equal(t, "alice", lookupName(func() (string, error) {
+		return "alice", nil
+	}))
+}
@@ -0,0 +1,171 @@
+package resticfs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+	"golang.org/x/sync/errgroup"
+)
+
+// prefetchFileSize is the size of the largest file whose contents are loaded
+// by Prefetch. Larger files don't benefit from sharing a request with other
+// blobs.
+const prefetchFileSize = 64 << 10
+
+// prefetchBudget limits the total size of the file contents loaded by
+// Prefetch, so that they don't evict each other from the blob cache.
+const prefetchBudget = blobCacheSize / 2
+
+// Prefetch loads the directories and small files below each of the given
+// paths, so that walking them afterwards doesn't need a request to the
+// backend for each directory and file. Blobs which are stored in the same
+// pack are loaded with a single request, and several packs are loaded
+// concurrently. Paths which don't exist are ignored.
+//
+// This makes reading many small files, such as the thousands of loose refs
+// in some git repositories, fast on backends with a high latency.
+func (fs *Filesystem) Prefetch(ctx context.Context, paths ...string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("Prefetch(%#v) => %v", paths, err)
+		}()
+	}
+	var nodes []*resticNode
+	for _, path := range paths {
+		dir, filename, err := splitPath(path)
+		if err != nil {
+			return err
+		} else if filename == "" {
+			nodes = append(nodes, fs.root.Nodes...)
+			continue
+		}
+		tree, err := fs.getTree(dir, false)
+		if os.IsNotExist(err) || err == ErrNotDirectory {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if node := tree.Find(filename); node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+	return fs.prefetch(ctx, nodes, prefetchBudget)
+}
+
+// prefetch loads the subtrees of the given nodes recursively, and the
+// contents of the small files among them, up to budget bytes.
+func (fs *Filesystem) prefetch(ctx context.Context, nodes []*resticNode, budget int) error {
+	for len(nodes) > 0 {
+		trees := map[restic.ID][]*resticNode{}
+		var handles []restic.BlobHandle
+		var next []*resticNode
+		for _, n := range nodes {
+			switch {
+			case n.Type == "dir" && n.subtree != nil:
+				next = append(next, n.subtree.Nodes...)
+			case n.Type == "dir" && n.Node.Subtree != nil:
+				id := *n.Node.Subtree
+				if tree, ok := fs.cachedTree(id); ok {
+					n.subtree = newTreeFromRestic(fs, n.parent, id, tree)
+					next = append(next, n.subtree.Nodes...)
+					continue
+				}
+				if trees[id] == nil {
+					handles = append(handles, restic.BlobHandle{ID: id, Type: restic.TreeBlob})
+				}
+				trees[id] = append(trees[id], n)
+			case n.Type == "file" && n.Backing() == nil && n.Node.Size <= prefetchFileSize:
+				if budget < int(n.Node.Size) {
+					continue
+				}
+				budget -= int(n.Node.Size)
+				for _, id := range n.Node.Content {
+					if _, ok := fs.blobCache.get(id); !ok {
+						handles = append(handles, restic.BlobHandle{ID: id, Type: restic.DataBlob})
+					}
+				}
+			}
+		}
+
+		var mu sync.Mutex
+		err := fs.loadBlobs(ctx, handles, func(h restic.BlobHandle, buf []byte) error {
+			if h.Type == restic.DataBlob {
+				fs.blobCache.add(h.ID, append([]byte(nil), buf...))
+				return nil
+			}
+			tree := &restic.Tree{}
+			if err := json.Unmarshal(buf, tree); err != nil {
+				return err
+			}
+			if fs.trees != nil {
+				fs.trees.addTree(h.ID, tree)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, n := range trees[h.ID] {
+				n.subtree = newTreeFromRestic(fs, n.parent, h.ID, tree)
+				next = append(next, n.subtree.Nodes...)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		nodes = next
+	}
+	return nil
+}
+
+// loadBlobs loads the given blobs and passes their contents to fn, which may
+// be called concurrently. The blobs in each pack are loaded with a single
+// request. Blobs which are missing from the index or damaged are skipped. The
+// buffer passed to fn is only valid until it returns.
+func (fs *Filesystem) loadBlobs(ctx context.Context, handles []restic.BlobHandle, fn func(restic.BlobHandle, []byte) error) error {
+	packs := map[restic.ID][]restic.Blob{}
+	seen := restic.NewBlobSet()
+	for _, h := range handles {
+		if seen.Has(h) {
+			continue
+		}
+		seen.Insert(h)
+		blobs := fs.repo.Index().Lookup(h)
+		if len(blobs) == 0 {
+			// The error is reported when the blob is read.
+			continue
+		}
+		packs[blobs[0].PackID] = append(packs[blobs[0].PackID], blobs[0].Blob)
+	}
+
+	wg, ctx := errgroup.WithContext(ctx)
+	connections := int(fs.repo.Connections())
+	if connections < 1 {
+		connections = 1
+	}
+	sem := make(chan struct{}, connections)
+	for packID, blobs := range packs {
+		packID, blobs := packID, blobs
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return wg.Wait()
+		}
+		wg.Go(func() error {
+			defer func() { <-sem }()
+			return repository.StreamPack(ctx, fs.repo.Backend().Load, fs.repo.Key(), packID, blobs, func(h restic.BlobHandle, buf []byte, err error) error {
+				if err != nil {
+					// Like missing blobs, damaged blobs are reported
+					// when they are read.
+					return nil
+				}
+				return fn(h, buf)
+			})
+		})
+	}
+	return wg.Wait()
+}
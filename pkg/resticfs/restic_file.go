@@ -133,6 +133,44 @@ func (f *resticFile) Seek(offset int64, whence int) (int64, error) {
 	return f.position, nil
 }
 
+// writeAt writes the contents of the file starting at off to w. The blobs
+// following the first one are loaded ahead of the one being written, and
+// bypass the blob cache, so that streaming a large file is fast and doesn't
+// evict the blobs of other files.
+func (f *resticFile) writeAt(w io.Writer, off int64) (int64, error) {
+	if f.isClosed {
+		return 0, os.ErrClosed
+	}
+	offset := uint64(off)
+	if offset >= f.cumsize[len(f.cumsize)-1] {
+		return 0, nil
+	}
+	startContent := -1 + sort.Search(len(f.cumsize), func(i int) bool {
+		return f.cumsize[i] > offset
+	})
+	blob, err := f.fs.getBlob(f.node.Content[startContent])
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{Writer: w}
+	if _, err := cw.Write(blob[offset-f.cumsize[startContent]:]); err != nil {
+		return cw.count, err
+	}
+	err = f.fs.copyBlobs(f.fs.ctx, cw, f.node.Content[startContent+1:])
+	return cw.count, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
 func (f *resticFile) getBlobAt(i int) ([]byte, error) {
 	panic("not implemented")
 }
@@ -0,0 +1,61 @@
+package resticfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/restic/restic/lib/restic"
+)
+
+// blobLoadAttempts is the number of times loading a blob is attempted before
+// the error is returned.
+const blobLoadAttempts = 4
+
+// blobRetryDelay is the delay before the first retry of a blob load, which
+// doubles with each further attempt.
+var blobRetryDelay = 500 * time.Millisecond
+
+// loadBlob loads a blob from the repository. Failures are retried a few
+// times with a growing delay, because the backend only retries failed
+// requests, and not data which was truncated or corrupted in transit and
+// fails to decrypt. Blobs which are missing from the index are not retried.
+func (fs *Filesystem) loadBlob(ctx context.Context, t restic.BlobType, id restic.ID) ([]byte, error) {
+	delay := blobRetryDelay
+	for attempt := 1; ; attempt++ {
+		blob, err := fs.repo.LoadBlob(ctx, t, id, nil)
+		if err == nil || attempt == blobLoadAttempts || ctx.Err() != nil {
+			return blob, err
+		}
+		if len(fs.repo.Index().Lookup(restic.BlobHandle{ID: id, Type: t})) == 0 {
+			return nil, err
+		}
+		if fs.Logger != nil {
+			fs.Logger.Warnf("loading %v blob %v failed, retrying in %v: %v", t, id.Str(), delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// loadTree loads a tree from the repository, retrying like loadBlob.
+func (fs *Filesystem) loadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	if tree, ok := fs.cachedTree(id); ok {
+		return tree, nil
+	}
+	tree, err := restic.LoadTree(ctx, retryingLoader{fs}, id)
+	if err == nil && fs.trees != nil {
+		fs.trees.addTree(id, tree)
+	}
+	return tree, err
+}
+
+// retryingLoader satisfies restic.BlobLoader using loadBlob.
+type retryingLoader struct{ fs *Filesystem }
+
+func (l retryingLoader) LoadBlob(ctx context.Context, t restic.BlobType, id restic.ID, buf []byte) ([]byte, error) {
+	return l.fs.loadBlob(ctx, t, id)
+}
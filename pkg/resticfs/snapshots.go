@@ -0,0 +1,105 @@
+package resticfs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/restic/restic/lib/restic"
+	"golang.org/x/sync/errgroup"
+)
+
+// treeCacheEntries is the number of trees kept by a Cache.
+const treeCacheEntries = 16384
+
+// A Cache holds the trees and file contents loaded by Filesystems, so that
+// Filesystems of different snapshots of the same repository, which usually
+// have most of their trees and files in common, only load each of them from
+// the backend once. It is safe for concurrent use.
+type Cache struct {
+	blobs   *blobCache
+	treesMu sync.Mutex
+	trees   *simplelru.LRU
+}
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	trees, err := simplelru.NewLRU(treeCacheEntries, nil)
+	if err != nil {
+		panic(err)
+	}
+	return &Cache{blobs: newBlobCache(blobCacheSize), trees: trees}
+}
+
+func (c *Cache) getTree(id restic.ID) (*restic.Tree, bool) {
+	c.treesMu.Lock()
+	defer c.treesMu.Unlock()
+	tree, ok := c.trees.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return tree.(*restic.Tree), true
+}
+
+func (c *Cache) addTree(id restic.ID, tree *restic.Tree) {
+	c.treesMu.Lock()
+	defer c.treesMu.Unlock()
+	c.trees.Add(id, tree)
+}
+
+// cachedTree returns the tree with the given ID if it is in the Cache of fs.
+func (fs *Filesystem) cachedTree(id restic.ID) (*restic.Tree, bool) {
+	if fs.trees == nil {
+		return nil, false
+	}
+	return fs.trees.getTree(id)
+}
+
+// NewWithCache returns a new, read-only Filesystem like New, which keeps the
+// trees and file contents it loads in cache.
+func NewWithCache(ctx context.Context, repo restic.Repository, parentSnapshotID *restic.ID, cache *Cache) (*Filesystem, error) {
+	fs := newFilesystem(ctx, repo, parentSnapshotID)
+	fs.blobCache = cache.blobs
+	fs.trees = cache
+	if err := fs.openRoot(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// OpenSnapshots returns a read-only Filesystem for each of the given
+// snapshots, in the same order. The snapshots are opened concurrently, and
+// all of the Filesystems share cache, which may be nil to use a new Cache.
+// This makes it cheap to compare many snapshots, for example to find the
+// snapshot in which a file changed.
+func OpenSnapshots(ctx context.Context, repo restic.Repository, ids []restic.ID, cache *Cache) ([]*Filesystem, error) {
+	if cache == nil {
+		cache = NewCache()
+	}
+	filesystems := make([]*Filesystem, len(ids))
+	// The Filesystems keep using ctx after the errgroup's context is done.
+	wg, groupCtx := errgroup.WithContext(ctx)
+	connections := int(repo.Connections())
+	if connections < 1 {
+		connections = 1
+	}
+	sem := make(chan struct{}, connections)
+	for i := range ids {
+		i := i
+		wg.Go(func() error {
+			select {
+			case sem <- struct{}{}:
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			}
+			defer func() { <-sem }()
+			fs, err := NewWithCache(ctx, repo, &ids[i], cache)
+			filesystems[i] = fs
+			return err
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		return nil, err
+	}
+	return filesystems, nil
+}
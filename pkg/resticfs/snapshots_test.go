@@ -0,0 +1,63 @@
+package resticfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenSnapshots(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	var ids []restic.ID
+	for i := 0; i < 4; i++ {
+		file, err := fs.Create(fmt.Sprintf("dir/file-%d", i))
+		require.NoError(t, err)
+		_, err = file.Write([]byte(fmt.Sprintf("contents %d", i)))
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		id, err := fs.CommitSnapshot("/tmp", []string{})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	counting := &countingRepository{Repository: repo}
+	cache := NewCache()
+	filesystems, err := OpenSnapshots(testCtx, counting, ids, cache)
+	require.NoError(t, err)
+	require.Len(t, filesystems, len(ids))
+	for i, fs := range filesystems {
+		entries, err := fs.ReadDir("dir")
+		require.NoError(t, err)
+		require.Len(t, entries, i+1)
+		file, err := fs.Open(fmt.Sprintf("dir/file-%d", i))
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.Equal(t, fmt.Sprintf("contents %d", i), string(data))
+	}
+
+	// Every tree and file is in the cache now.
+	loaded := atomic.LoadInt32(&counting.loads)
+	filesystems, err = OpenSnapshots(testCtx, counting, ids, cache)
+	require.NoError(t, err)
+	for i, fs := range filesystems {
+		file, err := fs.Open(fmt.Sprintf("dir/file-%d", i))
+		require.NoError(t, err)
+		_, err = ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+	}
+	require.Equal(t, loaded, atomic.LoadInt32(&counting.loads))
+
+	_, err = OpenSnapshots(testCtx, repo, []restic.ID{restic.NewRandomID()}, nil)
+	require.Error(t, err)
+}
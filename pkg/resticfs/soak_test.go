@@ -0,0 +1,311 @@
+package resticfs
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/restic/restic/lib/repository"
+	"github.com/restic/restic/lib/restic"
+	"github.com/stretchr/testify/require"
+)
+
+var soakOps = flag.Int("soak.ops", 300, "number of operations performed by TestSoak")
+var soakSeed = flag.Int64("soak.seed", 0, "random seed for TestSoak, or 0 to use the current time")
+
+// soakTest performs random operations on a Filesystem, and compares it with
+// a model of the files it should contain. Files are named f0 to f3, and
+// directories d0 to d2, so that a path never names both a file and a
+// directory.
+type soakTest struct {
+	t     *testing.T
+	rnd   *rand.Rand
+	repo  restic.Repository
+	fs    *Filesystem
+	files map[string][]byte
+	// snapshot and committed are the latest snapshot and its files.
+	snapshot  *restic.ID
+	committed map[string][]byte
+}
+
+// TestSoak performs many random create, write, rename, remove, commit and
+// reopen operations, and checks the files of the Filesystem and of each
+// snapshot. Use -soak.ops to run longer, and -soak.seed to repeat a failure.
+func TestSoak(t *testing.T) {
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+	s := &soakTest{
+		t:     t,
+		rnd:   rand.New(rand.NewSource(seed)),
+		repo:  repository.TestRepository(t),
+		files: map[string][]byte{},
+	}
+	s.reopen()
+	for i := 0; i < *soakOps; i++ {
+		switch n := s.rnd.Intn(100); {
+		case n < 35:
+			s.write()
+		case n < 55:
+			s.overwrite()
+		case n < 70:
+			s.rename()
+		case n < 85:
+			s.remove()
+		case n < 97:
+			s.commit()
+		default:
+			s.reopen()
+		}
+		if t.Failed() {
+			t.Fatalf("failed after %d operations with seed %d", i+1, seed)
+		}
+	}
+	s.commit()
+}
+
+// randomPath returns the path of a file, which may not exist.
+func (s *soakTest) randomPath() string {
+	var p string
+	for depth := s.rnd.Intn(3); depth > 0; depth-- {
+		p = path.Join(p, fmt.Sprintf("d%d", s.rnd.Intn(3)))
+	}
+	return path.Join(p, fmt.Sprintf("f%d", s.rnd.Intn(4)))
+}
+
+// existingPath returns the path of a random file, or "" if there is none.
+func (s *soakTest) existingPath() string {
+	if len(s.files) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names[s.rnd.Intn(len(names))]
+}
+
+// randomData returns data of a random size, which occasionally spans
+// several chunks.
+func (s *soakTest) randomData() []byte {
+	size := s.rnd.Intn(4 << 10)
+	if s.rnd.Intn(20) == 0 {
+		size = s.rnd.Intn(3 << 20)
+	}
+	data := make([]byte, size)
+	s.rnd.Read(data)
+	return data
+}
+
+// write creates or truncates a file.
+func (s *soakTest) write() {
+	name, data := s.randomPath(), s.randomData()
+	file, err := s.fs.Create(name)
+	require.NoError(s.t, err)
+	_, err = file.Write(data)
+	require.NoError(s.t, err)
+	require.NoError(s.t, file.Close())
+	s.files[name] = data
+}
+
+// overwrite writes to part of an existing file, possibly extending it.
+func (s *soakTest) overwrite() {
+	name := s.existingPath()
+	if name == "" {
+		return
+	}
+	data := s.randomData()
+	offset := s.rnd.Intn(len(s.files[name]) + 1)
+	file, err := s.fs.OpenFile(name, os.O_RDWR, 0)
+	require.NoError(s.t, err)
+	_, err = file.Seek(int64(offset), io.SeekStart)
+	require.NoError(s.t, err)
+	_, err = file.Write(data)
+	require.NoError(s.t, err)
+	require.NoError(s.t, file.Close())
+	expected := append([]byte(nil), s.files[name]...)
+	if end := offset + len(data); end > len(expected) {
+		expected = append(expected, make([]byte, end-len(expected))...)
+	}
+	copy(expected[offset:], data)
+	s.files[name] = expected
+}
+
+// rename moves a file, possibly replacing another one.
+func (s *soakTest) rename() {
+	from, to := s.existingPath(), s.randomPath()
+	if from == "" {
+		return
+	}
+	require.NoError(s.t, s.fs.MkdirAll(path.Dir(to), defaultDirectoryMode))
+	require.NoError(s.t, s.fs.Rename(from, to))
+	data := s.files[from]
+	delete(s.files, from)
+	s.files[to] = data
+}
+
+// remove removes a file.
+func (s *soakTest) remove() {
+	name := s.existingPath()
+	if name == "" {
+		return
+	}
+	require.NoError(s.t, s.fs.Remove(name))
+	delete(s.files, name)
+}
+
+// commit commits a snapshot, and checks that the Filesystem and the snapshot
+// contain the expected files.
+func (s *soakTest) commit() {
+	id, err := s.fs.CommitSnapshot("/soak", []string{})
+	if errors.Is(err, ErrNoChanges) {
+		s.check(s.fs, s.files)
+		return
+	}
+	require.NoError(s.t, err)
+	s.snapshot = &id
+	s.committed = map[string][]byte{}
+	for name, data := range s.files {
+		s.committed[name] = data
+	}
+	s.check(s.fs, s.files)
+	temporary, err := s.fs.Temporary.ReadDir("/")
+	require.NoError(s.t, err)
+	require.Empty(s.t, temporary, "temporary files remain after the commit")
+	// Nothing changed since the snapshot was committed.
+	_, err = s.fs.CommitSnapshot("/soak", []string{})
+	require.Equal(s.t, ErrNoChanges, err)
+
+	fs, err := New(testCtx, s.repo, &id)
+	require.NoError(s.t, err)
+	s.check(fs, s.committed)
+}
+
+// reopen discards the uncommitted changes, and continues from the latest
+// snapshot with a new Filesystem.
+func (s *soakTest) reopen() {
+	var err error
+	s.fs, err = New(testCtx, s.repo, s.snapshot)
+	require.NoError(s.t, err)
+	// memfs isn't safe for concurrent use, so several chunker workers check
+	// that the Filesystem serializes its access to Temporary.
+	s.fs.Temporary = memfs.New()
+	s.fs.StartNewSnapshot()
+	s.fs.ChunkerWorkers = 1 + s.rnd.Intn(4)
+	s.files = map[string][]byte{}
+	for name, data := range s.committed {
+		s.files[name] = data
+	}
+}
+
+// check compares the files in fs with expected.
+func (s *soakTest) check(fs *Filesystem, expected map[string][]byte) {
+	actual := map[string][]byte{}
+	var walk func(dir string)
+	walk = func(dir string) {
+		entries, err := fs.ReadDir(dir)
+		require.NoError(s.t, err)
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name())
+			if entry.IsDir() {
+				walk(name)
+				continue
+			}
+			file, err := fs.Open(name)
+			require.NoError(s.t, err)
+			data, err := ioutil.ReadAll(file)
+			require.NoError(s.t, err)
+			require.NoError(s.t, file.Close())
+			require.Equal(s.t, int64(len(data)), entry.Size(), name)
+			actual[name] = data
+		}
+	}
+	walk("")
+	require.Equal(s.t, len(expected), len(actual))
+	for name, data := range expected {
+		require.True(s.t, bytes.Equal(data, actual[name]), "contents of %s", name)
+	}
+}
+
+func BenchmarkCreateFiles(b *testing.B) {
+	repo := repository.TestRepository(b)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(b, err)
+	fs.StartNewSnapshot()
+	data := make([]byte, 1<<10)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		file, err := fs.Create(fmt.Sprintf("objects/%02x/%d", i%256, i))
+		require.NoError(b, err)
+		_, err = file.Write(data)
+		require.NoError(b, err)
+		require.NoError(b, file.Close())
+	}
+	_, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(b, err)
+}
+
+func BenchmarkCommitLargeFile(b *testing.B) {
+	repo := repository.TestRepository(b)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(b, err)
+	fs.StartNewSnapshot()
+	data := make([]byte, 8<<20)
+	b.SetBytes(int64(len(data)))
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rnd.Read(data)
+		b.StartTimer()
+		file, err := fs.Create("pack")
+		require.NoError(b, err)
+		_, err = file.Write(data)
+		require.NoError(b, err)
+		require.NoError(b, file.Close())
+		_, err = fs.CommitSnapshot("/tmp", []string{})
+		require.NoError(b, err)
+	}
+}
+
+func BenchmarkReadLargeFile(b *testing.B) {
+	repo := repository.TestRepository(b)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(b, err)
+	fs.StartNewSnapshot()
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	file, err := fs.Create("pack")
+	require.NoError(b, err)
+	_, err = file.Write(data)
+	require.NoError(b, err)
+	require.NoError(b, file.Close())
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(b, err)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// A new Filesystem starts with an empty blob cache.
+		fs, err := New(testCtx, repo, &id)
+		require.NoError(b, err)
+		file, err := fs.Open("pack")
+		require.NoError(b, err)
+		_, err = io.Copy(ioutil.Discard, file)
+		require.NoError(b, err)
+		require.NoError(b, file.Close())
+	}
+}
@@ -0,0 +1,81 @@
+package resticfs
+
+import (
+	"path/filepath"
+	"sync/atomic"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// stage counts the temporary file of a node which was closed in the staged
+// size of the Filesystem.
+func (n *resticNode) stage() {
+	size := n.tempSize()
+	atomic.AddInt64(&n.fs.staged, size-n.staged)
+	n.staged = size
+}
+
+// unstage removes the temporary file of a node from the staged size of the
+// Filesystem, once it was saved to the repository or removed.
+func (n *resticNode) unstage() {
+	atomic.AddInt64(&n.fs.staged, -n.staged)
+	n.staged = 0
+}
+
+// StagedBytes returns the size of the temporary files of the closed, modified
+// files which are not yet saved to the repository.
+func (fs *Filesystem) StagedBytes() int64 {
+	return atomic.LoadInt64(&fs.staged)
+}
+
+// flushStaged saves the closed, modified files to the repository, and removes
+// their temporary files. The trees are left alone until the next snapshot is
+// committed.
+func (fs *Filesystem) flushStaged() (err error) {
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("flushStaged() => %v", err)
+		}()
+	}
+	var files []pendingFile
+	for _, file := range fs.root.pendingFiles("", nil) {
+		if file.node.openWriters == 0 && file.node.staged > 0 {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if !fs.flushed {
+		fs.stats = CommitStats{Files: map[string]BlobStats{}}
+		fs.flushed = true
+	}
+	wg, ctx := errgroup.WithContext(fs.ctx)
+	fs.repo.StartPackUploader(ctx, wg)
+	if fs.ChunkerWorkers > 1 {
+		err = fs.commitFiles(ctx, files)
+	} else {
+		if fs.chunker == nil {
+			fs.chunker = &fileChunker{}
+		}
+		for _, file := range files {
+			if err = file.node.commitFile(file.name, fs.chunker); err != nil {
+				break
+			}
+		}
+	}
+	// Flushing also saves the index, so the saved blobs are reused by the
+	// next push if this one is interrupted.
+	if flushErr := fs.repo.Flush(fs.ctx); err == nil {
+		err = flushErr
+	}
+	if waitErr := wg.Wait(); err == nil {
+		err = waitErr
+	}
+	if err == nil {
+		for _, file := range files {
+			fs.flushedFiles = append(fs.flushedFiles, filepath.ToSlash(file.name))
+		}
+	}
+	return err
+}
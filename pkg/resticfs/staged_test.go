@@ -0,0 +1,56 @@
+package resticfs
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/restic/restic/lib/repository"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxStagedBytes(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.Temporary = memfs.New()
+	fs.MaxStagedBytes = 10
+	fs.StartNewSnapshot()
+
+	first, err := fs.Create("dir/first")
+	require.NoError(t, err)
+	_, err = first.Write([]byte("more than ten bytes"))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fs.StagedBytes())
+	require.NoError(t, first.Close())
+	require.Equal(t, int64(19), fs.StagedBytes())
+
+	// Opening the next file saves the first one.
+	second, err := fs.Create("second")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fs.StagedBytes())
+	entries, err := fs.Temporary.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	_, err = second.Write([]byte("short"))
+	require.NoError(t, err)
+	require.NoError(t, second.Close())
+	require.Equal(t, int64(5), fs.StagedBytes())
+
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), fs.StagedBytes())
+	require.Contains(t, fs.Stats().Files, "dir/first")
+	require.Contains(t, fs.Stats().Files, "second")
+
+	fs, err = New(testCtx, repo, &id)
+	require.NoError(t, err)
+	for name, content := range map[string]string{"dir/first": "more than ten bytes", "second": "short"} {
+		file, err := fs.Open(name)
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+		require.Equal(t, content, string(data))
+	}
+}
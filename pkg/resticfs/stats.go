@@ -0,0 +1,46 @@
+package resticfs
+
+// BlobStats counts the blobs which make up some data written to a snapshot,
+// and how many of them had to be added to the repository.
+type BlobStats struct {
+	// Blobs and Bytes count every blob of the data.
+	Blobs int
+	Bytes uint64
+	// NewBlobs and NewBytes count the blobs which were not already
+	// stored in the repository; the rest were deduplicated.
+	NewBlobs int
+	NewBytes uint64
+	// StoredBytes is the size of the new blobs after compression and
+	// encryption.
+	StoredBytes uint64
+}
+
+// Add adds the counts of other to s.
+func (s *BlobStats) Add(other BlobStats) {
+	s.Blobs += other.Blobs
+	s.Bytes += other.Bytes
+	s.NewBlobs += other.NewBlobs
+	s.NewBytes += other.NewBytes
+	s.StoredBytes += other.StoredBytes
+}
+
+func (s *BlobStats) addBlob(length uint, saved bool, storedLength int) {
+	s.Blobs++
+	s.Bytes += uint64(length)
+	if saved {
+		s.NewBlobs++
+		s.NewBytes += uint64(length)
+		s.StoredBytes += uint64(storedLength)
+	}
+}
+
+// CommitStats describes the data written by a call to CommitSnapshot. Only
+// files and directories which were modified since the previous snapshot are
+// included.
+type CommitStats struct {
+	// Files maps the path of each modified file to the blobs of its
+	// content.
+	Files map[string]BlobStats
+	// Trees counts the blobs which store the modified directories.
+	Trees BlobStats
+}
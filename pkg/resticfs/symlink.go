@@ -0,0 +1,165 @@
+package resticfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// maxSymlinks is the number of symbolic links which are followed while
+// resolving a path, like the limit of Linux.
+const maxSymlinks = 40
+
+// ErrTooManySymlinks indicates that resolving a path followed more than
+// maxSymlinks symbolic links, which usually means that they form a loop.
+var ErrTooManySymlinks = errors.New("too many levels of symbolic links")
+
+var _ billy.Symlink = (*Filesystem)(nil)
+
+// resolve returns the components of path, with each symbolic link among them
+// replaced by its target. The last component is only followed if followLast
+// is true. Relative targets are resolved against the directory containing
+// the link, and absolute targets against the root of the Filesystem, which
+// is where they lead in a snapshot of the root directory. Resolving stops at
+// the first component which doesn't exist.
+func (fs *Filesystem) resolve(path string, followLast bool) ([]string, error) {
+	components, err := cleanPath(path)
+	if err != nil {
+		return nil, err
+	}
+	links := 0
+	for i := 0; i < len(components); i++ {
+		if i == len(components)-1 && !followLast {
+			break
+		}
+		tree, err := fs.getTree(components[:i], false)
+		if err != nil {
+			return nil, err
+		}
+		node := tree.Find(components[i])
+		if node == nil {
+			break
+		} else if node.Type != "symlink" {
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return nil, ErrTooManySymlinks
+		}
+		target := node.LinkTarget
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(append(components[:i:i], target)...)
+		}
+		target = filepath.Join(append([]string{target}, components[i+1:]...)...)
+		if components, err = cleanPath(target); err != nil {
+			return nil, err
+		}
+		// Start over, since the target may contain other links.
+		i = -1
+	}
+	return components, nil
+}
+
+// lookup returns the node with the given path components.
+func (fs *Filesystem) lookup(components []string) (*resticNode, error) {
+	if len(components) == 0 {
+		return fs.rootNode(), nil
+	}
+	tree, err := fs.getTree(components[:len(components)-1], false)
+	if err != nil {
+		return nil, err
+	}
+	node := tree.Find(components[len(components)-1])
+	if node == nil {
+		return nil, os.ErrNotExist
+	}
+	return node, nil
+}
+
+// lookupSupported is lookup for reads of the node at fullpath, which treat
+// nodes of unsupported types as missing, see skipUnsupported.
+func (fs *Filesystem) lookupSupported(fullpath string, components []string) (*resticNode, error) {
+	node, err := fs.lookup(components)
+	if err != nil {
+		return nil, err
+	} else if !isSupportedType(node.Type) {
+		fs.skipUnsupported(fullpath, node.Type)
+		return nil, os.ErrNotExist
+	}
+	return node, nil
+}
+
+// Lstat returns a FileInfo describing the named file. If the file is a
+// symbolic link, the returned FileInfo describes the symbolic link.
+func (fs *Filesystem) Lstat(fullpath string) (fi os.FileInfo, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("Lstat(%#v) => %v, %v", fullpath, fi, err)
+		}()
+	}
+	components, err := fs.resolve(fullpath, false)
+	if err != nil {
+		return nil, err
+	}
+	node, err := fs.lookupSupported(fullpath, components)
+	if err != nil {
+		return nil, err
+	}
+	return NodeInfo{node}, nil
+}
+
+// Readlink returns the target of the named symbolic link.
+func (fs *Filesystem) Readlink(link string) (target string, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("Readlink(%#v) => %#v, %v", link, target, err)
+		}()
+	}
+	components, err := fs.resolve(link, false)
+	if err != nil {
+		return "", err
+	}
+	node, err := fs.lookup(components)
+	if err != nil {
+		return "", err
+	} else if node.Type != "symlink" {
+		return "", &os.PathError{Op: "readlink", Path: link, Err: os.ErrInvalid}
+	}
+	return node.LinkTarget, nil
+}
+
+// Symlink creates a symbolic link named link which points to target, along
+// with any missing parent directories.
+func (fs *Filesystem) Symlink(target, link string) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.Logger != nil {
+		defer func() {
+			fs.Logger.Debugf("Symlink(%#v, %#v) => %v", target, link, err)
+		}()
+	}
+	if !fs.writable {
+		return os.ErrPermission
+	}
+	components, err := fs.resolve(link, false)
+	if err != nil {
+		return err
+	} else if len(components) == 0 {
+		return ErrInvalidPath
+	}
+	tree, err := fs.getTree(components[:len(components)-1], true)
+	if err != nil {
+		return err
+	}
+	name := components[len(components)-1]
+	if tree.Find(name) != nil {
+		return os.ErrExist
+	}
+	newSymlink(fs, tree, name, target)
+	return nil
+}
@@ -0,0 +1,105 @@
+package resticfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/restic/restic/lib/archiver"
+	localfs "github.com/restic/restic/lib/fs"
+	"github.com/restic/restic/lib/repository"
+	"github.com/stretchr/testify/require"
+)
+
+// TestBrowseSnapshot reads a snapshot which was created by restic rather
+// than by a Filesystem.
+func TestBrowseSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	large := make([]byte, 3<<20)
+	rand.New(rand.NewSource(1)).Read(large)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dir", "file"), []byte("contents"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "dir", "large"), large, 0644))
+	require.NoError(t, os.Symlink("dir/file", filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink("dir", filepath.Join(dir, "dirlink")))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "dir", "file"), filepath.Join(dir, "abslink")))
+	require.NoError(t, os.Symlink("loop", filepath.Join(dir, "loop")))
+	require.NoError(t, os.Symlink(strings.Repeat("../", 40)+"outside", filepath.Join(dir, "escape")))
+
+	repo := repository.TestRepository(t)
+	arch := archiver.New(repo, localfs.Local{}, archiver.Options{})
+	_, id, err := arch.Snapshot(testCtx, []string{dir}, archiver.SnapshotOptions{Time: time.Now()})
+	require.NoError(t, err)
+	fs, err := New(testCtx, repo, &id)
+	require.NoError(t, err)
+	// The snapshot contains the full path of dir.
+	root := strings.TrimPrefix(filepath.ToSlash(dir), "/")
+
+	fi, err := fs.Lstat(root + "/link")
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSymlink, fi.Mode().Type())
+	target, err := fs.Readlink(root + "/link")
+	require.NoError(t, err)
+	require.Equal(t, "dir/file", target)
+	_, err = fs.Readlink(root + "/dir/file")
+	require.Error(t, err)
+
+	for _, name := range []string{"link", "abslink", "dirlink/file"} {
+		fi, err := fs.Stat(root + "/" + name)
+		require.NoError(t, err, name)
+		require.True(t, fi.Mode().IsRegular(), name)
+		file, err := fs.Open(root + "/" + name)
+		require.NoError(t, err, name)
+		data, err := ioutil.ReadAll(file)
+		require.NoError(t, err, name)
+		require.NoError(t, file.Close())
+		require.Equal(t, "contents", string(data), name)
+	}
+	entries, err := fs.ReadDir(root + "/dirlink")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = fs.Stat(root + "/loop")
+	require.Equal(t, ErrTooManySymlinks, err)
+	_, err = fs.Stat(root + "/escape")
+	require.Equal(t, ErrInvalidPath, err)
+
+	// Large files are streamed by io.Copy, starting at the current offset.
+	file, err := fs.Open(root + "/dir/large")
+	require.NoError(t, err)
+	_, err = file.Seek(1000, io.SeekStart)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(large)-1000), n)
+	require.True(t, bytes.Equal(large[1000:], buf.Bytes()))
+	n, err = io.Copy(&buf, file)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	require.NoError(t, file.Close())
+}
+
+func TestSymlink(t *testing.T) {
+	fs := openTestRepo(t)
+	require.Equal(t, os.ErrPermission, fs.Symlink("target", "link"))
+	fs.StartNewSnapshot()
+	require.NoError(t, fs.Symlink("../target", "dir/link"))
+	require.Equal(t, os.ErrExist, fs.Symlink("target", "dir/link"))
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	fs, err = New(testCtx, fs.repo, &id)
+	require.NoError(t, err)
+	target, err := fs.Readlink("dir/link")
+	require.NoError(t, err)
+	require.Equal(t, "../target", target)
+	_, err = fs.Stat("dir/link")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,33 @@
+package resticfs
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// The methods below are the only ones which access Temporary. The chunker
+// workers release the temporary files of the files they commit concurrently,
+// but billy.Filesystem doesn't require implementations such as memfs to be
+// safe for concurrent use, so every access holds tempMu.
+
+// tempFile creates a new temporary file in Temporary.
+func (fs *Filesystem) tempFile(prefix string) (billy.File, error) {
+	fs.tempMu.Lock()
+	defer fs.tempMu.Unlock()
+	return fs.Temporary.TempFile("", prefix)
+}
+
+// removeTemp removes the temporary file name from Temporary.
+func (fs *Filesystem) removeTemp(name string) error {
+	fs.tempMu.Lock()
+	defer fs.tempMu.Unlock()
+	return fs.Temporary.Remove(name)
+}
+
+// statTemp returns the information about the temporary file name.
+func (fs *Filesystem) statTemp(name string) (os.FileInfo, error) {
+	fs.tempMu.Lock()
+	defer fs.tempMu.Unlock()
+	return fs.Temporary.Stat(name)
+}
@@ -6,7 +6,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -42,20 +44,26 @@ func newTree(fs *Filesystem, parent *resticTree) *resticTree {
 }
 
 func openTree(fs *Filesystem, parent *resticTree, original restic.ID) (*resticTree, error) {
-	tree, err := restic.LoadTree(fs.ctx, fs.repo, original)
+	tree, err := fs.loadTree(fs.ctx, original)
 	if err != nil {
 		return nil, err
 	}
+	return newTreeFromRestic(fs, parent, original, tree), nil
+}
+
+// newTreeFromRestic creates the resticTree for tree, which was loaded from the
+// tree blob with the given ID.
+func newTreeFromRestic(fs *Filesystem, parent *resticTree, id restic.ID, tree *restic.Tree) *resticTree {
 	t := &resticTree{
 		fs:     fs,
 		parent: parent,
 		Nodes:  make([]*resticNode, len(tree.Nodes)),
-		ID:     &original,
+		ID:     &id,
 	}
 	for i := range tree.Nodes {
 		t.Nodes[i] = newFromNode(t.fs, t, tree.Nodes[i])
 	}
-	return t, nil
+	return t
 }
 
 func (t *resticTree) Find(name string) *resticNode {
@@ -104,25 +112,72 @@ func (t *resticTree) OpenFile(original string, name string, flag int, perm os.Fi
 	} else if flag&os.O_EXCL != 0 {
 		return nil, os.ErrExist
 	} else if node.Type != "file" {
-		// XXX - need to handle the other node types here
+		if flag&(oWRITEABLE|os.O_CREATE) == 0 && !isSupportedType(node.Type) {
+			t.fs.skipUnsupported(original, node.Type)
+			return nil, os.ErrNotExist
+		}
+		// Directories and symlinks aren't opened as files, and nodes of
+		// unsupported types can't be written.
 		return nil, fmt.Errorf("refusing to open restic node with type %#v", node.Type)
 	}
 	return node.Open(original, flag, perm)
 }
 
-// Commit will persist any modifications to the restic repository.
-func (t *resticTree) Commit() (restic.ID, error) {
+// isSupportedType reports whether restic nodes of the type can be read.
+// Snapshots made by restic itself may also contain sockets, devices, and other
+// irregular files, which never appear in git repositories.
+func isSupportedType(nodeType string) bool {
+	switch nodeType {
+	case "file", "dir", "symlink":
+		return true
+	}
+	return false
+}
+
+// Check verifies that all subtrees can be loaded and that the blobs of all
+// committed files are present in the repository.
+func (t *resticTree) Check(path string) error {
+	for _, n := range t.Nodes {
+		fullpath := filepath.Join(path, n.Name)
+		switch n.Type {
+		case "dir":
+			subtree, err := n.OpenSubtree()
+			if err != nil {
+				return fmt.Errorf("%v: %w", fullpath, err)
+			}
+			if err := subtree.Check(fullpath); err != nil {
+				return err
+			}
+		case "file":
+			for _, id := range n.Content {
+				if _, found := t.fs.repo.LookupBlobSize(id, restic.DataBlob); !found {
+					return fmt.Errorf("%v: blob %v not found in repository", fullpath, id.Str())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Commit will persist any modifications to the restic repository. The path of
+// the tree is used to record statistics.
+func (t *resticTree) Commit(dir string) (restic.ID, error) {
 	if t.ID != nil {
 		return *t.ID, nil
 	}
 	tree := restic.Tree{
-		Nodes: make([]*restic.Node, len(t.Nodes)),
+		Nodes: make([]*restic.Node, 0, len(t.Nodes)),
 	}
-	for i, n := range t.Nodes {
-		if err := n.Commit(); err != nil {
+	for _, n := range t.Nodes {
+		name := filepath.Join(dir, n.Node.Name)
+		if t.fs.isExcluded(name) {
+			continue
+		}
+		if err := n.Commit(name); err != nil {
 			return restic.ID{}, err
 		}
-		tree.Nodes[i] = &n.Node
+		n.syncTimes()
+		tree.Nodes = append(tree.Nodes, &n.Node)
 	}
 	data, err := json.Marshal(tree)
 	if err != nil {
@@ -132,18 +187,39 @@ func (t *resticTree) Commit() (restic.ID, error) {
 
 	id := restic.Hash(data)
 	if t.fs.repo.Index().Has(restic.BlobHandle{ID: id, Type: restic.TreeBlob}) {
-		goto success
-	}
-	_, _, _, err = t.fs.repo.SaveBlob(t.fs.ctx, restic.TreeBlob, data, id, false)
-	if err != nil {
-		return restic.ID{}, err
+		t.fs.stats.Trees.addBlob(uint(len(data)), false, 0)
+	} else {
+		_, known, size, err := t.fs.repo.SaveBlob(t.fs.ctx, restic.TreeBlob, data, id, false)
+		if err != nil {
+			return restic.ID{}, err
+		}
+		t.fs.stats.Trees.addBlob(uint(len(data)), !known, size)
 	}
-
-success:
 	t.ID = &id
 	return id, nil
 }
 
+// pendingFiles appends the modified files in the tree which will be part of
+// the next snapshot to files, along with their paths.
+func (t *resticTree) pendingFiles(dir string, files []pendingFile) []pendingFile {
+	if t.ID != nil {
+		return files
+	}
+	for _, n := range t.Nodes {
+		name := filepath.Join(dir, n.Node.Name)
+		if t.fs.isExcluded(name) {
+			continue
+		}
+		switch {
+		case n.Node.Type == "file" && n.Node.Content == nil:
+			files = append(files, pendingFile{name: name, node: n})
+		case n.Node.Type == "dir" && n.subtree != nil:
+			files = n.subtree.pendingFiles(name, files)
+		}
+	}
+	return files
+}
+
 func (t *resticTree) addNode(n *resticNode) {
 	existing := t.Find(n.Node.Name)
 	if existing != nil {
@@ -184,14 +260,24 @@ func (t *resticTree) markDirty() {
 // resticNode stores information about a single file or directory. The only
 // methods which are save to be called concurrently are Backing and SetBacking.
 type resticNode struct {
-	fs     *Filesystem
-	parent *resticTree
+	// modified is the time of the last write to the file which is not yet
+	// reflected in Node, in nanoseconds since the epoch. It is accessed
+	// atomically, and is first to keep it aligned on 32-bit platforms.
+	modified int64
+	fs       *Filesystem
+	parent   *resticTree
 	restic.Node
 	subtree     *resticTree
 	flock       sync.Mutex
 	backingMu   sync.Mutex
 	backing     billy.File
 	openWriters int
+	// staged is the size of the temporary file of the node which is counted
+	// in the staged size of the Filesystem.
+	staged int64
+	// removed is set when the node is removed or replaced while it is open
+	// for writing, so that its temporary file is removed once it is closed.
+	removed bool
 }
 
 func newFromNode(fs *Filesystem, parent *resticTree, node *restic.Node) *resticNode {
@@ -201,20 +287,9 @@ func newFromNode(fs *Filesystem, parent *resticTree, node *restic.Node) *resticN
 
 func newDirectory(fs *Filesystem, parent *resticTree, name string, perm os.FileMode) *resticNode {
 	n := &resticNode{
-		fs:     fs,
-		parent: parent,
-		Node: restic.Node{
-			Name:       name,
-			Type:       "dir",
-			Mode:       perm & ^uMask,
-			ModTime:    time.Now(),
-			AccessTime: time.Now(),
-			ChangeTime: time.Now(),
-			UID:        uid,
-			GID:        gid,
-			User:       userName,
-			Group:      groupName,
-		},
+		fs:      fs,
+		parent:  parent,
+		Node:    fs.newNode(name, "dir", perm),
 		subtree: newTree(fs, parent),
 	}
 	parent.addNode(n)
@@ -225,34 +300,53 @@ func newFile(fs *Filesystem, parent *resticTree, name string, perm os.FileMode)
 	n := &resticNode{
 		fs:     fs,
 		parent: parent,
-		Node: restic.Node{
-			Name:       name,
-			Type:       "file",
-			Mode:       perm & ^uMask,
-			ModTime:    time.Now(),
-			AccessTime: time.Now(),
-			ChangeTime: time.Now(),
-			UID:        uid,
-			GID:        gid,
-			User:       userName,
-			Group:      groupName,
-		},
+		Node:   fs.newNode(name, "file", perm),
+	}
+	parent.addNode(n)
+	return n
+}
+
+func newSymlink(fs *Filesystem, parent *resticTree, name string, target string) *resticNode {
+	n := &resticNode{
+		fs:     fs,
+		parent: parent,
+		Node:   fs.newNode(name, "symlink", os.ModeSymlink|os.ModePerm),
 	}
+	n.LinkTarget = target
 	parent.addNode(n)
 	return n
 }
 
-// Rename moves this node into the new tree under the new name.
+// Rename moves this node into the new tree under the new name, replacing any
+// file which already has that name.
 func (n *resticNode) Rename(newtree *resticTree, newname string) error {
-	if exist := newtree.Find(newname); exist != nil {
-		return os.ErrExist
+	if exist := newtree.Find(newname); exist == n {
+		return nil
+	} else if exist != nil {
+		if exist.Type == "dir" || n.Type == "dir" {
+			return os.ErrExist
+		}
+		// Like rename(2), replace the existing file. This is how git and
+		// go-git update files such as packed-refs.
+		newtree.Remove(newname)
+		exist.release()
 	}
 	if n.parent != newtree && n.parent != nil {
 		n.parent.Remove(n.Node.Name)
 	}
 	n.Node.Name = newname
+	n.syncTimes()
+	if !n.fs.freezeTimes() {
+		n.Node.ChangeTime = time.Now()
+	}
 	if n.parent != newtree {
 		newtree.addNode(n)
+		n.parent = newtree
+		if n.subtree != nil {
+			n.subtree.parent = newtree
+		}
+	} else {
+		newtree.markDirty()
 	}
 	return nil
 }
@@ -262,7 +356,7 @@ func (n *resticNode) Open(name string, flag int, perm os.FileMode) (billy.File,
 	if n.Backing() == nil {
 		if n.Node.Content == nil {
 			// This is a new, empty file. Create a temporary backing.
-			backing, err := n.fs.Temporary.TempFile("", n.Node.Name)
+			backing, err := n.fs.tempFile(n.Node.Name)
 			if err != nil {
 				return nil, err
 			}
@@ -283,7 +377,7 @@ func (n *resticNode) Open(name string, flag int, perm os.FileMode) (billy.File,
 				}
 			}
 		}
-	} else if flag&oWRITEABLE != 0 && n.Node.Content != nil {
+	} else if _, compressed := n.Backing().(*compressedFile); flag&oWRITEABLE != 0 && (n.Node.Content != nil || compressed) {
 		// This existing file needs to be converted to a writable one.
 		err := n.makeWritable()
 		if err != nil {
@@ -319,6 +413,99 @@ func (n *resticNode) OpenSubtree() (*resticTree, error) {
 	return n.subtree, nil
 }
 
+// commitFile splits the contents of the file into chunks and saves them to the
+// restic repository. It may be called for different files concurrently, as
+// long as each call uses a separate fileChunker.
+func (n *resticNode) commitFile(name string, fc *fileChunker) error {
+	if n.openWriters > 0 {
+		// The goal here is for the snapshot to be internally consistent.
+		// Check how restic handles this, and possibly change this
+		// behavior.
+		return ErrInUse
+	}
+	rd := n.Backing()
+	rd.Seek(0, io.SeekStart)
+	if fc.batch == nil {
+		fc.batch = make([]byte, 0, saveBatchSize+chunker.MaxSize)
+	}
+	fc.batch, fc.chunks = fc.batch[:0], fc.chunks[:0]
+	if fc.chunker == nil {
+		fc.chunker = chunker.New(rd, n.fs.repo.Config().ChunkerPolynomial)
+	} else {
+		fc.chunker.Reset(rd, n.fs.repo.Config().ChunkerPolynomial)
+	}
+	blobs := restic.IDs{}
+	var size uint64
+	var stats BlobStats
+	for {
+		// The chunk is read directly into the unused part of the batch.
+		start := len(fc.batch)
+		chunk, err := fc.chunker.Next(fc.batch[start:])
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		size += uint64(chunk.Length)
+		fc.batch = fc.batch[:start+len(chunk.Data)]
+
+		id := restic.Hash(chunk.Data)
+		fc.chunks = append(fc.chunks, batchChunk{id: id, start: start, end: len(fc.batch)})
+		blobs = append(blobs, id)
+		if len(fc.batch) >= saveBatchSize {
+			if err := n.fs.saveBatch(fc, &stats); err != nil {
+				return err
+			}
+		}
+	}
+	if err := n.fs.saveBatch(fc, &stats); err != nil {
+		return err
+	}
+	n.Node.Size = size
+	n.Node.Content = blobs
+	n.fs.statsMu.Lock()
+	n.fs.stats.Files[name] = stats
+	n.fs.statsMu.Unlock()
+	// We need to switch back to the read-only backing, but the node data
+	// isn't yet fully committed to restic yet. When the full commit
+	// finishes, the next call to open will open the file read-only.
+	// XXX - we've invalidated the backing so all open handles are now
+	// invalid and will segfault.
+	return n.releaseBacking()
+}
+
+// release is called when the node is removed from its tree. The temporary
+// file of the node is removed now, or once it is no longer open for writing.
+func (n *resticNode) release() error {
+	if n.Type != "file" {
+		return nil
+	} else if n.openWriters > 0 {
+		n.removed = true
+		return nil
+	}
+	return n.releaseBacking()
+}
+
+// releaseBacking closes the backing of the node, and removes it from
+// Temporary if it is a temporary file.
+func (n *resticNode) releaseBacking() error {
+	n.backingMu.Lock()
+	backing := n.backing
+	n.backing = nil
+	n.backingMu.Unlock()
+	if backing == nil {
+		return nil
+	}
+	n.unstage()
+	err := backing.Close()
+	if _, ok := backing.(*resticFile); !ok {
+		if removeErr := n.fs.removeTemp(backing.Name()); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
 // Backing returns the underlying datastore for the file's data. Since it is
 // accessed by each file handle, it needs to be concurrency-safe. When a file
 // is converted from read-only to writeable, the backing store is swapped out,
@@ -336,11 +523,42 @@ func (n *resticNode) SetBacking(val billy.File) {
 	n.backing = val
 }
 
-// Commit will persist any modifications to the restic repository.
-func (n *resticNode) Commit() (err error) {
+// size returns the size of the file, including writes to its temporary file
+// which are not yet reflected in Node.
+func (n *resticNode) size() int64 {
+	backing := n.Backing()
+	if _, ok := backing.(*resticFile); backing == nil || ok {
+		return int64(n.Node.Size)
+	} else if compressed, ok := backing.(*compressedFile); ok {
+		return compressed.size
+	}
+	fi, err := n.fs.statTemp(backing.Name())
+	if err != nil {
+		return int64(n.Node.Size)
+	}
+	return fi.Size()
+}
+
+// tempSize returns the size of the temporary file of the node, which is
+// smaller than its size when the file is compressed, or 0 if it has none.
+func (n *resticNode) tempSize() int64 {
+	backing := n.Backing()
+	if _, ok := backing.(*resticFile); backing == nil || ok {
+		return 0
+	}
+	fi, err := n.fs.statTemp(backing.Name())
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Commit will persist any modifications to the restic repository. The path of
+// the node is used to record statistics.
+func (n *resticNode) Commit(name string) (err error) {
 	if n.fs.Logger != nil {
 		defer func() {
-			n.fs.Logger.Printf("(*resticNode)(%p).Commit() => %v\n", n, err)
+			n.fs.Logger.Debugf("(*resticNode)(%p).Commit() => %v", n, err)
 		}()
 	}
 	switch n.Node.Type {
@@ -349,52 +567,10 @@ func (n *resticNode) Commit() (err error) {
 			// Already committed.
 			return nil
 		}
-		if n.openWriters > 0 {
-			// The goal here is for the snapshot to be internally consistent.
-			// Check how restic handles this, and possibly change this
-			// behavior.
-			return ErrInUse
-		}
-		n.Node.Size = 0
-		rd := n.Backing()
-		rd.Seek(0, io.SeekStart)
-		if n.fs.buf == nil {
-			n.fs.buf = make([]byte, chunker.MaxSize)
-		}
 		if n.fs.chunker == nil {
-			n.fs.chunker = chunker.New(rd, n.fs.repo.Config().ChunkerPolynomial)
-		} else {
-			n.fs.chunker.Reset(rd, n.fs.repo.Config().ChunkerPolynomial)
+			n.fs.chunker = &fileChunker{}
 		}
-		blobs := restic.IDs{}
-		for {
-			chunk, err := n.fs.chunker.Next(n.fs.buf)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				return err
-			}
-			n.Node.Size += uint64(chunk.Length)
-
-			id := restic.Hash(chunk.Data)
-			if !n.fs.repo.Index().Has(restic.BlobHandle{ID: id, Type: restic.DataBlob}) {
-				_, _, _, err := n.fs.repo.SaveBlob(n.fs.ctx, restic.DataBlob, chunk.Data, id, true)
-				if err != nil {
-					return err
-				}
-
-			}
-
-			blobs = append(blobs, id)
-		}
-		n.Node.Content = blobs
-		// We need to switch back to the read-only backing, but the node data
-		// isn't yet fully committed to restic yet. When the full commit
-		// finishes, the next call to open will open the file read-only.
-		// XXX - we've invalidated the backing so all open handles are now
-		// invalid and will segfault.
-		n.SetBacking(nil)
-		return nil
+		return n.commitFile(name, n.fs.chunker)
 	case "dir":
 		if n.subtree == nil {
 			// Dir was never opened
@@ -403,7 +579,7 @@ func (n *resticNode) Commit() (err error) {
 			}
 			return nil
 		}
-		id, err := n.subtree.Commit()
+		id, err := n.subtree.Commit(name)
 		if err == nil {
 			n.Node.Subtree = &id
 		}
@@ -415,12 +591,16 @@ func (n *resticNode) Commit() (err error) {
 	}
 }
 
+// makeWritable copies the read-only backing of the file, which is either
+// stored in the repository or a compressed temporary file, into a new
+// temporary file.
 func (n *resticNode) makeWritable() error {
-	tempfile, err := n.fs.Temporary.TempFile("", n.Node.Name)
+	tempfile, err := n.fs.tempFile(n.Node.Name)
 	if err != nil {
 		return err
 	}
-	source := n.Backing().(*resticFile)
+	source := n.Backing()
+	source.Seek(0, io.SeekStart)
 	_, err = io.Copy(tempfile, source)
 	if err != nil {
 		return err
@@ -429,9 +609,64 @@ func (n *resticNode) makeWritable() error {
 	n.SetBacking(tempfile)
 	n.markDirty()
 	err = source.Close()
+	if _, ok := source.(*compressedFile); ok {
+		if removeErr := n.fs.removeTemp(source.Name()); err == nil {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// compressBacking replaces the temporary file of a file which was closed with
+// a compressed copy, if the Filesystem has a TempCompressor.
+func (n *resticNode) compressBacking() error {
+	if n.fs.TempCompressor == nil {
+		return nil
+	}
+	backing := n.Backing()
+	if _, ok := backing.(*resticFile); backing == nil || ok {
+		return nil
+	} else if _, ok := backing.(*compressedFile); ok {
+		return nil
+	}
+	compressed, err := n.fs.compress(backing, n.size(), n.Node.Name)
+	if err != nil {
+		return err
+	}
+	n.SetBacking(compressed)
+	err = backing.Close()
+	if removeErr := n.fs.removeTemp(backing.Name()); err == nil {
+		err = removeErr
+	}
 	return err
 }
 
+// touch records that the contents of the file were modified. It is safe to
+// call concurrently.
+func (n *resticNode) touch() {
+	if !n.fs.freezeTimes() {
+		atomic.StoreInt64(&n.modified, time.Now().UnixNano())
+	}
+}
+
+// modTime returns the modification time of the node, including writes which
+// are not yet reflected in Node.
+func (n *resticNode) modTime() time.Time {
+	if modified := atomic.LoadInt64(&n.modified); modified != 0 {
+		return time.Unix(0, modified)
+	}
+	return n.Node.ModTime
+}
+
+// syncTimes updates the timestamps in Node to reflect writes recorded by
+// touch.
+func (n *resticNode) syncTimes() {
+	if modified := atomic.SwapInt64(&n.modified, 0); modified != 0 {
+		n.Node.ModTime = time.Unix(0, modified)
+		n.Node.ChangeTime = n.Node.ModTime
+	}
+}
+
 func (n *resticNode) markDirty() {
 	n.Node.Content = nil
 	if n.parent != nil {
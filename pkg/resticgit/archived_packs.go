@@ -0,0 +1,214 @@
+package resticgit
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	billyutil "github.com/go-git/go-billy/v5/util"
+)
+
+// ArchivedPacksPath is the directory of the stored repository which holds
+// the packs of earlier snapshots when the incremental layout is used.
+const ArchivedPacksPath = "restic-packs"
+
+// packDir is the directory where git stores packs.
+const packDir = "objects/pack"
+
+// archivedPacksFS presents the packs in ArchivedPacksPath as if they were in
+// objects/pack. Every archived directory is a directory which was moved there
+// unchanged, so restic stores it by reference to the tree of the snapshot which
+// wrote it, and committing a snapshot only writes the new packs, a tree which
+// lists them, and a small tree which lists the archived directories. Packs are
+// always written to objects/pack.
+type archivedPacksFS struct {
+	billy.Filesystem
+}
+
+func (fs *archivedPacksFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *archivedPacksFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	file, err := fs.Filesystem.OpenFile(filename, flag, perm)
+	if !os.IsNotExist(err) || flag != os.O_RDONLY {
+		return file, err
+	}
+	archived, ok, archiveErr := fs.findArchived(filename)
+	if archiveErr != nil {
+		return nil, archiveErr
+	} else if !ok {
+		return nil, err
+	}
+	return fs.Filesystem.Open(archived)
+}
+
+func (fs *archivedPacksFS) Stat(filename string) (os.FileInfo, error) {
+	fi, err := fs.Filesystem.Stat(filename)
+	if !os.IsNotExist(err) {
+		return fi, err
+	}
+	archived, ok, archiveErr := fs.findArchived(filename)
+	if archiveErr != nil {
+		return nil, archiveErr
+	} else if !ok {
+		return nil, err
+	}
+	return fs.Filesystem.Stat(archived)
+}
+
+func (fs *archivedPacksFS) Remove(filename string) error {
+	err := fs.Filesystem.Remove(filename)
+	if !os.IsNotExist(err) {
+		return err
+	}
+	archived, ok, archiveErr := fs.findArchived(filename)
+	if archiveErr != nil {
+		return archiveErr
+	} else if !ok {
+		return err
+	}
+	return fs.Filesystem.Remove(archived)
+}
+
+func (fs *archivedPacksFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	entries, err := fs.Filesystem.ReadDir(dirname)
+	if path.Clean(dirname) != packDir || (err != nil && !os.IsNotExist(err)) {
+		return entries, err
+	}
+	dirs, archiveErr := archivedPackDirs(fs.Filesystem)
+	if archiveErr != nil {
+		return nil, archiveErr
+	} else if len(dirs) == 0 {
+		return entries, err
+	}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		seen[entry.Name()] = true
+	}
+	for _, dir := range dirs {
+		archived, err := fs.Filesystem.ReadDir(path.Join(ArchivedPacksPath, dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range archived {
+			if !seen[entry.Name()] {
+				seen[entry.Name()] = true
+				entries = append(entries, entry)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// findArchived returns the path of the archived copy of a file in
+// objects/pack. It returns false if filename is not in objects/pack, or if
+// there is no archived copy.
+func (fs *archivedPacksFS) findArchived(filename string) (string, bool, error) {
+	name := path.Clean(filename)
+	if path.Dir(name) != packDir {
+		return "", false, nil
+	}
+	dirs, err := archivedPackDirs(fs.Filesystem)
+	if err != nil {
+		return "", false, err
+	}
+	// The newest copy of a pack is used if it was written more than once.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		archived := path.Join(ArchivedPacksPath, dirs[i], path.Base(name))
+		if _, err := fs.Filesystem.Stat(archived); err == nil {
+			return archived, true, nil
+		} else if !os.IsNotExist(err) {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// archivedPackDirs returns the names of the directories in ArchivedPacksPath,
+// from the oldest to the newest.
+func archivedPackDirs(fs billy.Dir) ([]string, error) {
+	entries, err := fs.ReadDir(ArchivedPacksPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// ArchivePacks prepares the repository stored in fs, which must be writable,
+// for a new snapshot. With the incremental layout, the packs in objects/pack,
+// which were written by the snapshot that fs was opened from, are moved into a
+// new directory in ArchivedPacksPath, so that objects/pack only holds the packs
+// which are written to the new snapshot. Otherwise, any archived packs are
+// moved back into objects/pack, which converts the repository to the ordinary
+// layout of a git repository. Repositories with archived packs can be read
+// regardless of the layout.
+func ArchivePacks(fs billy.Basic, incremental bool) error {
+	pf := polyfill.New(fs)
+	dirs, err := archivedPackDirs(pf)
+	if err != nil {
+		return err
+	}
+	if !incremental {
+		return restoreArchivedPacks(pf, dirs)
+	}
+	entries, err := pf.ReadDir(packDir)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	next := 1
+	if len(dirs) > 0 {
+		last, err := strconv.Atoi(dirs[len(dirs)-1])
+		if err != nil {
+			return fmt.Errorf("unexpected directory %s in %s", dirs[len(dirs)-1], ArchivedPacksPath)
+		}
+		next = last + 1
+	}
+	if err := pf.MkdirAll(ArchivedPacksPath, 0755); err != nil {
+		return err
+	}
+	if err := pf.Rename(packDir, path.Join(ArchivedPacksPath, fmt.Sprintf("%06d", next))); err != nil {
+		return err
+	}
+	return pf.MkdirAll(packDir, 0755)
+}
+
+// restoreArchivedPacks moves the packs in the given archived directories into
+// objects/pack, and removes ArchivedPacksPath.
+func restoreArchivedPacks(fs billy.Filesystem, dirs []string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	if err := fs.MkdirAll(packDir, 0755); err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		dir = path.Join(ArchivedPacksPath, dir)
+		entries, err := fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err := fs.Rename(path.Join(dir, entry.Name()), path.Join(packDir, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return billyutil.RemoveAll(fs, ArchivedPacksPath)
+}
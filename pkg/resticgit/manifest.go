@@ -0,0 +1,193 @@
+package resticgit
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Manifest summarizes the contents of a stored repository, so that it can be
+// audited without opening the repository.
+type Manifest struct {
+	// Head is the ref which HEAD points to.
+	Head string        `json:"head,omitempty"`
+	Refs []ManifestRef `json:"refs"`
+	// Objects is the number of objects in all packs, plus the number of
+	// loose objects. An object which is stored more than once is counted
+	// each time.
+	Objects      int            `json:"objects"`
+	LooseObjects int            `json:"looseObjects"`
+	Packs        []ManifestPack `json:"packs"`
+}
+
+// ManifestRef describes a ref in a Manifest. Exactly one of Hash and Target
+// is set.
+type ManifestRef struct {
+	Name   string `json:"name"`
+	Hash   string `json:"hash,omitempty"`
+	Target string `json:"target,omitempty"`
+	// Commit is the object which an annotated tag points to, if it differs
+	// from Hash.
+	Commit string `json:"commit,omitempty"`
+}
+
+// ManifestPack describes a pack in a Manifest.
+type ManifestPack struct {
+	Name    string `json:"name"`
+	Objects int    `json:"objects"`
+	Size    int64  `json:"size"`
+}
+
+// storageFilesystem is implemented by the storage of every repository opened
+// by OpenWithOptions.
+type storageFilesystem interface {
+	Filesystem() billy.Filesystem
+}
+
+// BuildManifest returns the Manifest of a repository opened by Open or
+// OpenWithOptions. The number of objects in each pack is read from the
+// header of its index, so the packs themselves are not read.
+func BuildManifest(repo *git.Repository) (*Manifest, error) {
+	storage, ok := repo.Storer.(storageFilesystem)
+	if !ok {
+		return nil, errors.New("repository is not stored in a filesystem")
+	}
+	fs := storage.Filesystem()
+	manifest := &Manifest{Refs: []ManifestRef{}, Packs: []ManifestPack{}}
+
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() == plumbing.HEAD {
+			manifest.Head = ref.Target().String()
+			return nil
+		}
+		entry := ManifestRef{Name: ref.Name().String()}
+		if ref.Type() == plumbing.SymbolicReference {
+			entry.Target = ref.Target().String()
+		} else {
+			entry.Hash = ref.Hash().String()
+			if ref.Name().IsTag() {
+				commit, err := peelTag(repo, ref.Hash())
+				if err != nil {
+					return fmt.Errorf("unable to read %s: %w", ref.Name(), err)
+				} else if commit != ref.Hash() {
+					entry.Commit = commit.String()
+				}
+			}
+		}
+		manifest.Refs = append(manifest.Refs, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(manifest.Refs, func(i, j int) bool {
+		return manifest.Refs[i].Name < manifest.Refs[j].Name
+	})
+	if manifest.Head == "" {
+		// HEAD is not returned by every ref storage.
+		if head, err := repo.Storer.Reference(plumbing.HEAD); err == nil && head.Type() == plumbing.SymbolicReference {
+			manifest.Head = head.Target().String()
+		}
+	}
+
+	entries, err := fs.ReadDir(packDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "pack-") || !strings.HasSuffix(name, ".pack") {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".pack")
+		count, err := packObjectCount(fs, path.Join(packDir, name+".idx"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the index of %s: %w", name, err)
+		}
+		manifest.Packs = append(manifest.Packs, ManifestPack{Name: name, Objects: count, Size: entry.Size()})
+		manifest.Objects += count
+	}
+	sort.Slice(manifest.Packs, func(i, j int) bool {
+		return manifest.Packs[i].Name < manifest.Packs[j].Name
+	})
+
+	if manifest.LooseObjects, err = countLooseObjects(fs); err != nil {
+		return nil, err
+	}
+	manifest.Objects += manifest.LooseObjects
+	return manifest, nil
+}
+
+// peelTag returns the object which the annotated tag with the given hash
+// points to, following tags of tags, or hash itself if it isn't a tag.
+func peelTag(repo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		tag, err := repo.TagObject(hash)
+		if err == plumbing.ErrObjectNotFound {
+			return hash, nil
+		} else if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		hash = tag.Target
+	}
+}
+
+// idxHeaderSize is the size of the header and fanout table of a version 2
+// pack index. The last entry of the fanout table is the number of objects.
+const idxHeaderSize = 8 + 256*4
+
+// packObjectCount returns the number of objects in a pack, from its index.
+func packObjectCount(fs billy.Filesystem, idxPath string) (int, error) {
+	file, err := fs.Open(idxPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	header := make([]byte, idxHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return 0, err
+	}
+	if string(header[:4]) != "\377tOc" || binary.BigEndian.Uint32(header[4:8]) != 2 {
+		return 0, errors.New("unsupported pack index version")
+	}
+	return int(binary.BigEndian.Uint32(header[idxHeaderSize-4:])), nil
+}
+
+// countLooseObjects returns the number of loose objects in fs.
+func countLooseObjects(fs billy.Filesystem) (int, error) {
+	dirs, err := fs.ReadDir("objects")
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := fs.ReadDir(path.Join("objects", dir.Name()))
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			if len(file.Name()) == 38 {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
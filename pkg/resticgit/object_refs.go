@@ -0,0 +1,96 @@
+package resticgit
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// objectRefPrefix is the prefix of the refs which stand in for objects that
+// are fetched by hash. They only exist while the objects are fetched.
+const objectRefPrefix = "refs/restic-objects/"
+
+// IsObjectName reports whether name is the full hexadecimal name of an object,
+// which git sends instead of a ref name when a commit is fetched by hash.
+func IsObjectName(name string) bool {
+	if len(name) != 2*len(plumbing.ZeroHash) {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// objectRefsStorage adds refs to a storage without storing them, so that
+// objects which no ref points to can be transferred.
+type objectRefsStorage struct {
+	storage.Storer
+	refs map[plumbing.ReferenceName]*plumbing.Reference
+}
+
+func (s *objectRefsStorage) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if ref, ok := s.refs[name]; ok {
+		return ref, nil
+	}
+	return s.Storer.Reference(name)
+}
+
+func (s *objectRefsStorage) IterReferences() (storer.ReferenceIter, error) {
+	iter, err := s.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	if err := iter.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, ref)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, ref := range s.refs {
+		refs = append(refs, ref)
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+// resolveObjectRefSpecs replaces the source of each refspec which is the name
+// of an object with a ref which points to the object, and returns a view of
+// repo in which those refs exist. Objects which aren't in repo are reported
+// as errors.
+func resolveObjectRefSpecs(repo *git.Repository, refSpecs []config.RefSpec) (*git.Repository, []config.RefSpec, error) {
+	refs := map[plumbing.ReferenceName]*plumbing.Reference{}
+	resolved := make([]config.RefSpec, len(refSpecs))
+	for i, refSpec := range refSpecs {
+		resolved[i] = refSpec
+		src := refSpec.Src()
+		if refSpec.IsDelete() || !IsObjectName(src) {
+			continue
+		}
+		hash := plumbing.NewHash(src)
+		if err := repo.Storer.HasEncodedObject(hash); err != nil {
+			if err == plumbing.ErrObjectNotFound {
+				return nil, nil, fmt.Errorf("object %s not found in the stored repository", src)
+			}
+			return nil, nil, err
+		}
+		name := plumbing.ReferenceName(objectRefPrefix + src)
+		refs[name] = plumbing.NewHashReference(name, hash)
+		force := ""
+		if refSpec.IsForceUpdate() {
+			force = "+"
+		}
+		resolved[i] = config.RefSpec(force + name.String() + ":" + destination(refSpec))
+	}
+	if len(refs) == 0 {
+		return repo, resolved, nil
+	}
+	view, err := git.Open(&objectRefsStorage{Storer: repo.Storer, refs: refs}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return view, resolved, nil
+}
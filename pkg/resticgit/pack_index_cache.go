@@ -0,0 +1,76 @@
+package resticgit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+)
+
+// packIndexPattern matches the pack index files of a git repository. Since a
+// pack is named after the hash of its content, the index of a pack with a
+// given name never changes, and can be cached regardless of which repository
+// it came from.
+var packIndexPattern = regexp.MustCompile(`^objects/pack/pack-[0-9a-f]{40}\.idx$`)
+
+// packIndexCacheFS serves the pack index files of a stored repository from a
+// cache, so that opening a repository doesn't require reading every index from
+// restic. All other operations are passed through.
+type packIndexCacheFS struct {
+	billy.Filesystem
+	cache billy.Filesystem
+}
+
+func (fs *packIndexCacheFS) Open(filename string) (billy.File, error) {
+	return fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+func (fs *packIndexCacheFS) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
+	name := path.Clean(filename)
+	if flag != os.O_RDONLY || !packIndexPattern.MatchString(name) {
+		return fs.Filesystem.OpenFile(filename, flag, perm)
+	}
+	cacheName := path.Base(name)
+	if cached, err := fs.cache.Open(cacheName); err == nil {
+		return cached, nil
+	}
+
+	file, err := fs.Filesystem.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Failing to populate the cache only makes the next open slower.
+	fs.store(cacheName, content)
+	return newMemoryFile(filename, content)
+}
+
+// store adds an index to the cache. The index is written to a temporary file
+// first, so that concurrent processes never read a partial index.
+func (fs *packIndexCacheFS) store(name string, content []byte) {
+	temp := fmt.Sprintf("%s.%d.tmp", name, os.Getpid())
+	if err := billyutil.WriteFile(fs.cache, temp, content, 0666); err != nil {
+		return
+	}
+	if err := fs.cache.Rename(temp, name); err != nil {
+		fs.cache.Remove(temp)
+	}
+}
+
+// newMemoryFile returns a read-only billy.File with the given content.
+func newMemoryFile(name string, content []byte) (billy.File, error) {
+	mem := memfs.New()
+	if err := billyutil.WriteFile(mem, name, content, 0444); err != nil {
+		return nil, err
+	}
+	return mem.Open(name)
+}
@@ -0,0 +1,37 @@
+package resticgit
+
+import (
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	gitfs "github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// packedRefsStorage allows updating refs which are only stored in
+// packed-refs. go-git compares the expected old value of such a ref against
+// its loose ref file, which doesn't exist, so every update would fail with
+// storage.ErrReferenceHasChanged.
+type packedRefsStorage struct {
+	*gitfs.Storage
+}
+
+func (s *packedRefsStorage) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	return checkAndSetReference(s, ref, old)
+}
+
+// checkAndSetReference stores ref in s if old is nil, or if the current value
+// of the ref named by old matches it.
+func checkAndSetReference(s storer.ReferenceStorer, ref, old *plumbing.Reference) error {
+	if old != nil {
+		current, err := s.Reference(old.Name())
+		if err == plumbing.ErrReferenceNotFound {
+			return storage.ErrReferenceHasChanged
+		} else if err != nil {
+			return err
+		}
+		if current.Hash() != old.Hash() {
+			return storage.ErrReferenceHasChanged
+		}
+	}
+	return s.SetReference(ref)
+}
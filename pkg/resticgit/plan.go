@@ -0,0 +1,170 @@
+package resticgit
+
+import (
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// RefChange is a ref which a transfer would create, update, or delete.
+type RefChange struct {
+	// Name is the ref in the destination repository.
+	Name plumbing.ReferenceName
+	// Old is the current value of the ref, or the zero hash if it doesn't
+	// exist.
+	Old plumbing.Hash
+	// New is the value which the ref would be given, or the zero hash if it
+	// would be deleted.
+	New plumbing.Hash
+	// Forced is set when the ref would be updated to a commit which doesn't
+	// descend from its current value, which requires a forced update.
+	Forced bool
+}
+
+// Plan describes what a Push or Fetch would do, without doing it.
+type Plan struct {
+	// Refs are the refs which would change, in the order of the refspecs.
+	// Refs which are already up to date are left out.
+	Refs []RefChange
+	// Objects is the number of objects which would be copied.
+	Objects int
+	// Size is the total size of the objects which would be copied, before
+	// compression. Git compresses the objects and stores them as deltas
+	// where possible, so the size of the transfer is normally much smaller.
+	Size int64
+}
+
+// PlanPush returns what Push would do with the same arguments, without
+// modifying either repository. The stored repository may be read-only.
+func PlanPush(stored *git.Repository, localPath string, refSpecs []config.RefSpec) (*Plan, error) {
+	local, err := git.PlainOpen(localPath)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := ResolveSymbolicRefSpecs(stored, refSpecs)
+	if err != nil {
+		return nil, err
+	}
+	return plan(local, stored, resolved)
+}
+
+// PlanFetch returns what Fetch would do with the same arguments, without
+// modifying either repository. Refspecs whose source is the hash of an object
+// are not supported.
+func PlanFetch(stored *git.Repository, localPath string, refSpecs []config.RefSpec) (*Plan, error) {
+	local, err := git.PlainOpen(localPath)
+	if err != nil {
+		return nil, err
+	}
+	return plan(stored, local, refSpecs)
+}
+
+// plan computes the Plan of copying the refs named by refSpecs from source to
+// dest.
+func plan(source, dest *git.Repository, refSpecs []config.RefSpec) (*Plan, error) {
+	var sourceRefs []*plumbing.Reference
+	p := &Plan{}
+	var wants []plumbing.Hash
+	for _, refSpec := range refSpecs {
+		var updates []RefChange
+		if refSpec.IsDelete() {
+			updates = append(updates, RefChange{Name: refSpec.Dst("")})
+		} else if refSpec.IsWildcard() {
+			if sourceRefs == nil {
+				var err error
+				if sourceRefs, err = listReferences(source); err != nil {
+					return nil, err
+				}
+			}
+			for _, ref := range sourceRefs {
+				if refSpec.Match(ref.Name()) {
+					updates = append(updates, RefChange{Name: refSpec.Dst(ref.Name()), New: ref.Hash()})
+				}
+			}
+		} else {
+			ref, err := storer.ResolveReference(source.Storer, plumbing.ReferenceName(refSpec.Src()))
+			if err != nil {
+				return nil, err
+			}
+			updates = append(updates, RefChange{Name: refSpec.Dst(""), New: ref.Hash()})
+		}
+		for _, update := range updates {
+			ref, err := storer.ResolveReference(dest.Storer, update.Name)
+			if err == nil {
+				update.Old = ref.Hash()
+			} else if err != plumbing.ErrReferenceNotFound {
+				return nil, err
+			}
+			if update.Old == update.New {
+				continue
+			}
+			if !update.Old.IsZero() && !update.New.IsZero() {
+				update.Forced = !descendsFrom(source, update.New, update.Old)
+			}
+			if !update.New.IsZero() {
+				wants = append(wants, update.New)
+			}
+			p.Refs = append(p.Refs, update)
+		}
+	}
+	if len(wants) == 0 {
+		return p, nil
+	}
+
+	destRefs, err := listReferences(dest)
+	if err != nil {
+		return nil, err
+	}
+	var haves []plumbing.Hash
+	for _, ref := range destRefs {
+		haves = append(haves, ref.Hash())
+	}
+	hashes, err := revlist.ObjectsWithStorageForIgnores(source.Storer, dest.Storer, wants, haves)
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		obj, err := source.Storer.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return nil, err
+		}
+		p.Objects++
+		p.Size += obj.Size()
+	}
+	return p, nil
+}
+
+// listReferences returns the refs of repo which point to objects.
+func listReferences(repo *git.Repository) ([]*plumbing.Reference, error) {
+	refs, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var result []*plumbing.Reference
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			result = append(result, ref)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// descendsFrom reports whether the commit new descends from the commit old,
+// both of which are read from repo. Objects which aren't commits, or which
+// aren't in repo, never descend from each other.
+func descendsFrom(repo *git.Repository, new, old plumbing.Hash) bool {
+	oldCommit, err := object.GetCommit(repo.Storer, old)
+	if err != nil {
+		return false
+	}
+	newCommit, err := object.GetCommit(repo.Storer, new)
+	if err != nil {
+		return false
+	}
+	ok, err := oldCommit.IsAncestor(newCommit)
+	return err == nil && ok
+}
@@ -0,0 +1,135 @@
+package resticgit
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// ProgressEvent reports the progress of one phase of a transfer, such as
+// counting, compressing, or staging objects.
+type ProgressEvent struct {
+	// Phase names the work, such as "Counting objects".
+	Phase string
+	// Done is the number of units of work which are complete.
+	Done int
+	// Total is the number of units of work in the phase, or 0 if it isn't
+	// known in advance.
+	Total int
+	// Finished is set on the last event of the phase.
+	Finished bool
+}
+
+// String formats the event like git does, such as "Counting objects: 100%
+// (3/3), done.".
+func (e ProgressEvent) String() string {
+	var s string
+	if e.Total > 0 {
+		s = fmt.Sprintf("%s: %3d%% (%d/%d)", e.Phase, e.Done*100/e.Total, e.Done, e.Total)
+	} else {
+		s = fmt.Sprintf("%s: %d", e.Phase, e.Done)
+	}
+	if e.Finished {
+		s += ", done."
+	}
+	return s
+}
+
+// Progress receives the progress of a transfer. Either function may be nil.
+type Progress struct {
+	// Event receives the progress of each phase of the transfer.
+	Event func(event ProgressEvent)
+	// Log receives the other messages produced by the transfer, such as
+	// "Total 3 (delta 0), reused 0 (delta 0)". The message does not include
+	// the line terminator.
+	Log func(message string)
+}
+
+func (p *Progress) event(event ProgressEvent) {
+	if p != nil && p.Event != nil {
+		p.Event(event)
+	}
+}
+
+func (p *Progress) log(message string) {
+	if p != nil && p.Log != nil {
+		p.Log(message)
+	}
+}
+
+// ProgressFunc receives the human-readable progress messages produced while
+// objects are transferred, such as "Counting objects: 100% (3/3), done.". The
+// message does not include the line terminator.
+type ProgressFunc func(message string)
+
+// Progress returns a Progress which delivers both the formatted events and
+// the log messages to fn, or nil if fn is nil.
+func (fn ProgressFunc) Progress() *Progress {
+	if fn == nil {
+		return nil
+	}
+	return &Progress{
+		Event: func(event ProgressEvent) {
+			fn(event.String())
+		},
+		Log: fn,
+	}
+}
+
+// progressPattern matches the progress messages of git, such as "Counting
+// objects:  50% (1/2)" and "Enumerating objects: 5, done.".
+var progressPattern = regexp.MustCompile(`^([^:]+):\s+(?:\d+%\s+\((\d+)/(\d+)\)|(\d+))(, done\.)?`)
+
+// parseProgress returns the event described by a progress message of git.
+func parseProgress(message string) (ProgressEvent, bool) {
+	m := progressPattern.FindStringSubmatch(message)
+	if m == nil {
+		return ProgressEvent{}, false
+	}
+	event := ProgressEvent{Phase: m[1], Finished: m[5] != ""}
+	if m[4] != "" {
+		event.Done, _ = strconv.Atoi(m[4])
+	} else {
+		event.Done, _ = strconv.Atoi(m[2])
+		event.Total, _ = strconv.Atoi(m[3])
+	}
+	return event, true
+}
+
+// progressWriter splits the progress stream produced by git into messages,
+// which are delivered as events when they describe the progress of a phase.
+// Git terminates a message with "\r" when the next message replaces it.
+type progressWriter struct {
+	progress *Progress
+	buf      []byte
+}
+
+func newProgressWriter(progress *Progress) sideband.Progress {
+	if progress == nil {
+		return nil
+	}
+	return &progressWriter{progress: progress}
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			message := string(w.buf[:i])
+			if event, ok := parseProgress(message); ok {
+				w.progress.event(event)
+			} else {
+				w.progress.log(message)
+			}
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
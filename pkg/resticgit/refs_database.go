@@ -0,0 +1,272 @@
+package resticgit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+	gitfs "github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// RefsDatabasePath is the location of the refs database in the stored
+// repository.
+const RefsDatabasePath = "restic-refs"
+
+// refsDatabaseHeader is the first line of the refs database, and identifies
+// the version of its format.
+const refsDatabaseHeader = "# restic-refs v1"
+
+// packedRefsPath is the location of the packed-refs file of a git repository.
+const packedRefsPath = "packed-refs"
+
+// refsDatabaseStorage stores every ref other than HEAD in a single file,
+// instead of one file per ref, which keeps the number of tree nodes and blobs
+// which change with each push small for repositories with many refs. Refs
+// which are still stored by git, as loose refs or in packed-refs, remain
+// visible, and are moved into the database when they are updated or when
+// PackRefs is called. When the database is disabled, refs are instead moved
+// out of it as they are updated.
+type refsDatabaseStorage struct {
+	*gitfs.Storage
+	fs      billy.Basic
+	enabled bool
+	refs    map[plumbing.ReferenceName]*plumbing.Reference
+	// held counts the callers which have deferred saving the database, and
+	// dirty records whether it has changed since it was last saved.
+	held  int
+	dirty bool
+}
+
+// openRefsDatabase wraps s with a refs database stored in fs if enabled is
+// true, or if fs already contains a refs database. Otherwise s is only
+// wrapped with packedRefsStorage.
+func openRefsDatabase(s *gitfs.Storage, fs billy.Basic, enabled bool) (storage.Storer, error) {
+	refs, err := readRefsDatabase(fs)
+	if err != nil {
+		return nil, err
+	}
+	if refs == nil && !enabled {
+		return &packedRefsStorage{s}, nil
+	}
+	if refs == nil {
+		refs = map[plumbing.ReferenceName]*plumbing.Reference{}
+	}
+	return &refsDatabaseStorage{Storage: s, fs: fs, enabled: enabled, refs: refs}, nil
+}
+
+// readRefsDatabase returns the refs in the database in fs, or nil if there is
+// no database.
+func readRefsDatabase(fs billy.Basic) (map[plumbing.ReferenceName]*plumbing.Reference, error) {
+	file, err := fs.Open(RefsDatabasePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != refsDatabaseHeader {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s has an unsupported format", RefsDatabasePath)
+	}
+	refs := map[plumbing.ReferenceName]*plumbing.Reference{}
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid entry %#v in %s", scanner.Text(), RefsDatabasePath)
+		}
+		name := plumbing.ReferenceName(fields[1])
+		if strings.HasPrefix(fields[0], "@") {
+			refs[name] = plumbing.NewSymbolicReference(name, plumbing.ReferenceName(fields[0][1:]))
+		} else {
+			refs[name] = plumbing.NewHashReference(name, plumbing.NewHash(fields[0]))
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// save writes the database, unless saving has been deferred by hold. The
+// database is removed once it is empty and disabled.
+func (s *refsDatabaseStorage) save() error {
+	s.dirty = true
+	if s.held > 0 {
+		return nil
+	}
+	s.dirty = false
+	if len(s.refs) == 0 && !s.enabled {
+		err := s.fs.Remove(RefsDatabasePath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(refsDatabaseHeader + "\n")
+	for _, name := range s.sortedNames() {
+		ref := s.refs[plumbing.ReferenceName(name)]
+		if ref.Type() == plumbing.SymbolicReference {
+			fmt.Fprintf(&buf, "@%s %s\n", ref.Target(), name)
+		} else {
+			fmt.Fprintf(&buf, "%s %s\n", ref.Hash(), name)
+		}
+	}
+	return billyutil.WriteFile(s.fs, RefsDatabasePath, buf.Bytes(), 0666)
+}
+
+// sortedNames returns the names of the refs in the database in order.
+func (s *refsDatabaseStorage) sortedNames() []string {
+	names := make([]string, 0, len(s.refs))
+	for name := range s.refs {
+		names = append(names, name.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// hold defers saving the database until the matching call to release, so
+// that updating many refs writes the database once.
+func (s *refsDatabaseStorage) hold() {
+	s.held++
+}
+
+// release saves the database if it changed while saving was held.
+func (s *refsDatabaseStorage) release() error {
+	s.held--
+	if s.held > 0 || !s.dirty {
+		return nil
+	}
+	return s.save()
+}
+
+// holdRefsDatabase defers saving the refs database of repo, if it has one,
+// and returns the function which saves it.
+func holdRefsDatabase(repo *git.Repository) (release func() error) {
+	s, ok := repo.Storer.(*refsDatabaseStorage)
+	if !ok {
+		return func() error { return nil }
+	}
+	s.hold()
+	return s.release
+}
+
+func (s *refsDatabaseStorage) SetReference(ref *plumbing.Reference) error {
+	if !s.enabled || ref.Name() == plumbing.HEAD {
+		if err := s.Storage.SetReference(ref); err != nil {
+			return err
+		}
+		if _, ok := s.refs[ref.Name()]; ok {
+			delete(s.refs, ref.Name())
+			return s.save()
+		}
+		return nil
+	}
+	s.refs[ref.Name()] = ref
+	if err := s.save(); err != nil {
+		return err
+	}
+	return s.Storage.RemoveReference(ref.Name())
+}
+
+func (s *refsDatabaseStorage) CheckAndSetReference(ref, old *plumbing.Reference) error {
+	return checkAndSetReference(s, ref, old)
+}
+
+func (s *refsDatabaseStorage) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if ref, ok := s.refs[name]; ok {
+		return ref, nil
+	}
+	return s.Storage.Reference(name)
+}
+
+func (s *refsDatabaseStorage) IterReferences() (storer.ReferenceIter, error) {
+	iter, err := s.Storage.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if _, ok := s.refs[ref.Name()]; !ok {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range s.sortedNames() {
+		refs = append(refs, s.refs[plumbing.ReferenceName(name)])
+	}
+	return storer.NewReferenceSliceIter(refs), nil
+}
+
+func (s *refsDatabaseStorage) RemoveReference(name plumbing.ReferenceName) error {
+	if _, ok := s.refs[name]; ok {
+		delete(s.refs, name)
+		if err := s.save(); err != nil {
+			return err
+		}
+	}
+	return s.Storage.RemoveReference(name)
+}
+
+// PackRefs moves all refs other than HEAD into the database when it is
+// enabled. Otherwise the refs in the database are moved back to git, and
+// packed like git pack-refs does.
+func (s *refsDatabaseStorage) PackRefs() error {
+	s.hold()
+	err := s.packRefs()
+	if releaseErr := s.release(); err == nil {
+		err = releaseErr
+	}
+	return err
+}
+
+func (s *refsDatabaseStorage) packRefs() error {
+	if !s.enabled {
+		for _, ref := range s.refs {
+			if err := s.SetReference(ref); err != nil {
+				return err
+			}
+		}
+		return s.Storage.PackRefs()
+	}
+	iter, err := s.Storage.IterReferences()
+	if err != nil {
+		return err
+	}
+	var moved []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			s.refs[ref.Name()] = ref
+			moved = append(moved, ref.Name())
+		}
+		return nil
+	})
+	if err != nil || len(moved) == 0 {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	// Removing packed-refs first avoids rewriting it once for each ref.
+	if err := s.fs.Remove(packedRefsPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, name := range moved {
+		if err := s.Storage.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
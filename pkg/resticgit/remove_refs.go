@@ -0,0 +1,95 @@
+package resticgit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// RemoveReferences removes the named refs from a repository opened by Open or
+// OpenWithOptions. go-git rewrites packed-refs for each ref which it removes,
+// so deleting thousands of refs, as git push --mirror or --prune may, takes
+// time quadratic in the number of refs. Instead, the loose refs are removed
+// one at a time, while packed-refs and the refs database are rewritten once.
+// Refs which don't exist are ignored.
+func RemoveReferences(repo *git.Repository, names []plumbing.ReferenceName) error {
+	if len(names) == 0 {
+		return nil
+	}
+	storage, ok := repo.Storer.(storageFilesystem)
+	if !ok {
+		return errors.New("repository is not stored in a filesystem")
+	}
+	fs := storage.Filesystem()
+	remove := make(map[plumbing.ReferenceName]bool, len(names))
+	for _, name := range names {
+		remove[name] = true
+	}
+
+	if db, ok := repo.Storer.(*refsDatabaseStorage); ok {
+		changed := false
+		for _, name := range names {
+			if _, ok := db.refs[name]; ok {
+				delete(db.refs, name)
+				changed = true
+			}
+		}
+		if changed {
+			if err := db.save(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range names {
+		if err := fs.Remove(name.String()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	file, err := fs.Open(packedRefsPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	removing := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "^"):
+			// The peeled value belongs to the preceding ref.
+			if removing {
+				continue
+			}
+		case !strings.HasPrefix(line, "#"):
+			fields := strings.SplitN(line, " ", 2)
+			removing = remove[plumbing.ReferenceName(fields[len(fields)-1])]
+			if removing {
+				continue
+			}
+		}
+		buf.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if buf.Len() == len(content) {
+		return nil
+	}
+	return billyutil.WriteFile(fs, packedRefsPath, buf.Bytes(), 0666)
+}
@@ -0,0 +1,259 @@
+// Package resticgit transfers refs between a local git repository and a git
+// repository which is stored in a restic snapshot using resticfs.
+package resticgit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	gitfs "github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+const anonymous = "anonymous"
+
+// Options controls how a stored repository is opened.
+type Options struct {
+	// AllowInit creates the repository if it doesn't exist, in which case
+	// the filesystem must be writable.
+	AllowInit bool
+	// PackIndexCache, if set, is a local directory which holds copies of
+	// the pack index files of stored repositories. Opening a repository
+	// requires reading every pack index, so caching them avoids reading
+	// them from restic each time. The cache may be shared by any number of
+	// repositories.
+	PackIndexCache billy.Filesystem
+	// RefsDatabase stores refs in a single file maintained by
+	// git-remote-restic, instead of one file per ref. Repositories which
+	// already have a refs database always use it to read refs, but refs
+	// are moved out of it as they are updated unless this is set.
+	RefsDatabase bool
+}
+
+// Open opens the git repository stored in fs, which is normally a
+// resticfs.Filesystem or a subdirectory of one. If no such repository exists,
+// one will be created if allowInit is true, in which case fs must be writable.
+func Open(fs billy.Basic, allowInit bool) (*git.Repository, error) {
+	return OpenWithOptions(fs, Options{AllowInit: allowInit})
+}
+
+// OpenWithOptions opens the git repository stored in fs, like Open, using the
+// provided options.
+func OpenWithOptions(fs billy.Basic, opts Options) (*git.Repository, error) {
+	var pf billy.Filesystem = &archivedPacksFS{polyfill.New(fs)}
+	if opts.PackIndexCache != nil {
+		pf = &packIndexCacheFS{Filesystem: pf, cache: opts.PackIndexCache}
+	}
+	s, err := openRefsDatabase(gitfs.NewStorageWithOptions(pf, cache.NewObjectLRUDefault(), gitfs.Options{KeepDescriptors: true}), fs, opts.RefsDatabase)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.Open(s, nil)
+	if err == git.ErrRepositoryNotExists && opts.AllowInit {
+		repo, err = git.Init(s, nil)
+	}
+	return repo, err
+}
+
+// Fetch copies refs from the stored repository into the local repository at
+// localPath. The source of each refspec names refs in the stored repository,
+// or is the full hash of an object in it, which is copied along with the
+// objects it references, and the destination names refs in the local
+// repository. Progress is reported to progress, which may be nil.
+func Fetch(ctx context.Context, stored *git.Repository, localPath string, refSpecs []config.RefSpec, progress *Progress) error {
+	stored, refSpecs, err := resolveObjectRefSpecs(stored, refSpecs)
+	if err != nil {
+		return err
+	}
+	remote, err := stored.CreateRemoteAnonymous(&config.RemoteConfig{
+		Name: anonymous,
+		URLs: []string{localPath},
+	})
+	if err != nil {
+		return err
+	}
+	// Since the stored repository is the one which go-git has opened, the
+	// transfer operates in reverse: fetching is a push to the local
+	// repository.
+	err = remote.PushContext(ctx, &git.PushOptions{
+		RemoteName: anonymous,
+		RefSpecs:   refSpecs,
+		Progress:   newProgressWriter(progress),
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return err
+	}
+	return nil
+}
+
+// Push copies refs from the local repository at localPath into the stored
+// repository, which must be writable. The source of each refspec names refs in
+// the local repository, and the destination names refs in the stored
+// repository. Refspecs with an empty source delete the destination ref.
+// Pushing to a symbolic ref updates the ref it points to, like git does, and
+// HEAD is repointed if it was left dangling, preferring the branch which is
+// checked out in the local repository. Progress is reported to progress,
+// which may be nil.
+//
+// The result maps the destination of each refspec, as requested, to the error
+// which prevented it from being updated, or nil on success.
+func Push(ctx context.Context, stored *git.Repository, localPath string, refSpecs []config.RefSpec, progress *Progress) (_ map[string]error, err error) {
+	release := holdRefsDatabase(stored)
+	defer func() {
+		if releaseErr := release(); err == nil {
+			err = releaseErr
+		}
+	}()
+	remote, err := stored.CreateRemoteAnonymous(&config.RemoteConfig{
+		Name: anonymous,
+		URLs: []string{localPath},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := ResolveSymbolicRefSpecs(stored, refSpecs)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]error, len(refSpecs))
+	var fetchRefSpecs []config.RefSpec
+	var pushed, deleted []plumbing.ReferenceName
+	for i, refSpec := range resolved {
+		dst := plumbing.ReferenceName(destination(refSpecs[i]))
+		if refSpec.IsDelete() {
+			if refSpec.IsWildcard() {
+				results[dst.String()] = fmt.Errorf("wildcards (%#v) not supported for deletes", refSpec)
+				continue
+			}
+			deleted = append(deleted, dst)
+			continue
+		}
+		fetchRefSpecs = append(fetchRefSpecs, refSpec)
+		if !refSpec.IsWildcard() {
+			pushed = append(pushed, refSpec.Dst(""))
+		}
+	}
+	if len(deleted) > 0 {
+		// Mirror pushes may delete many refs, which are removed together.
+		err := RemoveReferences(stored, deleted)
+		for _, name := range deleted {
+			results[name.String()] = err
+		}
+	}
+	if len(fetchRefSpecs) == 0 {
+		return results, nil
+	}
+
+	// Pushing is a fetch from the local repository, see Fetch.
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: anonymous,
+		RefSpecs:   fetchRefSpecs,
+		Progress:   newProgressWriter(progress),
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		err = nil
+	}
+	for _, refSpec := range refSpecs {
+		if !refSpec.IsDelete() {
+			results[destination(refSpec)] = err
+		}
+	}
+
+	// Prefer the branch which is checked out locally, since git push
+	// --mirror sends the branches in alphabetical order.
+	if head := localHead(localPath); head != "" {
+		pushed = append([]plumbing.ReferenceName{head}, pushed...)
+	}
+	if err := RepointDanglingHead(stored, pushed); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// localHead returns the branch which HEAD of the local repository at
+// localPath points to, or an empty name if HEAD is detached or can't be read.
+func localHead(localPath string) plumbing.ReferenceName {
+	data, err := ioutil.ReadFile(filepath.Join(localPath, plumbing.HEAD.String()))
+	if err != nil {
+		return ""
+	}
+	line := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(line, "ref: ") {
+		return ""
+	}
+	return plumbing.ReferenceName(strings.TrimPrefix(line, "ref: "))
+}
+
+// destination returns the destination of refSpec, which is a pattern for
+// wildcard refspecs.
+func destination(refSpec config.RefSpec) string {
+	s := string(refSpec)
+	return s[strings.Index(s, ":")+1:]
+}
+
+// ResolveSymbolicRefSpecs replaces the destination of each refspec which
+// refers to a symbolic ref in repo with the ref that it points to, so that
+// pushing to a symbolic ref updates its target like git does. Deletions are
+// not affected, since deleting a symbolic ref removes the symbolic ref itself.
+func ResolveSymbolicRefSpecs(repo *git.Repository, refSpecs []config.RefSpec) ([]config.RefSpec, error) {
+	resolved := make([]config.RefSpec, len(refSpecs))
+	for i, refSpec := range refSpecs {
+		resolved[i] = refSpec
+		if refSpec.IsDelete() || refSpec.IsWildcard() {
+			continue
+		}
+		ref, err := repo.Storer.Reference(refSpec.Dst(""))
+		if err == plumbing.ErrReferenceNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if ref.Type() != plumbing.SymbolicReference {
+			continue
+		}
+		target := refSpec.Src() + ":" + ref.Target().String()
+		if refSpec.IsForceUpdate() {
+			target = "+" + target
+		}
+		resolved[i] = config.RefSpec(target)
+	}
+	return resolved, nil
+}
+
+// RepointDanglingHead updates HEAD when it points to a branch that doesn't
+// exist, for example after the first push to a new repository used a branch
+// name other than the default. HEAD is pointed at the first of the candidate
+// branches which exists.
+func RepointDanglingHead(repo *git.Repository, candidates []plumbing.ReferenceName) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if head.Type() != plumbing.SymbolicReference {
+		return nil
+	}
+	if _, err := repo.Reference(head.Target(), true); err != plumbing.ErrReferenceNotFound {
+		return err
+	}
+	for _, name := range candidates {
+		if !name.IsBranch() {
+			continue
+		}
+		if _, err := repo.Reference(name, true); err != nil {
+			continue
+		}
+		return repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name))
+	}
+	return nil
+}
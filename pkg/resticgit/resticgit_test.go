@@ -0,0 +1,691 @@
+package resticgit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CGamesPlay/git-remote-restic/pkg/resticfs"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/helper/polyfill"
+	"github.com/go-git/go-billy/v5/memfs"
+	billyutil "github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/restic/restic/lib/repository"
+	"github.com/stretchr/testify/require"
+)
+
+var testCtx = context.Background()
+
+// openTestRepo creates a git repository stored in an in-memory restic
+// repository.
+func openTestRepo(t *testing.T) *git.Repository {
+	repo, err := Open(openTestFS(t), true)
+	require.NoError(t, err)
+	return repo
+}
+
+// openTestFS creates a writable filesystem in an in-memory restic
+// repository.
+func openTestFS(t *testing.T) *resticfs.Filesystem {
+	fs, err := resticfs.New(testCtx, repository.TestRepository(t), nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	return fs
+}
+
+// createLocalRepo creates a local repository with a single commit on master,
+// and returns its path and the commit.
+func createLocalRepo(t *testing.T) (string, plumbing.Hash) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	require.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello\n"), 0666)
+	require.NoError(t, err)
+	wt, err := repo.Worktree()
+	require.NoError(t, err)
+	_, err = wt.Add("README")
+	require.NoError(t, err)
+	hash, err := wt.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+	})
+	require.NoError(t, err)
+	return filepath.Join(dir, git.GitDirName), hash
+}
+
+func TestPushAndFetch(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/main",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/heads/main": nil}, results)
+	ref, err := stored.Reference("refs/heads/main", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+	// HEAD followed the only pushed branch.
+	head, err := stored.Reference(plumbing.HEAD, true)
+	require.NoError(t, err)
+	require.Equal(t, hash, head.Hash())
+
+	otherPath, _ := createLocalRepo(t)
+	err = Fetch(testCtx, stored, otherPath, []config.RefSpec{
+		"refs/heads/main:refs/remotes/origin/main",
+	}, nil)
+	require.NoError(t, err)
+	other, err := git.PlainOpen(filepath.Dir(otherPath))
+	require.NoError(t, err)
+	ref, err = other.Reference("refs/remotes/origin/main", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+}
+
+func TestFetchObject(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+	_, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+	}, nil)
+	require.NoError(t, err)
+	// The commit is no longer referenced by a ref.
+	require.NoError(t, RemoveReferences(stored, []plumbing.ReferenceName{"refs/heads/master"}))
+
+	otherPath, _ := createLocalRepo(t)
+	err = Fetch(testCtx, stored, otherPath, []config.RefSpec{
+		config.RefSpec(hash.String() + ":refs/remotes/origin/fetched"),
+	}, nil)
+	require.NoError(t, err)
+	other, err := git.PlainOpen(filepath.Dir(otherPath))
+	require.NoError(t, err)
+	ref, err := other.Reference("refs/remotes/origin/fetched", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+	_, err = stored.Reference(plumbing.ReferenceName(objectRefPrefix+hash.String()), true)
+	require.Equal(t, plumbing.ErrReferenceNotFound, err)
+
+	missing := strings.Repeat("1", 40)
+	err = Fetch(testCtx, stored, otherPath, []config.RefSpec{
+		config.RefSpec(missing + ":refs/remotes/origin/missing"),
+	}, nil)
+	require.EqualError(t, err, "object "+missing+" not found in the stored repository")
+}
+
+func TestOpenSubdirectory(t *testing.T) {
+	fs := openTestFS(t)
+	localPath, hash := createLocalRepo(t)
+	for _, dir := range []string{"", "modules/sub"} {
+		repo, err := Open(chroot.New(polyfill.New(fs), dir), true)
+		require.NoError(t, err)
+		_, err = Push(testCtx, repo, localPath, []config.RefSpec{
+			"refs/heads/master:refs/heads/master",
+		}, nil)
+		require.NoError(t, err)
+	}
+	_, err := fs.Stat("modules/sub/refs/heads/master")
+	require.NoError(t, err)
+	repo, err := Open(chroot.New(polyfill.New(fs), "modules/sub"), false)
+	require.NoError(t, err)
+	ref, err := repo.Reference("refs/heads/master", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+}
+
+func TestPackIndexCache(t *testing.T) {
+	fs := openTestFS(t)
+	stored, err := Open(fs, true)
+	require.NoError(t, err)
+	localPath, hash := createLocalRepo(t)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+	}, nil)
+	require.NoError(t, err)
+
+	cache := memfs.New()
+	for i := 0; i < 2; i++ {
+		repo, err := OpenWithOptions(fs, Options{PackIndexCache: cache})
+		require.NoError(t, err)
+		_, err = repo.CommitObject(hash)
+		require.NoError(t, err)
+		files, err := cache.ReadDir("")
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Regexp(t, `^pack-[0-9a-f]{40}\.idx$`, files[0].Name())
+	}
+}
+
+func TestPushWildcard(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		"+refs/heads/*:refs/backup/*",
+		"+refs/tags/*:refs/tags/*",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/backup/*": nil, "refs/tags/*": nil}, results)
+	ref, err := stored.Reference("refs/backup/master", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+}
+
+func TestPushDelete(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, _ := createLocalRepo(t)
+
+	_, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+		"refs/heads/master:refs/heads/feature",
+	}, nil)
+	require.NoError(t, err)
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		":refs/heads/feature",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/heads/feature": nil}, results)
+	_, err = stored.Reference("refs/heads/feature", true)
+	require.Equal(t, plumbing.ErrReferenceNotFound, err)
+}
+
+func TestPushSymbolicRef(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+
+	// HEAD of the new repository points to master.
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:HEAD",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"HEAD": nil}, results)
+	head, err := stored.Storer.Reference(plumbing.HEAD)
+	require.NoError(t, err)
+	require.Equal(t, plumbing.SymbolicReference, head.Type())
+	ref, err := stored.Reference("refs/heads/master", true)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+}
+
+func TestPushPrefersLocalHead(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+	local, err := git.PlainOpen(filepath.Dir(localPath))
+	require.NoError(t, err)
+	require.NoError(t, local.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", hash)))
+	require.NoError(t, local.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/main")))
+
+	// Like git push --mirror, which sends the branches in order.
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		"+refs/heads/master:refs/heads/feature",
+		"+refs/heads/main:refs/heads/main",
+	}, nil)
+	require.NoError(t, err)
+	head, err := stored.Storer.Reference(plumbing.HEAD)
+	require.NoError(t, err)
+	require.Equal(t, plumbing.ReferenceName("refs/heads/main"), head.Target())
+}
+
+func TestPackedRefsOnly(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := resticfs.New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	stored, err := Open(fs, true)
+	require.NoError(t, err)
+	localPath, hash := createLocalRepo(t)
+	local, err := git.PlainOpen(filepath.Dir(localPath))
+	require.NoError(t, err)
+	tag, err := local.CreateTag("v1", hash, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+		Message: "version 1",
+	})
+	require.NoError(t, err)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+		"refs/tags/v1:refs/tags/v1",
+	}, nil)
+	require.NoError(t, err)
+
+	// Move every ref into packed-refs, as git gc does, including the peeled
+	// value of the annotated tag, and leave the refs directory empty.
+	packed := "# pack-refs with: peeled fully-peeled sorted \n" +
+		hash.String() + " refs/heads/master\n" +
+		tag.Hash().String() + " refs/tags/v1\n" +
+		"^" + hash.String() + "\n"
+	require.NoError(t, billyutil.WriteFile(fs, "packed-refs", []byte(packed), 0644))
+	require.NoError(t, fs.Remove("refs"))
+	require.NoError(t, fs.MkdirAll("refs", 0755))
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	snapshot, err := resticfs.New(testCtx, repo, &id)
+	require.NoError(t, err)
+	stored, err = Open(snapshot, false)
+	require.NoError(t, err)
+	refs, err := stored.References()
+	require.NoError(t, err)
+	listed := map[plumbing.ReferenceName]plumbing.Hash{}
+	require.NoError(t, refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			listed[ref.Name()] = ref.Hash()
+		}
+		return nil
+	}))
+	require.Equal(t, map[plumbing.ReferenceName]plumbing.Hash{
+		"refs/heads/master": hash,
+		"refs/tags/v1":      tag.Hash(),
+	}, listed)
+	head, err := stored.Reference(plumbing.HEAD, true)
+	require.NoError(t, err)
+	require.Equal(t, hash, head.Hash())
+
+	otherPath, _ := createLocalRepo(t)
+	err = Fetch(testCtx, stored, otherPath, []config.RefSpec{
+		"+refs/heads/*:refs/remotes/origin/*",
+		"+refs/tags/*:refs/tags/*",
+	}, nil)
+	require.NoError(t, err)
+	other, err := git.PlainOpen(filepath.Dir(otherPath))
+	require.NoError(t, err)
+	ref, err := other.Reference("refs/tags/v1", false)
+	require.NoError(t, err)
+	require.Equal(t, tag.Hash(), ref.Hash())
+
+	// Refs which only exist in packed-refs can be updated and deleted.
+	snapshot.StartNewSnapshot()
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{
+		":refs/tags/v1",
+		"refs/heads/master:refs/heads/feature",
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/tags/v1": nil, "refs/heads/feature": nil}, results)
+	_, err = stored.Reference("refs/tags/v1", false)
+	require.Equal(t, plumbing.ErrReferenceNotFound, err)
+	ref, err = stored.Reference("refs/heads/master", false)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+	// Rewriting packed-refs leaves no temporary directory behind.
+	_, err = snapshot.Stat("tmp")
+	require.True(t, os.IsNotExist(err))
+
+	wt, err := local.Worktree()
+	require.NoError(t, err)
+	second, err := wt.Commit("second commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1, 0)},
+	})
+	require.NoError(t, err)
+	results, err = Push(testCtx, stored, localPath, []config.RefSpec{"refs/heads/master:refs/heads/master"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/heads/master": nil}, results)
+	ref, err = stored.Reference("refs/heads/master", false)
+	require.NoError(t, err)
+	require.Equal(t, second, ref.Hash())
+}
+
+func TestStage(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, first := createLocalRepo(t)
+	local, err := git.PlainOpen(filepath.Dir(localPath))
+	require.NoError(t, err)
+	wt, err := local.Worktree()
+	require.NoError(t, err)
+	commits := []plumbing.Hash{first}
+	for i := 0; i < 3; i++ {
+		hash, err := wt.Commit("empty commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(i+1), 0)},
+		})
+		require.NoError(t, err)
+		commits = append(commits, hash)
+	}
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+	}, nil)
+	require.NoError(t, err)
+
+	staging, err := git.PlainInit(t.TempDir(), true)
+	require.NoError(t, err)
+	packs := func() int {
+		hashes, err := staging.Storer.(storer.PackedObjectStorer).ObjectPacks()
+		require.NoError(t, err)
+		return len(hashes)
+	}
+	tip := commits[len(commits)-1]
+
+	// An interrupted stage left the first two commits behind.
+	err = Stage(testCtx, stored, staging, []plumbing.Hash{commits[1]}, StageOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 1, packs())
+
+	var messages []string
+	var checkpoints []plumbing.Hash
+	err = Stage(testCtx, stored, staging, []plumbing.Hash{tip}, StageOptions{
+		Interval: 1,
+		Progress: ProgressFunc(func(message string) {
+			messages = append(messages, message)
+		}).Progress(),
+		Checkpoint: func(hash plumbing.Hash, packSize int64) error {
+			require.NotZero(t, packSize)
+			checkpoints = append(checkpoints, hash)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, packs())
+	require.Equal(t, commits[2:], checkpoints)
+	require.Equal(t, "Staging objects: 100% (2/2), done.", messages[len(messages)-1])
+	for _, hash := range commits {
+		_, err := staging.CommitObject(hash)
+		require.NoError(t, err)
+	}
+
+	// Everything is staged, so nothing is copied.
+	err = Stage(testCtx, stored, staging, []plumbing.Hash{tip}, StageOptions{Interval: 1})
+	require.NoError(t, err)
+	require.Equal(t, 3, packs())
+}
+
+func TestProgressWriter(t *testing.T) {
+	var events []ProgressEvent
+	var logs []string
+	w := newProgressWriter(&Progress{
+		Event: func(event ProgressEvent) {
+			events = append(events, event)
+		},
+		Log: func(message string) {
+			logs = append(logs, message)
+		},
+	})
+	w.Write([]byte("Enumerating objects: 2, done.\nCounting objects:  50% (1/2)\rCounting obj"))
+	w.Write([]byte("ects: 100% (2/2), done.\n"))
+	w.Write([]byte("Total 2 (delta 0), reused 0 (delta 0)\nTotal 3"))
+	require.Equal(t, []ProgressEvent{
+		{Phase: "Enumerating objects", Done: 2, Finished: true},
+		{Phase: "Counting objects", Done: 1, Total: 2},
+		{Phase: "Counting objects", Done: 2, Total: 2, Finished: true},
+	}, events)
+	require.Equal(t, []string{"Total 2 (delta 0), reused 0 (delta 0)"}, logs)
+	require.Nil(t, newProgressWriter(nil))
+}
+
+func TestProgressFuncAdapter(t *testing.T) {
+	var messages []string
+	w := newProgressWriter(ProgressFunc(func(message string) {
+		messages = append(messages, message)
+	}).Progress())
+	w.Write([]byte("Counting objects:  50% (1/2)\rCounting obj"))
+	w.Write([]byte("ects: 100% (2/2), done.\n"))
+	w.Write([]byte("Enumerating objects: 5, done.\nTotal 2 (delta 0)\nTotal 2"))
+	require.Equal(t, []string{
+		"Counting objects:  50% (1/2)",
+		"Counting objects: 100% (2/2), done.",
+		"Enumerating objects: 5, done.",
+		"Total 2 (delta 0)",
+	}, messages)
+	require.Nil(t, ProgressFunc(nil).Progress())
+}
+
+func TestRefsDatabase(t *testing.T) {
+	fs := openTestFS(t)
+	localPath, hash := createLocalRepo(t)
+	stored, err := Open(fs, true)
+	require.NoError(t, err)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{"refs/heads/master:refs/heads/master"}, nil)
+	require.NoError(t, err)
+
+	// Existing refs are moved into the database by PackRefs, and new refs
+	// are written to it directly.
+	stored, err = OpenWithOptions(fs, Options{RefsDatabase: true})
+	require.NoError(t, err)
+	results, err := Push(testCtx, stored, localPath, []config.RefSpec{"refs/heads/master:refs/heads/feature"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, map[string]error{"refs/heads/feature": nil}, results)
+	symbolic := plumbing.NewSymbolicReference("refs/remotes/origin/HEAD", "refs/heads/master")
+	require.NoError(t, stored.Storer.SetReference(symbolic))
+	require.NoError(t, stored.Storer.PackRefs())
+	for _, name := range []string{"refs/heads/master", "refs/heads/feature", "refs/remotes/origin/HEAD"} {
+		_, err = fs.Stat(name)
+		require.True(t, os.IsNotExist(err), name)
+	}
+	file, err := fs.Open(RefsDatabasePath)
+	require.NoError(t, err)
+	content, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	require.Equal(t, "# restic-refs v1\n"+
+		hash.String()+" refs/heads/feature\n"+
+		hash.String()+" refs/heads/master\n"+
+		"@refs/heads/master refs/remotes/origin/HEAD\n", string(content))
+
+	// Without the option, the database is still read, but refs are moved
+	// out of it as they are updated.
+	stored, err = Open(fs, false)
+	require.NoError(t, err)
+	head, err := stored.Reference(plumbing.HEAD, true)
+	require.NoError(t, err)
+	require.Equal(t, hash, head.Hash())
+	refs, err := stored.References()
+	require.NoError(t, err)
+	count := 0
+	require.NoError(t, refs.ForEach(func(*plumbing.Reference) error { count++; return nil }))
+	require.Equal(t, 4, count)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		":refs/heads/feature",
+		"+refs/heads/master:refs/heads/master",
+	}, nil)
+	require.NoError(t, err)
+	require.NoError(t, stored.Storer.SetReference(symbolic))
+	ref, err := stored.Reference("refs/heads/master", false)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+	_, err = stored.Reference("refs/heads/feature", false)
+	require.Equal(t, plumbing.ErrReferenceNotFound, err)
+	refsDB, err := readRefsDatabase(fs)
+	require.NoError(t, err)
+	require.Equal(t, map[plumbing.ReferenceName]*plumbing.Reference{
+		"refs/heads/master": plumbing.NewHashReference("refs/heads/master", hash),
+	}, refsDB)
+	// PackRefs moves the remaining refs to packed-refs.
+	require.NoError(t, stored.Storer.RemoveReference(symbolic.Name()))
+	require.NoError(t, stored.Storer.PackRefs())
+	_, err = fs.Stat(RefsDatabasePath)
+	require.True(t, os.IsNotExist(err))
+	ref, err = stored.Reference("refs/heads/master", false)
+	require.NoError(t, err)
+	require.Equal(t, hash, ref.Hash())
+}
+
+func TestRemoveReferences(t *testing.T) {
+	for _, refsDB := range []bool{false, true} {
+		fs := openTestFS(t)
+		localPath, hash := createLocalRepo(t)
+		stored, err := OpenWithOptions(fs, Options{AllowInit: true, RefsDatabase: refsDB})
+		require.NoError(t, err)
+		var refSpecs []config.RefSpec
+		for i := 0; i < 20; i++ {
+			refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("refs/heads/master:refs/heads/b%02d", i)))
+		}
+		_, err = Push(testCtx, stored, localPath, refSpecs, nil)
+		require.NoError(t, err)
+		if !refsDB {
+			// Pack half of the refs, with a peeled value after a
+			// removed ref.
+			packed := "# pack-refs with: peeled fully-peeled sorted \n"
+			for i := 0; i < 10; i++ {
+				name := fmt.Sprintf("refs/heads/b%02d", i)
+				packed += hash.String() + " " + name + "\n^" + hash.String() + "\n"
+				require.NoError(t, fs.Remove(name))
+			}
+			require.NoError(t, billyutil.WriteFile(fs, "packed-refs", []byte(packed), 0644))
+		}
+
+		var deletes []config.RefSpec
+		for i := 0; i < 20; i += 2 {
+			deletes = append(deletes, config.RefSpec(fmt.Sprintf(":refs/heads/b%02d", i)))
+		}
+		deletes = append(deletes, ":refs/heads/missing")
+		results, err := Push(testCtx, stored, localPath, deletes, nil)
+		require.NoError(t, err)
+		for _, refSpec := range deletes {
+			require.NoError(t, results[refSpec.Dst("").String()])
+		}
+		refs, err := allRefNames(stored)
+		require.NoError(t, err)
+		var expected []string
+		for i := 1; i < 20; i += 2 {
+			expected = append(expected, fmt.Sprintf("refs/heads/b%02d", i))
+		}
+		require.Equal(t, expected, refs, "refsDB=%v", refsDB)
+	}
+}
+
+// allRefNames returns the sorted names of the refs in repo other than HEAD.
+func allRefNames(repo *git.Repository) ([]string, error) {
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			names = append(names, ref.Name().String())
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+func TestArchivePacks(t *testing.T) {
+	repo := repository.TestRepository(t)
+	fs, err := resticfs.New(testCtx, repo, nil)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	localPath, first := createLocalRepo(t)
+	stored, err := Open(fs, true)
+	require.NoError(t, err)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{"refs/heads/master:refs/heads/master"}, nil)
+	require.NoError(t, err)
+	id, err := fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+
+	// The second snapshot only has the new pack in objects/pack.
+	fs, err = resticfs.New(testCtx, repo, &id)
+	require.NoError(t, err)
+	fs.StartNewSnapshot()
+	require.NoError(t, ArchivePacks(fs, true))
+	local, err := git.PlainOpen(filepath.Dir(localPath))
+	require.NoError(t, err)
+	wt, err := local.Worktree()
+	require.NoError(t, err)
+	second, err := wt.Commit("second commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1, 0)},
+	})
+	require.NoError(t, err)
+	stored, err = Open(fs, false)
+	require.NoError(t, err)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{"refs/heads/master:refs/heads/master"}, nil)
+	require.NoError(t, err)
+	id, err = fs.CommitSnapshot("/tmp", []string{})
+	require.NoError(t, err)
+	for _, dir := range []string{"objects/pack", "restic-packs/000001"} {
+		entries, err := fs.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 2, dir)
+	}
+
+	fs, err = resticfs.New(testCtx, repo, &id)
+	require.NoError(t, err)
+	stored, err = Open(fs, false)
+	require.NoError(t, err)
+	for _, hash := range []plumbing.Hash{first, second} {
+		_, err = stored.CommitObject(hash)
+		require.NoError(t, err)
+	}
+
+	// Without the incremental layout, the packs are moved back.
+	fs.StartNewSnapshot()
+	require.NoError(t, ArchivePacks(fs, false))
+	_, err = fs.Stat(ArchivedPacksPath)
+	require.True(t, os.IsNotExist(err))
+	entries, err := fs.ReadDir("objects/pack")
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	stored, err = Open(fs, false)
+	require.NoError(t, err)
+	for _, hash := range []plumbing.Hash{first, second} {
+		_, err = stored.CommitObject(hash)
+		require.NoError(t, err)
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+	local, err := git.PlainOpen(filepath.Dir(localPath))
+	require.NoError(t, err)
+	tag, err := local.CreateTag("v1", hash, &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(0, 0)},
+		Message: "v1",
+	})
+	require.NoError(t, err)
+	_, err = Push(testCtx, stored, localPath, []config.RefSpec{
+		"refs/heads/master:refs/heads/master",
+		"refs/tags/v1:refs/tags/v1",
+	}, nil)
+	require.NoError(t, err)
+
+	manifest, err := BuildManifest(stored)
+	require.NoError(t, err)
+	require.Equal(t, "refs/heads/master", manifest.Head)
+	require.Equal(t, []ManifestRef{
+		{Name: "refs/heads/master", Hash: hash.String()},
+		{Name: "refs/tags/v1", Hash: tag.Hash().String(), Commit: hash.String()},
+	}, manifest.Refs)
+	require.Len(t, manifest.Packs, 1)
+	// The commit, its tree, the README blob and the tag.
+	require.Equal(t, 4, manifest.Packs[0].Objects)
+	require.NotZero(t, manifest.Packs[0].Size)
+	require.Equal(t, 4, manifest.Objects)
+	require.Zero(t, manifest.LooseObjects)
+}
+
+func TestPlanPush(t *testing.T) {
+	stored := openTestRepo(t)
+	localPath, hash := createLocalRepo(t)
+	refSpecs := []config.RefSpec{"refs/heads/master:refs/heads/master"}
+
+	plan, err := PlanPush(stored, localPath, refSpecs)
+	require.NoError(t, err)
+	require.Equal(t, []RefChange{{Name: "refs/heads/master", New: hash}}, plan.Refs)
+	// The commit, its tree, and the README blob.
+	require.Equal(t, 3, plan.Objects)
+	require.True(t, plan.Size > 0)
+	_, err = stored.Reference("refs/heads/master", false)
+	require.Equal(t, plumbing.ErrReferenceNotFound, err)
+
+	_, err = Push(testCtx, stored, localPath, refSpecs, nil)
+	require.NoError(t, err)
+	plan, err = PlanPush(stored, localPath, refSpecs)
+	require.NoError(t, err)
+	require.Empty(t, plan.Refs)
+	require.Equal(t, 0, plan.Objects)
+
+	plan, err = PlanPush(stored, localPath, []config.RefSpec{":refs/heads/master"})
+	require.NoError(t, err)
+	require.Equal(t, []RefChange{{Name: "refs/heads/master", Old: hash}}, plan.Refs)
+
+	plan, err = PlanFetch(stored, localPath, []config.RefSpec{"refs/heads/master:refs/remotes/origin/master"})
+	require.NoError(t, err)
+	require.Equal(t, []RefChange{{Name: "refs/remotes/origin/master", New: hash}}, plan.Refs)
+	require.Equal(t, 0, plan.Objects)
+}
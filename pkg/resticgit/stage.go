@@ -0,0 +1,197 @@
+package resticgit
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// packWindow is the number of objects considered for delta compression, which
+// is the same as go-git uses when pushing.
+const packWindow = 10
+
+// StageOptions controls how Stage copies objects.
+type StageOptions struct {
+	// Interval is the approximate number of commits copied by each step.
+	// An interval of 0 copies everything in a single step.
+	Interval int
+	// Progress receives the progress of the staging, if set.
+	Progress *Progress
+	// Checkpoint, if set, is called after each step with the object which
+	// was copied along with everything it references, and the size of the
+	// pack which was written for the step. If it returns an error, Stage
+	// stops and returns it.
+	Checkpoint func(hash plumbing.Hash, packSize int64) error
+}
+
+// Stage copies the objects reachable from wants from the source repository
+// into the destination repository, which are normally the stored repository
+// and a local repository when fetching. The objects are copied in steps,
+// oldest first, and each step is written as a separate pack. If Stage is
+// interrupted, calling it again with the same destination repository resumes
+// after the last completed step instead of copying everything again.
+//
+// Objects which the destination repository can already read, including
+// through its alternates, are not copied.
+func Stage(ctx context.Context, source, dest *git.Repository, wants []plumbing.Hash, opts StageOptions) error {
+	checkpoints, haves, err := planCheckpoints(source, dest, wants, opts.Interval)
+	if err != nil {
+		return err
+	}
+	progress := opts.Progress
+	for i, checkpoint := range checkpoints {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		progress.event(ProgressEvent{Phase: "Staging objects", Done: i, Total: len(checkpoints)})
+		size, err := stageObjects(source, dest, checkpoint, haves)
+		if err != nil {
+			return err
+		}
+		haves = append(haves, checkpoint)
+		if opts.Checkpoint != nil {
+			if err := opts.Checkpoint(checkpoint, size); err != nil {
+				return err
+			}
+		}
+	}
+	if len(checkpoints) > 0 {
+		progress.event(ProgressEvent{Phase: "Staging objects", Done: len(checkpoints), Total: len(checkpoints), Finished: true})
+	}
+	return nil
+}
+
+// planCheckpoints returns the objects to copy in each step of Stage, such that
+// every step copies about interval commits which are not yet staged. Commits
+// are ordered so that every commit follows its parents, and the final steps
+// copy the wanted objects themselves. It also returns the staged commits which
+// the unstaged ones build on, whose objects need not be copied.
+func planCheckpoints(source, dest *git.Repository, wants []plumbing.Hash, interval int) (checkpoints, haves []plumbing.Hash, err error) {
+	type entry struct {
+		hash     plumbing.Hash
+		expanded bool
+	}
+	var order []plumbing.Hash
+	visited := map[plumbing.Hash]bool{}
+	var stack []entry
+	for i := len(wants) - 1; i >= 0; i-- {
+		commit, err := peelToCommit(source, wants[i])
+		if err != nil {
+			return nil, nil, err
+		} else if commit != plumbing.ZeroHash {
+			stack = append(stack, entry{hash: commit})
+		}
+	}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if top.expanded {
+			order = append(order, top.hash)
+			continue
+		}
+		if visited[top.hash] {
+			continue
+		}
+		visited[top.hash] = true
+		if isStaged(dest, top.hash) {
+			haves = append(haves, top.hash)
+			continue
+		}
+		commit, err := source.CommitObject(top.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		stack = append(stack, entry{hash: top.hash, expanded: true})
+		for i := len(commit.ParentHashes) - 1; i >= 0; i-- {
+			if !visited[commit.ParentHashes[i]] {
+				stack = append(stack, entry{hash: commit.ParentHashes[i]})
+			}
+		}
+	}
+
+	planned := map[plumbing.Hash]bool{}
+	if interval > 0 {
+		for i := interval - 1; i < len(order); i += interval {
+			checkpoints = append(checkpoints, order[i])
+			planned[order[i]] = true
+		}
+	}
+	for _, want := range wants {
+		if !planned[want] && !isStaged(dest, want) {
+			checkpoints = append(checkpoints, want)
+			planned[want] = true
+		}
+	}
+	return checkpoints, haves, nil
+}
+
+// peelToCommit returns the commit which the object refers to, following
+// annotated tags, or the zero hash if it doesn't refer to a commit.
+func peelToCommit(repo *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := repo.Object(plumbing.AnyObject, hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		switch obj := obj.(type) {
+		case *object.Commit:
+			return obj.Hash, nil
+		case *object.Tag:
+			hash = obj.Target
+		default:
+			return plumbing.ZeroHash, nil
+		}
+	}
+}
+
+// isStaged reports whether the destination repository can read the object.
+// Unlike HasEncodedObject, this consults the alternates of the repository.
+func isStaged(dest *git.Repository, hash plumbing.Hash) bool {
+	_, err := dest.Storer.EncodedObject(plumbing.AnyObject, hash)
+	return err == nil
+}
+
+// stageObjects writes a pack to the destination repository with the objects
+// reachable from checkpoint which are not reachable from haves, and returns
+// its size.
+func stageObjects(source, dest *git.Repository, checkpoint plumbing.Hash, haves []plumbing.Hash) (int64, error) {
+	hashes, err := revlist.ObjectsWithStorageForIgnores(source.Storer, dest.Storer, []plumbing.Hash{checkpoint}, haves)
+	if err != nil {
+		return 0, err
+	}
+	if len(hashes) == 0 {
+		return 0, nil
+	}
+	pw, ok := dest.Storer.(storer.PackfileWriter)
+	if !ok {
+		return 0, fmt.Errorf("destination repository does not support writing packs")
+	}
+	w, err := pw.PackfileWriter()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{Writer: w}
+	_, err = packfile.NewEncoder(cw, source.Storer, false).Encode(hashes, packWindow)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return cw.count, err
+}
+
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}